@@ -13,6 +13,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	_ "embed"
 
@@ -36,7 +37,11 @@ func Run(ctx context.Context, flags *flag.FlagSet, args []string) {
 			"Example:\n"+
 			"  %v -portal_addr localhost:9999 \\\n"+
 			"    \"pattern: '/test/' fixed_port: 8080 strip_pattern: true\" \\\n"+
-			"    \"pattern: ':tcp:8181' fixed_port: 1337\"\n\n", flags.Name())
+			"    \"pattern: ':tcp:8181' fixed_port: 1337\" \\\n"+
+			"    \"pattern: ':tcp:2222' fixed_port: 22 tcp_mode: TCP_MODE_PLAIN\" \\\n"+
+			"    \"pattern: ':udp:5353' fixed_port: 53\" \\\n"+
+			"    \"pattern: '/wiki/' unix_socket: '/run/wiki/http.sock'\" \\\n"+
+			"    \"pattern: '/chat' redirect: {url: 'https://t.me/example'}\"\n\n", flags.Name())
 		flags.PrintDefaults()
 	}
 	flags.Var(
@@ -68,16 +73,42 @@ func Run(ctx context.Context, flags *flag.FlagSet, args []string) {
 			errCount++
 			continue
 		}
+		request := &gate.RegisterRequest{
+			Pattern:           registration.Pattern,
+			FixedPort:         uint16(registration.FixedPort),
+			Hostname:          registration.Hostname,
+			UnixSocket:        registration.UnixSocket,
+			StripPattern:      registration.StripPattern,
+			AllowHttp:         registration.AllowHttp,
+			NoCompression:     registration.NoCompression,
+			Cache:             registration.Cache,
+			CacheTTL:          time.Duration(registration.CacheTtlSeconds) * time.Second,
+			HTTP2:             registration.Http2,
+			DTLS:              registration.Dtls,
+			ProxyProtocol:     int(registration.ProxyProtocol),
+			TCPMode:           gate.TCPMode(registration.TcpMode),
+			TCPIdleTimeout:    time.Duration(registration.TcpIdleTimeoutSeconds) * time.Second,
+			TCPMaxConnections: int(registration.TcpMaxConnections),
+		}
+		if r := registration.Redirect; r != nil {
+			request.Redirect = &gate.Redirect{
+				URL:           r.Url,
+				StatusCode:    int(r.Status),
+				PreservePath:  r.PreservePath,
+				PreserveQuery: r.PreserveQuery,
+			}
+		}
+		if r := registration.StaticResponse; r != nil {
+			request.StaticResponse = &gate.StaticResponse{
+				Body:        r.Body,
+				ContentType: r.ContentType,
+				StatusCode:  int(r.Status),
+			}
+		}
 		idx := i
 		wg.Add(1)
 		go func() {
-			err := client.AutoRegister(ctx, &gate.RegisterRequest{
-				Pattern:      registration.Pattern,
-				FixedPort:    uint16(registration.FixedPort),
-				Hostname:     registration.Hostname,
-				StripPattern: registration.StripPattern,
-				AllowHttp:    registration.AllowHttp,
-			}, nil)
+			err := client.AutoRegister(ctx, request, nil)
 			wg.Done()
 			if err != nil && !errors.Is(err, context.Cause(ctx)) {
 				log.Printf("Error for registration #%v: %v", idx, err)
@@ -0,0 +1,339 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.28.1
+// 	protoc        v5.29.5
+// source: internal/portalpb/peer.proto
+
+package portalpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Applying an update that doesn't change anything is a no-op, so updates that
+// are sent back to the instance they came from stop there.
+type PeerUpdate struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The -peer_id of the sender. The live instance with the lowest ID is the
+	// leader, which expires leases and renews the ACME certs.
+	NodeId string `protobuf:"bytes,1,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`
+	// New or renewed registrations. The lease with the later timeout wins.
+	Registrations []*Registration `protobuf:"bytes,2,rep,name=registrations,proto3" json:"registrations,omitempty"`
+	// Registrations that were unregistered or expired.
+	Unregistered []*Lease `protobuf:"bytes,3,rep,name=unregistered,proto3" json:"unregistered,omitempty"`
+	// The root CA certs that signed the backend client certs.
+	RootCas [][]byte `protobuf:"bytes,4,rep,name=root_cas,json=rootCas,proto3" json:"root_cas,omitempty"`
+	// The cert with the later expiration wins.
+	Certificates   []*Certificate        `protobuf:"bytes,5,rep,name=certificates,proto3" json:"certificates,omitempty"`
+	Maintenance    []*MaintenanceRequest `protobuf:"bytes,6,rep,name=maintenance,proto3" json:"maintenance,omitempty"`
+	AcmeChallenges []*AcmeChallenge      `protobuf:"bytes,7,rep,name=acme_challenges,json=acmeChallenges,proto3" json:"acme_challenges,omitempty"`
+	// Only sent with the full state. The ACME account of the instance with the
+	// lowest ID is used by all of them.
+	AcmeAccount []byte `protobuf:"bytes,9,opt,name=acme_account,json=acmeAccount,proto3" json:"acme_account,omitempty"`
+}
+
+func (x *PeerUpdate) Reset() {
+	*x = PeerUpdate{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_portalpb_peer_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PeerUpdate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PeerUpdate) ProtoMessage() {}
+
+func (x *PeerUpdate) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_portalpb_peer_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PeerUpdate.ProtoReflect.Descriptor instead.
+func (*PeerUpdate) Descriptor() ([]byte, []int) {
+	return file_internal_portalpb_peer_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *PeerUpdate) GetNodeId() string {
+	if x != nil {
+		return x.NodeId
+	}
+	return ""
+}
+
+func (x *PeerUpdate) GetRegistrations() []*Registration {
+	if x != nil {
+		return x.Registrations
+	}
+	return nil
+}
+
+func (x *PeerUpdate) GetUnregistered() []*Lease {
+	if x != nil {
+		return x.Unregistered
+	}
+	return nil
+}
+
+func (x *PeerUpdate) GetRootCas() [][]byte {
+	if x != nil {
+		return x.RootCas
+	}
+	return nil
+}
+
+func (x *PeerUpdate) GetCertificates() []*Certificate {
+	if x != nil {
+		return x.Certificates
+	}
+	return nil
+}
+
+func (x *PeerUpdate) GetMaintenance() []*MaintenanceRequest {
+	if x != nil {
+		return x.Maintenance
+	}
+	return nil
+}
+
+func (x *PeerUpdate) GetAcmeChallenges() []*AcmeChallenge {
+	if x != nil {
+		return x.AcmeChallenges
+	}
+	return nil
+}
+
+func (x *PeerUpdate) GetAcmeAccount() []byte {
+	if x != nil {
+		return x.AcmeAccount
+	}
+	return nil
+}
+
+// The HTTP-01 challenges have to be served by every instance because the ACME
+// server might connect to any of them.
+type AcmeChallenge struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Path    string `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	Value   string `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	Deleted bool   `protobuf:"varint,3,opt,name=deleted,proto3" json:"deleted,omitempty"`
+}
+
+func (x *AcmeChallenge) Reset() {
+	*x = AcmeChallenge{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_portalpb_peer_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AcmeChallenge) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AcmeChallenge) ProtoMessage() {}
+
+func (x *AcmeChallenge) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_portalpb_peer_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AcmeChallenge.ProtoReflect.Descriptor instead.
+func (*AcmeChallenge) Descriptor() ([]byte, []int) {
+	return file_internal_portalpb_peer_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *AcmeChallenge) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *AcmeChallenge) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
+func (x *AcmeChallenge) GetDeleted() bool {
+	if x != nil {
+		return x.Deleted
+	}
+	return false
+}
+
+var File_internal_portalpb_peer_proto protoreflect.FileDescriptor
+
+var file_internal_portalpb_peer_proto_rawDesc = []byte{
+	0x0a, 0x1c, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x70, 0x6f, 0x72, 0x74, 0x61,
+	0x6c, 0x70, 0x62, 0x2f, 0x70, 0x65, 0x65, 0x72, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a, 0x1b,
+	0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f,
+	0x65, 0x6d, 0x70, 0x74, 0x79, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a, 0x1f, 0x69, 0x6e, 0x74,
+	0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x70, 0x6f, 0x72, 0x74, 0x61, 0x6c, 0x70, 0x62, 0x2f, 0x73,
+	0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a, 0x1f, 0x69, 0x6e,
+	0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x70, 0x6f, 0x72, 0x74, 0x61, 0x6c, 0x70, 0x62, 0x2f,
+	0x73, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xf7, 0x02,
+	0x0a, 0x0a, 0x50, 0x65, 0x65, 0x72, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x12, 0x17, 0x0a, 0x07,
+	0x6e, 0x6f, 0x64, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6e,
+	0x6f, 0x64, 0x65, 0x49, 0x64, 0x12, 0x33, 0x0a, 0x0d, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x72,
+	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0d, 0x2e, 0x52,
+	0x65, 0x67, 0x69, 0x73, 0x74, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x0d, 0x72, 0x65, 0x67,
+	0x69, 0x73, 0x74, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x2a, 0x0a, 0x0c, 0x75, 0x6e,
+	0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x65, 0x64, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b,
+	0x32, 0x06, 0x2e, 0x4c, 0x65, 0x61, 0x73, 0x65, 0x52, 0x0c, 0x75, 0x6e, 0x72, 0x65, 0x67, 0x69,
+	0x73, 0x74, 0x65, 0x72, 0x65, 0x64, 0x12, 0x19, 0x0a, 0x08, 0x72, 0x6f, 0x6f, 0x74, 0x5f, 0x63,
+	0x61, 0x73, 0x18, 0x04, 0x20, 0x03, 0x28, 0x0c, 0x52, 0x07, 0x72, 0x6f, 0x6f, 0x74, 0x43, 0x61,
+	0x73, 0x12, 0x30, 0x0a, 0x0c, 0x63, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65,
+	0x73, 0x18, 0x05, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0c, 0x2e, 0x43, 0x65, 0x72, 0x74, 0x69, 0x66,
+	0x69, 0x63, 0x61, 0x74, 0x65, 0x52, 0x0c, 0x63, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61,
+	0x74, 0x65, 0x73, 0x12, 0x35, 0x0a, 0x0b, 0x6d, 0x61, 0x69, 0x6e, 0x74, 0x65, 0x6e, 0x61, 0x6e,
+	0x63, 0x65, 0x18, 0x06, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x4d, 0x61, 0x69, 0x6e, 0x74,
+	0x65, 0x6e, 0x61, 0x6e, 0x63, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x0b, 0x6d,
+	0x61, 0x69, 0x6e, 0x74, 0x65, 0x6e, 0x61, 0x6e, 0x63, 0x65, 0x12, 0x37, 0x0a, 0x0f, 0x61, 0x63,
+	0x6d, 0x65, 0x5f, 0x63, 0x68, 0x61, 0x6c, 0x6c, 0x65, 0x6e, 0x67, 0x65, 0x73, 0x18, 0x07, 0x20,
+	0x03, 0x28, 0x0b, 0x32, 0x0e, 0x2e, 0x41, 0x63, 0x6d, 0x65, 0x43, 0x68, 0x61, 0x6c, 0x6c, 0x65,
+	0x6e, 0x67, 0x65, 0x52, 0x0e, 0x61, 0x63, 0x6d, 0x65, 0x43, 0x68, 0x61, 0x6c, 0x6c, 0x65, 0x6e,
+	0x67, 0x65, 0x73, 0x12, 0x21, 0x0a, 0x0c, 0x61, 0x63, 0x6d, 0x65, 0x5f, 0x61, 0x63, 0x63, 0x6f,
+	0x75, 0x6e, 0x74, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0b, 0x61, 0x63, 0x6d, 0x65, 0x41,
+	0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x4a, 0x04, 0x08, 0x08, 0x10, 0x09, 0x52, 0x09, 0x61, 0x70,
+	0x69, 0x5f, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x22, 0x53, 0x0a, 0x0d, 0x41, 0x63, 0x6d, 0x65, 0x43,
+	0x68, 0x61, 0x6c, 0x6c, 0x65, 0x6e, 0x67, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x70, 0x61, 0x74, 0x68,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x70, 0x61, 0x74, 0x68, 0x12, 0x14, 0x0a, 0x05,
+	0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c,
+	0x75, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x64, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x64, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x08, 0x52, 0x07, 0x64, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x64, 0x32, 0x42, 0x0a, 0x0a,
+	0x50, 0x6f, 0x72, 0x74, 0x61, 0x6c, 0x50, 0x65, 0x65, 0x72, 0x12, 0x34, 0x0a, 0x09, 0x52, 0x65,
+	0x70, 0x6c, 0x69, 0x63, 0x61, 0x74, 0x65, 0x12, 0x0b, 0x2e, 0x50, 0x65, 0x65, 0x72, 0x55, 0x70,
+	0x64, 0x61, 0x74, 0x65, 0x1a, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x22, 0x00, 0x28, 0x01,
+	0x42, 0x26, 0x5a, 0x24, 0x61, 0x73, 0x6b, 0x2e, 0x73, 0x79, 0x73, 0x74, 0x65, 0x6d, 0x73, 0x2f,
+	0x64, 0x61, 0x65, 0x6d, 0x6f, 0x6e, 0x2f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f,
+	0x70, 0x6f, 0x72, 0x74, 0x61, 0x6c, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_internal_portalpb_peer_proto_rawDescOnce sync.Once
+	file_internal_portalpb_peer_proto_rawDescData = file_internal_portalpb_peer_proto_rawDesc
+)
+
+func file_internal_portalpb_peer_proto_rawDescGZIP() []byte {
+	file_internal_portalpb_peer_proto_rawDescOnce.Do(func() {
+		file_internal_portalpb_peer_proto_rawDescData = protoimpl.X.CompressGZIP(file_internal_portalpb_peer_proto_rawDescData)
+	})
+	return file_internal_portalpb_peer_proto_rawDescData
+}
+
+var file_internal_portalpb_peer_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_internal_portalpb_peer_proto_goTypes = []interface{}{
+	(*PeerUpdate)(nil),         // 0: PeerUpdate
+	(*AcmeChallenge)(nil),      // 1: AcmeChallenge
+	(*Registration)(nil),       // 2: Registration
+	(*Lease)(nil),              // 3: Lease
+	(*Certificate)(nil),        // 4: Certificate
+	(*MaintenanceRequest)(nil), // 5: MaintenanceRequest
+	(*emptypb.Empty)(nil),      // 6: google.protobuf.Empty
+}
+var file_internal_portalpb_peer_proto_depIdxs = []int32{
+	2, // 0: PeerUpdate.registrations:type_name -> Registration
+	3, // 1: PeerUpdate.unregistered:type_name -> Lease
+	4, // 2: PeerUpdate.certificates:type_name -> Certificate
+	5, // 3: PeerUpdate.maintenance:type_name -> MaintenanceRequest
+	1, // 4: PeerUpdate.acme_challenges:type_name -> AcmeChallenge
+	0, // 5: PortalPeer.Replicate:input_type -> PeerUpdate
+	6, // 6: PortalPeer.Replicate:output_type -> google.protobuf.Empty
+	6, // [6:7] is the sub-list for method output_type
+	5, // [5:6] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
+}
+
+func init() { file_internal_portalpb_peer_proto_init() }
+func file_internal_portalpb_peer_proto_init() {
+	if File_internal_portalpb_peer_proto != nil {
+		return
+	}
+	file_internal_portalpb_service_proto_init()
+	file_internal_portalpb_storage_proto_init()
+	if !protoimpl.UnsafeEnabled {
+		file_internal_portalpb_peer_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PeerUpdate); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_portalpb_peer_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*AcmeChallenge); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_internal_portalpb_peer_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_internal_portalpb_peer_proto_goTypes,
+		DependencyIndexes: file_internal_portalpb_peer_proto_depIdxs,
+		MessageInfos:      file_internal_portalpb_peer_proto_msgTypes,
+	}.Build()
+	File_internal_portalpb_peer_proto = out.File
+	file_internal_portalpb_peer_proto_rawDesc = nil
+	file_internal_portalpb_peer_proto_goTypes = nil
+	file_internal_portalpb_peer_proto_depIdxs = nil
+}
@@ -0,0 +1,146 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v5.29.5
+// source: internal/portalpb/peer.proto
+
+package portalpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// PortalPeerClient is the client API for PortalPeer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PortalPeerClient interface {
+	// Each instance opens a stream to each of its peers and sends all of its
+	// state first, then the changes as they happen. Empty updates are sent
+	// regularly as a heartbeat.
+	Replicate(ctx context.Context, opts ...grpc.CallOption) (PortalPeer_ReplicateClient, error)
+}
+
+type portalPeerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPortalPeerClient(cc grpc.ClientConnInterface) PortalPeerClient {
+	return &portalPeerClient{cc}
+}
+
+func (c *portalPeerClient) Replicate(ctx context.Context, opts ...grpc.CallOption) (PortalPeer_ReplicateClient, error) {
+	stream, err := c.cc.NewStream(ctx, &PortalPeer_ServiceDesc.Streams[0], "/PortalPeer/Replicate", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &portalPeerReplicateClient{stream}
+	return x, nil
+}
+
+type PortalPeer_ReplicateClient interface {
+	Send(*PeerUpdate) error
+	CloseAndRecv() (*emptypb.Empty, error)
+	grpc.ClientStream
+}
+
+type portalPeerReplicateClient struct {
+	grpc.ClientStream
+}
+
+func (x *portalPeerReplicateClient) Send(m *PeerUpdate) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *portalPeerReplicateClient) CloseAndRecv() (*emptypb.Empty, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(emptypb.Empty)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PortalPeerServer is the server API for PortalPeer service.
+// All implementations must embed UnimplementedPortalPeerServer
+// for forward compatibility
+type PortalPeerServer interface {
+	// Each instance opens a stream to each of its peers and sends all of its
+	// state first, then the changes as they happen. Empty updates are sent
+	// regularly as a heartbeat.
+	Replicate(PortalPeer_ReplicateServer) error
+	mustEmbedUnimplementedPortalPeerServer()
+}
+
+// UnimplementedPortalPeerServer must be embedded to have forward compatible implementations.
+type UnimplementedPortalPeerServer struct {
+}
+
+func (UnimplementedPortalPeerServer) Replicate(PortalPeer_ReplicateServer) error {
+	return status.Errorf(codes.Unimplemented, "method Replicate not implemented")
+}
+func (UnimplementedPortalPeerServer) mustEmbedUnimplementedPortalPeerServer() {}
+
+// UnsafePortalPeerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PortalPeerServer will
+// result in compilation errors.
+type UnsafePortalPeerServer interface {
+	mustEmbedUnimplementedPortalPeerServer()
+}
+
+func RegisterPortalPeerServer(s grpc.ServiceRegistrar, srv PortalPeerServer) {
+	s.RegisterService(&PortalPeer_ServiceDesc, srv)
+}
+
+func _PortalPeer_Replicate_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PortalPeerServer).Replicate(&portalPeerReplicateServer{stream})
+}
+
+type PortalPeer_ReplicateServer interface {
+	SendAndClose(*emptypb.Empty) error
+	Recv() (*PeerUpdate, error)
+	grpc.ServerStream
+}
+
+type portalPeerReplicateServer struct {
+	grpc.ServerStream
+}
+
+func (x *portalPeerReplicateServer) SendAndClose(m *emptypb.Empty) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *portalPeerReplicateServer) Recv() (*PeerUpdate, error) {
+	m := new(PeerUpdate)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PortalPeer_ServiceDesc is the grpc.ServiceDesc for PortalPeer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var PortalPeer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "PortalPeer",
+	HandlerType: (*PortalPeerServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Replicate",
+			Handler:       _PortalPeer_Replicate_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "internal/portalpb/peer.proto",
+}
@@ -22,6 +22,61 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type TCPMode int32
+
+const (
+	// Clients connect with TLS using the portal certificate and portal connects
+	// to the backend with TLS if it supports it, otherwise with plain TCP.
+	TCPMode_TCP_MODE_TLS TCPMode = 0
+	// Portal forwards the bytes unchanged with no TLS on either side, for
+	// protocols that don't use TLS or start it themselves like SSH or STARTTLS.
+	TCPMode_TCP_MODE_PLAIN TCPMode = 1
+	// Clients connect with plain TCP and portal always connects to the backend
+	// with TLS, so only the traffic behind portal is encrypted.
+	TCPMode_TCP_MODE_BACKEND_TLS TCPMode = 2
+)
+
+// Enum value maps for TCPMode.
+var (
+	TCPMode_name = map[int32]string{
+		0: "TCP_MODE_TLS",
+		1: "TCP_MODE_PLAIN",
+		2: "TCP_MODE_BACKEND_TLS",
+	}
+	TCPMode_value = map[string]int32{
+		"TCP_MODE_TLS":         0,
+		"TCP_MODE_PLAIN":       1,
+		"TCP_MODE_BACKEND_TLS": 2,
+	}
+)
+
+func (x TCPMode) Enum() *TCPMode {
+	p := new(TCPMode)
+	*p = x
+	return p
+}
+
+func (x TCPMode) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (TCPMode) Descriptor() protoreflect.EnumDescriptor {
+	return file_internal_portalpb_service_proto_enumTypes[0].Descriptor()
+}
+
+func (TCPMode) Type() protoreflect.EnumType {
+	return &file_internal_portalpb_service_proto_enumTypes[0]
+}
+
+func (x TCPMode) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use TCPMode.Descriptor instead.
+func (TCPMode) EnumDescriptor() ([]byte, []int) {
+	return file_internal_portalpb_service_proto_rawDescGZIP(), []int{0}
+}
+
 // The response proto for the [gate.PortalClient.MyHostname] RPC
 type Hostname struct {
 	state         protoimpl.MessageState
@@ -82,6 +137,52 @@ type RegisterRequest struct {
 	AllowHttp    bool   `protobuf:"varint,5,opt,name=allow_http,json=allowHttp,proto3" json:"allow_http,omitempty"`
 	// This is ASN.1 DER data.
 	CertificateRequest []byte `protobuf:"bytes,4,opt,name=certificate_request,json=certificateRequest,proto3" json:"certificate_request,omitempty"`
+	// If true, portal never compresses responses for this pattern, even if
+	// compression is turned on with the portal -compress flag.
+	NoCompression bool `protobuf:"varint,9,opt,name=no_compression,json=noCompression,proto3" json:"no_compression,omitempty"`
+	// If true, portal keeps responses from this backend in its HTTP cache when
+	// the response headers allow it (Cache-Control, Expires, etc.). Caching must
+	// also be turned on with the portal -cache_size flag.
+	Cache bool `protobuf:"varint,10,opt,name=cache,proto3" json:"cache,omitempty"`
+	// If non-zero, responses are considered fresh in the cache for this long
+	// instead of the time given by the response headers. Responses that forbid
+	// caching are still not cached.
+	CacheTtlSeconds uint32 `protobuf:"varint,11,opt,name=cache_ttl_seconds,json=cacheTtlSeconds,proto3" json:"cache_ttl_seconds,omitempty"`
+	// If true, portal talks to the backend with HTTP/2, using TLS if the
+	// backend supports it and h2c (HTTP/2 without TLS) otherwise. This is
+	// required for gRPC backends. Portal also translates gRPC-web requests from
+	// browsers to gRPC for these backends.
+	Http2 bool `protobuf:"varint,12,opt,name=http2,proto3" json:"http2,omitempty"`
+	// For ":udp" patterns. If true, portal terminates DTLS from the clients
+	// with its serving certificate and relays the plain datagrams to the
+	// backend.
+	Dtls bool `protobuf:"varint,13,opt,name=dtls,proto3" json:"dtls,omitempty"`
+	// If 1 or 2, portal sends a HAProxy PROXY protocol header of that version at
+	// the start of each connection to the backend so it can see the client
+	// address. For HTTP backends this turns off connection reuse because the
+	// header is per connection. Not supported with http2 or for ":udp".
+	ProxyProtocol uint32 `protobuf:"varint,14,opt,name=proxy_protocol,json=proxyProtocol,proto3" json:"proxy_protocol,omitempty"`
+	// For ":tcp" patterns. How portal handles TLS for the connections.
+	TcpMode TCPMode `protobuf:"varint,15,opt,name=tcp_mode,json=tcpMode,proto3,enum=TCPMode" json:"tcp_mode,omitempty"`
+	// For ":tcp" patterns. If non-zero, connections are closed when no data is
+	// sent in either direction for this long.
+	TcpIdleTimeoutSeconds uint32 `protobuf:"varint,16,opt,name=tcp_idle_timeout_seconds,json=tcpIdleTimeoutSeconds,proto3" json:"tcp_idle_timeout_seconds,omitempty"`
+	// For ":tcp" patterns. If non-zero, the maximum number of open connections.
+	// New connections are closed right away when there are this many.
+	TcpMaxConnections uint32 `protobuf:"varint,17,opt,name=tcp_max_connections,json=tcpMaxConnections,proto3" json:"tcp_max_connections,omitempty"`
+	// If set, portal forwards HTTP and ":tcp" patterns to the unix socket at
+	// this absolute path on the portal machine instead of a port on the
+	// hostname. No port is leased. Only clients on the portal machine (the
+	// -rpc_socket or a loopback address) may set it, and portal must be able to
+	// open the socket. With -peers, each portal uses the path on its own
+	// machine.
+	UnixSocket string `protobuf:"bytes,18,opt,name=unix_socket,json=unixSocket,proto3" json:"unix_socket,omitempty"`
+	// If set, portal answers HTTP requests for the pattern directly with a
+	// redirect instead of forwarding them to a backend. No port is leased.
+	Redirect *Redirect `protobuf:"bytes,7,opt,name=redirect,proto3" json:"redirect,omitempty"`
+	// If set, portal answers HTTP requests for the pattern directly with this
+	// fixed response instead of forwarding them to a backend. No port is leased.
+	StaticResponse *StaticResponse `protobuf:"bytes,8,opt,name=static_response,json=staticResponse,proto3" json:"static_response,omitempty"`
 }
 
 func (x *RegisterRequest) Reset() {
@@ -158,6 +259,231 @@ func (x *RegisterRequest) GetCertificateRequest() []byte {
 	return nil
 }
 
+func (x *RegisterRequest) GetNoCompression() bool {
+	if x != nil {
+		return x.NoCompression
+	}
+	return false
+}
+
+func (x *RegisterRequest) GetCache() bool {
+	if x != nil {
+		return x.Cache
+	}
+	return false
+}
+
+func (x *RegisterRequest) GetCacheTtlSeconds() uint32 {
+	if x != nil {
+		return x.CacheTtlSeconds
+	}
+	return 0
+}
+
+func (x *RegisterRequest) GetHttp2() bool {
+	if x != nil {
+		return x.Http2
+	}
+	return false
+}
+
+func (x *RegisterRequest) GetDtls() bool {
+	if x != nil {
+		return x.Dtls
+	}
+	return false
+}
+
+func (x *RegisterRequest) GetProxyProtocol() uint32 {
+	if x != nil {
+		return x.ProxyProtocol
+	}
+	return 0
+}
+
+func (x *RegisterRequest) GetTcpMode() TCPMode {
+	if x != nil {
+		return x.TcpMode
+	}
+	return TCPMode_TCP_MODE_TLS
+}
+
+func (x *RegisterRequest) GetTcpIdleTimeoutSeconds() uint32 {
+	if x != nil {
+		return x.TcpIdleTimeoutSeconds
+	}
+	return 0
+}
+
+func (x *RegisterRequest) GetTcpMaxConnections() uint32 {
+	if x != nil {
+		return x.TcpMaxConnections
+	}
+	return 0
+}
+
+func (x *RegisterRequest) GetUnixSocket() string {
+	if x != nil {
+		return x.UnixSocket
+	}
+	return ""
+}
+
+func (x *RegisterRequest) GetRedirect() *Redirect {
+	if x != nil {
+		return x.Redirect
+	}
+	return nil
+}
+
+func (x *RegisterRequest) GetStaticResponse() *StaticResponse {
+	if x != nil {
+		return x.StaticResponse
+	}
+	return nil
+}
+
+type Redirect struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The absolute or relative URL to redirect to.
+	Url string `protobuf:"bytes,1,opt,name=url,proto3" json:"url,omitempty"`
+	// One of 301, 302, 307, or 308. The default (0) is 302.
+	Status uint32 `protobuf:"varint,2,opt,name=status,proto3" json:"status,omitempty"`
+	// If true, the part of the request path after the pattern is appended to
+	// the url path.
+	PreservePath bool `protobuf:"varint,3,opt,name=preserve_path,json=preservePath,proto3" json:"preserve_path,omitempty"`
+	// If true, the request query string is added to the url query.
+	PreserveQuery bool `protobuf:"varint,4,opt,name=preserve_query,json=preserveQuery,proto3" json:"preserve_query,omitempty"`
+}
+
+func (x *Redirect) Reset() {
+	*x = Redirect{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_portalpb_service_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Redirect) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Redirect) ProtoMessage() {}
+
+func (x *Redirect) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_portalpb_service_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Redirect.ProtoReflect.Descriptor instead.
+func (*Redirect) Descriptor() ([]byte, []int) {
+	return file_internal_portalpb_service_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Redirect) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
+
+func (x *Redirect) GetStatus() uint32 {
+	if x != nil {
+		return x.Status
+	}
+	return 0
+}
+
+func (x *Redirect) GetPreservePath() bool {
+	if x != nil {
+		return x.PreservePath
+	}
+	return false
+}
+
+func (x *Redirect) GetPreserveQuery() bool {
+	if x != nil {
+		return x.PreserveQuery
+	}
+	return false
+}
+
+type StaticResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Body []byte `protobuf:"bytes,1,opt,name=body,proto3" json:"body,omitempty"`
+	// If unset, the type is detected from the body.
+	ContentType string `protobuf:"bytes,2,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	// The HTTP status code. The default (0) is 200.
+	Status uint32 `protobuf:"varint,3,opt,name=status,proto3" json:"status,omitempty"`
+}
+
+func (x *StaticResponse) Reset() {
+	*x = StaticResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_portalpb_service_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *StaticResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StaticResponse) ProtoMessage() {}
+
+func (x *StaticResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_portalpb_service_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StaticResponse.ProtoReflect.Descriptor instead.
+func (*StaticResponse) Descriptor() ([]byte, []int) {
+	return file_internal_portalpb_service_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *StaticResponse) GetBody() []byte {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+func (x *StaticResponse) GetContentType() string {
+	if x != nil {
+		return x.ContentType
+	}
+	return ""
+}
+
+func (x *StaticResponse) GetStatus() uint32 {
+	if x != nil {
+		return x.Status
+	}
+	return 0
+}
+
 // Information proto about a successful registration portal is storing.
 //
 // For the Certificate field use [tools.TLSCertificateFromBytes] for parsing the
@@ -186,7 +512,7 @@ type Lease struct {
 func (x *Lease) Reset() {
 	*x = Lease{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_internal_portalpb_service_proto_msgTypes[2]
+		mi := &file_internal_portalpb_service_proto_msgTypes[4]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -199,7 +525,7 @@ func (x *Lease) String() string {
 func (*Lease) ProtoMessage() {}
 
 func (x *Lease) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_portalpb_service_proto_msgTypes[2]
+	mi := &file_internal_portalpb_service_proto_msgTypes[4]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -212,7 +538,7 @@ func (x *Lease) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Lease.ProtoReflect.Descriptor instead.
 func (*Lease) Descriptor() ([]byte, []int) {
-	return file_internal_portalpb_service_proto_rawDescGZIP(), []int{2}
+	return file_internal_portalpb_service_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *Lease) GetPattern() string {
@@ -250,6 +576,190 @@ func (x *Lease) GetCertificate() [][]byte {
 	return nil
 }
 
+// Options for the [gate.PortalClient.SetMaintenance] RPC
+//
+// Maintenance mode is tracked by pattern, not by lease, so it stays on if the
+// backend re-registers the pattern during an upgrade. It is turned off when the
+// pattern is unregistered or the lease expires. The lease itself is unaffected
+// and must still be renewed as usual.
+type MaintenanceRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The exact pattern that was registered, including the hostname if any.
+	Pattern string `protobuf:"bytes,1,opt,name=pattern,proto3" json:"pattern,omitempty"`
+	// True to start serving the 503 maintenance page, false to resume proxying.
+	Enabled bool `protobuf:"varint,2,opt,name=enabled,proto3" json:"enabled,omitempty"`
+	// If non-zero, sent to clients in the Retry-After header.
+	RetryAfterSeconds uint32 `protobuf:"varint,3,opt,name=retry_after_seconds,json=retryAfterSeconds,proto3" json:"retry_after_seconds,omitempty"`
+}
+
+func (x *MaintenanceRequest) Reset() {
+	*x = MaintenanceRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_portalpb_service_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MaintenanceRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MaintenanceRequest) ProtoMessage() {}
+
+func (x *MaintenanceRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_portalpb_service_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MaintenanceRequest.ProtoReflect.Descriptor instead.
+func (*MaintenanceRequest) Descriptor() ([]byte, []int) {
+	return file_internal_portalpb_service_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *MaintenanceRequest) GetPattern() string {
+	if x != nil {
+		return x.Pattern
+	}
+	return ""
+}
+
+func (x *MaintenanceRequest) GetEnabled() bool {
+	if x != nil {
+		return x.Enabled
+	}
+	return false
+}
+
+func (x *MaintenanceRequest) GetRetryAfterSeconds() uint32 {
+	if x != nil {
+		return x.RetryAfterSeconds
+	}
+	return 0
+}
+
+// Options for the [gate.PortalClient.Purge] RPC
+//
+// At least one field must be set. If both are set, only responses matching
+// both are purged.
+type PurgeRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Purge all cached responses for this exact registered pattern.
+	Pattern string `protobuf:"bytes,1,opt,name=pattern,proto3" json:"pattern,omitempty"`
+	// Purge cached responses whose URL starts with this prefix. Either a host
+	// and path like "example.com/blog/" or only a path like "/blog/" which
+	// matches any host.
+	UrlPrefix string `protobuf:"bytes,2,opt,name=url_prefix,json=urlPrefix,proto3" json:"url_prefix,omitempty"`
+}
+
+func (x *PurgeRequest) Reset() {
+	*x = PurgeRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_portalpb_service_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PurgeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PurgeRequest) ProtoMessage() {}
+
+func (x *PurgeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_portalpb_service_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PurgeRequest.ProtoReflect.Descriptor instead.
+func (*PurgeRequest) Descriptor() ([]byte, []int) {
+	return file_internal_portalpb_service_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *PurgeRequest) GetPattern() string {
+	if x != nil {
+		return x.Pattern
+	}
+	return ""
+}
+
+func (x *PurgeRequest) GetUrlPrefix() string {
+	if x != nil {
+		return x.UrlPrefix
+	}
+	return ""
+}
+
+// The response proto for the [gate.PortalClient.Purge] RPC
+type PurgeResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The number of cached responses that were removed.
+	Purged uint32 `protobuf:"varint,1,opt,name=purged,proto3" json:"purged,omitempty"`
+}
+
+func (x *PurgeResponse) Reset() {
+	*x = PurgeResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_portalpb_service_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PurgeResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PurgeResponse) ProtoMessage() {}
+
+func (x *PurgeResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_portalpb_service_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PurgeResponse.ProtoReflect.Descriptor instead.
+func (*PurgeResponse) Descriptor() ([]byte, []int) {
+	return file_internal_portalpb_service_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *PurgeResponse) GetPurged() uint32 {
+	if x != nil {
+		return x.Purged
+	}
+	return 0
+}
+
 var File_internal_portalpb_service_proto protoreflect.FileDescriptor
 
 var file_internal_portalpb_service_proto_rawDesc = []byte{
@@ -261,7 +771,7 @@ var file_internal_portalpb_service_proto_rawDesc = []byte{
 	0x62, 0x75, 0x66, 0x2f, 0x65, 0x6d, 0x70, 0x74, 0x79, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22,
 	0x26, 0x0a, 0x08, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x68,
 	0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x68,
-	0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x22, 0xdb, 0x01, 0x0a, 0x0f, 0x52, 0x65, 0x67, 0x69,
+	0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x22, 0xa5, 0x05, 0x0a, 0x0f, 0x52, 0x65, 0x67, 0x69,
 	0x73, 0x74, 0x65, 0x72, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x70,
 	0x61, 0x74, 0x74, 0x65, 0x72, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x70, 0x61,
 	0x74, 0x74, 0x65, 0x72, 0x6e, 0x12, 0x1d, 0x0a, 0x0a, 0x66, 0x69, 0x78, 0x65, 0x64, 0x5f, 0x70,
@@ -275,30 +785,99 @@ var file_internal_portalpb_service_proto_rawDesc = []byte{
 	0x48, 0x74, 0x74, 0x70, 0x12, 0x2f, 0x0a, 0x13, 0x63, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63,
 	0x61, 0x74, 0x65, 0x5f, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28,
 	0x0c, 0x52, 0x12, 0x63, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x52, 0x65,
-	0x71, 0x75, 0x65, 0x73, 0x74, 0x22, 0xa7, 0x01, 0x0a, 0x05, 0x4c, 0x65, 0x61, 0x73, 0x65, 0x12,
-	0x18, 0x0a, 0x07, 0x70, 0x61, 0x74, 0x74, 0x65, 0x72, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x07, 0x70, 0x61, 0x74, 0x74, 0x65, 0x72, 0x6e, 0x12, 0x18, 0x0a, 0x07, 0x61, 0x64, 0x64,
-	0x72, 0x65, 0x73, 0x73, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x61, 0x64, 0x64, 0x72,
-	0x65, 0x73, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x70, 0x6f, 0x72, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28,
-	0x0d, 0x52, 0x04, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x34, 0x0a, 0x07, 0x74, 0x69, 0x6d, 0x65, 0x6f,
-	0x75, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c,
-	0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73,
-	0x74, 0x61, 0x6d, 0x70, 0x52, 0x07, 0x74, 0x69, 0x6d, 0x65, 0x6f, 0x75, 0x74, 0x12, 0x20, 0x0a,
-	0x0b, 0x63, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x18, 0x04, 0x20, 0x03,
-	0x28, 0x0c, 0x52, 0x0b, 0x63, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x32,
-	0x9e, 0x01, 0x0a, 0x06, 0x50, 0x6f, 0x72, 0x74, 0x61, 0x6c, 0x12, 0x26, 0x0a, 0x08, 0x52, 0x65,
-	0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x12, 0x10, 0x2e, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65,
-	0x72, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x06, 0x2e, 0x4c, 0x65, 0x61, 0x73, 0x65,
-	0x22, 0x00, 0x12, 0x19, 0x0a, 0x05, 0x52, 0x65, 0x6e, 0x65, 0x77, 0x12, 0x06, 0x2e, 0x4c, 0x65,
-	0x61, 0x73, 0x65, 0x1a, 0x06, 0x2e, 0x4c, 0x65, 0x61, 0x73, 0x65, 0x22, 0x00, 0x12, 0x1e, 0x0a,
-	0x0a, 0x55, 0x6e, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x12, 0x06, 0x2e, 0x4c, 0x65,
-	0x61, 0x73, 0x65, 0x1a, 0x06, 0x2e, 0x4c, 0x65, 0x61, 0x73, 0x65, 0x22, 0x00, 0x12, 0x31, 0x0a,
-	0x0a, 0x4d, 0x79, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x16, 0x2e, 0x67, 0x6f,
-	0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d,
-	0x70, 0x74, 0x79, 0x1a, 0x09, 0x2e, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x22, 0x00,
-	0x42, 0x26, 0x5a, 0x24, 0x61, 0x73, 0x6b, 0x2e, 0x73, 0x79, 0x73, 0x74, 0x65, 0x6d, 0x73, 0x2f,
-	0x64, 0x61, 0x65, 0x6d, 0x6f, 0x6e, 0x2f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f,
-	0x70, 0x6f, 0x72, 0x74, 0x61, 0x6c, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x25, 0x0a, 0x0e, 0x6e, 0x6f, 0x5f, 0x63, 0x6f, 0x6d, 0x70,
+	0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x09, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0d, 0x6e,
+	0x6f, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x14, 0x0a, 0x05,
+	0x63, 0x61, 0x63, 0x68, 0x65, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x08, 0x52, 0x05, 0x63, 0x61, 0x63,
+	0x68, 0x65, 0x12, 0x2a, 0x0a, 0x11, 0x63, 0x61, 0x63, 0x68, 0x65, 0x5f, 0x74, 0x74, 0x6c, 0x5f,
+	0x73, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0f, 0x63,
+	0x61, 0x63, 0x68, 0x65, 0x54, 0x74, 0x6c, 0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x12, 0x14,
+	0x0a, 0x05, 0x68, 0x74, 0x74, 0x70, 0x32, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x08, 0x52, 0x05, 0x68,
+	0x74, 0x74, 0x70, 0x32, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x74, 0x6c, 0x73, 0x18, 0x0d, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x04, 0x64, 0x74, 0x6c, 0x73, 0x12, 0x25, 0x0a, 0x0e, 0x70, 0x72, 0x6f, 0x78,
+	0x79, 0x5f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x0d,
+	0x52, 0x0d, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x12,
+	0x23, 0x0a, 0x08, 0x74, 0x63, 0x70, 0x5f, 0x6d, 0x6f, 0x64, 0x65, 0x18, 0x0f, 0x20, 0x01, 0x28,
+	0x0e, 0x32, 0x08, 0x2e, 0x54, 0x43, 0x50, 0x4d, 0x6f, 0x64, 0x65, 0x52, 0x07, 0x74, 0x63, 0x70,
+	0x4d, 0x6f, 0x64, 0x65, 0x12, 0x37, 0x0a, 0x18, 0x74, 0x63, 0x70, 0x5f, 0x69, 0x64, 0x6c, 0x65,
+	0x5f, 0x74, 0x69, 0x6d, 0x65, 0x6f, 0x75, 0x74, 0x5f, 0x73, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73,
+	0x18, 0x10, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x15, 0x74, 0x63, 0x70, 0x49, 0x64, 0x6c, 0x65, 0x54,
+	0x69, 0x6d, 0x65, 0x6f, 0x75, 0x74, 0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x12, 0x2e, 0x0a,
+	0x13, 0x74, 0x63, 0x70, 0x5f, 0x6d, 0x61, 0x78, 0x5f, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74,
+	0x69, 0x6f, 0x6e, 0x73, 0x18, 0x11, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x11, 0x74, 0x63, 0x70, 0x4d,
+	0x61, 0x78, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x1f, 0x0a,
+	0x0b, 0x75, 0x6e, 0x69, 0x78, 0x5f, 0x73, 0x6f, 0x63, 0x6b, 0x65, 0x74, 0x18, 0x12, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x0a, 0x75, 0x6e, 0x69, 0x78, 0x53, 0x6f, 0x63, 0x6b, 0x65, 0x74, 0x12, 0x25,
+	0x0a, 0x08, 0x72, 0x65, 0x64, 0x69, 0x72, 0x65, 0x63, 0x74, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x09, 0x2e, 0x52, 0x65, 0x64, 0x69, 0x72, 0x65, 0x63, 0x74, 0x52, 0x08, 0x72, 0x65, 0x64,
+	0x69, 0x72, 0x65, 0x63, 0x74, 0x12, 0x38, 0x0a, 0x0f, 0x73, 0x74, 0x61, 0x74, 0x69, 0x63, 0x5f,
+	0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f,
+	0x2e, 0x53, 0x74, 0x61, 0x74, 0x69, 0x63, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x52,
+	0x0e, 0x73, 0x74, 0x61, 0x74, 0x69, 0x63, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22,
+	0x80, 0x01, 0x0a, 0x08, 0x52, 0x65, 0x64, 0x69, 0x72, 0x65, 0x63, 0x74, 0x12, 0x10, 0x0a, 0x03,
+	0x75, 0x72, 0x6c, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x75, 0x72, 0x6c, 0x12, 0x16,
+	0x0a, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06,
+	0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x23, 0x0a, 0x0d, 0x70, 0x72, 0x65, 0x73, 0x65, 0x72,
+	0x76, 0x65, 0x5f, 0x70, 0x61, 0x74, 0x68, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0c, 0x70,
+	0x72, 0x65, 0x73, 0x65, 0x72, 0x76, 0x65, 0x50, 0x61, 0x74, 0x68, 0x12, 0x25, 0x0a, 0x0e, 0x70,
+	0x72, 0x65, 0x73, 0x65, 0x72, 0x76, 0x65, 0x5f, 0x71, 0x75, 0x65, 0x72, 0x79, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x08, 0x52, 0x0d, 0x70, 0x72, 0x65, 0x73, 0x65, 0x72, 0x76, 0x65, 0x51, 0x75, 0x65,
+	0x72, 0x79, 0x22, 0x5f, 0x0a, 0x0e, 0x53, 0x74, 0x61, 0x74, 0x69, 0x63, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x12, 0x21, 0x0a, 0x0c, 0x63, 0x6f, 0x6e, 0x74,
+	0x65, 0x6e, 0x74, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b,
+	0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x73,
+	0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x73, 0x74, 0x61,
+	0x74, 0x75, 0x73, 0x22, 0xa7, 0x01, 0x0a, 0x05, 0x4c, 0x65, 0x61, 0x73, 0x65, 0x12, 0x18, 0x0a,
+	0x07, 0x70, 0x61, 0x74, 0x74, 0x65, 0x72, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07,
+	0x70, 0x61, 0x74, 0x74, 0x65, 0x72, 0x6e, 0x12, 0x18, 0x0a, 0x07, 0x61, 0x64, 0x64, 0x72, 0x65,
+	0x73, 0x73, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73,
+	0x73, 0x12, 0x12, 0x0a, 0x04, 0x70, 0x6f, 0x72, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52,
+	0x04, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x34, 0x0a, 0x07, 0x74, 0x69, 0x6d, 0x65, 0x6f, 0x75, 0x74,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61,
+	0x6d, 0x70, 0x52, 0x07, 0x74, 0x69, 0x6d, 0x65, 0x6f, 0x75, 0x74, 0x12, 0x20, 0x0a, 0x0b, 0x63,
+	0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x18, 0x04, 0x20, 0x03, 0x28, 0x0c,
+	0x52, 0x0b, 0x63, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x22, 0x78, 0x0a,
+	0x12, 0x4d, 0x61, 0x69, 0x6e, 0x74, 0x65, 0x6e, 0x61, 0x6e, 0x63, 0x65, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x61, 0x74, 0x74, 0x65, 0x72, 0x6e, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x70, 0x61, 0x74, 0x74, 0x65, 0x72, 0x6e, 0x12, 0x18, 0x0a,
+	0x07, 0x65, 0x6e, 0x61, 0x62, 0x6c, 0x65, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07,
+	0x65, 0x6e, 0x61, 0x62, 0x6c, 0x65, 0x64, 0x12, 0x2e, 0x0a, 0x13, 0x72, 0x65, 0x74, 0x72, 0x79,
+	0x5f, 0x61, 0x66, 0x74, 0x65, 0x72, 0x5f, 0x73, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x0d, 0x52, 0x11, 0x72, 0x65, 0x74, 0x72, 0x79, 0x41, 0x66, 0x74, 0x65, 0x72,
+	0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x22, 0x47, 0x0a, 0x0c, 0x50, 0x75, 0x72, 0x67, 0x65,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x61, 0x74, 0x74, 0x65,
+	0x72, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x70, 0x61, 0x74, 0x74, 0x65, 0x72,
+	0x6e, 0x12, 0x1d, 0x0a, 0x0a, 0x75, 0x72, 0x6c, 0x5f, 0x70, 0x72, 0x65, 0x66, 0x69, 0x78, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x75, 0x72, 0x6c, 0x50, 0x72, 0x65, 0x66, 0x69, 0x78,
+	0x22, 0x27, 0x0a, 0x0d, 0x50, 0x75, 0x72, 0x67, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x12, 0x16, 0x0a, 0x06, 0x70, 0x75, 0x72, 0x67, 0x65, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x0d, 0x52, 0x06, 0x70, 0x75, 0x72, 0x67, 0x65, 0x64, 0x2a, 0x49, 0x0a, 0x07, 0x54, 0x43, 0x50,
+	0x4d, 0x6f, 0x64, 0x65, 0x12, 0x10, 0x0a, 0x0c, 0x54, 0x43, 0x50, 0x5f, 0x4d, 0x4f, 0x44, 0x45,
+	0x5f, 0x54, 0x4c, 0x53, 0x10, 0x00, 0x12, 0x12, 0x0a, 0x0e, 0x54, 0x43, 0x50, 0x5f, 0x4d, 0x4f,
+	0x44, 0x45, 0x5f, 0x50, 0x4c, 0x41, 0x49, 0x4e, 0x10, 0x01, 0x12, 0x18, 0x0a, 0x14, 0x54, 0x43,
+	0x50, 0x5f, 0x4d, 0x4f, 0x44, 0x45, 0x5f, 0x42, 0x41, 0x43, 0x4b, 0x45, 0x4e, 0x44, 0x5f, 0x54,
+	0x4c, 0x53, 0x10, 0x02, 0x32, 0x86, 0x02, 0x0a, 0x06, 0x50, 0x6f, 0x72, 0x74, 0x61, 0x6c, 0x12,
+	0x26, 0x0a, 0x08, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x12, 0x10, 0x2e, 0x52, 0x65,
+	0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x06, 0x2e,
+	0x4c, 0x65, 0x61, 0x73, 0x65, 0x22, 0x00, 0x12, 0x19, 0x0a, 0x05, 0x52, 0x65, 0x6e, 0x65, 0x77,
+	0x12, 0x06, 0x2e, 0x4c, 0x65, 0x61, 0x73, 0x65, 0x1a, 0x06, 0x2e, 0x4c, 0x65, 0x61, 0x73, 0x65,
+	0x22, 0x00, 0x12, 0x1e, 0x0a, 0x0a, 0x55, 0x6e, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72,
+	0x12, 0x06, 0x2e, 0x4c, 0x65, 0x61, 0x73, 0x65, 0x1a, 0x06, 0x2e, 0x4c, 0x65, 0x61, 0x73, 0x65,
+	0x22, 0x00, 0x12, 0x31, 0x0a, 0x0a, 0x4d, 0x79, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65,
+	0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
+	0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x09, 0x2e, 0x48, 0x6f, 0x73, 0x74, 0x6e,
+	0x61, 0x6d, 0x65, 0x22, 0x00, 0x12, 0x3c, 0x0a, 0x0e, 0x53, 0x65, 0x74, 0x4d, 0x61, 0x69, 0x6e,
+	0x74, 0x65, 0x6e, 0x61, 0x6e, 0x63, 0x65, 0x12, 0x13, 0x2e, 0x4d, 0x61, 0x69, 0x6e, 0x74, 0x65,
+	0x6e, 0x61, 0x6e, 0x63, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x13, 0x2e, 0x4d,
+	0x61, 0x69, 0x6e, 0x74, 0x65, 0x6e, 0x61, 0x6e, 0x63, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x22, 0x00, 0x12, 0x28, 0x0a, 0x05, 0x50, 0x75, 0x72, 0x67, 0x65, 0x12, 0x0d, 0x2e, 0x50,
+	0x75, 0x72, 0x67, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x0e, 0x2e, 0x50, 0x75,
+	0x72, 0x67, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x42, 0x26, 0x5a,
+	0x24, 0x61, 0x73, 0x6b, 0x2e, 0x73, 0x79, 0x73, 0x74, 0x65, 0x6d, 0x73, 0x2f, 0x64, 0x61, 0x65,
+	0x6d, 0x6f, 0x6e, 0x2f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x70, 0x6f, 0x72,
+	0x74, 0x61, 0x6c, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -313,29 +892,43 @@ func file_internal_portalpb_service_proto_rawDescGZIP() []byte {
 	return file_internal_portalpb_service_proto_rawDescData
 }
 
-var file_internal_portalpb_service_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_internal_portalpb_service_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_internal_portalpb_service_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
 var file_internal_portalpb_service_proto_goTypes = []interface{}{
-	(*Hostname)(nil),              // 0: Hostname
-	(*RegisterRequest)(nil),       // 1: RegisterRequest
-	(*Lease)(nil),                 // 2: Lease
-	(*timestamppb.Timestamp)(nil), // 3: google.protobuf.Timestamp
-	(*emptypb.Empty)(nil),         // 4: google.protobuf.Empty
+	(TCPMode)(0),                  // 0: TCPMode
+	(*Hostname)(nil),              // 1: Hostname
+	(*RegisterRequest)(nil),       // 2: RegisterRequest
+	(*Redirect)(nil),              // 3: Redirect
+	(*StaticResponse)(nil),        // 4: StaticResponse
+	(*Lease)(nil),                 // 5: Lease
+	(*MaintenanceRequest)(nil),    // 6: MaintenanceRequest
+	(*PurgeRequest)(nil),          // 7: PurgeRequest
+	(*PurgeResponse)(nil),         // 8: PurgeResponse
+	(*timestamppb.Timestamp)(nil), // 9: google.protobuf.Timestamp
+	(*emptypb.Empty)(nil),         // 10: google.protobuf.Empty
 }
 var file_internal_portalpb_service_proto_depIdxs = []int32{
-	3, // 0: Lease.timeout:type_name -> google.protobuf.Timestamp
-	1, // 1: Portal.Register:input_type -> RegisterRequest
-	2, // 2: Portal.Renew:input_type -> Lease
-	2, // 3: Portal.Unregister:input_type -> Lease
-	4, // 4: Portal.MyHostname:input_type -> google.protobuf.Empty
-	2, // 5: Portal.Register:output_type -> Lease
-	2, // 6: Portal.Renew:output_type -> Lease
-	2, // 7: Portal.Unregister:output_type -> Lease
-	0, // 8: Portal.MyHostname:output_type -> Hostname
-	5, // [5:9] is the sub-list for method output_type
-	1, // [1:5] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+	0,  // 0: RegisterRequest.tcp_mode:type_name -> TCPMode
+	3,  // 1: RegisterRequest.redirect:type_name -> Redirect
+	4,  // 2: RegisterRequest.static_response:type_name -> StaticResponse
+	9,  // 3: Lease.timeout:type_name -> google.protobuf.Timestamp
+	2,  // 4: Portal.Register:input_type -> RegisterRequest
+	5,  // 5: Portal.Renew:input_type -> Lease
+	5,  // 6: Portal.Unregister:input_type -> Lease
+	10, // 7: Portal.MyHostname:input_type -> google.protobuf.Empty
+	6,  // 8: Portal.SetMaintenance:input_type -> MaintenanceRequest
+	7,  // 9: Portal.Purge:input_type -> PurgeRequest
+	5,  // 10: Portal.Register:output_type -> Lease
+	5,  // 11: Portal.Renew:output_type -> Lease
+	5,  // 12: Portal.Unregister:output_type -> Lease
+	1,  // 13: Portal.MyHostname:output_type -> Hostname
+	6,  // 14: Portal.SetMaintenance:output_type -> MaintenanceRequest
+	8,  // 15: Portal.Purge:output_type -> PurgeResponse
+	10, // [10:16] is the sub-list for method output_type
+	4,  // [4:10] is the sub-list for method input_type
+	4,  // [4:4] is the sub-list for extension type_name
+	4,  // [4:4] is the sub-list for extension extendee
+	0,  // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_internal_portalpb_service_proto_init() }
@@ -369,6 +962,30 @@ func file_internal_portalpb_service_proto_init() {
 			}
 		}
 		file_internal_portalpb_service_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Redirect); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_portalpb_service_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*StaticResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_portalpb_service_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*Lease); i {
 			case 0:
 				return &v.state
@@ -380,19 +997,56 @@ func file_internal_portalpb_service_proto_init() {
 				return nil
 			}
 		}
+		file_internal_portalpb_service_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MaintenanceRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_portalpb_service_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PurgeRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_portalpb_service_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PurgeResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_internal_portalpb_service_proto_rawDesc,
-			NumEnums:      0,
-			NumMessages:   3,
+			NumEnums:      1,
+			NumMessages:   8,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_internal_portalpb_service_proto_goTypes,
 		DependencyIndexes: file_internal_portalpb_service_proto_depIdxs,
+		EnumInfos:         file_internal_portalpb_service_proto_enumTypes,
 		MessageInfos:      file_internal_portalpb_service_proto_msgTypes,
 	}.Build()
 	File_internal_portalpb_service_proto = out.File
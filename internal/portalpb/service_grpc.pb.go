@@ -27,6 +27,11 @@ type PortalClient interface {
 	Renew(ctx context.Context, in *Lease, opts ...grpc.CallOption) (*Lease, error)
 	Unregister(ctx context.Context, in *Lease, opts ...grpc.CallOption) (*Lease, error)
 	MyHostname(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Hostname, error)
+	// Turn maintenance mode on or off for an HTTP pattern. While on, portal
+	// serves a 503 page for the pattern instead of forwarding to the backend.
+	SetMaintenance(ctx context.Context, in *MaintenanceRequest, opts ...grpc.CallOption) (*MaintenanceRequest, error)
+	// Remove responses from the portal HTTP cache by pattern or URL prefix.
+	Purge(ctx context.Context, in *PurgeRequest, opts ...grpc.CallOption) (*PurgeResponse, error)
 }
 
 type portalClient struct {
@@ -73,6 +78,24 @@ func (c *portalClient) MyHostname(ctx context.Context, in *emptypb.Empty, opts .
 	return out, nil
 }
 
+func (c *portalClient) SetMaintenance(ctx context.Context, in *MaintenanceRequest, opts ...grpc.CallOption) (*MaintenanceRequest, error) {
+	out := new(MaintenanceRequest)
+	err := c.cc.Invoke(ctx, "/Portal/SetMaintenance", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *portalClient) Purge(ctx context.Context, in *PurgeRequest, opts ...grpc.CallOption) (*PurgeResponse, error) {
+	out := new(PurgeResponse)
+	err := c.cc.Invoke(ctx, "/Portal/Purge", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // PortalServer is the server API for Portal service.
 // All implementations must embed UnimplementedPortalServer
 // for forward compatibility
@@ -81,6 +104,11 @@ type PortalServer interface {
 	Renew(context.Context, *Lease) (*Lease, error)
 	Unregister(context.Context, *Lease) (*Lease, error)
 	MyHostname(context.Context, *emptypb.Empty) (*Hostname, error)
+	// Turn maintenance mode on or off for an HTTP pattern. While on, portal
+	// serves a 503 page for the pattern instead of forwarding to the backend.
+	SetMaintenance(context.Context, *MaintenanceRequest) (*MaintenanceRequest, error)
+	// Remove responses from the portal HTTP cache by pattern or URL prefix.
+	Purge(context.Context, *PurgeRequest) (*PurgeResponse, error)
 	mustEmbedUnimplementedPortalServer()
 }
 
@@ -100,6 +128,12 @@ func (UnimplementedPortalServer) Unregister(context.Context, *Lease) (*Lease, er
 func (UnimplementedPortalServer) MyHostname(context.Context, *emptypb.Empty) (*Hostname, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method MyHostname not implemented")
 }
+func (UnimplementedPortalServer) SetMaintenance(context.Context, *MaintenanceRequest) (*MaintenanceRequest, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetMaintenance not implemented")
+}
+func (UnimplementedPortalServer) Purge(context.Context, *PurgeRequest) (*PurgeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Purge not implemented")
+}
 func (UnimplementedPortalServer) mustEmbedUnimplementedPortalServer() {}
 
 // UnsafePortalServer may be embedded to opt out of forward compatibility for this service.
@@ -185,6 +219,42 @@ func _Portal_MyHostname_Handler(srv interface{}, ctx context.Context, dec func(i
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Portal_SetMaintenance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MaintenanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PortalServer).SetMaintenance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Portal/SetMaintenance",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PortalServer).SetMaintenance(ctx, req.(*MaintenanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Portal_Purge_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PurgeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PortalServer).Purge(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Portal/Purge",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PortalServer).Purge(ctx, req.(*PurgeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Portal_ServiceDesc is the grpc.ServiceDesc for Portal service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -208,6 +278,14 @@ var Portal_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "MyHostname",
 			Handler:    _Portal_MyHostname_Handler,
 		},
+		{
+			MethodName: "SetMaintenance",
+			Handler:    _Portal_SetMaintenance_Handler,
+		},
+		{
+			MethodName: "Purge",
+			Handler:    _Portal_Purge_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "internal/portalpb/service.proto",
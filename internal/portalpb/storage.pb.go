@@ -9,6 +9,7 @@ package portalpb
 import (
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 	reflect "reflect"
 	sync "sync"
 )
@@ -29,6 +30,9 @@ type Registration struct {
 	// Note: the Certificate field is not filled in the stored copy because it is
 	// not passed through. It could have been done but it wasn't necessary.
 	Lease *Lease `protobuf:"bytes,2,opt,name=lease,proto3" json:"lease,omitempty"`
+	// True if this registration came from the -routes_file. Pinned registrations
+	// never expire and can't be renewed, replaced or unregistered by clients.
+	Pinned bool `protobuf:"varint,3,opt,name=pinned,proto3" json:"pinned,omitempty"`
 }
 
 func (x *Registration) Reset() {
@@ -77,6 +81,228 @@ func (x *Registration) GetLease() *Lease {
 	return nil
 }
 
+func (x *Registration) GetPinned() bool {
+	if x != nil {
+		return x.Pinned
+	}
+	return false
+}
+
+// The schema of the -routes_file config, in textproto format.
+type Routes struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Route []*RegisterRequest `protobuf:"bytes,1,rep,name=route,proto3" json:"route,omitempty"`
+}
+
+func (x *Routes) Reset() {
+	*x = Routes{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_portalpb_storage_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Routes) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Routes) ProtoMessage() {}
+
+func (x *Routes) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_portalpb_storage_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Routes.ProtoReflect.Descriptor instead.
+func (*Routes) Descriptor() ([]byte, []int) {
+	return file_internal_portalpb_storage_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Routes) GetRoute() []*RegisterRequest {
+	if x != nil {
+		return x.Route
+	}
+	return nil
+}
+
+// The schema of the -tls_policy_file config, in textproto format.
+type TLSPolicies struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Policy []*TLSPolicy `protobuf:"bytes,1,rep,name=policy,proto3" json:"policy,omitempty"`
+}
+
+func (x *TLSPolicies) Reset() {
+	*x = TLSPolicies{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_portalpb_storage_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *TLSPolicies) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TLSPolicies) ProtoMessage() {}
+
+func (x *TLSPolicies) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_portalpb_storage_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TLSPolicies.ProtoReflect.Descriptor instead.
+func (*TLSPolicies) Descriptor() ([]byte, []int) {
+	return file_internal_portalpb_storage_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *TLSPolicies) GetPolicy() []*TLSPolicy {
+	if x != nil {
+		return x.Policy
+	}
+	return nil
+}
+
+// The TLS and HSTS settings for the HTTPS connections to a hostname.
+type TLSPolicy struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The hostname the policy is for. Use *.example.com for the subdomains of
+	// example.com, and leave it empty for the default policy for the hostnames
+	// that don't have one. Only the most specific matching policy is used.
+	Hostname string `protobuf:"bytes,1,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	// The minimum TLS version clients can use: "1.0", "1.1", "1.2", or "1.3".
+	// The default is 1.2.
+	MinVersion string `protobuf:"bytes,2,opt,name=min_version,json=minVersion,proto3" json:"min_version,omitempty"`
+	// The TLS 1.0-1.2 cipher suites to allow, by their Go names such as
+	// "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256". The TLS 1.3 cipher suites are
+	// always allowed. The default is the Go crypto/tls defaults.
+	CipherSuites []string `protobuf:"bytes,3,rep,name=cipher_suites,json=cipherSuites,proto3" json:"cipher_suites,omitempty"`
+	// The ALPN protocols to offer in order of preference, such as "h2" and
+	// "http/1.1". The default is h2 then http/1.1.
+	Alpn []string `protobuf:"bytes,4,rep,name=alpn,proto3" json:"alpn,omitempty"`
+	// The max-age of the Strict-Transport-Security header. 0 uses the default
+	// of 300 seconds, which isn't sent if a registration for the hostname sets
+	// allow_http. -1 turns the header off.
+	HstsMaxAgeSeconds     int64 `protobuf:"varint,5,opt,name=hsts_max_age_seconds,json=hstsMaxAgeSeconds,proto3" json:"hsts_max_age_seconds,omitempty"`
+	HstsIncludeSubdomains bool  `protobuf:"varint,6,opt,name=hsts_include_subdomains,json=hstsIncludeSubdomains,proto3" json:"hsts_include_subdomains,omitempty"`
+	HstsPreload           bool  `protobuf:"varint,7,opt,name=hsts_preload,json=hstsPreload,proto3" json:"hsts_preload,omitempty"`
+	// If true, plain HTTP requests are redirected to HTTPS even for
+	// registrations that set allow_http. ACME challenges are still served.
+	HttpsOnly bool `protobuf:"varint,8,opt,name=https_only,json=httpsOnly,proto3" json:"https_only,omitempty"`
+}
+
+func (x *TLSPolicy) Reset() {
+	*x = TLSPolicy{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_portalpb_storage_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *TLSPolicy) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TLSPolicy) ProtoMessage() {}
+
+func (x *TLSPolicy) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_portalpb_storage_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TLSPolicy.ProtoReflect.Descriptor instead.
+func (*TLSPolicy) Descriptor() ([]byte, []int) {
+	return file_internal_portalpb_storage_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *TLSPolicy) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *TLSPolicy) GetMinVersion() string {
+	if x != nil {
+		return x.MinVersion
+	}
+	return ""
+}
+
+func (x *TLSPolicy) GetCipherSuites() []string {
+	if x != nil {
+		return x.CipherSuites
+	}
+	return nil
+}
+
+func (x *TLSPolicy) GetAlpn() []string {
+	if x != nil {
+		return x.Alpn
+	}
+	return nil
+}
+
+func (x *TLSPolicy) GetHstsMaxAgeSeconds() int64 {
+	if x != nil {
+		return x.HstsMaxAgeSeconds
+	}
+	return 0
+}
+
+func (x *TLSPolicy) GetHstsIncludeSubdomains() bool {
+	if x != nil {
+		return x.HstsIncludeSubdomains
+	}
+	return false
+}
+
+func (x *TLSPolicy) GetHstsPreload() bool {
+	if x != nil {
+		return x.HstsPreload
+	}
+	return false
+}
+
+func (x *TLSPolicy) GetHttpsOnly() bool {
+	if x != nil {
+		return x.HttpsOnly
+	}
+	return false
+}
+
 type Certificate struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -85,12 +311,15 @@ type Certificate struct {
 	Domain string   `protobuf:"bytes,3,opt,name=domain,proto3" json:"domain,omitempty"`
 	Key    []byte   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
 	Der    [][]byte `protobuf:"bytes,2,rep,name=der,proto3" json:"der,omitempty"`
+	// The -autocert_server directory URL of the CA that issued the cert. Empty
+	// if it was imported or saved before portal tracked it.
+	Directory string `protobuf:"bytes,4,opt,name=directory,proto3" json:"directory,omitempty"`
 }
 
 func (x *Certificate) Reset() {
 	*x = Certificate{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_internal_portalpb_storage_proto_msgTypes[1]
+		mi := &file_internal_portalpb_storage_proto_msgTypes[4]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -103,7 +332,7 @@ func (x *Certificate) String() string {
 func (*Certificate) ProtoMessage() {}
 
 func (x *Certificate) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_portalpb_storage_proto_msgTypes[1]
+	mi := &file_internal_portalpb_storage_proto_msgTypes[4]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -116,7 +345,7 @@ func (x *Certificate) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Certificate.ProtoReflect.Descriptor instead.
 func (*Certificate) Descriptor() ([]byte, []int) {
-	return file_internal_portalpb_storage_proto_rawDescGZIP(), []int{1}
+	return file_internal_portalpb_storage_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *Certificate) GetDomain() string {
@@ -140,6 +369,80 @@ func (x *Certificate) GetDer() [][]byte {
 	return nil
 }
 
+func (x *Certificate) GetDirectory() string {
+	if x != nil {
+		return x.Directory
+	}
+	return ""
+}
+
+// An OCSP response to staple to the TLS handshakes for one of the serving certs
+type OCSPStaple struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The SHA-256 hash of the leaf certificate DER that the response is for
+	CertHash []byte `protobuf:"bytes,1,opt,name=cert_hash,json=certHash,proto3" json:"cert_hash,omitempty"`
+	// The DER encoded OCSP response
+	Response []byte `protobuf:"bytes,2,opt,name=response,proto3" json:"response,omitempty"`
+	// When the response expires
+	NextUpdate *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=next_update,json=nextUpdate,proto3" json:"next_update,omitempty"`
+}
+
+func (x *OCSPStaple) Reset() {
+	*x = OCSPStaple{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_portalpb_storage_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *OCSPStaple) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OCSPStaple) ProtoMessage() {}
+
+func (x *OCSPStaple) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_portalpb_storage_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OCSPStaple.ProtoReflect.Descriptor instead.
+func (*OCSPStaple) Descriptor() ([]byte, []int) {
+	return file_internal_portalpb_storage_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *OCSPStaple) GetCertHash() []byte {
+	if x != nil {
+		return x.CertHash
+	}
+	return nil
+}
+
+func (x *OCSPStaple) GetResponse() []byte {
+	if x != nil {
+		return x.Response
+	}
+	return nil
+}
+
+func (x *OCSPStaple) GetNextUpdate() *timestamppb.Timestamp {
+	if x != nil {
+		return x.NextUpdate
+	}
+	return nil
+}
+
 type State struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -151,12 +454,17 @@ type State struct {
 	ApiToken     string         `protobuf:"bytes,3,opt,name=api_token,json=apiToken,proto3" json:"api_token,omitempty"`
 	AcmeAccount  []byte         `protobuf:"bytes,5,opt,name=acme_account,json=acmeAccount,proto3" json:"acme_account,omitempty"`
 	Certificates []*Certificate `protobuf:"bytes,4,rep,name=certificates,proto3" json:"certificates,omitempty"` // These are the acme auto TLS certs
+	// Patterns that are currently in maintenance mode, keyed by pattern
+	Maintenance []*MaintenanceRequest `protobuf:"bytes,6,rep,name=maintenance,proto3" json:"maintenance,omitempty"`
+	// OCSP responses for both the acme certs and the -tls_cert files, so they
+	// can be stapled right away after a restart
+	OcspStaples []*OCSPStaple `protobuf:"bytes,7,rep,name=ocsp_staples,json=ocspStaples,proto3" json:"ocsp_staples,omitempty"`
 }
 
 func (x *State) Reset() {
 	*x = State{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_internal_portalpb_storage_proto_msgTypes[2]
+		mi := &file_internal_portalpb_storage_proto_msgTypes[6]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -169,7 +477,7 @@ func (x *State) String() string {
 func (*State) ProtoMessage() {}
 
 func (x *State) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_portalpb_storage_proto_msgTypes[2]
+	mi := &file_internal_portalpb_storage_proto_msgTypes[6]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -182,7 +490,7 @@ func (x *State) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use State.ProtoReflect.Descriptor instead.
 func (*State) Descriptor() ([]byte, []int) {
-	return file_internal_portalpb_storage_proto_rawDescGZIP(), []int{2}
+	return file_internal_portalpb_storage_proto_rawDescGZIP(), []int{6}
 }
 
 func (x *State) GetRegistrations() []*Registration {
@@ -220,24 +528,77 @@ func (x *State) GetCertificates() []*Certificate {
 	return nil
 }
 
+func (x *State) GetMaintenance() []*MaintenanceRequest {
+	if x != nil {
+		return x.Maintenance
+	}
+	return nil
+}
+
+func (x *State) GetOcspStaples() []*OCSPStaple {
+	if x != nil {
+		return x.OcspStaples
+	}
+	return nil
+}
+
 var File_internal_portalpb_storage_proto protoreflect.FileDescriptor
 
 var file_internal_portalpb_storage_proto_rawDesc = []byte{
 	0x0a, 0x1f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x70, 0x6f, 0x72, 0x74, 0x61,
 	0x6c, 0x70, 0x62, 0x2f, 0x73, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74,
-	0x6f, 0x1a, 0x1f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x70, 0x6f, 0x72, 0x74,
-	0x61, 0x6c, 0x70, 0x62, 0x2f, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x2e, 0x70, 0x72, 0x6f,
-	0x74, 0x6f, 0x22, 0x58, 0x0a, 0x0c, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x72, 0x61, 0x74, 0x69,
-	0x6f, 0x6e, 0x12, 0x2a, 0x0a, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20,
-	0x01, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x52, 0x65,
-	0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1c,
-	0x0a, 0x05, 0x6c, 0x65, 0x61, 0x73, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x06, 0x2e,
-	0x4c, 0x65, 0x61, 0x73, 0x65, 0x52, 0x05, 0x6c, 0x65, 0x61, 0x73, 0x65, 0x22, 0x49, 0x0a, 0x0b,
-	0x43, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x64,
-	0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x64, 0x6f, 0x6d,
-	0x61, 0x69, 0x6e, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c,
-	0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x64, 0x65, 0x72, 0x18, 0x02, 0x20, 0x03,
-	0x28, 0x0c, 0x52, 0x03, 0x64, 0x65, 0x72, 0x22, 0xc8, 0x01, 0x0a, 0x05, 0x53, 0x74, 0x61, 0x74,
+	0x6f, 0x1a, 0x1f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
+	0x75, 0x66, 0x2f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x1a, 0x1f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x70, 0x6f, 0x72,
+	0x74, 0x61, 0x6c, 0x70, 0x62, 0x2f, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x22, 0x70, 0x0a, 0x0c, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x72, 0x61, 0x74,
+	0x69, 0x6f, 0x6e, 0x12, 0x2a, 0x0a, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x1c, 0x0a, 0x05, 0x6c, 0x65, 0x61, 0x73, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x06,
+	0x2e, 0x4c, 0x65, 0x61, 0x73, 0x65, 0x52, 0x05, 0x6c, 0x65, 0x61, 0x73, 0x65, 0x12, 0x16, 0x0a,
+	0x06, 0x70, 0x69, 0x6e, 0x6e, 0x65, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x06, 0x70,
+	0x69, 0x6e, 0x6e, 0x65, 0x64, 0x22, 0x30, 0x0a, 0x06, 0x52, 0x6f, 0x75, 0x74, 0x65, 0x73, 0x12,
+	0x26, 0x0a, 0x05, 0x72, 0x6f, 0x75, 0x74, 0x65, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x10,
+	0x2e, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x52, 0x05, 0x72, 0x6f, 0x75, 0x74, 0x65, 0x22, 0x31, 0x0a, 0x0b, 0x54, 0x4c, 0x53, 0x50, 0x6f,
+	0x6c, 0x69, 0x63, 0x69, 0x65, 0x73, 0x12, 0x22, 0x0a, 0x06, 0x70, 0x6f, 0x6c, 0x69, 0x63, 0x79,
+	0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0a, 0x2e, 0x54, 0x4c, 0x53, 0x50, 0x6f, 0x6c, 0x69,
+	0x63, 0x79, 0x52, 0x06, 0x70, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x22, 0xac, 0x02, 0x0a, 0x09, 0x54,
+	0x4c, 0x53, 0x50, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x12, 0x1a, 0x0a, 0x08, 0x68, 0x6f, 0x73, 0x74,
+	0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x68, 0x6f, 0x73, 0x74,
+	0x6e, 0x61, 0x6d, 0x65, 0x12, 0x1f, 0x0a, 0x0b, 0x6d, 0x69, 0x6e, 0x5f, 0x76, 0x65, 0x72, 0x73,
+	0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x6d, 0x69, 0x6e, 0x56, 0x65,
+	0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x23, 0x0a, 0x0d, 0x63, 0x69, 0x70, 0x68, 0x65, 0x72, 0x5f,
+	0x73, 0x75, 0x69, 0x74, 0x65, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0c, 0x63, 0x69,
+	0x70, 0x68, 0x65, 0x72, 0x53, 0x75, 0x69, 0x74, 0x65, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x61, 0x6c,
+	0x70, 0x6e, 0x18, 0x04, 0x20, 0x03, 0x28, 0x09, 0x52, 0x04, 0x61, 0x6c, 0x70, 0x6e, 0x12, 0x2f,
+	0x0a, 0x14, 0x68, 0x73, 0x74, 0x73, 0x5f, 0x6d, 0x61, 0x78, 0x5f, 0x61, 0x67, 0x65, 0x5f, 0x73,
+	0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x11, 0x68, 0x73,
+	0x74, 0x73, 0x4d, 0x61, 0x78, 0x41, 0x67, 0x65, 0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x12,
+	0x36, 0x0a, 0x17, 0x68, 0x73, 0x74, 0x73, 0x5f, 0x69, 0x6e, 0x63, 0x6c, 0x75, 0x64, 0x65, 0x5f,
+	0x73, 0x75, 0x62, 0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28, 0x08,
+	0x52, 0x15, 0x68, 0x73, 0x74, 0x73, 0x49, 0x6e, 0x63, 0x6c, 0x75, 0x64, 0x65, 0x53, 0x75, 0x62,
+	0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x73, 0x12, 0x21, 0x0a, 0x0c, 0x68, 0x73, 0x74, 0x73, 0x5f,
+	0x70, 0x72, 0x65, 0x6c, 0x6f, 0x61, 0x64, 0x18, 0x07, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0b, 0x68,
+	0x73, 0x74, 0x73, 0x50, 0x72, 0x65, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x1d, 0x0a, 0x0a, 0x68, 0x74,
+	0x74, 0x70, 0x73, 0x5f, 0x6f, 0x6e, 0x6c, 0x79, 0x18, 0x08, 0x20, 0x01, 0x28, 0x08, 0x52, 0x09,
+	0x68, 0x74, 0x74, 0x70, 0x73, 0x4f, 0x6e, 0x6c, 0x79, 0x22, 0x67, 0x0a, 0x0b, 0x43, 0x65, 0x72,
+	0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x64, 0x6f, 0x6d, 0x61,
+	0x69, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e,
+	0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x6b,
+	0x65, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x64, 0x65, 0x72, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0c, 0x52,
+	0x03, 0x64, 0x65, 0x72, 0x12, 0x1c, 0x0a, 0x09, 0x64, 0x69, 0x72, 0x65, 0x63, 0x74, 0x6f, 0x72,
+	0x79, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x64, 0x69, 0x72, 0x65, 0x63, 0x74, 0x6f,
+	0x72, 0x79, 0x22, 0x82, 0x01, 0x0a, 0x0a, 0x4f, 0x43, 0x53, 0x50, 0x53, 0x74, 0x61, 0x70, 0x6c,
+	0x65, 0x12, 0x1b, 0x0a, 0x09, 0x63, 0x65, 0x72, 0x74, 0x5f, 0x68, 0x61, 0x73, 0x68, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x0c, 0x52, 0x08, 0x63, 0x65, 0x72, 0x74, 0x48, 0x61, 0x73, 0x68, 0x12, 0x1a,
+	0x0a, 0x08, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c,
+	0x52, 0x08, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x3b, 0x0a, 0x0b, 0x6e, 0x65,
+	0x78, 0x74, 0x5f, 0x75, 0x70, 0x64, 0x61, 0x74, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75,
+	0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x0a, 0x6e, 0x65, 0x78,
+	0x74, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x22, 0xaf, 0x02, 0x0a, 0x05, 0x53, 0x74, 0x61, 0x74,
 	0x65, 0x12, 0x33, 0x0a, 0x0d, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x72, 0x61, 0x74, 0x69, 0x6f,
 	0x6e, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0d, 0x2e, 0x52, 0x65, 0x67, 0x69, 0x73,
 	0x74, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x0d, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x72,
@@ -250,10 +611,16 @@ var file_internal_portalpb_storage_proto_rawDesc = []byte{
 	0x12, 0x30, 0x0a, 0x0c, 0x63, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x73,
 	0x18, 0x04, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0c, 0x2e, 0x43, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69,
 	0x63, 0x61, 0x74, 0x65, 0x52, 0x0c, 0x63, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74,
-	0x65, 0x73, 0x42, 0x26, 0x5a, 0x24, 0x61, 0x73, 0x6b, 0x2e, 0x73, 0x79, 0x73, 0x74, 0x65, 0x6d,
-	0x73, 0x2f, 0x64, 0x61, 0x65, 0x6d, 0x6f, 0x6e, 0x2f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61,
-	0x6c, 0x2f, 0x70, 0x6f, 0x72, 0x74, 0x61, 0x6c, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74,
-	0x6f, 0x33,
+	0x65, 0x73, 0x12, 0x35, 0x0a, 0x0b, 0x6d, 0x61, 0x69, 0x6e, 0x74, 0x65, 0x6e, 0x61, 0x6e, 0x63,
+	0x65, 0x18, 0x06, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x4d, 0x61, 0x69, 0x6e, 0x74, 0x65,
+	0x6e, 0x61, 0x6e, 0x63, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x0b, 0x6d, 0x61,
+	0x69, 0x6e, 0x74, 0x65, 0x6e, 0x61, 0x6e, 0x63, 0x65, 0x12, 0x2e, 0x0a, 0x0c, 0x6f, 0x63, 0x73,
+	0x70, 0x5f, 0x73, 0x74, 0x61, 0x70, 0x6c, 0x65, 0x73, 0x18, 0x07, 0x20, 0x03, 0x28, 0x0b, 0x32,
+	0x0b, 0x2e, 0x4f, 0x43, 0x53, 0x50, 0x53, 0x74, 0x61, 0x70, 0x6c, 0x65, 0x52, 0x0b, 0x6f, 0x63,
+	0x73, 0x70, 0x53, 0x74, 0x61, 0x70, 0x6c, 0x65, 0x73, 0x42, 0x26, 0x5a, 0x24, 0x61, 0x73, 0x6b,
+	0x2e, 0x73, 0x79, 0x73, 0x74, 0x65, 0x6d, 0x73, 0x2f, 0x64, 0x61, 0x65, 0x6d, 0x6f, 0x6e, 0x2f,
+	0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x70, 0x6f, 0x72, 0x74, 0x61, 0x6c, 0x70,
+	0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -268,24 +635,35 @@ func file_internal_portalpb_storage_proto_rawDescGZIP() []byte {
 	return file_internal_portalpb_storage_proto_rawDescData
 }
 
-var file_internal_portalpb_storage_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_internal_portalpb_storage_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
 var file_internal_portalpb_storage_proto_goTypes = []interface{}{
-	(*Registration)(nil),    // 0: Registration
-	(*Certificate)(nil),     // 1: Certificate
-	(*State)(nil),           // 2: State
-	(*RegisterRequest)(nil), // 3: RegisterRequest
-	(*Lease)(nil),           // 4: Lease
+	(*Registration)(nil),          // 0: Registration
+	(*Routes)(nil),                // 1: Routes
+	(*TLSPolicies)(nil),           // 2: TLSPolicies
+	(*TLSPolicy)(nil),             // 3: TLSPolicy
+	(*Certificate)(nil),           // 4: Certificate
+	(*OCSPStaple)(nil),            // 5: OCSPStaple
+	(*State)(nil),                 // 6: State
+	(*RegisterRequest)(nil),       // 7: RegisterRequest
+	(*Lease)(nil),                 // 8: Lease
+	(*timestamppb.Timestamp)(nil), // 9: google.protobuf.Timestamp
+	(*MaintenanceRequest)(nil),    // 10: MaintenanceRequest
 }
 var file_internal_portalpb_storage_proto_depIdxs = []int32{
-	3, // 0: Registration.request:type_name -> RegisterRequest
-	4, // 1: Registration.lease:type_name -> Lease
-	0, // 2: State.registrations:type_name -> Registration
-	1, // 3: State.certificates:type_name -> Certificate
-	4, // [4:4] is the sub-list for method output_type
-	4, // [4:4] is the sub-list for method input_type
-	4, // [4:4] is the sub-list for extension type_name
-	4, // [4:4] is the sub-list for extension extendee
-	0, // [0:4] is the sub-list for field type_name
+	7,  // 0: Registration.request:type_name -> RegisterRequest
+	8,  // 1: Registration.lease:type_name -> Lease
+	7,  // 2: Routes.route:type_name -> RegisterRequest
+	3,  // 3: TLSPolicies.policy:type_name -> TLSPolicy
+	9,  // 4: OCSPStaple.next_update:type_name -> google.protobuf.Timestamp
+	0,  // 5: State.registrations:type_name -> Registration
+	4,  // 6: State.certificates:type_name -> Certificate
+	10, // 7: State.maintenance:type_name -> MaintenanceRequest
+	5,  // 8: State.ocsp_staples:type_name -> OCSPStaple
+	9,  // [9:9] is the sub-list for method output_type
+	9,  // [9:9] is the sub-list for method input_type
+	9,  // [9:9] is the sub-list for extension type_name
+	9,  // [9:9] is the sub-list for extension extendee
+	0,  // [0:9] is the sub-list for field type_name
 }
 
 func init() { file_internal_portalpb_storage_proto_init() }
@@ -308,7 +686,7 @@ func file_internal_portalpb_storage_proto_init() {
 			}
 		}
 		file_internal_portalpb_storage_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Certificate); i {
+			switch v := v.(*Routes); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -320,6 +698,54 @@ func file_internal_portalpb_storage_proto_init() {
 			}
 		}
 		file_internal_portalpb_storage_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*TLSPolicies); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_portalpb_storage_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*TLSPolicy); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_portalpb_storage_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Certificate); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_portalpb_storage_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*OCSPStaple); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_portalpb_storage_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*State); i {
 			case 0:
 				return &v.state
@@ -338,7 +764,7 @@ func file_internal_portalpb_storage_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_internal_portalpb_storage_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   3,
+			NumMessages:   7,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -105,6 +105,13 @@ type Command struct {
 	// In the child process, the files will have fd = 3 + len(Ports) + i, where
 	// Files[i] is the file
 	Files []string `protobuf:"bytes,6,rep,name=files,proto3" json:"files,omitempty"`
+	// UDP ports to listen on and pass to the process as files. Portal uses
+	// this for the HTTP/3 (QUIC) port.
+	//
+	// In the child process, the sockets will have
+	// fd = 3 + len(Ports) + len(Files) + i, where UdpPorts[i] is the port to
+	// bind
+	UdpPorts []uint32 `protobuf:"varint,10,rep,packed,name=udp_ports,json=udpPorts,proto3" json:"udp_ports,omitempty"`
 	// Set to true if all of the files are tls certs you want to keep
 	// autoupdated. This is assumed to be true for portal. You only need this if
 	// you want to make your own binary that gets files refreshed.
@@ -206,6 +213,13 @@ func (x *Command) GetFiles() []string {
 	return nil
 }
 
+func (x *Command) GetUdpPorts() []uint32 {
+	if x != nil {
+		return x.UdpPorts
+	}
+	return nil
+}
+
 func (x *Command) GetAutoTlsCerts() bool {
 	if x != nil {
 		return x.AutoTlsCerts
@@ -220,7 +234,7 @@ var file_internal_spawnpb_config_proto_rawDesc = []byte{
 	0x70, 0x62, 0x2f, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22,
 	0x2c, 0x0a, 0x06, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x12, 0x22, 0x0a, 0x07, 0x63, 0x6f, 0x6d,
 	0x6d, 0x61, 0x6e, 0x64, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x08, 0x2e, 0x43, 0x6f, 0x6d,
-	0x6d, 0x61, 0x6e, 0x64, 0x52, 0x07, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x22, 0xed, 0x01,
+	0x6d, 0x61, 0x6e, 0x64, 0x52, 0x07, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x22, 0x8a, 0x02,
 	0x0a, 0x07, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x62, 0x69, 0x6e,
 	0x61, 0x72, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x62, 0x69, 0x6e, 0x61, 0x72,
 	0x79, 0x12, 0x12, 0x0a, 0x04, 0x75, 0x73, 0x65, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52,
@@ -233,12 +247,14 @@ var file_internal_spawnpb_config_proto_rawDesc = []byte{
 	0x04, 0x20, 0x03, 0x28, 0x09, 0x52, 0x04, 0x61, 0x72, 0x67, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x70,
 	0x6f, 0x72, 0x74, 0x73, 0x18, 0x05, 0x20, 0x03, 0x28, 0x0d, 0x52, 0x05, 0x70, 0x6f, 0x72, 0x74,
 	0x73, 0x12, 0x14, 0x0a, 0x05, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x09,
-	0x52, 0x05, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x12, 0x24, 0x0a, 0x0e, 0x61, 0x75, 0x74, 0x6f, 0x5f,
-	0x74, 0x6c, 0x73, 0x5f, 0x63, 0x65, 0x72, 0x74, 0x73, 0x18, 0x09, 0x20, 0x01, 0x28, 0x08, 0x52,
-	0x0c, 0x61, 0x75, 0x74, 0x6f, 0x54, 0x6c, 0x73, 0x43, 0x65, 0x72, 0x74, 0x73, 0x42, 0x25, 0x5a,
-	0x23, 0x61, 0x73, 0x6b, 0x2e, 0x73, 0x79, 0x73, 0x74, 0x65, 0x6d, 0x73, 0x2f, 0x64, 0x61, 0x65,
-	0x6d, 0x6f, 0x6e, 0x2f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x73, 0x70, 0x61,
-	0x77, 0x6e, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x52, 0x05, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x12, 0x1b, 0x0a, 0x09, 0x75, 0x64, 0x70, 0x5f, 0x70,
+	0x6f, 0x72, 0x74, 0x73, 0x18, 0x0a, 0x20, 0x03, 0x28, 0x0d, 0x52, 0x08, 0x75, 0x64, 0x70, 0x50,
+	0x6f, 0x72, 0x74, 0x73, 0x12, 0x24, 0x0a, 0x0e, 0x61, 0x75, 0x74, 0x6f, 0x5f, 0x74, 0x6c, 0x73,
+	0x5f, 0x63, 0x65, 0x72, 0x74, 0x73, 0x18, 0x09, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0c, 0x61, 0x75,
+	0x74, 0x6f, 0x54, 0x6c, 0x73, 0x43, 0x65, 0x72, 0x74, 0x73, 0x42, 0x25, 0x5a, 0x23, 0x61, 0x73,
+	0x6b, 0x2e, 0x73, 0x79, 0x73, 0x74, 0x65, 0x6d, 0x73, 0x2f, 0x64, 0x61, 0x65, 0x6d, 0x6f, 0x6e,
+	0x2f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x73, 0x70, 0x61, 0x77, 0x6e, 0x70,
+	0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
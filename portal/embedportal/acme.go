@@ -5,24 +5,117 @@ import (
 	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
+	"ask.systems/daemon/internal/portalpb"
 	"ask.systems/daemon/tools"
 	"golang.org/x/crypto/acme"
 )
 
+// After this many failed cert requests in a row to one of the -autocert_server
+// CAs, portal uses the next one in the list.
+const acmeFallbackFailures = 3
+
+// How long portal uses the fallback CA before trying the failed one again
+const acmeFallbackTimeout = 24 * time.Hour
+
+// acmeOptions are the -autocert flags for the CAs and the account
+type acmeOptions struct {
+	// Contacts are mailto: URLs
+	Contacts []string
+	CAs      []*acmeCA
+}
+
+// acmeCA is one of the -autocert_server directories and portal's account with
+// it. The fields are protected by the acmeCertGenerator's acmeMut.
+type acmeCA struct {
+	Directory string
+	// For CAs that require an existing account, nil if not needed
+	EAB *acme.ExternalAccountBinding
+
+	client      *acme.Client
+	account     *acme.Account // nil until registered
+	failures    int           // cert requests that failed in a row
+	lastFailure time.Time
+}
+
+// parseACMEOptions reads the -autocert_server, -autocert_email, and
+// -autocert_eab flags. The EAB flags have an entry for each server.
+func parseACMEOptions(servers, emails, eabKeyIDs, eabHMACs string) (*acmeOptions, error) {
+	opts := &acmeOptions{}
+	for _, email := range strings.Split(emails, ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			opts.Contacts = append(opts.Contacts, "mailto:"+email)
+		}
+	}
+	keyIDs := strings.Split(eabKeyIDs, ",")
+	hmacs := strings.Split(eabHMACs, ",")
+	for _, server := range strings.Split(servers, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		if _, err := url.ParseRequestURI(server); err != nil {
+			return nil, fmt.Errorf("Invalid -autocert_server %#v: %w", server, err)
+		}
+		ca := &acmeCA{Directory: server}
+		// The EAB entries line up with the servers that aren't blank
+		i := len(opts.CAs)
+		var keyID, hmac string
+		if i < len(keyIDs) {
+			keyID = strings.TrimSpace(keyIDs[i])
+		}
+		if i < len(hmacs) {
+			hmac = strings.TrimSpace(hmacs[i])
+		}
+		if (keyID == "") != (hmac == "") {
+			return nil, fmt.Errorf("-autocert_eab_kid and -autocert_eab_hmac must both be set for %v", server)
+		}
+		if keyID != "" {
+			// CAs give out the key in base64url, usually without padding
+			key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(hmac, "="))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid -autocert_eab_hmac for %v, it should be base64url encoded: %w", server, err)
+			}
+			ca.EAB = &acme.ExternalAccountBinding{KID: keyID, Key: key}
+		}
+		opts.CAs = append(opts.CAs, ca)
+	}
+	if len(opts.CAs) == 0 {
+		return nil, errors.New("-autocert_server must have at least one directory URL.")
+	}
+	if len(keyIDs) > len(opts.CAs) || len(hmacs) > len(opts.CAs) {
+		return nil, errors.New("-autocert_eab_kid and -autocert_eab_hmac have more entries than -autocert_server.")
+	}
+	return opts, nil
+}
+
 type acmeChallenges struct {
 	sync.Map
+
+	// Called when a challenge is added or removed, to send it to the -peers.
+	// Must be set before the challenges are used.
+	onChange func(*portalpb.AcmeChallenge)
 }
 
 func (c *acmeChallenges) Write(path string, value string) {
-	c.Map.Store(path, value)
+	if old, loaded := c.Map.Swap(path, value); loaded && old.(string) == value {
+		return
+	}
+	if c.onChange != nil {
+		c.onChange(&portalpb.AcmeChallenge{Path: path, Value: value})
+	}
 }
 
 func (c *acmeChallenges) Read(path string) (string, bool) {
@@ -34,7 +127,25 @@ func (c *acmeChallenges) Read(path string) (string, bool) {
 }
 
 func (c *acmeChallenges) Delete(path string) {
-	c.Map.Delete(path)
+	if _, loaded := c.Map.LoadAndDelete(path); !loaded {
+		return
+	}
+	if c.onChange != nil {
+		c.onChange(&portalpb.AcmeChallenge{Path: path, Deleted: true})
+	}
+}
+
+// Snapshot returns all of the current challenges to send to a peer
+func (c *acmeChallenges) Snapshot() []*portalpb.AcmeChallenge {
+	var ret []*portalpb.AcmeChallenge
+	c.Map.Range(func(path, value any) bool {
+		ret = append(ret, &portalpb.AcmeChallenge{
+			Path:  path.(string),
+			Value: value.(string),
+		})
+		return true
+	})
+	return ret
 }
 
 func loadCACert(certFile string) *x509.CertPool {
@@ -62,7 +173,7 @@ func loadCACert(certFile string) *x509.CertPool {
 	return pool
 }
 
-func acmeClient(accountKey crypto.Signer) *acme.Client {
+func acmeClient(accountKey crypto.Signer, directory string) *acme.Client {
 	client := http.DefaultClient
 	if serverCertFile := os.Getenv("ACME_SERVER_CERT"); serverCertFile != "" {
 		log.Print("Loading test CA root file for ACME server testing: ", serverCertFile)
@@ -79,20 +190,25 @@ func acmeClient(accountKey crypto.Signer) *acme.Client {
 	}
 	return &acme.Client{
 		Key:          accountKey,
-		DirectoryURL: kACMEAddress,
+		DirectoryURL: directory,
 		HTTPClient:   client,
 		UserAgent:    "daemon portal",
 	}
 }
 
-// Make an account
-// TODO: should I bother adding the email address here?
-func fetchACMEAccount(client *acme.Client) (*acme.Account, error) {
+// Get the account for the client's key or make one. The contacts of an
+// existing account are updated if they changed.
+func fetchACMEAccount(client *acme.Client, contacts []string,
+	eab *acme.ExternalAccountBinding) (*acme.Account, error) {
+
 	ctx := context.Background()
 	account, err := client.GetReg(ctx, "")
 	if err != nil {
 		if errors.Is(err, acme.ErrNoAccount) {
-			account, err = client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+			account, err = client.Register(ctx, &acme.Account{
+				Contact:                contacts,
+				ExternalAccountBinding: eab,
+			}, acme.AcceptTOS)
 			if err != nil {
 				return nil, fmt.Errorf("acme.Register error: %w", err)
 			}
@@ -100,6 +216,16 @@ func fetchACMEAccount(client *acme.Client) (*acme.Account, error) {
 			return nil, fmt.Errorf("acme.GetReg error: %w", err)
 		}
 	}
+	if !slices.Equal(account.Contact, contacts) {
+		log.Printf("Updating the acme account contacts for %v to %v", client.DirectoryURL, contacts)
+		account.Contact = contacts
+		updated, err := client.UpdateReg(ctx, account)
+		if err != nil {
+			log.Printf("Warning: Failed to update the acme account contacts: %v", err)
+		} else {
+			account = updated
+		}
+	}
 	return account, nil
 }
 
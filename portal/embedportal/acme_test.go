@@ -0,0 +1,127 @@
+package embedportal
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestParseACMEOptions(t *testing.T) {
+	// base64url with both of the URL safe characters: -_-_AQI=
+	key := []byte{0xfb, 0xff, 0xbf, 0x01, 0x02}
+	tests := []struct {
+		name                      string
+		servers, emails, kid, hmc string
+		wantDirectories           []string
+		wantEAB                   []*acme.ExternalAccountBinding // one per CA
+		wantContacts              []string
+		wantErr                   bool
+	}{
+		{
+			name:            "no EAB",
+			servers:         "https://a.example/dir",
+			emails:          "me@example.com, you@example.com",
+			wantDirectories: []string{"https://a.example/dir"},
+			wantEAB:         []*acme.ExternalAccountBinding{nil},
+			wantContacts:    []string{"mailto:me@example.com", "mailto:you@example.com"},
+		},
+		{
+			name:            "unpadded hmac",
+			servers:         "https://a.example/dir",
+			kid:             "kid-a",
+			hmc:             "-_-_AQI",
+			wantDirectories: []string{"https://a.example/dir"},
+			wantEAB:         []*acme.ExternalAccountBinding{{KID: "kid-a", Key: key}},
+		},
+		{
+			name:            "padded hmac",
+			servers:         "https://a.example/dir",
+			kid:             "kid-a",
+			hmc:             "-_-_AQI=",
+			wantDirectories: []string{"https://a.example/dir"},
+			wantEAB:         []*acme.ExternalAccountBinding{{KID: "kid-a", Key: key}},
+		},
+		{
+			name:            "EAB for the second server",
+			servers:         "https://a.example/dir,https://b.example/dir",
+			kid:             ",kid-b",
+			hmc:             ",-_-_AQI",
+			wantDirectories: []string{"https://a.example/dir", "https://b.example/dir"},
+			wantEAB:         []*acme.ExternalAccountBinding{nil, {KID: "kid-b", Key: key}},
+		},
+		{
+			name:            "blank server entry",
+			servers:         "https://a.example/dir,,https://b.example/dir,",
+			kid:             ",kid-b",
+			hmc:             ",-_-_AQI",
+			wantDirectories: []string{"https://a.example/dir", "https://b.example/dir"},
+			wantEAB:         []*acme.ExternalAccountBinding{nil, {KID: "kid-b", Key: key}},
+		},
+		{
+			name:    "kid without hmac",
+			servers: "https://a.example/dir",
+			kid:     "kid-a",
+			wantErr: true,
+		},
+		{
+			name:    "hmac without kid",
+			servers: "https://a.example/dir",
+			hmc:     "-_-_AQI",
+			wantErr: true,
+		},
+		{
+			name:    "more EAB entries than servers",
+			servers: "https://a.example/dir",
+			kid:     "kid-a,kid-b",
+			hmc:     "-_-_AQI,-_-_AQI",
+			wantErr: true,
+		},
+		{
+			name:    "invalid hmac",
+			servers: "https://a.example/dir",
+			kid:     "kid-a",
+			hmc:     "not base64!",
+			wantErr: true,
+		},
+		{
+			name:    "invalid server",
+			servers: "a.example",
+			wantErr: true,
+		},
+		{
+			name:    "no servers",
+			servers: " , ",
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts, err := parseACMEOptions(tc.servers, tc.emails, tc.kid, tc.hmc)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error, got: %+v", opts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var directories []string
+			var eab []*acme.ExternalAccountBinding
+			for _, ca := range opts.CAs {
+				directories = append(directories, ca.Directory)
+				eab = append(eab, ca.EAB)
+			}
+			if !reflect.DeepEqual(directories, tc.wantDirectories) {
+				t.Errorf("Wrong servers, got: %v want: %v", directories, tc.wantDirectories)
+			}
+			if !reflect.DeepEqual(eab, tc.wantEAB) {
+				t.Errorf("Wrong EAB, got: %+v want: %+v", eab, tc.wantEAB)
+			}
+			if !reflect.DeepEqual(opts.Contacts, tc.wantContacts) {
+				t.Errorf("Wrong contacts, got: %v want: %v", opts.Contacts, tc.wantContacts)
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package embedportal
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ask.systems/daemon/internal/portalpb"
+	"ask.systems/daemon/portal/gate"
+	"ask.systems/daemon/tools"
+
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+//go:embed admin.tmpl.html
+var adminTemplate string
+
+// How many of the recent proxy errors the admin page shows
+const proxyErrorsSize = 50
+
+// How long the admin page waits to connect to each backend to check if it's up
+const adminHealthTimeout = time.Second
+
+// proxyError is a failed request or connection to a backend
+type proxyError struct {
+	Time    time.Time
+	Pattern string
+	Message string
+}
+
+// proxyErrors keeps the most recent proxy errors for the admin page. Add does
+// nothing on a nil *proxyErrors.
+type proxyErrors struct {
+	mut    sync.Mutex
+	errors []proxyError
+	next   int // The index to overwrite next once errors is full
+}
+
+func (e *proxyErrors) Add(pattern, message string) {
+	if e == nil {
+		return
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	err := proxyError{Time: time.Now(), Pattern: pattern, Message: message}
+	if len(e.errors) < proxyErrorsSize {
+		e.errors = append(e.errors, err)
+		return
+	}
+	e.errors[e.next] = err
+	e.next = (e.next + 1) % proxyErrorsSize
+}
+
+// List returns the errors with the newest first
+func (e *proxyErrors) List() []proxyError {
+	if e == nil {
+		return nil
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	ret := make([]proxyError, 0, len(e.errors))
+	for i := len(e.errors) - 1; i >= 0; i-- {
+		ret = append(ret, e.errors[(e.next+i)%len(e.errors)])
+	}
+	return ret
+}
+
+// adminPage serves the -admin_url page which shows the routing table, the TCP
+// proxies, the serving certs, and the recent proxy errors. Admins can
+// unregister leases, toggle maintenance mode, and refresh the certs with it.
+type adminPage struct {
+	rpc       *rpcServ
+	certs     *tlsRefresher // nil when using the self-signed cert
+	errors    *proxyErrors
+	auth      *tools.BasicAuthHandler
+	templates *template.Template
+}
+
+type adminRoute struct {
+	Pattern string
+	Host    string
+	// Empty for direct responses
+	Backend     string
+	Port        uint32
+	TLS         string
+	Timeout     time.Time
+	Health      string // "up" or "down", empty if there's no backend
+	Maintenance bool
+	Pinned      bool
+}
+
+type adminTCPProxy struct {
+	Pattern          string
+	Backend          string
+	Mode             string
+	Timeout          time.Time
+	Health           string
+	Pinned           bool
+	Connections      int32
+	TotalConnections uint64
+	BytesIn          uint64
+	BytesOut         uint64
+}
+
+type adminData struct {
+	Routes     []adminRoute
+	TCPProxies []adminTCPProxy
+	Certs      []certInfo
+	SelfSigned bool
+	Errors     []proxyError
+	// The result of the last button press
+	Message string
+}
+
+// startAdminPage serves the admin page on the pattern with the httpProxy.
+// Logins is a comma separated list of username:password_hash.
+func startAdminPage(pattern, logins string, rpc *rpcServ,
+	certs *tlsRefresher, errors *proxyErrors) error {
+
+	auth := &tools.BasicAuthHandler{Realm: "portal"}
+	for i, login := range strings.Split(logins, ",") {
+		if err := auth.SetLogin(strings.TrimSpace(login)); err != nil {
+			return fmt.Errorf("Failed to add -admin_logins entry #%v: %w", i+1, err)
+		}
+	}
+	templates, err := template.New("admin").Funcs(template.FuncMap{
+		"until": func(t time.Time) string {
+			return time.Until(t).Round(time.Second).String()
+		},
+		"since": func(t time.Time) string {
+			return time.Since(t).Round(time.Second).String()
+		},
+	}).Parse(adminTemplate)
+	if err != nil {
+		return err
+	}
+	if rpc.httpProxy.IsRegistered(pattern) {
+		return fmt.Errorf("The -admin_url %#v is already registered by a client.", pattern)
+	}
+	page := &adminPage{
+		rpc:       rpc,
+		certs:     certs,
+		errors:    errors,
+		auth:      auth,
+		templates: templates,
+	}
+	// Like the cert challenge handler, there's no Drain so clients can't replace
+	// it and it isn't shown in the routing table.
+	rpc.httpProxy.forwarders.Store(pattern, &forwarder{
+		Handler: page,
+		Lease: &portalpb.Lease{
+			Pattern: pattern,
+		},
+	})
+	return nil
+}
+
+func (a *adminPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.auth.Check(w, r) {
+		if user, _, ok := r.BasicAuth(); ok {
+			log.Printf("%v failed authentication for %v on %v%v", r.RemoteAddr, user, r.Host, r.URL.Path)
+		}
+		return
+	}
+	if r.Method == "POST" {
+		a.handleAction(w, r)
+		return
+	}
+
+	data := adminData{
+		Routes:     a.routes(),
+		TCPProxies: a.tcpProxies(),
+		SelfSigned: a.certs == nil,
+		Errors:     a.errors.List(),
+		Message:    r.URL.Query().Get("message"),
+	}
+	if a.certs != nil {
+		data.Certs = a.certs.Certs()
+	}
+	a.checkHealth(data.Routes, data.TCPProxies)
+	var buff bytes.Buffer
+	if err := a.templates.Execute(&buff, data); err != nil {
+		log.Print("Error in admin page template: ", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buff.Bytes())
+}
+
+func (a *adminPage) handleAction(w http.ResponseWriter, r *http.Request) {
+	// Browsers send the basic auth login with cross site form posts too
+	if !sameOrigin(r) {
+		http.Error(w, "Cross site requests are not allowed.", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		log.Print("Recieved invaid form data: ", err)
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	user, _, _ := r.BasicAuth()
+	pattern := r.Form.Get("pattern")
+	var message string
+	switch r.Form.Get("submit") {
+	case "unregister":
+		log.Printf("Admin %v requested to unregister %v", user, pattern)
+		message = a.unregister(r.Context(), pattern)
+	case "maintenance":
+		_, enabled := a.rpc.httpProxy.maintenance.Load(pattern)
+		log.Printf("Admin %v requested to toggle maintenance mode for %v", user, pattern)
+		_, err := a.rpc.SetMaintenance(r.Context(), &portalpb.MaintenanceRequest{
+			Pattern: pattern,
+			Enabled: !enabled,
+		})
+		if err != nil {
+			message = status.Convert(err).Message()
+		} else if enabled {
+			message = fmt.Sprintf("Turned off maintenance mode for %v", pattern)
+		} else {
+			message = fmt.Sprintf("Turned on maintenance mode for %v", pattern)
+		}
+	case "refresh-certs":
+		if a.certs == nil {
+			message = "Portal is using a self-signed certificate, there is nothing to refresh."
+			break
+		}
+		log.Printf("Admin %v requested a cert refresh", user)
+		a.certs.Refresh()
+		message = "Refreshing the certificates. Reload the page to see the result."
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, r.URL.Path+"?message="+url.QueryEscape(message), http.StatusSeeOther)
+}
+
+// sameOrigin returns true if the browser says the request came from the admin
+// page. Browsers without Sec-Fetch-Site still send Origin with form posts, so
+// requests that have neither are rejected too.
+func sameOrigin(r *http.Request) bool {
+	site := r.Header.Get("Sec-Fetch-Site")
+	if site != "" && site != "same-origin" {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return site != ""
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+func (a *adminPage) unregister(ctx context.Context, pattern string) string {
+	var lease *portalpb.Lease
+	if val, ok := a.rpc.httpProxy.forwarders.Load(pattern); ok {
+		if fwd := val.(*forwarder); fwd.Drain != nil {
+			lease = fwd.Lease
+		}
+	} else if val, ok := a.rpc.tcpProxy.leases.Load(pattern); ok {
+		lease = val.(*tcpLease).Lease
+	}
+	if lease == nil {
+		return fmt.Sprintf("No registration found for pattern %#v", pattern)
+	}
+	// Unregister sets the timeout on the lease it's passed
+	if _, err := a.rpc.Unregister(ctx, proto.Clone(lease).(*portalpb.Lease)); err != nil {
+		return status.Convert(err).Message()
+	}
+	return fmt.Sprintf("Unregistered %v", pattern)
+}
+
+// registrations returns the saved registrations by pattern. These have the
+// renewed lease timeouts.
+func (a *adminPage) registrations() map[string]*portalpb.Registration {
+	ret := make(map[string]*portalpb.Registration)
+	a.rpc.state.ForEachRegistration(func(r *portalpb.Registration) {
+		ret[r.GetLease().GetPattern()] = proto.Clone(r).(*portalpb.Registration)
+	})
+	return ret
+}
+
+func (a *adminPage) routes() []adminRoute {
+	registrations := a.registrations()
+	var ret []adminRoute
+	a.rpc.httpProxy.forwarders.Range(func(key, value any) bool {
+		fwd := value.(*forwarder)
+		if fwd.Drain == nil {
+			return true // portal's own handlers
+		}
+		host, _ := gate.ParsePattern(fwd.Lease.Pattern)
+		if host == "" {
+			host = a.rpc.httpProxy.defaultHost
+		}
+		route := adminRoute{
+			Pattern: fwd.Lease.Pattern,
+			Host:    host,
+			Port:    fwd.Lease.Port,
+			Timeout: fwd.Lease.Timeout.AsTime(),
+		}
+		if r, ok := registrations[fwd.Lease.Pattern]; ok {
+			route.Timeout = r.Lease.Timeout.AsTime()
+			route.Pinned = r.Pinned
+		}
+		if fwd.Backend != nil {
+			route.Backend = fwd.Backend.Host
+			if fwd.Backend.Scheme == "https" {
+				route.TLS = "TLS"
+			} else {
+				route.TLS = "none"
+			}
+		}
+		if socket := registrations[fwd.Lease.Pattern].GetRequest().GetUnixSocket(); socket != "" {
+			route.Backend = unixBackend(socket)
+		}
+		_, route.Maintenance = a.rpc.httpProxy.maintenance.Load(fwd.Lease.Pattern)
+		ret = append(ret, route)
+		return true
+	})
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Pattern < ret[j].Pattern })
+	return ret
+}
+
+func (a *adminPage) tcpProxies() []adminTCPProxy {
+	registrations := a.registrations()
+	var ret []adminTCPProxy
+	a.rpc.tcpProxy.leases.Range(func(key, value any) bool {
+		l := value.(*tcpLease)
+		f := l.Forwarder
+		proxy := adminTCPProxy{
+			Pattern:          l.Lease.Pattern,
+			Backend:          f.ServerAddress,
+			Mode:             f.Mode.String(),
+			Timeout:          l.Lease.Timeout.AsTime(),
+			Connections:      f.conns.Load(),
+			TotalConnections: f.totalConns.Load(),
+			BytesIn:          f.bytesIn.Load(),
+			BytesOut:         f.bytesOut.Load(),
+		}
+		if r, ok := registrations[l.Lease.Pattern]; ok {
+			proxy.Timeout = r.Lease.Timeout.AsTime()
+			proxy.Pinned = r.Pinned
+		}
+		ret = append(ret, proxy)
+		return true
+	})
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Pattern < ret[j].Pattern })
+	return ret
+}
+
+// checkHealth sets the Health of the routes and proxies by connecting to each
+// of the backends at the same time.
+func (a *adminPage) checkHealth(routes []adminRoute, proxies []adminTCPProxy) {
+	var mut sync.Mutex
+	health := make(map[string]string)
+	var wg sync.WaitGroup
+	check := func(addr string) {
+		if addr == "" {
+			return
+		}
+		mut.Lock()
+		defer mut.Unlock()
+		if _, ok := health[addr]; ok {
+			return
+		}
+		health[addr] = ""
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := "up"
+			network, address := backendNetwork(addr)
+			conn, err := net.DialTimeout(network, address, adminHealthTimeout)
+			if err != nil {
+				result = "down"
+			} else {
+				conn.Close()
+			}
+			mut.Lock()
+			health[addr] = result
+			mut.Unlock()
+		}()
+	}
+	for _, r := range routes {
+		check(r.Backend)
+	}
+	for _, p := range proxies {
+		check(p.Backend)
+	}
+	wg.Wait()
+	for i := range routes {
+		routes[i].Health = health[routes[i].Backend]
+	}
+	for i := range proxies {
+		proxies[i].Health = health[proxies[i].Backend]
+	}
+}
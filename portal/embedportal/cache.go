@@ -0,0 +1,687 @@
+package embedportal
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The status codes that can be cached without explicit freshness information.
+// See RFC 9110 section 15.1
+var cacheableByDefault = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// The longest heuristic freshness lifetime we'll use for responses with a
+// Last-Modified header but no explicit expiration
+const maxHeuristicLifetime = 24 * time.Hour
+
+// responseCache is an RFC 9111 shared HTTP cache for responses from the
+// backends that opted in to caching.
+//
+// Responses are kept in memory in least recently used order and when memory
+// is full the oldest responses are moved to the disk tier, if there is one.
+type responseCache struct {
+	// The total number of bytes of responses to keep in memory
+	maxSize int64
+	// Responses bigger than this are never cached
+	maxEntrySize int64
+	// nil if there is no disk tier
+	disk *diskCache
+
+	mut  sync.Mutex
+	size int64
+	// List of *cacheEntry with the most recently used at the front
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// cacheEntry is a stored response. It must not be modified after it is stored
+// in the cache, make a copy instead.
+//
+// The fields are exported for gob encoding in the disk tier.
+type cacheEntry struct {
+	Key     string
+	Pattern string
+	Status  int
+	Header  http.Header
+	Body    []byte
+	// The request header values for the header names listed in the Vary
+	// response header
+	Vary map[string]string
+
+	// When the response was received
+	ResponseTime time.Time
+	// The age the response already had when we got it. See RFC 9111 4.2.3
+	InitialAge time.Duration
+	// How long after InitialAge the response is fresh
+	Lifetime time.Duration
+}
+
+func newResponseCache(maxSize, maxEntrySize int64, diskDir string, diskSize int64) (*responseCache, error) {
+	c := &responseCache{
+		maxSize:      maxSize,
+		maxEntrySize: maxEntrySize,
+		lru:          list.New(),
+		entries:      make(map[string]*list.Element),
+	}
+	if diskDir != "" {
+		disk, err := newDiskCache(diskDir, diskSize)
+		if err != nil {
+			return nil, err
+		}
+		c.disk = disk
+	}
+	return c, nil
+}
+
+// cacheKey returns the key for the response to the request, which is the
+// lowercase host followed by the path and query.
+func cacheKey(req *http.Request) string {
+	return strings.ToLower(req.Host) + req.URL.RequestURI()
+}
+
+func (e *cacheEntry) size() int64 {
+	size := len(e.Key) + len(e.Pattern) + len(e.Body)
+	for k, vals := range e.Header {
+		size += len(k)
+		for _, v := range vals {
+			size += len(v)
+		}
+	}
+	return int64(size)
+}
+
+// Get returns the stored response for the key, or nil if there isn't one.
+// Responses found in the disk tier are moved back into memory.
+func (c *responseCache) Get(key string) *cacheEntry {
+	c.mut.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		c.mut.Unlock()
+		return elem.Value.(*cacheEntry)
+	}
+	c.mut.Unlock()
+	if c.disk == nil {
+		return nil
+	}
+	entry := c.disk.Take(key)
+	if entry != nil {
+		c.Put(entry)
+	}
+	return entry
+}
+
+// Put stores the response, replacing any previous response for the same key
+func (c *responseCache) Put(entry *cacheEntry) {
+	size := entry.size()
+	if size > c.maxEntrySize || size > c.maxSize {
+		c.Remove(entry.Key)
+		return
+	}
+	if c.disk != nil {
+		c.disk.Remove(entry.Key)
+	}
+	c.mut.Lock()
+	c.removeUnsafe(entry.Key)
+	c.entries[entry.Key] = c.lru.PushFront(entry)
+	c.size += size
+	var evicted []*cacheEntry
+	for c.size > c.maxSize {
+		oldest := c.lru.Back()
+		old := oldest.Value.(*cacheEntry)
+		c.removeUnsafe(old.Key)
+		evicted = append(evicted, old)
+	}
+	c.mut.Unlock()
+	if c.disk != nil {
+		for _, old := range evicted {
+			c.disk.Put(old)
+		}
+	}
+}
+
+// Remove deletes the stored response for the key, if any
+func (c *responseCache) Remove(key string) {
+	c.mut.Lock()
+	c.removeUnsafe(key)
+	c.mut.Unlock()
+	if c.disk != nil {
+		c.disk.Remove(key)
+	}
+}
+
+// You must hold mut
+func (c *responseCache) removeUnsafe(key string) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.lru.Remove(elem)
+	delete(c.entries, key)
+	c.size -= elem.Value.(*cacheEntry).size()
+}
+
+// Purge removes all of the stored responses for the pattern (if not empty)
+// that have a key starting with urlPrefix (if not empty). Returns the number
+// of responses removed.
+//
+// It is safe to call on a nil *responseCache.
+func (c *responseCache) Purge(pattern, urlPrefix string) int {
+	if c == nil {
+		return 0
+	}
+	match := makePurgeMatcher(pattern, urlPrefix)
+	count := 0
+	c.mut.Lock()
+	for key, elem := range c.entries {
+		if match(key, elem.Value.(*cacheEntry).Pattern) {
+			c.removeUnsafe(key)
+			count++
+		}
+	}
+	c.mut.Unlock()
+	if c.disk != nil {
+		count += c.disk.Purge(match)
+	}
+	return count
+}
+
+func makePurgeMatcher(pattern, urlPrefix string) func(key, keyPattern string) bool {
+	urlPrefix = strings.TrimPrefix(urlPrefix, "https://")
+	urlPrefix = strings.TrimPrefix(urlPrefix, "http://")
+	pathOnly := strings.HasPrefix(urlPrefix, "/")
+	if !pathOnly {
+		// Only lowercase the host part, paths are case sensitive
+		host, path, _ := strings.Cut(urlPrefix, "/")
+		if path != "" || strings.HasSuffix(urlPrefix, "/") {
+			urlPrefix = strings.ToLower(host) + "/" + path
+		} else {
+			urlPrefix = strings.ToLower(host)
+		}
+	}
+	return func(key, keyPattern string) bool {
+		if pattern != "" && keyPattern != pattern {
+			return false
+		}
+		if urlPrefix == "" {
+			return true
+		}
+		if pathOnly {
+			if idx := strings.Index(key, "/"); idx >= 0 {
+				key = key[idx:]
+			}
+		}
+		return strings.HasPrefix(key, urlPrefix)
+	}
+}
+
+// parseCacheControl returns the directives in the Cache-Control header values
+// with lowercase names and unquoted values.
+func parseCacheControl(values []string) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			directives[name] = strings.Trim(strings.TrimSpace(arg), "\"")
+		}
+	}
+	return directives
+}
+
+// directiveSeconds returns the delta-seconds value of the directive
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	arg, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds < 0 {
+		// Invalid values are treated as stale, see RFC 9111 1.2.2
+		return 0, true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// makeCacheEntry returns the entry to store for a response to a GET request or
+// nil if the response must not be stored.
+//
+// If ttl is non-zero it replaces the freshness lifetime from the headers.
+func makeCacheEntry(key, pattern string, req *http.Request,
+	code int, header http.Header, body []byte,
+	requestTime, responseTime time.Time, ttl time.Duration) *cacheEntry {
+
+	if code < 200 || code == http.StatusPartialContent || code == http.StatusNotModified {
+		return nil
+	}
+	directives := parseCacheControl(header.Values("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return nil
+	}
+	// We're a shared cache so we can't store responses for one user
+	if _, ok := directives["private"]; ok {
+		return nil
+	}
+	// RFC 9111 allows storing these but we would send the cookie to everyone
+	if len(header.Values("Set-Cookie")) != 0 {
+		return nil
+	}
+	if req.Header.Get("Authorization") != "" {
+		_, public := directives["public"]
+		_, sMaxAge := directives["s-maxage"]
+		_, mustRevalidate := directives["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return nil
+		}
+	}
+	vary := make(map[string]string)
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				vary[name] = strings.Join(req.Header.Values(name), ",")
+			}
+		}
+	}
+	entry := &cacheEntry{
+		Key:     key,
+		Pattern: pattern,
+		Status:  code,
+		Header:  header.Clone(),
+		Body:    body,
+		Vary:    vary,
+	}
+	if !entry.updateFreshness(directives, requestTime, responseTime, ttl) {
+		return nil
+	}
+	if entry.Lifetime <= 0 && !entry.hasValidator() {
+		return nil // It would never be used
+	}
+	return entry
+}
+
+// updateFreshness sets the age and lifetime fields based on the Header.
+// Returns false if the response is not cacheable.
+func (e *cacheEntry) updateFreshness(directives map[string]string,
+	requestTime, responseTime time.Time, ttl time.Duration) bool {
+
+	date, err := http.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		date = responseTime
+	}
+	// See RFC 9111 4.2.3
+	var ageValue time.Duration
+	if age, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && age > 0 {
+		ageValue = time.Duration(age) * time.Second
+	}
+	apparentAge := max(0, responseTime.Sub(date))
+	correctedAge := ageValue + responseTime.Sub(requestTime)
+	e.ResponseTime = responseTime
+	e.InitialAge = max(apparentAge, correctedAge)
+
+	// See RFC 9111 4.2.1
+	explicit := true
+	if sMaxAge, ok := directiveSeconds(directives, "s-maxage"); ok {
+		e.Lifetime = sMaxAge
+	} else if maxAge, ok := directiveSeconds(directives, "max-age"); ok {
+		e.Lifetime = maxAge
+	} else if expiresHeader := e.Header.Get("Expires"); expiresHeader != "" {
+		// Invalid dates like "0" mean it's already expired
+		if expires, err := http.ParseTime(expiresHeader); err == nil {
+			e.Lifetime = expires.Sub(date)
+		} else {
+			e.Lifetime = 0
+		}
+	} else {
+		explicit = false
+		e.Lifetime = 0
+	}
+	_, public := directives["public"]
+	if !cacheableByDefault[e.Status] && !explicit && !public {
+		return false
+	}
+	if _, ok := directives["no-cache"]; ok {
+		e.Lifetime = 0 // Always revalidate
+		return true
+	}
+	if ttl > 0 && cacheableByDefault[e.Status] {
+		e.Lifetime = ttl
+		return true
+	}
+	// See RFC 9111 4.2.2
+	if !explicit {
+		if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && date.After(lastModified) {
+			e.Lifetime = min(date.Sub(lastModified)/10, maxHeuristicLifetime)
+		}
+	}
+	return true
+}
+
+func (e *cacheEntry) hasValidator() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.InitialAge + now.Sub(e.ResponseTime)
+}
+
+// varyMatches returns true if the request has the same values as the stored
+// request for all of the headers named in the Vary response header.
+func (e *cacheEntry) varyMatches(req *http.Request) bool {
+	for name, value := range e.Vary {
+		if strings.Join(req.Header.Values(name), ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// isFresh returns true if the entry can be served without asking the backend
+// given the request Cache-Control directives.
+func (e *cacheEntry) isFresh(now time.Time, requestDirectives map[string]string) bool {
+	if _, ok := requestDirectives["no-cache"]; ok {
+		return false
+	}
+	age := e.age(now)
+	if maxAge, ok := directiveSeconds(requestDirectives, "max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := directiveSeconds(requestDirectives, "min-fresh"); ok {
+		age += minFresh
+	}
+	return age < e.Lifetime
+}
+
+// revalidated returns a copy of the entry updated with the headers from a 304
+// response, or nil if the new headers don't allow caching anymore.
+func (e *cacheEntry) revalidated(header http.Header,
+	requestTime, responseTime time.Time, ttl time.Duration) *cacheEntry {
+
+	updated := *e
+	updated.Header = e.Header.Clone()
+	// See RFC 9111 3.2
+	for name, values := range header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding":
+			continue
+		}
+		updated.Header[name] = values
+	}
+	directives := parseCacheControl(updated.Header.Values("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return nil
+	}
+	if !updated.updateFreshness(directives, requestTime, responseTime, ttl) {
+		return nil
+	}
+	return &updated
+}
+
+// serve writes the stored response to w. Conditional and range requests are
+// handled for 200 responses.
+func (e *cacheEntry) serve(w http.ResponseWriter, req *http.Request, cacheStatus string) {
+	header := w.Header()
+	for name, values := range e.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	header.Set("Age", strconv.FormatInt(int64(e.age(time.Now())/time.Second), 10))
+	header.Set("Cache-Status", cacheStatus)
+	if e.Status == http.StatusOK {
+		header.Del("Content-Length") // ServeContent sets it
+		lastModified, _ := http.ParseTime(e.Header.Get("Last-Modified"))
+		http.ServeContent(w, req, "", lastModified, bytes.NewReader(e.Body))
+		return
+	}
+	w.WriteHeader(e.Status)
+	if req.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// cacheHandler wraps the [http.Handler] for one registration to serve
+// responses from the cache when possible and store the responses from the
+// handler.
+type cacheHandler struct {
+	Cache   *responseCache
+	Handler http.Handler
+	Pattern string
+	// If non-zero, overrides the freshness lifetime from the response headers
+	TTL time.Duration
+}
+
+func (h cacheHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key := cacheKey(req)
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions, http.MethodTrace:
+		h.Handler.ServeHTTP(w, req)
+		return
+	default:
+		// Unsafe methods might change the resource. See RFC 9111 4.4
+		h.Cache.Remove(key)
+		h.Handler.ServeHTTP(w, req)
+		return
+	}
+	if req.Header.Get("Upgrade") != "" {
+		h.Handler.ServeHTTP(w, req)
+		return
+	}
+	requestDirectives := parseCacheControl(req.Header.Values("Cache-Control"))
+	if _, ok := requestDirectives["no-store"]; ok {
+		w.Header().Set("Cache-Status", "portal; fwd=request")
+		h.Handler.ServeHTTP(w, req)
+		return
+	}
+	if len(requestDirectives) == 0 && req.Header.Get("Pragma") == "no-cache" {
+		requestDirectives["no-cache"] = ""
+	}
+
+	entry := h.Cache.Get(key)
+	if entry != nil && !entry.varyMatches(req) {
+		entry = nil
+	}
+	if entry != nil {
+		if entry.isFresh(time.Now(), requestDirectives) {
+			entry.serve(w, req, "portal; hit")
+			return
+		}
+		if entry.hasValidator() && req.Method == http.MethodGet {
+			h.revalidate(w, req, key, entry)
+			return
+		}
+	}
+	if _, ok := requestDirectives["only-if-cached"]; ok {
+		w.Header().Set("Cache-Status", "portal; fwd=miss")
+		http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		return
+	}
+	cacheStatus := "portal; fwd=miss"
+	if entry != nil {
+		cacheStatus = "portal; fwd=stale"
+	}
+	cw := &cacheWriter{
+		w:           w,
+		header:      make(http.Header),
+		limit:       h.Cache.maxEntrySize,
+		cacheStatus: cacheStatus,
+	}
+	requestTime := time.Now()
+	h.Handler.ServeHTTP(cw, req)
+	h.store(req, key, cw, requestTime)
+}
+
+// revalidate asks the backend if the stale entry is still valid and serves it
+// if so, otherwise the new response is sent to the client.
+func (h cacheHandler) revalidate(w http.ResponseWriter, req *http.Request,
+	key string, entry *cacheEntry) {
+
+	outreq := req.Clone(req.Context())
+	// The client might get a full response instead of the range or 304 they
+	// asked for, which is allowed.
+	for _, name := range []string{"If-None-Match", "If-Modified-Since",
+		"If-Match", "If-Unmodified-Since", "If-Range", "Range"} {
+		outreq.Header.Del(name)
+	}
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		outreq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+		outreq.Header.Set("If-Modified-Since", lastModified)
+	}
+	cw := &cacheWriter{
+		w:           w,
+		header:      make(http.Header),
+		limit:       h.Cache.maxEntrySize,
+		cacheStatus: "portal; fwd=stale",
+		hold304:     true,
+	}
+	requestTime := time.Now()
+	h.Handler.ServeHTTP(cw, outreq)
+	if !cw.held {
+		h.store(req, key, cw, requestTime)
+		return
+	}
+	updated := entry.revalidated(cw.stored, requestTime, time.Now(), h.TTL)
+	if updated == nil {
+		h.Cache.Remove(key)
+		updated = entry
+	} else {
+		h.Cache.Put(updated)
+	}
+	updated.serve(w, req, "portal; fwd=stale; fwd-status=304")
+}
+
+// store saves the response written to cw if it is allowed
+func (h cacheHandler) store(req *http.Request, key string, cw *cacheWriter, requestTime time.Time) {
+	if req.Method != http.MethodGet || cw.code == 0 {
+		return
+	}
+	if cw.overflow {
+		h.Cache.Remove(key)
+		return
+	}
+	entry := makeCacheEntry(key, h.Pattern, req, cw.code, cw.stored, cw.body,
+		requestTime, time.Now(), h.TTL)
+	if entry == nil {
+		h.Cache.Remove(key)
+		return
+	}
+	h.Cache.Put(entry)
+}
+
+// cacheWriter sends the response to the client and keeps a copy of it to be
+// stored in the cache.
+type cacheWriter struct {
+	w http.ResponseWriter
+	// The header the handler writes to before WriteHeader is called
+	header http.Header
+	// The most bytes of body to keep
+	limit int64
+	// The value for the Cache-Status header sent to the client
+	cacheStatus string
+	// If true, a 304 response is not sent to the client so that a stored
+	// response can be sent instead
+	hold304 bool
+
+	code int
+	// The response header, saved when WriteHeader is called
+	stored http.Header
+	// True if the response was a 304 kept from the client
+	held     bool
+	body     []byte
+	overflow bool
+}
+
+func (c *cacheWriter) Header() http.Header {
+	if c.code != 0 && !c.held {
+		// Needed for trailers
+		return c.w.Header()
+	}
+	return c.header
+}
+
+func (c *cacheWriter) WriteHeader(code int) {
+	if c.code != 0 {
+		return
+	}
+	if code < 200 {
+		// Informational responses like 103 Early Hints go out immediately
+		dst := c.w.Header()
+		for name, values := range c.header {
+			dst[name] = values
+		}
+		c.w.WriteHeader(code)
+		for name := range c.header {
+			dst.Del(name)
+		}
+		return
+	}
+	c.code = code
+	c.stored = c.header.Clone()
+	if c.hold304 && code == http.StatusNotModified {
+		c.held = true
+		return
+	}
+	dst := c.w.Header()
+	for name, values := range c.header {
+		dst[name] = values
+	}
+	dst.Set("Cache-Status", c.cacheStatus)
+	c.w.WriteHeader(code)
+}
+
+func (c *cacheWriter) Write(data []byte) (int, error) {
+	if c.code == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.overflow {
+		if int64(len(c.body)+len(data)) > c.limit {
+			c.overflow = true
+			c.body = nil
+		} else {
+			c.body = append(c.body, data...)
+		}
+	}
+	if c.held {
+		return len(data), nil
+	}
+	return c.w.Write(data)
+}
+
+func (c *cacheWriter) Flush() {
+	if c.held {
+		return
+	}
+	if c.code == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets [http.ResponseController] find the underlying writer
+func (c *cacheWriter) Unwrap() http.ResponseWriter {
+	return c.w
+}
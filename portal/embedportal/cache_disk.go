@@ -0,0 +1,231 @@
+package embedportal
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// diskCache is the second tier of [responseCache] that holds the responses
+// evicted from memory in files in a directory, one file per response.
+//
+// The index of files is kept in memory and rebuilt from the directory on
+// startup so the cache survives restarts.
+type diskCache struct {
+	dir     string
+	maxSize int64
+
+	mut  sync.Mutex
+	size int64
+	// List of *diskIndex with the most recently stored at the front
+	lru   *list.List
+	index map[string]*list.Element
+}
+
+// diskIndex is the value type of diskCache.lru
+type diskIndex struct {
+	Key     string
+	Pattern string
+	Size    int64
+}
+
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create cache directory: %w", err)
+	}
+	d := &diskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		index:   make(map[string]*list.Element),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load builds the index from the files in the directory
+func (d *diskCache) load() error {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return fmt.Errorf("Failed to read cache directory: %w", err)
+	}
+	type loaded struct {
+		index   *diskIndex
+		modTime time.Time
+	}
+	var found []loaded
+	for _, file := range files {
+		if !file.Type().IsRegular() {
+			continue
+		}
+		filename := filepath.Join(d.dir, file.Name())
+		entry, err := readCacheFile(filename)
+		if err == nil && d.filename(entry.Key) != filename {
+			err = fmt.Errorf("The filename doesn't match the key %#v", entry.Key)
+		}
+		if err != nil {
+			log.Printf("Removing invalid cache file %v: %v", filename, err)
+			os.Remove(filename)
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		found = append(found, loaded{
+			index: &diskIndex{
+				Key:     entry.Key,
+				Pattern: entry.Pattern,
+				Size:    info.Size(),
+			},
+			modTime: info.ModTime(),
+		})
+	}
+	// Oldest first so that the newest end up at the front
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].modTime.Before(found[j].modTime)
+	})
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	for _, f := range found {
+		d.index[f.index.Key] = d.lru.PushFront(f.index)
+		d.size += f.index.Size
+	}
+	d.evictUnsafe()
+	if len(found) > 0 {
+		log.Printf("Loaded %v cached responses from %v", len(d.index), d.dir)
+	}
+	return nil
+}
+
+func readCacheFile(filename string) (*cacheEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entry := &cacheEntry{}
+	if err := gob.NewDecoder(file).Decode(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (d *diskCache) filename(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(hash[:]))
+}
+
+// Put writes the entry to a file, replacing any previous file for the key
+func (d *diskCache) Put(entry *cacheEntry) {
+	tmp, err := os.CreateTemp(d.dir, ".tmp-*")
+	if err != nil {
+		log.Printf("Failed to write to the cache directory: %v", err)
+		return
+	}
+	err = gob.NewEncoder(tmp).Encode(entry)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Failed to write cached response for %v: %v", entry.Key, err)
+		os.Remove(tmp.Name())
+		return
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if err := os.Rename(tmp.Name(), d.filename(entry.Key)); err != nil {
+		log.Printf("Failed to write cached response for %v: %v", entry.Key, err)
+		os.Remove(tmp.Name())
+		return
+	}
+	d.removeIndexUnsafe(entry.Key)
+	d.index[entry.Key] = d.lru.PushFront(&diskIndex{
+		Key:     entry.Key,
+		Pattern: entry.Pattern,
+		Size:    info.Size(),
+	})
+	d.size += info.Size()
+	d.evictUnsafe()
+}
+
+// Take reads and removes the entry for the key. Returns nil if there isn't
+// one.
+func (d *diskCache) Take(key string) *cacheEntry {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if _, ok := d.index[key]; !ok {
+		return nil
+	}
+	filename := d.filename(key)
+	entry, err := readCacheFile(filename)
+	d.removeIndexUnsafe(key)
+	os.Remove(filename)
+	if err != nil {
+		log.Printf("Failed to read cache file %v: %v", filename, err)
+		return nil
+	}
+	return entry
+}
+
+// Remove deletes the file for the key, if any
+func (d *diskCache) Remove(key string) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if _, ok := d.index[key]; !ok {
+		return
+	}
+	d.removeIndexUnsafe(key)
+	os.Remove(d.filename(key))
+}
+
+// Purge deletes the files for all the keys that match. Returns the number of
+// files removed.
+func (d *diskCache) Purge(match func(key, pattern string) bool) int {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	count := 0
+	for key, elem := range d.index {
+		if match(key, elem.Value.(*diskIndex).Pattern) {
+			d.removeIndexUnsafe(key)
+			os.Remove(d.filename(key))
+			count++
+		}
+	}
+	return count
+}
+
+// You must hold mut
+func (d *diskCache) removeIndexUnsafe(key string) {
+	elem, ok := d.index[key]
+	if !ok {
+		return
+	}
+	d.lru.Remove(elem)
+	delete(d.index, key)
+	d.size -= elem.Value.(*diskIndex).Size
+}
+
+// You must hold mut
+func (d *diskCache) evictUnsafe() {
+	for d.size > d.maxSize && d.lru.Len() > 0 {
+		oldest := d.lru.Back().Value.(*diskIndex)
+		d.removeIndexUnsafe(oldest.Key)
+		os.Remove(d.filename(oldest.Key))
+	}
+}
@@ -0,0 +1,232 @@
+package embedportal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the serving certs are checked for expiring soon
+const certCheckInterval = time.Hour
+
+// The same alert for the same cert is sent at most this often
+const certAlertRepeat = 24 * time.Hour
+
+// The most time between retries of a failed cert refresh
+const maxRefreshBackoff = time.Hour
+
+// The kinds of cert alerts, in the Type field of the webhook JSON
+const (
+	alertCertExpiring = "cert_expiring"
+	alertCertFailing  = "cert_renewal_failing"
+	alertCertRecovery = "cert_renewal_recovered"
+)
+
+// certAlert is the JSON body POSTed to the -alert_webhook
+type certAlert struct {
+	Type     string    `json:"type"`
+	Message  string    `json:"message"`
+	Hostname string    `json:"hostname"`
+	Source   string    `json:"source"`
+	Names    []string  `json:"names"`
+	NotAfter time.Time `json:"not_after"`
+	Failures int       `json:"failures"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// certAlerts sends alerts when a serving cert is close to expiring or fails to
+// refresh too many times in a row. The alerts are always logged, and sent to
+// the webhook and the emails if they're set.
+type certAlerts struct {
+	webhook  string
+	smtpAddr string
+	from     string
+	to       []string
+	// Alert when a cert expires in less than this
+	expiryWarning time.Duration
+	// Alert when a cert fails to refresh this many times in a row
+	maxFailures int
+
+	client   *http.Client
+	hostname string
+
+	mut sync.Mutex
+	// The last time each alert was sent, by type and cert source
+	sent map[string]time.Time
+}
+
+func newCertAlerts(webhook, smtpAddr, from, to string,
+	expiryWarning time.Duration, maxFailures int) *certAlerts {
+
+	hostname, _ := os.Hostname()
+	if from == "" {
+		from = "portal@" + hostname
+	}
+	a := &certAlerts{
+		webhook:       webhook,
+		smtpAddr:      smtpAddr,
+		from:          from,
+		expiryWarning: expiryWarning,
+		maxFailures:   maxFailures,
+		client:        &http.Client{Timeout: 30 * time.Second},
+		hostname:      hostname,
+		sent:          make(map[string]time.Time),
+	}
+	for _, addr := range strings.Split(to, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			a.to = append(a.to, addr)
+		}
+	}
+	return a
+}
+
+// Health returns ok, expired, expiring, or failing for the cert
+func (a *certAlerts) Health(info certInfo) string {
+	switch {
+	case info.NotAfter.IsZero():
+		return "ok" // Not loaded yet
+	case time.Now().After(info.NotAfter):
+		return "expired"
+	case a.maxFailures > 0 && info.Failures >= a.maxFailures:
+		return "failing"
+	case time.Until(info.NotAfter) < a.expiryWarning:
+		return "expiring"
+	}
+	return "ok"
+}
+
+// Check sends an alert if the cert is expiring or failing, unless the same
+// alert was sent recently. If the cert refreshed after a failing alert, it
+// sends a recovery alert.
+func (a *certAlerts) Check(info certInfo) {
+	names := strings.Join(info.Names, ", ")
+	var alert *certAlert
+	switch a.Health(info) {
+	case "expired":
+		alert = &certAlert{
+			Type: alertCertExpiring,
+			Message: fmt.Sprintf("The TLS certificate for %v (%v) expired at %v.",
+				names, info.Source, info.NotAfter.Format(time.DateTime)),
+		}
+	case "failing":
+		alert = &certAlert{
+			Type: alertCertFailing,
+			Message: fmt.Sprintf("Refreshing the TLS certificate for %v (%v) failed %v times in a row. It expires in %v.",
+				names, info.Source, info.Failures, time.Until(info.NotAfter).Round(time.Minute)),
+		}
+	case "expiring":
+		alert = &certAlert{
+			Type: alertCertExpiring,
+			Message: fmt.Sprintf("The TLS certificate for %v (%v) expires in %v and hasn't been renewed.",
+				names, info.Source, time.Until(info.NotAfter).Round(time.Minute)),
+		}
+	case "ok":
+		if info.Failures == 0 && a.clear(alertCertFailing, info.Source) {
+			alert = &certAlert{
+				Type: alertCertRecovery,
+				Message: fmt.Sprintf("The TLS certificate for %v (%v) was refreshed. It expires in %v.",
+					names, info.Source, time.Until(info.NotAfter).Round(time.Minute)),
+			}
+			a.clear(alertCertExpiring, info.Source)
+			break
+		}
+		if a.clear(alertCertExpiring, info.Source) {
+			log.Printf("The TLS certificate for %v (%v) was renewed.", names, info.Source)
+		}
+	}
+	if alert == nil || (alert.Type != alertCertRecovery && !a.shouldSend(alert.Type, info.Source)) {
+		return
+	}
+	alert.Hostname = a.hostname
+	alert.Source = info.Source
+	alert.Names = info.Names
+	alert.NotAfter = info.NotAfter
+	alert.Failures = info.Failures
+	alert.Error = info.LastError
+	log.Print("Alert! ", alert.Message)
+	go a.send(alert)
+}
+
+// shouldSend records that the alert is being sent and returns true if it
+// wasn't sent recently
+func (a *certAlerts) shouldSend(alertType, source string) bool {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	key := alertType + " " + source
+	if last, ok := a.sent[key]; ok && time.Since(last) < certAlertRepeat {
+		return false
+	}
+	a.sent[key] = time.Now()
+	return true
+}
+
+// clear forgets that the alert was sent, and returns true if it was
+func (a *certAlerts) clear(alertType, source string) bool {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	key := alertType + " " + source
+	_, ok := a.sent[key]
+	delete(a.sent, key)
+	return ok
+}
+
+func (a *certAlerts) send(alert *certAlert) {
+	if a.webhook != "" {
+		if err := a.sendWebhook(alert); err != nil {
+			log.Printf("Failed to send the alert to the -alert_webhook: %v", err)
+		}
+	}
+	if a.smtpAddr != "" && len(a.to) > 0 {
+		if err := a.sendEmail(alert); err != nil {
+			log.Printf("Failed to send the alert email: %v", err)
+		}
+	}
+}
+
+func (a *certAlerts) sendWebhook(alert *certAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("The webhook returned status %v", resp.Status)
+	}
+	return nil
+}
+
+func (a *certAlerts) sendEmail(alert *certAlert) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %v\r\n", a.from)
+	fmt.Fprintf(&msg, "To: %v\r\n", strings.Join(a.to, ", "))
+	fmt.Fprintf(&msg, "Subject: portal on %v: %v\r\n", a.hostname, alert.Message)
+	fmt.Fprintf(&msg, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("\r\n")
+	msg.WriteString(alert.Message + "\r\n")
+	if alert.Error != "" {
+		fmt.Fprintf(&msg, "\r\nThe last error was: %v\r\n", alert.Error)
+	}
+	// A local mail server that doesn't need a login
+	return smtp.SendMail(a.smtpAddr, nil, a.from, a.to, []byte(msg.String()))
+}
+
+// refreshBackoff is how long to wait to retry after the number of failed
+// refreshes in a row
+func refreshBackoff(failures int) time.Duration {
+	backoff := time.Minute
+	for i := 1; i < failures && backoff < maxRefreshBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRefreshBackoff)
+}
@@ -0,0 +1,280 @@
+package embedportal
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content types that are already compressed, so compressing them again just
+// wastes CPU. Matched as prefixes of the media type.
+var precompressedTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/vnd.rar",
+	"application/octet-stream",
+	"application/pdf",
+	"application/wasm",
+}
+
+// The compressed image types that are actually text
+var textImageTypes = []string{
+	"image/svg+xml",
+	"image/x-icon",
+	"image/vnd.microsoft.icon",
+	"image/bmp",
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}}
+	brotliWriters = sync.Pool{New: func() any {
+		return brotli.NewWriterLevel(nil, 4)
+	}}
+)
+
+// compressHandler wraps an [http.Handler] and compresses the responses if the
+// client accepts it and the response is worth compressing.
+type compressHandler struct {
+	Handler http.Handler
+	// Responses with fewer bytes than this are sent uncompressed
+	MinSize int
+}
+
+func (h compressHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+	// gRPC has its own compression and can't wait for the buffer to fill
+	if encoding == "" || req.Method == http.MethodHead || req.Header.Get("Range") != "" || isGRPC(req) {
+		h.Handler.ServeHTTP(w, req)
+		return
+	}
+	cw := &compressWriter{
+		ResponseWriter: w,
+		encoding:       encoding,
+		minSize:        h.MinSize,
+	}
+	defer cw.Close()
+	h.Handler.ServeHTTP(cw, req)
+}
+
+// negotiateEncoding picks the best encoding we support from an
+// Accept-Encoding header value. Returns "" if we shouldn't compress.
+func negotiateEncoding(acceptEncoding string) string {
+	var best string
+	var bestQ float64
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "br" && name != "gzip" {
+			continue
+		}
+		q := 1.0
+		if qStr, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			q, err = strconv.ParseFloat(qStr, 64)
+			if err != nil {
+				continue
+			}
+		}
+		// Prefer brotli when the q values are the same
+		if q > bestQ || (q == bestQ && name == "br") {
+			best, bestQ = name, q
+		}
+	}
+	if bestQ <= 0 {
+		return ""
+	}
+	return best
+}
+
+func shouldCompressType(contentType string) bool {
+	if contentType == "" {
+		return false // Unknown, it could be anything
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range textImageTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	for _, prefix := range precompressedTypes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// compressWriter buffers the start of the response until it has minSize bytes
+// and then decides if the response will be compressed.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	code    int
+	buf     []byte
+	decided bool
+	enc     io.WriteCloser // nil if we decided not to compress
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if code < 200 {
+		// Informational responses like 103 Early Hints go out immediately
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	if w.decided {
+		if w.enc != nil {
+			return w.enc.Write(data)
+		}
+		return w.ResponseWriter.Write(data)
+	}
+	w.buf = append(w.buf, data...)
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// decide chooses if we'll compress, writes the header and sends the buffer.
+func (w *compressWriter) decide() error {
+	w.decided = true
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	header := w.Header()
+	if w.canCompress() {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", w.encoding)
+		// A strong ETag refers to the exact bytes, which changed
+		if etag := header.Get("ETag"); strings.HasPrefix(etag, "\"") {
+			header.Set("ETag", "W/"+etag)
+		}
+		switch w.encoding {
+		case "br":
+			bw := brotliWriters.Get().(*brotli.Writer)
+			bw.Reset(w.ResponseWriter)
+			w.enc = bw
+		case "gzip":
+			gw := gzipWriters.Get().(*gzip.Writer)
+			gw.Reset(w.ResponseWriter)
+			w.enc = gw
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (w *compressWriter) canCompress() bool {
+	header := w.Header()
+	// Vary is set even if we don't compress because it would be compressed for
+	// the same URL if the response were bigger.
+	header.Add("Vary", "Accept-Encoding")
+	if len(w.buf) == 0 || len(w.buf) < w.minSize {
+		return false
+	}
+	if w.code == http.StatusNoContent || w.code == http.StatusNotModified ||
+		w.code == http.StatusPartialContent {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	if strings.Contains(header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	return shouldCompressType(header.Get("Content-Type"))
+}
+
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if err := w.decide(); err != nil {
+			return
+		}
+	}
+	switch enc := w.enc.(type) {
+	case *gzip.Writer:
+		enc.Flush()
+	case *brotli.Writer:
+		enc.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the compressed stream. It must be called after the handler
+// returns.
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		if w.code == 0 {
+			// The handler never wrote anything, let the server do the default
+			return nil
+		}
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.enc == nil {
+		return nil
+	}
+	err := w.enc.Close()
+	switch enc := w.enc.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(enc)
+	case *brotli.Writer:
+		brotliWriters.Put(enc)
+	}
+	w.enc = nil
+	return err
+}
+
+// Unwrap lets [http.ResponseController] find the underlying writer, for
+// example so that httputil.ReverseProxy can hijack for websockets.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
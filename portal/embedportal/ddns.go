@@ -0,0 +1,355 @@
+package embedportal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// How long each check of the public IP and the DNS updates can take
+const ddnsTimeout = 30 * time.Second
+
+// The STUN magic cookie from RFC 5389
+const stunMagicCookie = 0x2112A442
+
+// dnsProvider sets the DNS records of the -ddns_domains
+type dnsProvider interface {
+	// Update replaces the A or AAAA records of the domain, depending on the
+	// type of the ip, with just the ip.
+	Update(ctx context.Context, domain string, ip netip.Addr, ttl time.Duration) error
+}
+
+// ipSource finds portal's public IP addresses
+type ipSource interface {
+	PublicIPs(ctx context.Context) ([]netip.Addr, error)
+	String() string
+}
+
+func recordType(ip netip.Addr) string {
+	if ip.Is4() {
+		return "A"
+	}
+	return "AAAA"
+}
+
+// ddnsUpdater keeps the DNS records for the domains pointing at portal's
+// public IP addresses.
+type ddnsUpdater struct {
+	sources  []ipSource
+	provider dnsProvider
+	domains  []string
+	ttl      time.Duration
+	// Only the leader of the -peers updates the records
+	isLeader func() bool
+
+	// The address the records were last set to, by record type. Cleared when
+	// the node becomes the leader, because another leader may have changed
+	// them since.
+	current   map[string]netip.Addr
+	wasLeader bool
+}
+
+func newDDNSUpdater(provider dnsProvider, sourceSpec string, domains []string,
+	ttl time.Duration, isLeader func() bool) (*ddnsUpdater, error) {
+
+	if len(domains) == 0 {
+		return nil, errors.New("There are no -ddns_domains or -autocert_domains to update.")
+	}
+	sources, err := parseIPSources(sourceSpec)
+	if err != nil {
+		return nil, err
+	}
+	return &ddnsUpdater{
+		sources:  sources,
+		provider: provider,
+		domains:  domains,
+		ttl:      ttl,
+		isLeader: isLeader,
+		current:  make(map[string]netip.Addr),
+	}, nil
+}
+
+// Run checks the public IP every interval until quit is closed
+func (u *ddnsUpdater) Run(interval time.Duration, quit chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		u.update()
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// update sets the records for the domains if the public IP changed. Failed
+// updates are retried on the next check.
+func (u *ddnsUpdater) update() {
+	if !u.isLeader() {
+		u.wasLeader = false
+		return
+	}
+	if !u.wasLeader {
+		u.current = make(map[string]netip.Addr)
+		u.wasLeader = true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ddnsTimeout)
+	defer cancel()
+
+	// The first IPv4 and IPv6 address from the sources
+	found := make(map[string]netip.Addr)
+	for _, source := range u.sources {
+		ips, err := source.PublicIPs(ctx)
+		if err != nil {
+			log.Printf("Failed to get the public IP from %v: %v", source, err)
+			continue
+		}
+		for _, ip := range ips {
+			ip = ip.Unmap()
+			if _, ok := found[recordType(ip)]; !ok {
+				found[recordType(ip)] = ip
+			}
+		}
+	}
+	for rrType, ip := range found {
+		if u.current[rrType] == ip {
+			continue
+		}
+		log.Printf("The public IP is now %v, updating the %v records for %v",
+			ip, rrType, strings.Join(u.domains, ", "))
+		failed := false
+		for _, domain := range u.domains {
+			if err := u.provider.Update(ctx, domain, ip, u.ttl); err != nil {
+				log.Printf("Failed to update the %v record for %v: %v", rrType, domain, err)
+				failed = true
+			}
+		}
+		if !failed {
+			u.current[rrType] = ip
+		}
+	}
+}
+
+// parseIPSources reads the -ddns_ip_source list
+func parseIPSources(spec string) ([]ipSource, error) {
+	var sources []ipSource
+	for _, source := range strings.Split(spec, ",") {
+		source = strings.TrimSpace(source)
+		switch {
+		case source == "":
+			continue
+		case strings.HasPrefix(source, "interface:"):
+			sources = append(sources, interfaceIPSource(strings.TrimPrefix(source, "interface:")))
+		case strings.HasPrefix(source, "stun:"):
+			addr := strings.TrimPrefix(source, "stun:")
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(addr, "3478")
+			}
+			sources = append(sources, stunIPSource(addr))
+		case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+			sources = append(sources, httpIPSource(source))
+		default:
+			return nil, fmt.Errorf("Invalid -ddns_ip_source %#v, use interface:name, stun:host:port, or an http(s) URL", source)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("-ddns_ip_source must have at least one source.")
+	}
+	return sources, nil
+}
+
+// interfaceIPSource is the name of a network interface with a public address
+type interfaceIPSource string
+
+func (s interfaceIPSource) String() string {
+	return "interface " + string(s)
+}
+
+// PublicIPs returns the global unicast addresses of the interface that aren't
+// private network addresses.
+func (s interfaceIPSource) PublicIPs(ctx context.Context) ([]netip.Addr, error) {
+	iface, err := net.InterfaceByName(string(s))
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ret []netip.Addr
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		ip = ip.Unmap()
+		if ip.IsGlobalUnicast() && !ip.IsPrivate() {
+			ret = append(ret, ip)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("The interface has no public addresses.")
+	}
+	return ret, nil
+}
+
+// httpIPSource is the URL of a server that responds with the client's IP in
+// plain text, like https://api.ipify.org
+type httpIPSource string
+
+func (s httpIPSource) String() string {
+	return string(s)
+}
+
+func (s httpIPSource) PublicIPs(ctx context.Context) ([]netip.Addr, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", string(s), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("The server returned status %v", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return nil, err
+	}
+	ip, err := netip.ParseAddr(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, fmt.Errorf("The response is not an IP address: %w", err)
+	}
+	return []netip.Addr{ip}, nil
+}
+
+// stunIPSource is the host:port of a STUN server, which tells clients the
+// address their UDP packets come from.
+type stunIPSource string
+
+func (s stunIPSource) String() string {
+	return "stun:" + string(s)
+}
+
+// PublicIPs sends a STUN binding request (RFC 5389) and returns the mapped
+// address from the response.
+func (s stunIPSource) PublicIPs(ctx context.Context) ([]netip.Addr, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", string(s))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:], 0x0001) // Binding request
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	if _, err := rand.Read(request[8:]); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 1500)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := parseSTUNResponse(response[:n], request[8:20])
+	if err != nil {
+		return nil, err
+	}
+	return []netip.Addr{ip}, nil
+}
+
+func parseSTUNResponse(msg, transactionID []byte) (netip.Addr, error) {
+	if len(msg) < 20 || binary.BigEndian.Uint16(msg[0:]) != 0x0101 ||
+		binary.BigEndian.Uint32(msg[4:]) != stunMagicCookie ||
+		string(msg[8:20]) != string(transactionID) {
+		return netip.Addr{}, errors.New("Invalid STUN binding response.")
+	}
+	attrs := msg[20:]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:])
+		length := int(binary.BigEndian.Uint16(attrs[2:]))
+		if len(attrs) < 4+length {
+			break
+		}
+		value := attrs[4 : 4+length]
+		switch attrType {
+		case 0x0020: // XOR-MAPPED-ADDRESS
+			if ip, ok := stunAddress(value, msg[4:20]); ok {
+				return ip, nil
+			}
+		case 0x0001: // MAPPED-ADDRESS
+			if ip, ok := stunAddress(value, nil); ok {
+				return ip, nil
+			}
+		}
+		// Attributes are padded to 4 bytes
+		attrs = attrs[min(len(attrs), 4+(length+3)/4*4):]
+	}
+	return netip.Addr{}, errors.New("The STUN response has no mapped address.")
+}
+
+// stunAddress parses a (XOR-)MAPPED-ADDRESS attribute value. The address is
+// XORed with the key (the magic cookie and transaction ID) if it isn't nil.
+func stunAddress(value, key []byte) (netip.Addr, bool) {
+	if len(value) < 4 {
+		return netip.Addr{}, false
+	}
+	var size int
+	switch value[1] {
+	case 0x01:
+		size = 4
+	case 0x02:
+		size = 16
+	default:
+		return netip.Addr{}, false
+	}
+	if len(value) < 4+size {
+		return netip.Addr{}, false
+	}
+	addr := make([]byte, size)
+	copy(addr, value[4:4+size])
+	if key != nil {
+		for i := range addr {
+			addr[i] ^= key[i]
+		}
+	}
+	return netip.AddrFromSlice(addr)
+}
+
+// execDNSProvider runs the -ddns_exec command with the arguments: domain,
+// record type (A or AAAA), and IP address.
+type execDNSProvider string
+
+func (command execDNSProvider) Update(ctx context.Context, domain string, ip netip.Addr, ttl time.Duration) error {
+	cmd := exec.CommandContext(ctx, string(command), domain, recordType(ip), ip.String())
+	cmd.Env = append(os.Environ(), fmt.Sprintf("DDNS_TTL=%v", int(ttl.Seconds())))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+package embedportal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The DNS UPDATE opcode from RFC 2136
+const dnsOpcodeUpdate = 5
+
+// The TSIG resource record type from RFC 8945
+const dnsTypeTSIG = 250
+
+// How far the DNS server's clock can be from portal's for the TSIG to be valid
+const tsigFudge = 300
+
+// The TSIG error codes from RFC 8945
+var tsigErrors = map[uint16]string{
+	16: "BADSIG",
+	17: "BADKEY",
+	18: "BADTIME",
+	22: "BADTRUNC",
+}
+
+// The TSIG algorithms supported in -ddns_tsig_key_file
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1.":   sha1.New,
+	"hmac-sha256.": sha256.New,
+	"hmac-sha512.": sha512.New,
+}
+
+// tsigKey signs the DNS UPDATE messages so the server can authenticate them
+type tsigKey struct {
+	Name      string // Fully qualified
+	Algorithm string // Fully qualified
+	Secret    []byte
+}
+
+// rfc2136Provider sends DNS UPDATE messages (RFC 2136) to the primary DNS
+// server of the zone, like nsupdate.
+type rfc2136Provider struct {
+	Server string   // host:port
+	Zone   string   // Fully qualified
+	Key    *tsigKey // nil for unsigned updates
+}
+
+func newRFC2136Provider(server, zone, keyFile string) (*rfc2136Provider, error) {
+	if server == "" {
+		return nil, errors.New("-ddns_server is required for the rfc2136 provider.")
+	}
+	if zone == "" {
+		return nil, errors.New("-ddns_zone is required for the rfc2136 provider.")
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	p := &rfc2136Provider{
+		Server: server,
+		Zone:   fullyQualified(zone),
+	}
+	if keyFile != "" {
+		var err error
+		p.Key, err = readTSIGKey(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read -ddns_tsig_key_file: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// readTSIGKey reads a key in the nsupdate -y format: [algorithm:]name:secret
+// where the secret is base64 encoded. The default algorithm is hmac-sha256.
+func readTSIGKey(filename string) (*tsigKey, error) {
+	text, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(strings.TrimSpace(string(text)), ":")
+	algorithm := "hmac-sha256"
+	switch len(parts) {
+	case 2:
+	case 3:
+		algorithm = parts[0]
+		parts = parts[1:]
+	default:
+		return nil, errors.New("The key must be in the format [algorithm:]name:secret")
+	}
+	key := &tsigKey{
+		Name:      fullyQualified(strings.ToLower(parts[0])),
+		Algorithm: fullyQualified(strings.ToLower(algorithm)),
+	}
+	if _, ok := tsigAlgorithms[key.Algorithm]; !ok {
+		return nil, fmt.Errorf("Unsupported algorithm %#v, use hmac-sha256, hmac-sha512, or hmac-sha1", algorithm)
+	}
+	key.Secret, err = base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid base64 secret: %w", err)
+	}
+	return key, nil
+}
+
+func (p *rfc2136Provider) Update(ctx context.Context, domain string, ip netip.Addr, ttl time.Duration) error {
+	domain = fullyQualified(domain)
+	if domain != p.Zone && !strings.HasSuffix(domain, "."+p.Zone) {
+		return fmt.Errorf("The domain is not in the -ddns_zone %v", p.Zone)
+	}
+	msg, id, requestMAC, err := p.updateMessage(domain, ip, ttl)
+	if err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", p.Server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	// The last response that had the ID but failed the checks, returned if we
+	// don't get a valid one
+	var invalidErr error
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if invalidErr != nil {
+				return invalidErr
+			}
+			return err
+		}
+		var parser dnsmessage.Parser
+		header, err := parser.Start(buf[:n])
+		if err != nil || header.ID != id || !header.Response {
+			continue // Not the response to this update
+		}
+		// The conn only gets packets from the server's address, but they could
+		// still be spoofed
+		if err := p.checkResponse(&parser, buf[:n], requestMAC); err != nil {
+			invalidErr = fmt.Errorf("Invalid response from the DNS server %v: %w", p.Server, err)
+			continue
+		}
+		if header.RCode != dnsmessage.RCodeSuccess {
+			return fmt.Errorf("The DNS server %v refused the update: %v", p.Server, header.RCode)
+		}
+		return nil
+	}
+}
+
+// checkResponse checks that the response is for the zone and, if there's a
+// key, that the server signed it. The parser must be after the header.
+func (p *rfc2136Provider) checkResponse(parser *dnsmessage.Parser, msg, requestMAC []byte) error {
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return err
+	}
+	if len(questions) != 1 || !strings.EqualFold(questions[0].Name.String(), p.Zone) ||
+		questions[0].Type != dnsmessage.TypeSOA {
+		return fmt.Errorf("The response is not for the zone %v: %v", p.Zone, questions)
+	}
+	if p.Key == nil {
+		return nil
+	}
+	return p.Key.verify(msg, requestMAC, time.Now())
+}
+
+// updateMessage returns the DNS UPDATE message that replaces the A or AAAA
+// records of the domain with the ip, the message ID, and the TSIG MAC if it's
+// signed.
+func (p *rfc2136Provider) updateMessage(domain string, ip netip.Addr, ttl time.Duration) ([]byte, uint16, []byte, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, 0, nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	zone, err := dnsmessage.NewName(p.Zone)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	name, err := dnsmessage.NewName(domain)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	rrType := dnsmessage.TypeA
+	if ip.Is6() {
+		rrType = dnsmessage.TypeAAAA
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, OpCode: dnsOpcodeUpdate})
+	// The zone section
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, nil, err
+	}
+	if err := b.Question(dnsmessage.Question{
+		Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, 0, nil, err
+	}
+	// The update section. The prerequisite section is empty.
+	if err := b.StartAuthorities(); err != nil {
+		return nil, 0, nil, err
+	}
+	// Delete the old records
+	if err := b.UnknownResource(dnsmessage.ResourceHeader{
+		Name: name, Class: dnsmessage.ClassANY,
+	}, dnsmessage.UnknownResource{Type: rrType}); err != nil {
+		return nil, 0, nil, err
+	}
+	// Add the new one
+	header := dnsmessage.ResourceHeader{
+		Name: name, Class: dnsmessage.ClassINET, TTL: uint32(ttl.Seconds()),
+	}
+	if ip.Is4() {
+		err = b.AResource(header, dnsmessage.AResource{A: ip.As4()})
+	} else {
+		err = b.AAAAResource(header, dnsmessage.AAAAResource{AAAA: ip.As16()})
+	}
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	var mac []byte
+	if p.Key != nil {
+		msg, mac = p.Key.sign(msg, id, nil, time.Now())
+	}
+	return msg, id, mac, nil
+}
+
+// sign appends the TSIG record (RFC 8945) to the message and returns it and
+// the MAC. requestMAC is the MAC of the request when signing a response, nil
+// otherwise.
+func (k *tsigKey) sign(msg []byte, id uint16, requestMAC []byte, now time.Time) ([]byte, []byte) {
+	keyName := appendDNSName(nil, k.Name)
+	algorithm := appendDNSName(nil, k.Algorithm)
+	var timeSigned [8]byte
+	binary.BigEndian.PutUint64(timeSigned[:], uint64(now.Unix()))
+	sum := k.mac(requestMAC, msg, timeSigned[2:], tsigFudge, 0, nil)
+
+	var rdata []byte
+	rdata = append(rdata, algorithm...)
+	rdata = append(rdata, timeSigned[2:]...)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = binary.BigEndian.AppendUint16(rdata, id)
+	rdata = append(rdata, 0, 0, 0, 0) // Error and other data length
+
+	signed := append([]byte{}, msg...)
+	signed = append(signed, keyName...)
+	signed = binary.BigEndian.AppendUint16(signed, dnsTypeTSIG)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(dnsmessage.ClassANY))
+	signed = binary.BigEndian.AppendUint32(signed, 0) // TTL
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(rdata)))
+	signed = append(signed, rdata...)
+	// Count the TSIG record in the additional section
+	arcount := binary.BigEndian.Uint16(signed[10:])
+	binary.BigEndian.PutUint16(signed[10:], arcount+1)
+	return signed, sum
+}
+
+// mac returns the TSIG MAC, which covers the request MAC for responses, the
+// message without the TSIG record, and the TSIG variables.
+func (k *tsigKey) mac(requestMAC, msg, timeSigned []byte, fudge, tsigErr uint16, otherData []byte) []byte {
+	mac := hmac.New(tsigAlgorithms[k.Algorithm], k.Secret)
+	if requestMAC != nil {
+		mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(requestMAC))))
+		mac.Write(requestMAC)
+	}
+	mac.Write(msg)
+	mac.Write(appendDNSName(nil, k.Name))
+	mac.Write([]byte{0, byte(dnsmessage.ClassANY)}) // Class
+	mac.Write([]byte{0, 0, 0, 0})                   // TTL
+	mac.Write(appendDNSName(nil, k.Algorithm))
+	mac.Write(timeSigned) // 48 bits
+	mac.Write(binary.BigEndian.AppendUint16(nil, fudge))
+	mac.Write(binary.BigEndian.AppendUint16(nil, tsigErr))
+	mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(otherData))))
+	mac.Write(otherData)
+	return mac.Sum(nil)
+}
+
+// verify checks the TSIG record at the end of the response to the request
+// that had the requestMAC.
+func (k *tsigKey) verify(msg, requestMAC []byte, now time.Time) error {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(msg); err != nil {
+		return err
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return err
+	}
+	if err := parser.SkipAllAnswers(); err != nil {
+		return err
+	}
+	if err := parser.SkipAllAuthorities(); err != nil {
+		return err
+	}
+	additionals, err := parser.AllAdditionals()
+	if err != nil {
+		return err
+	}
+	if len(additionals) == 0 || additionals[len(additionals)-1].Header.Type != dnsTypeTSIG {
+		return errors.New("The response is not signed")
+	}
+	tsig := additionals[len(additionals)-1]
+	if !strings.EqualFold(tsig.Header.Name.String(), k.Name) {
+		return fmt.Errorf("The response is signed with a different key: %v", tsig.Header.Name)
+	}
+	rdata := tsig.Body.(*dnsmessage.UnknownResource).Data
+	// The record is last and the name isn't compressed, find where it starts
+	keyName := appendDNSName(nil, k.Name)
+	start := len(msg) - len(rdata) - 10 - len(keyName)
+	if start < 12 || !bytes.EqualFold(msg[start:start+len(keyName)], keyName) {
+		return errors.New("Invalid TSIG record")
+	}
+
+	// Algorithm, time signed, fudge, MAC size, MAC, original ID, error, other
+	// data size, other data
+	algorithm := appendDNSName(nil, k.Algorithm)
+	if len(rdata) < len(algorithm)+10 || !bytes.EqualFold(rdata[:len(algorithm)], algorithm) {
+		return errors.New("The response is signed with a different algorithm")
+	}
+	rest := rdata[len(algorithm):]
+	timeSigned := rest[:6]
+	fudge := binary.BigEndian.Uint16(rest[6:])
+	macSize := int(binary.BigEndian.Uint16(rest[8:]))
+	rest = rest[10:]
+	if len(rest) < macSize+6 {
+		return errors.New("Invalid TSIG record")
+	}
+	mac := rest[:macSize]
+	originalID := rest[macSize : macSize+2]
+	tsigErr := binary.BigEndian.Uint16(rest[macSize+2:])
+	otherSize := int(binary.BigEndian.Uint16(rest[macSize+4:]))
+	otherData := rest[macSize+6:]
+	if len(otherData) != otherSize {
+		return errors.New("Invalid TSIG record")
+	}
+	if tsigErr != 0 {
+		name, ok := tsigErrors[tsigErr]
+		if !ok {
+			name = fmt.Sprint(tsigErr)
+		}
+		return fmt.Errorf("The DNS server didn't accept the TSIG: %v", name)
+	}
+
+	// The MAC is for the message before the TSIG was added
+	unsigned := append([]byte{}, msg[:start]...)
+	copy(unsigned, originalID)
+	arcount := binary.BigEndian.Uint16(unsigned[10:])
+	binary.BigEndian.PutUint16(unsigned[10:], arcount-1)
+	if !hmac.Equal(mac, k.mac(requestMAC, unsigned, timeSigned, fudge, tsigErr, otherData)) {
+		return errors.New("The TSIG MAC is invalid")
+	}
+	signedAt := int64(binary.BigEndian.Uint16(timeSigned))<<32 | int64(binary.BigEndian.Uint32(timeSigned[2:]))
+	if diff := now.Unix() - signedAt; diff > int64(fudge) || diff < -int64(fudge) {
+		return errors.New("The TSIG time is outside the fudge")
+	}
+	return nil
+}
+
+// appendDNSName appends the uncompressed wire format of the fully qualified
+// name
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func fullyQualified(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -0,0 +1,122 @@
+package embedportal
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRFC2136Provider_Response(t *testing.T) {
+	key := &tsigKey{Name: "portal-key.", Algorithm: "hmac-sha256.", Secret: []byte("secret")}
+	otherKey := &tsigKey{Name: "portal-key.", Algorithm: "hmac-sha256.", Secret: []byte("other")}
+	type reply struct {
+		zone  string
+		rcode dnsmessage.RCode
+		key   *tsigKey // nil for unsigned
+	}
+	replies := make(chan []reply, 1)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			request := buf[:n]
+			if err := key.verify(request, nil, time.Now()); err != nil {
+				t.Error("The update isn't signed right:", err)
+			}
+			header, requestMAC, err := parseTSIGRequest(request)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, r := range <-replies {
+				b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+					ID: header.ID, Response: true, OpCode: header.OpCode, RCode: r.rcode,
+				})
+				b.StartQuestions()
+				b.Question(dnsmessage.Question{
+					Name:  dnsmessage.MustNewName(r.zone),
+					Type:  dnsmessage.TypeSOA,
+					Class: dnsmessage.ClassINET,
+				})
+				resp, err := b.Finish()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if r.key != nil {
+					resp, _ = r.key.sign(resp, header.ID, requestMAC, time.Now())
+				}
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	p := &rfc2136Provider{Server: conn.LocalAddr().String(), Zone: "example.com.", Key: key}
+	update := func(r ...reply) error {
+		t.Helper()
+		replies <- r
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		return p.Update(ctx, "home.example.com", netip.MustParseAddr("203.0.113.7"), time.Minute)
+	}
+	good := reply{zone: "example.com.", key: key}
+
+	if err := update(good); err != nil {
+		t.Error("Wanted a signed response to work:", err)
+	}
+	// A spoofed response doesn't keep the real one from being used
+	if err := update(reply{zone: "example.com."}, good); err != nil {
+		t.Error("Wanted the signed response after an unsigned one to work:", err)
+	}
+	for _, tc := range []struct {
+		name    string
+		reply   reply
+		wantErr string
+	}{
+		{"unsigned", reply{zone: "example.com."}, "not signed"},
+		{"wrong key", reply{zone: "example.com.", key: otherKey}, "MAC is invalid"},
+		{"wrong zone", reply{zone: "example.org.", key: key}, "not for the zone"},
+		{"refused", reply{zone: "example.com.", rcode: dnsmessage.RCodeRefused, key: key}, "refused"},
+	} {
+		if err := update(tc.reply); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%v: wanted an error with %#v, got: %v", tc.name, tc.wantErr, err)
+		}
+	}
+}
+
+// parseTSIGRequest returns the header and TSIG MAC of the signed request
+func parseTSIGRequest(msg []byte) (dnsmessage.Header, []byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil {
+		return header, nil, err
+	}
+	parser.SkipAllQuestions()
+	parser.SkipAllAnswers()
+	parser.SkipAllAuthorities()
+	additionals, err := parser.AllAdditionals()
+	if err != nil || len(additionals) == 0 {
+		return header, nil, fmt.Errorf("Wanted a TSIG record, got %v: %v", additionals, err)
+	}
+	rdata := additionals[len(additionals)-1].Body.(*dnsmessage.UnknownResource).Data
+	// Skip the algorithm name, time signed, and fudge
+	rest := rdata[len(appendDNSName(nil, "hmac-sha256."))+8:]
+	size := int(binary.BigEndian.Uint16(rest))
+	return header, rest[2 : 2+size], nil
+}
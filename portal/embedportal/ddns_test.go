@@ -0,0 +1,54 @@
+package embedportal
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type fixedIPSource []netip.Addr
+
+func (s fixedIPSource) PublicIPs(ctx context.Context) ([]netip.Addr, error) {
+	return s, nil
+}
+
+func (s fixedIPSource) String() string {
+	return "fixed"
+}
+
+// countingProvider counts the updates for each domain
+type countingProvider map[string]int
+
+func (p countingProvider) Update(ctx context.Context, domain string, ip netip.Addr, ttl time.Duration) error {
+	p[domain]++
+	return nil
+}
+
+func TestDDNSUpdater_NewLeader(t *testing.T) {
+	leader := true
+	provider := countingProvider{}
+	u := &ddnsUpdater{
+		sources:  []ipSource{fixedIPSource{netip.MustParseAddr("203.0.113.7")}},
+		provider: provider,
+		domains:  []string{"example.com"},
+		ttl:      time.Minute,
+		isLeader: func() bool { return leader },
+		current:  make(map[string]netip.Addr),
+	}
+
+	u.update()
+	u.update()
+	if provider["example.com"] != 1 {
+		t.Fatalf("Wanted one update while the IP is the same, got %v", provider["example.com"])
+	}
+	// Another node is leader for a while and might set the records
+	leader = false
+	u.update()
+	leader = true
+	u.update()
+	if provider["example.com"] != 2 {
+		t.Errorf("Wanted the records set again after becoming the leader, got %v updates in total",
+			provider["example.com"])
+	}
+}
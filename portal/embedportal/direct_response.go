@@ -0,0 +1,89 @@
+package embedportal
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"ask.systems/daemon/internal/portalpb"
+	"ask.systems/daemon/portal/gate"
+)
+
+// isDirectResponse returns true if portal answers requests for this
+// registration itself, so there is no backend and no port to lease.
+func isDirectResponse(request *portalpb.RegisterRequest) bool {
+	return request.GetRedirect() != nil || request.GetStaticResponse() != nil
+}
+
+func makeDirectResponseHandler(pattern string, request *portalpb.RegisterRequest) (http.Handler, error) {
+	if request.Redirect != nil && request.StaticResponse != nil {
+		return nil, fmt.Errorf("Only one of redirect and static_response may be set.")
+	}
+	if request.Redirect != nil {
+		return makeRedirectHandler(pattern, request.Redirect)
+	}
+	return makeStaticHandler(request.StaticResponse)
+}
+
+func makeRedirectHandler(pattern string, r *portalpb.Redirect) (http.Handler, error) {
+	code := int(r.Status)
+	switch code {
+	case 0:
+		code = http.StatusFound
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, fmt.Errorf("Invalid redirect status %v, must be one of 301, 302, 307, or 308.", code)
+	}
+	if r.Url == "" {
+		return nil, fmt.Errorf("Redirect url must not be empty.")
+	}
+	target, err := url.Parse(r.Url)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid redirect url: %w", err)
+	}
+	_, patternPath := gate.ParsePattern(pattern)
+	prefix := strings.TrimSuffix(patternPath, "/")
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u := *target // make a copy
+		if r.PreservePath {
+			rest := strings.TrimPrefix(req.URL.Path, prefix)
+			u.Path = strings.TrimSuffix(u.Path, "/") + rest
+			u.RawPath = ""
+		}
+		if r.PreserveQuery && req.URL.RawQuery != "" {
+			if u.RawQuery == "" {
+				u.RawQuery = req.URL.RawQuery
+			} else {
+				u.RawQuery = u.RawQuery + "&" + req.URL.RawQuery
+			}
+		}
+		http.Redirect(w, req, u.String(), code)
+	}), nil
+}
+
+func makeStaticHandler(s *portalpb.StaticResponse) (http.Handler, error) {
+	code := int(s.Status)
+	if code == 0 {
+		code = http.StatusOK
+	}
+	// 1xx codes are not final responses, net/http would send another status
+	if code < 200 || code > 599 {
+		return nil, fmt.Errorf("Invalid static response status %v, must be 200-599.", code)
+	}
+	contentType := s.ContentType
+	if contentType == "" {
+		contentType = http.DetectContentType(s.Body)
+	}
+	length := strconv.Itoa(len(s.Body))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", length)
+		w.WriteHeader(code)
+		if req.Method != http.MethodHead {
+			w.Write(s.Body)
+		}
+	}), nil
+}
@@ -0,0 +1,187 @@
+package embedportal
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// drainer lets in-flight requests and connections finish when their lease is
+// unregistered or portal shuts down, instead of cutting them off. Each lease
+// has a drainGroup tracking its active work. Once a group is draining nothing
+// new is routed to it, and whatever is still active after the timeout is
+// closed.
+type drainer struct {
+	timeout time.Duration
+	// Counts the groups that are draining so portal can wait before exiting
+	draining sync.WaitGroup
+}
+
+// drainGroup tracks the active requests or connections for one lease
+type drainGroup struct {
+	// Canceled when the active work must be closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mut      sync.Mutex
+	active   int
+	draining bool
+	// Closed when draining and there is no active work left
+	idle chan struct{}
+	// Set when idle is closed. Work can still be added after draining starts,
+	// e.g. a request that was routed right before, so it can become idle again.
+	idleClosed bool
+}
+
+func newDrainGroup() *drainGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &drainGroup{
+		ctx:    ctx,
+		cancel: cancel,
+		idle:   make(chan struct{}),
+	}
+}
+
+// Add starts tracking one request or connection. Call Done when it finishes.
+func (g *drainGroup) Add() {
+	g.mut.Lock()
+	g.active++
+	g.mut.Unlock()
+}
+
+func (g *drainGroup) Done() {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.active--
+	g.closeIdle()
+}
+
+// closeIdle closes the idle channel the first time the group is draining with
+// no active work. Must hold mut.
+func (g *drainGroup) closeIdle() {
+	if g.draining && g.active == 0 && !g.idleClosed {
+		close(g.idle)
+		g.idleClosed = true
+	}
+}
+
+// Context is canceled when the active work must close
+func (g *drainGroup) Context() context.Context {
+	return g.ctx
+}
+
+// Drain closes the group's active work once it is done or after the drain
+// timeout, whichever is first. The name is used for the logs. Returns right
+// away and it is safe to call more than once.
+func (d *drainer) Drain(g *drainGroup, name string) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.draining {
+		return
+	}
+	g.draining = true
+	if g.active == 0 {
+		g.closeIdle()
+		g.cancel()
+		return
+	}
+	log.Printf("Draining %v active connections for %v for up to %v",
+		g.active, name, d.timeout)
+	d.draining.Add(1)
+	go func() {
+		defer d.draining.Done()
+		timer := time.NewTimer(d.timeout)
+		defer timer.Stop()
+		select {
+		case <-g.idle:
+			log.Printf("Finished draining connections for %v", name)
+		case <-timer.C:
+			g.mut.Lock()
+			log.Printf("Drain timeout for %v, closing %v active connections",
+				name, g.active)
+			g.mut.Unlock()
+		}
+		g.cancel()
+	}()
+}
+
+// Wait blocks until all the groups that are draining are done
+func (d *drainer) Wait() {
+	d.draining.Wait()
+}
+
+// drainHandler tracks the requests to Handler in the drainGroup and cancels
+// them if the group is closed before they finish. WebSocket connections are
+// sent a close frame first so the clients know to reconnect.
+type drainHandler struct {
+	Handler http.Handler
+	Group   *drainGroup
+}
+
+func (h drainHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.Group.Add()
+	defer h.Group.Done()
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	var ws *webSocketWriter
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		ws = &webSocketWriter{ResponseWriter: w}
+		w = ws
+	}
+	stop := context.AfterFunc(h.Group.Context(), func() {
+		if ws != nil {
+			ws.SendGoingAway()
+		}
+		// httputil.ReverseProxy closes upgraded connections when canceled
+		cancel()
+	})
+	defer stop()
+	h.Handler.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// webSocketWriter keeps the client connection when the request is upgraded
+// so that we can send a close frame when draining.
+type webSocketWriter struct {
+	http.ResponseWriter
+
+	mut  sync.Mutex
+	conn net.Conn
+}
+
+func (w *webSocketWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.mut.Lock()
+	w.conn = conn
+	w.mut.Unlock()
+	return conn, brw, nil
+}
+
+// Unwrap lets [http.ResponseController] find the underlying writer
+func (w *webSocketWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// SendGoingAway sends a WebSocket close frame with the 1001 (going away)
+// status to the client, if the connection was upgraded.
+//
+// This is best effort, if the backend is in the middle of sending a frame the
+// client gets a broken frame instead, which also closes the connection.
+func (w *webSocketWriter) SendGoingAway() {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	if w.conn == nil {
+		return
+	}
+	// FIN + close opcode, 2 byte unmasked payload with the status code
+	// See RFC 6455 section 5.5.1
+	w.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	w.conn.Write([]byte{0x88, 0x02, 0x03, 0xE9})
+}
@@ -0,0 +1,49 @@
+package embedportal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDrainGroup_AddAfterDrain(t *testing.T) {
+	d := &drainer{timeout: time.Minute}
+	g := newDrainGroup()
+	d.Drain(g, "idle")
+	select {
+	case <-g.Context().Done():
+	default:
+		t.Fatal("Draining an idle group should close it right away")
+	}
+
+	// Work routed right before the drain can still finish after it
+	g.Add()
+	g.Done()
+	g.Add()
+	g.Add()
+	g.Done()
+	g.Done()
+	d.Drain(g, "idle")
+	d.Wait()
+}
+
+func TestDrainGroup_DoneAfterDrain(t *testing.T) {
+	d := &drainer{timeout: time.Minute}
+	g := newDrainGroup()
+	g.Add()
+	d.Drain(g, "active")
+	select {
+	case <-g.Context().Done():
+		t.Fatal("Group closed with active work before the timeout")
+	default:
+	}
+
+	g.Done()
+	d.Wait()
+	select {
+	case <-g.Context().Done():
+	default:
+		t.Fatal("Group wasn't closed after the active work finished")
+	}
+	g.Add()
+	g.Done()
+}
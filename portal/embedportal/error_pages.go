@@ -0,0 +1,140 @@
+package embedportal
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// The status codes that can have custom error page templates
+var errorPageCodes = []int{
+	http.StatusNotFound,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// errorPages holds the parsed HTML templates for the error responses portal
+// serves itself, instead of the backend.
+//
+// The templates are read from a directory with the layout:
+//
+//	404.html             default page for all hostnames
+//	example.com/404.html page only for requests to example.com
+//
+// Any missing page falls back to the plain text go standard library response.
+// A nil *errorPages always uses the fallback.
+type errorPages struct {
+	// Key is "hostname/code" or just "code" for the default pages
+	pages map[string]*template.Template
+}
+
+// The data passed to the error page templates
+type errorPageData struct {
+	StatusCode int
+	StatusText string
+	Host       string
+	Path       string
+	// Seconds until the client should try again, 0 if unknown
+	RetryAfter uint32
+}
+
+func loadErrorPages(dir string) (*errorPages, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	e := &errorPages{
+		pages: make(map[string]*template.Template),
+	}
+	if err := e.loadDir(dir, ""); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if err := e.loadDir(filepath.Join(dir, entry.Name()), entry.Name()); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (e *errorPages) loadDir(dir, host string) error {
+	for _, code := range errorPageCodes {
+		name := filepath.Join(dir, strconv.Itoa(code)+".html")
+		if _, err := os.Stat(name); err != nil {
+			continue
+		}
+		tmpl, err := template.ParseFiles(name)
+		if err != nil {
+			return fmt.Errorf("failed to parse error page %v: %w", name, err)
+		}
+		e.pages[errorPageKey(host, code)] = tmpl
+		log.Printf("Loaded %v error page: %v", code, name)
+	}
+	return nil
+}
+
+func errorPageKey(host string, code int) string {
+	if host == "" {
+		return strconv.Itoa(code)
+	}
+	return host + "/" + strconv.Itoa(code)
+}
+
+// Serve writes the error response for the given status code using the most
+// specific template for the request hostname.
+//
+// If retryAfter is not zero the Retry-After header is set.
+func (e *errorPages) Serve(w http.ResponseWriter, req *http.Request, code int, retryAfter uint32) {
+	if retryAfter != 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+	}
+	tmpl := e.lookup(req.Host, code)
+	if tmpl == nil {
+		if code == http.StatusNotFound {
+			http.NotFound(w, req)
+		} else {
+			http.Error(w, http.StatusText(code), code)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	err := tmpl.Execute(w, errorPageData{
+		StatusCode: code,
+		StatusText: http.StatusText(code),
+		Host:       req.Host,
+		Path:       req.URL.Path,
+		RetryAfter: retryAfter,
+	})
+	if err != nil {
+		log.Printf("Error executing %v error page template: %v", code, err)
+	}
+}
+
+func (e *errorPages) lookup(host string, code int) *template.Template {
+	if e == nil {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host != "" {
+		if tmpl, ok := e.pages[errorPageKey(host, code)]; ok {
+			return tmpl
+		}
+	}
+	return e.pages[errorPageKey("", code)]
+}
@@ -0,0 +1,231 @@
+package embedportal
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// See https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-WEB.md
+const (
+	grpcContentType        = "application/grpc"
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+
+	// The flag on the frame in the response body that holds the trailers
+	grpcWebTrailerFlag = 0x80
+)
+
+// isGRPC returns true for gRPC and gRPC-web requests
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), grpcContentType)
+}
+
+// grpcWebHandler translates gRPC-web requests from browsers to gRPC requests
+// for the Handler, which must forward them to an HTTP/2 backend. Other
+// requests are passed through unchanged.
+//
+// Only same-origin requests are supported, portal doesn't answer CORS
+// preflight requests.
+type grpcWebHandler struct {
+	Handler http.Handler
+}
+
+func (h grpcWebHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	contentType := req.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, grpcWebContentType) {
+		h.Handler.ServeHTTP(w, req)
+		return
+	}
+	text := strings.HasPrefix(contentType, grpcWebTextContentType)
+	var suffix string // for example +proto
+	if text {
+		suffix = strings.TrimPrefix(contentType, grpcWebTextContentType)
+	} else {
+		suffix = strings.TrimPrefix(contentType, grpcWebContentType)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Content-Type", grpcContentType+suffix)
+	req.Header.Set("Te", "trailers")
+	req.Header.Del("X-Grpc-Web")
+	if text {
+		req.Body = io.NopCloser(&base64ChunkReader{r: req.Body})
+		req.Header.Del("Content-Length")
+		req.ContentLength = -1
+	}
+	ww := &grpcWebWriter{
+		w:      w,
+		header: make(http.Header),
+		text:   text,
+	}
+	h.Handler.ServeHTTP(ww, req)
+	ww.finish()
+}
+
+// grpcWebWriter translates a gRPC response to a gRPC-web response by sending
+// the trailers at the end of the body.
+type grpcWebWriter struct {
+	w http.ResponseWriter
+	// The header the handler writes to, which also gets the trailers
+	header http.Header
+	text   bool
+
+	wroteHeader bool
+	// The header names that were declared as trailers
+	trailers []string
+}
+
+func (g *grpcWebWriter) Header() http.Header {
+	return g.header
+}
+
+func (g *grpcWebWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	if code < 200 {
+		g.w.WriteHeader(code)
+		return
+	}
+	g.wroteHeader = true
+	dst := g.w.Header()
+	for name, values := range g.header {
+		if name == "Trailer" {
+			for _, value := range values {
+				for _, trailer := range strings.Split(value, ",") {
+					if trailer = strings.TrimSpace(trailer); trailer != "" {
+						g.trailers = append(g.trailers, http.CanonicalHeaderKey(trailer))
+					}
+				}
+			}
+			continue
+		}
+		dst[name] = values
+	}
+	// Remove the values so that only the values of the trailers are left
+	for name := range g.header {
+		delete(g.header, name)
+	}
+	if contentType := dst.Get("Content-Type"); strings.HasPrefix(contentType, grpcContentType) {
+		suffix := strings.TrimPrefix(contentType, grpcContentType)
+		if g.text {
+			dst.Set("Content-Type", grpcWebTextContentType+suffix)
+		} else {
+			dst.Set("Content-Type", grpcWebContentType+suffix)
+		}
+	}
+	dst.Del("Content-Length")
+	g.w.WriteHeader(code)
+}
+
+func (g *grpcWebWriter) Write(data []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if !g.text {
+		return g.w.Write(data)
+	}
+	// Each chunk is padded separately which is allowed by the spec
+	if _, err := g.w.Write([]byte(base64.StdEncoding.EncodeToString(data))); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (g *grpcWebWriter) Flush() {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if f, ok := g.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish writes the trailers frame at the end of the body
+func (g *grpcWebWriter) finish() {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	trailers := make(map[string]string)
+	for _, name := range g.trailers {
+		if values := g.header.Values(name); len(values) != 0 {
+			trailers[strings.ToLower(name)] = strings.Join(values, ",")
+		}
+	}
+	// httputil.ReverseProxy uses this when the trailers were not declared
+	for name, values := range g.header {
+		if trailer, ok := strings.CutPrefix(name, http.TrailerPrefix); ok {
+			trailers[strings.ToLower(trailer)] = strings.Join(values, ",")
+		}
+	}
+	if len(trailers) == 0 {
+		// A trailers-only response already sent grpc-status in the header
+		return
+	}
+	names := make([]string, 0, len(trailers))
+	for name := range trailers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var block strings.Builder
+	for _, name := range names {
+		block.WriteString(name)
+		block.WriteString(": ")
+		block.WriteString(trailers[name])
+		block.WriteString("\r\n")
+	}
+	frame := make([]byte, 5+block.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:5], uint32(block.Len()))
+	copy(frame[5:], block.String())
+	g.Write(frame)
+}
+
+// Unwrap lets [http.ResponseController] find the underlying writer
+func (g *grpcWebWriter) Unwrap() http.ResponseWriter {
+	return g.w
+}
+
+// base64ChunkReader decodes base64 text that may have padding in the middle,
+// which happens when the client encodes each message separately.
+type base64ChunkReader struct {
+	r io.Reader
+	// Encoded bytes that are not a full 4 byte group yet
+	pending []byte
+	// Decoded bytes that haven't been read yet
+	decoded []byte
+	err     error
+}
+
+func (b *base64ChunkReader) Read(p []byte) (int, error) {
+	for len(b.decoded) == 0 {
+		if b.err != nil {
+			if b.err == io.EOF && len(b.pending) != 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, b.err
+		}
+		buf := make([]byte, 4096)
+		n, err := b.r.Read(buf)
+		b.err = err
+		b.pending = append(b.pending, buf[:n]...)
+		groups := len(b.pending) / 4 * 4
+		for i := 0; i < groups; i += 4 {
+			var out [3]byte
+			n, err := base64.StdEncoding.Decode(out[:], b.pending[i:i+4])
+			if err != nil {
+				b.err = err
+				break
+			}
+			b.decoded = append(b.decoded, out[:n]...)
+		}
+		b.pending = b.pending[groups:]
+	}
+	n := copy(p, b.decoded)
+	b.decoded = b.decoded[n:]
+	return n, nil
+}
@@ -3,6 +3,7 @@ package embedportal
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -17,6 +18,8 @@ import (
 	"ask.systems/daemon/internal/portalpb"
 	"ask.systems/daemon/portal/gate"
 	"ask.systems/daemon/tools"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
 )
 
 // The path for the let's encrypt web-root cert challenge
@@ -37,14 +40,34 @@ type httpProxy struct {
 	clientLeasor *clientLeasor
 	// Map from pattern to *forwarder, which must not be modified
 	forwarders  sync.Map
-	allowsHTTP  atomic.Bool
 	rootCert    *tls.Config
 	state       *stateManager
 	defaultHost string
 	challenges  *acmeChallenges
+	errorPages  *errorPages
+	// If true, compress responses of at least compressMinSize bytes
+	compress        bool
+	compressMinSize int
+	// nil if caching is turned off
+	cache *responseCache
+	// Lets requests finish when forwarders are unregistered
+	drainer *drainer
+	// The recent backend errors, for the admin page
+	proxyErrors *proxyErrors
+	// The -tls_policy_file policies for the HTTPS connections and HSTS
+	tlsPolicies *tlsPolicies
+	// Map from pattern to *portalpb.MaintenanceRequest for the patterns that
+	// should get the 503 page instead of being forwarded
+	maintenance sync.Map
+	// Number of forwarders with AllowHTTP by the pattern hostname, for the HSTS
+	// header. Empty for patterns without a hostname.
+	allowHTTPMut   sync.Mutex
+	allowHTTPHosts map[string]int
 
 	httpList  net.Listener
 	httpsList net.Listener
+	// Set when the HTTP/3 server is running, used for the Alt-Svc header
+	http3Server atomic.Pointer[http3.Server]
 }
 
 // forwarder holds the data for a forwarding rule registered with httpProxy
@@ -52,10 +75,22 @@ type forwarder struct {
 	Handler   http.Handler
 	Lease     *portalpb.Lease
 	AllowHTTP bool
+	// Tracks the requests in progress, nil for portal's own handlers
+	Drain *drainGroup
+	// The backend the requests are forwarded to, nil for direct responses and
+	// portal's own handlers
+	Backend *url.URL
 }
 
 func (p *httpProxy) Unregister(lease *portalpb.Lease) {
-	p.forwarders.Delete(lease.Pattern)
+	val, _ := p.forwarders.LoadAndDelete(lease.GetPattern())
+	p.countAllowHTTP(val, -1)
+	if fwd, ok := val.(*forwarder); ok && fwd.Drain != nil {
+		// Let the requests in progress finish
+		p.drainer.Drain(fwd.Drain, lease.Pattern)
+	}
+	// The next backend for the pattern might serve different content
+	p.cache.Purge(lease.Pattern, "")
 }
 
 // Register leases a new forwarder for the given pattern.
@@ -72,6 +107,9 @@ func (p *httpProxy) Register(
 		if oldFwd.Lease.Pattern == certChallengePattern {
 			return nil, fmt.Errorf("Clients cannot register the cert challenge path %#v which covers your requested pattern %#v", certChallengePattern, request.Pattern)
 		}
+		if oldFwd.Drain == nil && oldFwd.Lease.Pattern == request.Pattern {
+			return nil, fmt.Errorf("The pattern %#v is used by portal itself.", request.Pattern)
+		}
 		if oldFwd.Lease.Pattern == request.Pattern {
 			log.Printf("Replacing existing lease with the same pattern: %#v", request.Pattern)
 			leasor.Unregister(oldFwd.Lease) // this calls also httpProxy.Unregister via callback
@@ -82,16 +120,94 @@ func (p *httpProxy) Register(
 		return nil, err
 	}
 
+	if isDirectResponse(request) {
+		handler, err := makeDirectResponseHandler(lease.Pattern, request)
+		if err != nil {
+			leasor.Unregister(lease)
+			return nil, err
+		}
+		p.storeForwarder(lease, request, handler, nil)
+		log.Printf("Registered direct response, Pattern: %#v, Timeout: %v",
+			lease.Pattern, lease.Timeout.AsTime().In(time.Local))
+		return lease, nil
+	}
+
 	err = p.saveForwarder(clientAddr, lease, request)
 	if err != nil {
 		leasor.Unregister(lease)
 		return nil, err
 	}
-	log.Printf("Registered forwarder to %v:%v, Pattern: %#v, Timeout: %v",
-		clientAddr, lease.Port, lease.Pattern, lease.Timeout.AsTime().In(time.Local))
+	backend := backendAddress(clientAddr, lease.Port)
+	if request.UnixSocket != "" {
+		backend = unixBackend(request.UnixSocket)
+	}
+	log.Printf("Registered forwarder to %v, Pattern: %#v, Timeout: %v",
+		backend, lease.Pattern, lease.Timeout.AsTime().In(time.Local))
 	return lease, nil
 }
 
+func (p *httpProxy) storeForwarder(lease *portalpb.Lease,
+	request *portalpb.RegisterRequest, handler http.Handler, backend *url.URL) {
+
+	if p.cache != nil && request.Cache && !isDirectResponse(request) {
+		handler = cacheHandler{
+			Cache:   p.cache,
+			Handler: handler,
+			Pattern: lease.Pattern,
+			TTL:     time.Duration(request.CacheTtlSeconds) * time.Second,
+		}
+	}
+
+	if p.compress && !request.NoCompression {
+		handler = compressHandler{
+			Handler: handler,
+			MinSize: p.compressMinSize,
+		}
+	}
+
+	group := newDrainGroup()
+	fwd := &forwarder{
+		Handler:   drainHandler{Handler: handler, Group: group},
+		Lease:     lease,
+		AllowHTTP: request.AllowHttp,
+		Drain:     group,
+		Backend:   backend,
+	}
+	p.countAllowHTTP(fwd, 1)
+	old, _ := p.forwarders.Swap(lease.Pattern, fwd)
+	p.countAllowHTTP(old, -1)
+}
+
+// countAllowHTTP adds delta to the allowHTTPHosts count for the forwarder's
+// hostname if it sets AllowHTTP. val may be nil.
+func (p *httpProxy) countAllowHTTP(val any, delta int) {
+	fwd, ok := val.(*forwarder)
+	if !ok || !fwd.AllowHTTP || fwd.Lease.Pattern == certChallengePattern {
+		return
+	}
+	host, _ := gate.ParsePattern(fwd.Lease.Pattern)
+	p.allowHTTPMut.Lock()
+	defer p.allowHTTPMut.Unlock()
+	if p.allowHTTPHosts == nil {
+		p.allowHTTPHosts = make(map[string]int)
+	}
+	p.allowHTTPHosts[host] += delta
+	if p.allowHTTPHosts[host] <= 0 {
+		delete(p.allowHTTPHosts, host)
+	}
+}
+
+// DrainAll lets the requests in progress for all the forwarders finish, up
+// to the drain timeout, then closes them. Used when portal shuts down.
+func (p *httpProxy) DrainAll() {
+	p.forwarders.Range(func(key, value any) bool {
+		if fwd := value.(*forwarder); fwd.Drain != nil {
+			p.drainer.Drain(fwd.Drain, fwd.Lease.Pattern)
+		}
+		return true
+	})
+}
+
 // Creates and saves a new forwarder that handles request and forwards them to
 // the given client.
 //
@@ -107,7 +223,38 @@ func (p *httpProxy) saveForwarder(clientAddr string, lease *portalpb.Lease,
 	} else {
 		host = clientAddr
 	}
-	hostPort := fmt.Sprintf("%v:%v", host, lease.Port)
+	hostPort := backendAddress(host, lease.Port)
+	// The backend in the logs and errors
+	backendName := hostPort
+	if request.UnixSocket != "" {
+		// The URL host is only used for the TLS server name, it always dials the
+		// socket
+		hostPort = strings.TrimSuffix(backendAddress(host, 0), ":0")
+		backendName = unixBackend(request.UnixSocket)
+	}
+	proxyVersion := int(request.ProxyProtocol)
+	if proxyVersion != 0 && request.Http2 {
+		return fmt.Errorf("The PROXY protocol is not supported for http2 backends.")
+	}
+	// Dials the unix_socket instead of the addr if it's set and sends the PROXY
+	// protocol header for the client in the ctx if it's on
+	dialTCP := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if request.UnixSocket != "" {
+			network, addr = "unix", request.UnixSocket
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil || proxyVersion == 0 {
+			return conn, err
+		}
+		src, _ := ctx.Value(proxyClientAddrKey{}).(net.Addr)
+		dst, _ := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+		if err := tools.WriteProxyHeader(conn, proxyVersion, src, dst); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
 
 	// TODO: when assimilate supports writing cert files, maybe make it so
 	// normally we only accept the portal root CA (and maybe add the system root
@@ -137,18 +284,19 @@ func (p *httpProxy) saveForwarder(clientAddr string, lease *portalpb.Lease,
 		}
 	}
 
-	// Detect TLS support for FixedPort backends, if we don't have a FixedPort set
-	// then the server cannot be already running and won't run until we return
-	// this RPC.
+	// Detect TLS support for FixedPort and unix socket backends, if we don't
+	// have a FixedPort set then the server cannot be already running and won't
+	// run until we return this RPC.
 	protocol := "http://"
-	if len(request.CertificateRequest) == 0 && request.FixedPort != 0 {
-		d := tls.Dialer{
-			NetDialer: &net.Dialer{Timeout: 6 * time.Second},
-			Config:    conf,
-		}
-		conn, err := d.Dial("tcp", hostPort)
+	if len(request.CertificateRequest) == 0 && (request.FixedPort != 0 || request.UnixSocket != "") {
+		ctx, cancel := context.WithTimeout(context.Background(), 6*time.Second)
+		conn, err := dialTCP(ctx, "tcp", hostPort)
 		if err == nil {
+			err = tls.Client(conn, conf).HandshakeContext(ctx)
 			conn.Close()
+		}
+		cancel()
+		if err == nil {
 			protocol = "https://"
 		} else {
 			log.Printf("Warning: TLS is not supported for the %v backend. This internal traffic will not be encrypted. Message: %v",
@@ -177,19 +325,67 @@ func (p *httpProxy) saveForwarder(clientAddr string, lease *portalpb.Lease,
 	pattern := lease.Pattern
 
 	// Accept certificates signed by the latest portal cert
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialTLS := func(ctx context.Context, network, addr string, nextProtos []string) (net.Conn, error) {
 		usedConf := conf
-		if conf.RootCAs != nil {
+		if conf.RootCAs != nil || len(nextProtos) != 0 {
 			usedConf = conf.Clone()
+			usedConf.NextProtos = nextProtos
+		}
+		if conf.RootCAs != nil {
 			usedConf.RootCAs = p.state.RootCAs()
 		}
-		dialer := &tls.Dialer{Config: usedConf}
-		return dialer.DialContext(ctx, network, addr)
+		if proxyVersion == 0 && request.UnixSocket == "" {
+			dialer := &tls.Dialer{Config: usedConf}
+			return dialer.DialContext(ctx, network, addr)
+		}
+		conn, err := dialTCP(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if usedConf.ServerName == "" { // tls.Dialer does this for us
+			usedConf = usedConf.Clone()
+			usedConf.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(conn, usedConf)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	var transport http.RoundTripper
+	var flushInterval time.Duration
+	if request.Http2 {
+		transport = &http2.Transport{
+			// Use h2c (HTTP/2 without TLS) for http:// backends
+			AllowHTTP: protocol == "http://",
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				if protocol == "http://" {
+					return dialTCP(ctx, network, addr)
+				}
+				return dialTLS(ctx, network, addr, []string{http2.NextProtoTLS})
+			},
+		}
+		// Send streaming responses, like gRPC server streams, right away
+		flushInterval = -1
+	} else {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialTLS(ctx, network, addr, nil)
+		}
+		if proxyVersion != 0 || request.UnixSocket != "" {
+			t.DialContext = dialTCP
+		}
+		if proxyVersion != 0 {
+			// The header is for one client so connections can't be shared
+			t.DisableKeepAlives = true
+		}
+		transport = t
 	}
 
 	proxy := &httputil.ReverseProxy{
-		Transport: transport,
+		Transport:     transport,
+		FlushInterval: flushInterval,
 		Director: func(req *http.Request) {
 			// Copied from https://golang.org/src/net/http/httputil/reverseproxy.go?s=2588:2649#L80
 			req.URL.Scheme = backend.Scheme
@@ -256,21 +452,48 @@ func (p *httpProxy) saveForwarder(clientAddr string, lease *portalpb.Lease,
 			// TODO: also do X-Forwarded-Port if portal is running on a non-standard
 			// port
 		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Printf("Proxy error for %v%v (backend: %v): %v",
+				req.Host, req.URL.EscapedPath(), backendName, err)
+			p.proxyErrors.Add(pattern, fmt.Sprintf("%v%v (backend: %v): %v",
+				req.Host, req.URL.EscapedPath(), backendName, err))
+			code := http.StatusBadGateway
+			var netErr net.Error
+			if errors.Is(err, context.DeadlineExceeded) ||
+				(errors.As(err, &netErr) && netErr.Timeout()) {
+				code = http.StatusGatewayTimeout
+			}
+			p.errorPages.Serve(w, req, code, 0)
+		},
 	}
 
-	if request.AllowHttp {
-		p.allowsHTTP.Store(true)
+	var handler http.Handler = proxy
+	if request.Http2 {
+		handler = grpcWebHandler{Handler: proxy}
 	}
-
-	fwd := &forwarder{
-		Handler:   proxy,
-		Lease:     lease,
-		AllowHTTP: request.AllowHttp,
+	if proxyVersion != 0 {
+		handler = proxyClientAddrHandler{Handler: handler}
 	}
-	p.forwarders.Store(pattern, fwd)
+	p.storeForwarder(lease, request, handler, backend)
 	return nil
 }
 
+// The context key for the client address to send in the PROXY protocol header
+type proxyClientAddrKey struct{}
+
+// proxyClientAddrHandler adds the client address to the request context for
+// the backend dial function to send in the PROXY protocol header
+type proxyClientAddrHandler struct {
+	Handler http.Handler
+}
+
+func (h proxyClientAddrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		req = req.WithContext(context.WithValue(req.Context(), proxyClientAddrKey{}, addr))
+	}
+	h.Handler.ServeHTTP(w, req)
+}
+
 // urlMatchesPattern returns whether or not the url matches the pattern string.
 func urlMatchesPattern(url, pattern string) bool {
 	if len(pattern) == 0 || len(url) == 0 {
@@ -361,26 +584,31 @@ func (p *httpProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if fwd == nil {
 		log.Printf("%v requested unregistered path: %v%v (useragent: %q) ",
 			req.RemoteAddr, req.Host, req.URL.EscapedPath(), req.UserAgent())
-		http.NotFound(w, req)
+		p.errorPages.Serve(w, req, http.StatusNotFound, 0)
 		return
 	}
 
-	// TODO: HSTS UX needs more improvement
-	//   - Need to track allowsHTTP per-host
-	//   - Have a flag that enables 1 (or maybe 2) year HSTS for single subdomains
-	//   - Have a flag that enables includeSubdomains, preload, immutable
-	//   - Print some instructions on how to set this up in the logs
-	//   - Should I just have a flag to set the raw string because there's lots of
-	//     options?
-	if !p.allowsHTTP.Load() {
-		w.Header().Add("Strict-Transport-Security", "max-age=300")
+	policy := p.tlsPolicies.Lookup(req.Host)
+	if req.TLS != nil {
+		if hsts := policy.HSTSHeader(p.hostAllowsHTTP(req.Host)); hsts != "" {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+	}
+	// Tell browsers they can switch to HTTP/3
+	if h3 := p.http3Server.Load(); h3 != nil && req.TLS != nil && req.ProtoMajor < 3 {
+		h3.SetQuicHeaders(w.Header())
 	}
 
-	if !fwd.AllowHTTP {
-		if req.TLS == nil {
-			tools.RedirectToHTTPS{}.ServeHTTP(w, req)
-			return
-		}
+	if req.TLS == nil && (!fwd.AllowHTTP ||
+		(policy.HTTPSOnly && fwd.Lease.Pattern != certChallengePattern)) {
+		tools.RedirectToHTTPS{}.ServeHTTP(w, req)
+		return
+	}
+
+	if val, ok := p.maintenance.Load(fwd.Lease.Pattern); ok {
+		m := val.(*portalpb.MaintenanceRequest)
+		p.errorPages.Serve(w, req, http.StatusServiceUnavailable, m.RetryAfterSeconds)
+		return
 	}
 
 	// If the pattern ends in /, redirect so the url ends in / so relative paths
@@ -396,6 +624,37 @@ func (p *httpProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	fwd.Handler.ServeHTTP(w, req)
 }
 
+// hostAllowsHTTP returns true if a registration that sets allow_http serves
+// the hostname, which may have a port. Browsers wouldn't be able to use it if
+// portal sent HSTS for the hostname.
+func (p *httpProxy) hostAllowsHTTP(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	p.allowHTTPMut.Lock()
+	defer p.allowHTTPMut.Unlock()
+	if (host != "" && p.allowHTTPHosts[host] > 0) || p.allowHTTPHosts["*"] > 0 {
+		return true
+	}
+	return p.allowHTTPHosts[""] > 0 && (p.defaultHost == "" || p.defaultHost == host)
+}
+
+// SetMaintenance turns maintenance mode on or off for the exact pattern given.
+// It does not check if the pattern is registered.
+func (p *httpProxy) SetMaintenance(m *portalpb.MaintenanceRequest) {
+	if m.Enabled {
+		p.maintenance.Store(m.Pattern, m)
+	} else {
+		p.maintenance.Delete(m.Pattern)
+	}
+}
+
+// IsRegistered returns true if there is a forwarder for exactly this pattern
+func (p *httpProxy) IsRegistered(pattern string) bool {
+	_, ok := p.forwarders.Load(pattern)
+	return ok
+}
+
 // runServer calls serv.Serv(list) and prints and error and closes the quit
 // channel if the server dies
 func runServer(quit chan struct{}, name string,
@@ -441,15 +700,24 @@ func makeChallengeHandler(webRoot string, challenges *acmeChallenges) (http.Hand
 
 func makeHTTPProxy(l *clientLeasor, rootCert *tls.Config,
 	httpList, httpsList net.Listener, defaultHost string, challenges *acmeChallenges, certChallengeWebRoot string,
-	state *stateManager) (*httpProxy, error) {
+	errorPages *errorPages, compress bool, compressMinSize int,
+	cache *responseCache, drainer *drainer, proxyErrors *proxyErrors,
+	tlsPolicies *tlsPolicies, state *stateManager) (*httpProxy, error) {
 	ret := &httpProxy{
-		clientLeasor: l,
-		rootCert:     rootCert,
-		state:        state,
-		defaultHost:  defaultHost,
-		httpList:     httpList,
-		httpsList:    httpsList,
-		challenges:   challenges,
+		clientLeasor:    l,
+		rootCert:        rootCert,
+		state:           state,
+		defaultHost:     defaultHost,
+		httpList:        httpList,
+		httpsList:       httpsList,
+		challenges:      challenges,
+		errorPages:      errorPages,
+		compress:        compress,
+		compressMinSize: compressMinSize,
+		cache:           cache,
+		drainer:         drainer,
+		proxyErrors:     proxyErrors,
+		tlsPolicies:     tlsPolicies,
 	}
 	l.OnCancel(ret.Unregister)
 
@@ -480,16 +748,22 @@ func (p *httpProxy) StartHTTP(quit chan struct{}) {
 	go runServer(quit, "HTTP", httpServer, p.httpList)
 	go func() {
 		<-quit
-		httpServer.Close()
-		log.Print("Got quit signal, killed HTTP server")
+		p.shutdown(httpServer)
+		log.Print("Got quit signal, stopped HTTP server")
 	}()
 }
 
-func (p *httpProxy) StartHTTPS(serveCert *tls.Config, quit chan struct{}) {
+// StartHTTPS serves HTTPS on the httpsList. Connections for the TLS passthrough
+// hostnames registered with the sniProxy are forwarded without decrypting
+// them.
+func (p *httpProxy) StartHTTPS(serveCert *tls.Config, sni *sniProxy, quit chan struct{}) {
 	// Support HTTP/2. See https://pkg.go.dev/net/http#Serve
 	// > HTTP/2 support is only enabled if ... configured with "h2" in the TLS Config.NextProtos.
-	serveCert.NextProtos = append(serveCert.NextProtos, "h2")
-	p.httpsList = tls.NewListener(p.httpsList, serveCert)
+	httpsConfig := serveCert.Clone()
+	httpsConfig.NextProtos = append(append([]string{}, serveCert.NextProtos...), "h2")
+	// Apply the -tls_policy_file for the SNI hostname
+	httpsConfig.GetConfigForClient = p.tlsPolicies.ConfigForClient(httpsConfig.Clone())
+	p.httpsList = tls.NewListener(sni.Listener(p.httpsList), httpsConfig)
 	// Start the TLS server
 	tlsServer := &http.Server{
 		Handler: p,
@@ -497,7 +771,52 @@ func (p *httpProxy) StartHTTPS(serveCert *tls.Config, quit chan struct{}) {
 	go runServer(quit, "HTTPS", tlsServer, p.httpsList)
 	go func() {
 		<-quit
-		tlsServer.Close()
-		log.Print("Got quit signal, killed HTTPS server")
+		p.shutdown(tlsServer)
+		log.Print("Got quit signal, stopped HTTPS server")
+	}()
+}
+
+// shutdown stops accepting connections and waits up to the drain timeout for
+// the requests in progress to finish before closing the server.
+func (p *httpProxy) shutdown(server *http.Server) {
+	p.DrainAll()
+	ctx, cancel := context.WithTimeout(context.Background(), p.drainer.timeout)
+	defer cancel()
+	server.Shutdown(ctx)
+	server.Close()
+}
+
+// StartHTTP3 serves HTTP/3 (QUIC) on the UDP conns with the same handler as
+// the HTTPS server. Once it is running HTTPS responses advertise it in the
+// Alt-Svc header.
+func (p *httpProxy) StartHTTP3(serveCert *tls.Config, conns []net.PacketConn, quit chan struct{}) {
+	// Apply the -tls_policy_file like HTTPS does. http3 sets the ALPN after.
+	h3Config := serveCert.Clone()
+	h3Config.GetConfigForClient = p.tlsPolicies.ConfigForClient(serveCert.Clone())
+	h3Server := &http3.Server{
+		Handler:   p,
+		TLSConfig: h3Config,
+	}
+	if addr, ok := conns[0].LocalAddr().(*net.UDPAddr); ok {
+		h3Server.Port = addr.Port
+	}
+	for _, conn := range conns {
+		go func(conn net.PacketConn) {
+			err := h3Server.Serve(conn)
+			select {
+			case <-quit:
+				return // Expected error from Close
+			default:
+			}
+			log.Printf("Proxy HTTP/3 server error on %v: %v", conn.LocalAddr(), err)
+			// Stop advertising it, but keep running HTTP/1 and HTTP/2
+			p.http3Server.Store(nil)
+		}(conn)
+	}
+	p.http3Server.Store(h3Server)
+	go func() {
+		<-quit
+		h3Server.Close()
+		log.Print("Got quit signal, killed HTTP/3 server")
 	}()
 }
@@ -0,0 +1,57 @@
+package embedportal
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"ask.systems/daemon/internal/portalpb"
+)
+
+func TestHTTPProxy_HostAllowsHTTP(t *testing.T) {
+	p := &httpProxy{
+		defaultHost: "default.example.com",
+		drainer:     &drainer{timeout: time.Minute},
+	}
+	register := func(pattern string, allowHTTP bool) *portalpb.Lease {
+		lease := &portalpb.Lease{Pattern: pattern}
+		p.storeForwarder(lease, &portalpb.RegisterRequest{
+			Pattern:   pattern,
+			AllowHttp: allowHTTP,
+		}, http.NotFoundHandler(), nil)
+		return lease
+	}
+	expect := func(host string, want bool) {
+		t.Helper()
+		if got := p.hostAllowsHTTP(host); got != want {
+			t.Errorf("hostAllowsHTTP(%#v) = %v, want %v", host, got, want)
+		}
+	}
+
+	open := register("open.example.com/", true)
+	register("closed.example.com/", false)
+	expect("open.example.com", true)
+	expect("open.example.com:8080", true)
+	expect("closed.example.com", false)
+	expect("default.example.com", false)
+
+	// Patterns without a hostname are served on the -default_hostname
+	noHost := register("/path/", true)
+	expect("default.example.com", true)
+	expect("closed.example.com", false)
+	expect("", false)
+
+	// Replacing the forwarder for a pattern removes the old one from the count
+	register("/path/", false)
+	expect("default.example.com", false)
+	p.Unregister(noHost)
+	expect("default.example.com", false)
+
+	// It stays on until every forwarder for the hostname is gone
+	other := register("open.example.com/other/", true)
+	p.Unregister(open)
+	expect("open.example.com", true)
+	p.Unregister(other)
+	expect("open.example.com", false)
+	p.drainer.Wait()
+}
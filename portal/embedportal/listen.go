@@ -0,0 +1,271 @@
+package embedportal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"ask.systems/daemon/internal/portalpb"
+)
+
+// bindAddrs is a comma separated list of the addresses to listen on. Empty
+// means all interfaces.
+type bindAddrs []string
+
+func (l *bindAddrs) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *bindAddrs) Set(in string) error {
+	*l = nil
+	for _, field := range strings.Split(in, ",") {
+		addr := strings.TrimSpace(field)
+		if addr == "" {
+			continue
+		}
+		// Accept IPv6 literals with or without the brackets
+		addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		if net.ParseIP(addr) == nil && strings.Contains(addr, ":") {
+			return fmt.Errorf("Invalid address %#v, it should be an IP or hostname without a port.", field)
+		}
+		*l = append(*l, addr)
+	}
+	return nil
+}
+
+// backendAddress joins the host and port for dialing, adding brackets for IPv6
+// literals. The host may already have brackets.
+func backendAddress(host string, port uint32) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+}
+
+// The prefix of the backend addresses that are unix socket paths
+const unixBackendPrefix = "unix:"
+
+// unixBackend returns the backend address for the unix socket at the path
+func unixBackend(path string) string {
+	return unixBackendPrefix + path
+}
+
+// backendNetwork returns the network and address to dial for the backend
+// address, which is either host:port or a unixBackend.
+func backendNetwork(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, unixBackendPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// checkUnixSocket returns an error if the request can't use its unix_socket
+// backend.
+func checkUnixSocket(request *portalpb.RegisterRequest) error {
+	if request.UnixSocket == "" {
+		return nil
+	}
+	if strings.HasPrefix(request.Pattern, udpProxyPrefix) ||
+		strings.HasPrefix(request.Pattern, sniProxyPrefix) {
+		return errors.New("unix_socket is only supported for HTTP and :tcp patterns.")
+	}
+	if isDirectResponse(request) {
+		return errors.New("unix_socket can't be used with redirects and static responses.")
+	}
+	if request.Hostname != "" {
+		return errors.New("Only one of hostname and unix_socket may be set.")
+	}
+	if !filepath.IsAbs(request.UnixSocket) {
+		return fmt.Errorf("unix_socket must be an absolute path, got %#v", request.UnixSocket)
+	}
+	return nil
+}
+
+// socketName is the name the upgrader tracks the socket on the address with
+func socketName(name, addr string) string {
+	if addr == "" {
+		return name
+	}
+	return name + "@" + addr
+}
+
+// listenTCP listens on the port at each of the addrs, or all interfaces if
+// there are none, using the listeners from the old portal when upgrading.
+// Negative ports are file descriptors passed in from spawn. The listeners are
+// tracked by the upgrader with the name.
+func listenTCP(upgrader *upgrader, name string, addrs bindAddrs, portOrFD int) (net.Listener, error) {
+	if portOrFD < 0 || len(addrs) == 0 {
+		l := upgrader.Listener(name)
+		if l == nil {
+			var err error
+			l, err = listenerFromPortOrFD(portOrFD)
+			if err != nil {
+				return nil, err
+			}
+		}
+		upgrader.Track(name, l)
+		return l, nil
+	}
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		l := upgrader.Listener(socketName(name, addr))
+		if l == nil {
+			var err error
+			l, err = net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(portOrFD)))
+			if err != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+				return nil, err
+			}
+		}
+		listeners = append(listeners, l)
+	}
+	for i, l := range listeners {
+		upgrader.Track(socketName(name, addrs[i]), l)
+	}
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+	return newMultiListener(listeners), nil
+}
+
+// listenUDP is listenTCP for UDP sockets, one for each of the addrs.
+func listenUDP(upgrader *upgrader, name string, addrs bindAddrs, portOrFD int) ([]net.PacketConn, error) {
+	if portOrFD < 0 || len(addrs) == 0 {
+		conn := upgrader.PacketConn(name)
+		if conn == nil {
+			var err error
+			conn, err = packetConnFromPortOrFD(portOrFD)
+			if err != nil {
+				return nil, err
+			}
+		}
+		upgrader.Track(name, conn)
+		return []net.PacketConn{conn}, nil
+	}
+	var conns []net.PacketConn
+	for _, addr := range addrs {
+		conn := upgrader.PacketConn(socketName(name, addr))
+		if conn == nil {
+			var err error
+			conn, err = net.ListenPacket("udp", net.JoinHostPort(addr, strconv.Itoa(portOrFD)))
+			if err != nil {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return nil, err
+			}
+		}
+		conns = append(conns, conn)
+	}
+	for i, conn := range conns {
+		upgrader.Track(socketName(name, addrs[i]), conn)
+	}
+	return conns, nil
+}
+
+func packetConnFromPortOrFD(portOrFD int) (net.PacketConn, error) {
+	if portOrFD < 0 {
+		fdFile := os.NewFile(uintptr(-portOrFD), "fd")
+		if fdFile == nil {
+			return nil, fmt.Errorf("file descriptor %v is not valid.", -portOrFD)
+		}
+		return net.FilePacketConn(fdFile)
+	}
+	return net.ListenPacket("udp", fmt.Sprintf(":%v", portOrFD))
+}
+
+func listenerFromPortOrFD(portOrFD int) (net.Listener, error) {
+	if portOrFD < 0 {
+		fdFile := os.NewFile(uintptr(-portOrFD), "fd")
+		if fdFile == nil {
+			return nil, fmt.Errorf("file descriptor %v is not valid.", -portOrFD)
+		}
+		return net.FileListener(fdFile)
+	}
+	return net.Listen("tcp", fmt.Sprintf(":%v", portOrFD))
+}
+
+// multiListener accepts the connections from several listeners, such as one
+// for IPv4 and one for IPv6, so one server can serve all of them.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		closed:    make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go m.acceptLoop(l)
+	}
+	return m
+}
+
+func (m *multiListener) acceptLoop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		select {
+		case m.accepted <- acceptResult{conn, err}:
+		case <-m.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			return // The server stops on this error
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-m.accepted:
+		return result.conn, result.err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var errs []error
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		for _, l := range m.listeners {
+			errs = append(errs, l.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Addr returns the address of the first listener
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
+
+// parsePatternPort returns the public port of a :tcp or :udp pattern, from
+// the ":port" after the prefix.
+func parsePatternPort(port string) (int, error) {
+	_, portStr, err := net.SplitHostPort(port)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(portStr, 10, 16)
+	return int(n), err
+}
@@ -0,0 +1,265 @@
+package embedportal
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// The biggest OCSP response portal will read from a responder
+const maxOCSPResponseSize = 1 << 20
+
+// How long an OCSP response without a NextUpdate time is used for
+const defaultOCSPValidity = 24 * time.Hour
+
+// The TLS Feature extension, which has status_request (5) for Must-Staple
+// certs. See RFC 7633.
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// The cert has no OCSP server, so there is nothing to staple
+var errNoOCSPServer = errors.New("The certificate has no OCSP server.")
+
+// ocspStapler fetches the OCSP responses that portal staples to the TLS
+// handshakes, so clients don't need to ask the CA if the cert is revoked.
+type ocspStapler struct {
+	// Sends the requests to the OCSP responders. Replaceable for testing with a
+	// local responder.
+	Client *http.Client
+}
+
+func newOCSPStapler() *ocspStapler {
+	return &ocspStapler{
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Fetch gets a good OCSP response for the leaf cert. It is an error if the
+// responder says the cert is revoked.
+func (s *ocspStapler) Fetch(leaf, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errNoOCSPServer
+	}
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to create the OCSP request: %w", err)
+	}
+	var errs []error
+	for _, server := range leaf.OCSPServer {
+		resp, der, err := s.fetchFrom(server, request, leaf, issuer)
+		if err == nil {
+			return resp, der, nil
+		}
+		errs = append(errs, fmt.Errorf("%v: %w", server, err))
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+func (s *ocspStapler) fetchFrom(server string, request []byte,
+	leaf, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+
+	httpReq, err := http.NewRequest("POST", server, bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+	httpReq.Header.Set("Accept", "application/ocsp-response")
+	httpResp, err := s.Client.Do(httpReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("The OCSP responder returned status %v", httpResp.Status)
+	}
+	der, err := io.ReadAll(io.LimitReader(httpResp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := parseOCSPStaple(der, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, der, nil
+}
+
+// parseOCSPStaple parses and checks the OCSP response, and returns an error if
+// it isn't a good response that can be stapled right now.
+func parseOCSPStaple(der []byte, leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	resp, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid OCSP response: %w", err)
+	}
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		return nil, fmt.Errorf("The OCSP responder says the certificate was revoked at %v.",
+			resp.RevokedAt.Format(time.DateTime))
+	default:
+		return nil, errors.New("The OCSP responder doesn't know the certificate.")
+	}
+	if resp.NextUpdate.IsZero() {
+		resp.NextUpdate = resp.ThisUpdate.Add(defaultOCSPValidity)
+	}
+	if time.Now().After(resp.NextUpdate) {
+		return nil, fmt.Errorf("The OCSP response expired at %v.",
+			resp.NextUpdate.Format(time.DateTime))
+	}
+	return resp, nil
+}
+
+// Fetch a new response half way through the validity of the current one, like
+// the CAs recommend.
+func stapleRefreshTime(resp *ocsp.Response) time.Duration {
+	refreshAt := resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	return time.Until(refreshAt)
+}
+
+// keepStapleRefreshed staples an OCSP response to the cert at idx in the cache
+// and gets a new one before it expires and whenever the cert is refreshed.
+func (t *tlsRefresher) keepStapleRefreshed(idx int) {
+	status := t.status[idx]
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	failures := 0
+	for {
+		select {
+		case <-t.quit:
+			return
+		case <-status.newCert:
+			stopTimer(timer)
+			failures = 0
+		case <-timer.C:
+		}
+		refreshIn, err := t.refreshStaple(idx)
+		if errors.Is(err, errNoOCSPServer) {
+			continue // Nothing to do until the cert is refreshed
+		} else if err != nil {
+			failures++
+			retryIn := refreshBackoff(failures)
+			log.Printf("Failed to get the OCSP response for %v, retrying in %v: %v",
+				status.Source, retryIn, err)
+			t.removeExpiredStaple(idx)
+			timer.Reset(retryIn)
+			continue
+		}
+		failures = 0
+		timer.Reset(max(refreshIn, time.Minute))
+	}
+}
+
+// refreshStaple staples the saved OCSP response for the cert if it isn't time
+// to refresh it yet, otherwise it fetches and saves a new one.
+func (t *tlsRefresher) refreshStaple(idx int) (time.Duration, error) {
+	status := t.status[idx]
+	cert := t.cache[idx].Load().(*tls.Certificate)
+	leaf := cert.Leaf
+	if len(leaf.OCSPServer) == 0 {
+		if isMustStaple(leaf) {
+			log.Printf("Warning: The Must-Staple certificate for %v has no OCSP server. Clients will refuse to connect.",
+				status.Source)
+		}
+		return 0, errNoOCSPServer
+	}
+	issuer, err := issuerCert(cert)
+	if err != nil {
+		return 0, err
+	}
+	// The saved response is from before portal restarted or the cert file was
+	// re-read.
+	if der := t.state.OCSPStaple(leaf.Raw); der != nil {
+		resp, err := parseOCSPStaple(der, leaf, issuer)
+		if err == nil && stapleRefreshTime(resp) > 0 {
+			t.setStaple(idx, cert, der, resp)
+			return stapleRefreshTime(resp), nil
+		}
+	}
+	resp, der, err := t.stapler.Fetch(leaf, issuer)
+	if err != nil {
+		return 0, err
+	}
+	t.setStaple(idx, cert, der, resp)
+	t.state.SaveOCSPStaple(leaf.Raw, der, resp.NextUpdate)
+	log.Printf("Stapled a new OCSP response for %v, valid until %v",
+		status.Source, resp.NextUpdate.Format(time.DateTime))
+	return stapleRefreshTime(resp), nil
+}
+
+// setStaple replaces the cert in the cache with a copy that has the OCSP
+// response, unless the cert was refreshed since it was loaded.
+func (t *tlsRefresher) setStaple(idx int, cert *tls.Certificate, der []byte, resp *ocsp.Response) {
+	// Copy it because the stateManager and the -peers have the same cert
+	stapled := *cert
+	stapled.OCSPStaple = der
+	if !t.cache[idx].CompareAndSwap(cert, &stapled) {
+		return // The newCert signal staples the new one
+	}
+	status := t.status[idx]
+	status.mut.Lock()
+	status.stapleExpires = resp.NextUpdate
+	status.mut.Unlock()
+}
+
+// removeExpiredStaple stops stapling the OCSP response once it expires,
+// because clients reject expired responses.
+func (t *tlsRefresher) removeExpiredStaple(idx int) {
+	status := t.status[idx]
+	cert := t.cache[idx].Load().(*tls.Certificate)
+	status.mut.Lock()
+	expired := time.Now().After(status.stapleExpires)
+	status.mut.Unlock()
+	if !expired {
+		return
+	}
+	if cert.OCSPStaple != nil {
+		unstapled := *cert
+		unstapled.OCSPStaple = nil
+		if t.cache[idx].CompareAndSwap(cert, &unstapled) {
+			status.mut.Lock()
+			status.stapleExpires = time.Time{}
+			status.mut.Unlock()
+		}
+	}
+	if isMustStaple(cert.Leaf) {
+		log.Printf("Warning: The Must-Staple certificate for %v has no valid OCSP response. Clients will refuse to connect until portal gets one.",
+			status.Source)
+	}
+}
+
+// issuerCert returns the cert that signed the leaf, from the chain
+func issuerCert(cert *tls.Certificate) (*x509.Certificate, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, errors.New("The certificate chain has no issuer certificate, use the fullchain.pem file.")
+	}
+	return x509.ParseCertificate(cert.Certificate[1])
+}
+
+// isMustStaple returns true if clients must refuse the cert without a stapled
+// OCSP response.
+func isMustStaple(leaf *x509.Certificate) bool {
+	for _, ext := range leaf.Extensions {
+		if !ext.Id.Equal(oidTLSFeature) {
+			continue
+		}
+		var features []int
+		if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+			log.Printf("Invalid TLS Feature extension in the certificate for %v: %v",
+				leaf.Subject.CommonName, err)
+			return false
+		}
+		for _, feature := range features {
+			if feature == 5 { // status_request
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,681 @@
+package embedportal
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ask.systems/daemon/internal/portalpb"
+	"ask.systems/daemon/tools"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	grpcpeer "google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	// How often the peers send an empty update so the others know they're up
+	peerHeartbeat = 2 * time.Second
+	// A peer that hasn't sent anything for this long is down
+	peerTimeout = 3 * peerHeartbeat
+	// If more updates than this are waiting to be sent to a peer, we reconnect
+	// and send the whole state instead
+	peerQueueSize = 1024
+	// The TLS server name the peers connect with, so the RPC server knows to
+	// send the -peer_key_file cert instead of the root CA cert
+	peerServerName = "portal-peer"
+)
+
+// peerSync replicates the state between the portal instances in -peers so
+// clients can register with any of them. Every instance sends its changes to
+// all of its peers and applies the changes it receives like they were made
+// locally. Applying a change that was already made does nothing, so the changes
+// stop after going around once.
+//
+// The instance with the lowest -peer_id that is up is the leader. Only the
+// leader expires leases and renews the ACME certs, so they don't race. If the
+// leader goes down the next one takes over after the peerTimeout.
+//
+// Unregistrations that happen while a peer is disconnected are not sent to it
+// when it reconnects, it keeps serving those until the lease expires.
+// Backends on a loopback address or unix socket are only served by the
+// instance they registered with.
+//
+// The peers send each other the private keys, so they only connect to a peer
+// that has the key with the fingerprint in its -peers entry, and only accept
+// updates from the keys in -peers. A node ID belongs to the key that sent it.
+type peerSync struct {
+	portalpb.UnimplementedPortalPeerServer
+
+	nodeID     string
+	token      string
+	cert       *tls.Certificate // nil without a -peer_key_file
+	state      *stateManager
+	challenges *acmeChallenges
+	rpc        *rpcServ // set by Start
+	started    time.Time
+	quit       chan struct{}
+
+	peers []*peerConn
+
+	mut      sync.Mutex
+	lastSeen map[string]time.Time // node ID key
+	nodeKeys map[string]string    // node ID key, fingerprint value
+}
+
+type peerConn struct {
+	addr string
+	// The hex sha256 of the peer's public key, from the -peers entry
+	fingerprint string
+	updates     chan *portalpb.PeerUpdate
+	// Set when the updates queue was full and some were dropped
+	resync atomic.Bool
+	// Only used by replicateTo, to log once when the connection breaks
+	failing bool
+}
+
+// newPeerSync sets up the -peers, which are host:port#fingerprint. The key
+// can be nil if there are no peers.
+func newPeerSync(nodeID string, addrs []string, token string, key crypto.Signer,
+	state *stateManager, challenges *acmeChallenges, quit chan struct{}) (*peerSync, error) {
+	if len(addrs) > 0 && token == "" {
+		return nil, fmt.Errorf("-peer_token is required to use -peers.")
+	}
+	if len(addrs) > 0 && key == nil {
+		return nil, fmt.Errorf("-peer_key_file is required to use -peers.")
+	}
+	p := &peerSync{
+		nodeID:     nodeID,
+		token:      token,
+		state:      state,
+		challenges: challenges,
+		started:    time.Now(),
+		quit:       quit,
+		lastSeen:   make(map[string]time.Time),
+		nodeKeys:   make(map[string]string),
+	}
+	if key != nil {
+		cert, err := peerCertificate(key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to make the peer TLS cert: %w", err)
+		}
+		p.cert = cert
+	}
+	for _, entry := range addrs {
+		addr, fingerprint, _ := strings.Cut(entry, "#")
+		fingerprint = strings.ToLower(fingerprint)
+		if decoded, err := hex.DecodeString(fingerprint); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("The -peers entry %#v needs to end with #fingerprint, "+
+				"the sha256 of the peer's -peer_key_file public key which it logs when it starts.", entry)
+		}
+		p.peers = append(p.peers, &peerConn{
+			addr:        addr,
+			fingerprint: fingerprint,
+			updates:     make(chan *portalpb.PeerUpdate, peerQueueSize),
+		})
+	}
+	if len(p.peers) > 0 {
+		state.OnChange(p.Broadcast)
+		challenges.onChange = func(c *portalpb.AcmeChallenge) {
+			p.Broadcast(&portalpb.PeerUpdate{AcmeChallenges: []*portalpb.AcmeChallenge{c}})
+		}
+	}
+	return p, nil
+}
+
+// ServerTLSConfig returns the config for the RPC server that uses the
+// -peer_key_file cert with the peers and requires theirs, and uses the
+// rootCert with everyone else.
+func (p *peerSync) ServerTLSConfig(rootCert *tls.Config) *tls.Config {
+	if p.cert == nil {
+		return rootCert
+	}
+	peerConf := &tls.Config{
+		Certificates: []tls.Certificate{*p.cert},
+		// The peer certs are self-signed, we check the key fingerprint instead
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			fingerprint, err := certFingerprint(rawCerts)
+			if err != nil {
+				return err
+			}
+			if !p.isPeerKey(fingerprint) {
+				return fmt.Errorf("The peer's key fingerprint %v is not in -peers.", fingerprint)
+			}
+			return nil
+		},
+		// Required by gRPC, it only sets this on the top level config
+		NextProtos: []string{"h2"},
+	}
+	conf := rootCert.Clone()
+	conf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if hello.ServerName == peerServerName {
+			return peerConf, nil
+		}
+		return nil, nil // Use conf
+	}
+	return conf
+}
+
+func (p *peerSync) isPeerKey(fingerprint string) bool {
+	for _, peer := range p.peers {
+		if peer.fingerprint == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// Start connects to the peers. Updates from the peers are registered with the
+// rpcServ.
+func (p *peerSync) Start(rpc *rpcServ) {
+	p.rpc = rpc
+	for _, peer := range p.peers {
+		go p.replicateTo(peer)
+	}
+}
+
+// IsLeader returns true if this instance has the lowest ID of the peers that
+// are up. Always true when there are no -peers.
+func (p *peerSync) IsLeader() bool {
+	if len(p.peers) == 0 {
+		return true
+	}
+	if time.Since(p.started) < peerTimeout {
+		// Wait to hear from the peers so that there's only one leader
+		return false
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	for id, seen := range p.lastSeen {
+		if id < p.nodeID && time.Since(seen) < peerTimeout {
+			return false
+		}
+	}
+	return true
+}
+
+// Broadcast queues the update to send to all of the peers. Doesn't block, if
+// a peer's queue is full it gets the whole state again instead.
+func (p *peerSync) Broadcast(update *portalpb.PeerUpdate) {
+	update.NodeId = p.nodeID
+	for _, peer := range p.peers {
+		select {
+		case peer.updates <- update:
+		default:
+			peer.resync.Store(true)
+		}
+	}
+}
+
+// Authorize checks the -peer_token sent by a peer, and that it connected
+// with a key in -peers.
+func (p *peerSync) Authorize(ctx context.Context) error {
+	if p.token == "" {
+		return status.Error(codes.FailedPrecondition, "This portal has no -peer_token set.")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	token := md["authorization"]
+	if len(token) != 1 || subtle.ConstantTimeCompare([]byte(token[0]), []byte(p.token)) == 0 {
+		return status.Error(codes.Unauthenticated, "Invalid peer token")
+	}
+	if _, err := p.peerKeyFingerprint(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// peerKeyFingerprint returns the fingerprint of the key the peer connected
+// with, if it's one of the -peers.
+func (p *peerSync) peerKeyFingerprint(ctx context.Context) (string, error) {
+	caller, ok := grpcpeer.FromContext(ctx)
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "No peer info for the connection")
+	}
+	info, ok := caller.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return "", status.Error(codes.Unauthenticated,
+			"Peers must connect over TLS with their -peer_key_file cert.")
+	}
+	fingerprint := peerFingerprint(info.State.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	if !p.isPeerKey(fingerprint) {
+		return "", status.Errorf(codes.PermissionDenied,
+			"The peer's key fingerprint %v is not in -peers.", fingerprint)
+	}
+	return fingerprint, nil
+}
+
+// Replicate applies the updates sent by a peer
+func (p *peerSync) Replicate(stream portalpb.PortalPeer_ReplicateServer) error {
+	fingerprint, err := p.peerKeyFingerprint(stream.Context())
+	if err != nil {
+		return err
+	}
+	nodeID := ""
+	for {
+		update, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&emptypb.Empty{})
+		}
+		if err != nil {
+			return err
+		}
+		if update.NodeId == p.nodeID {
+			return status.Errorf(codes.FailedPrecondition,
+				"The peer has the same -peer_id as this portal (%v).", p.nodeID)
+		}
+		if nodeID == "" {
+			if err := p.claimNodeID(update.NodeId, fingerprint); err != nil {
+				return err
+			}
+			log.Printf("Receiving updates from peer %v", update.NodeId)
+			nodeID = update.NodeId
+		} else if update.NodeId != nodeID {
+			return status.Errorf(codes.InvalidArgument,
+				"The peer changed its -peer_id from %v to %v.", nodeID, update.NodeId)
+		}
+		p.mut.Lock()
+		p.lastSeen[update.NodeId] = time.Now()
+		p.mut.Unlock()
+		p.apply(update)
+	}
+}
+
+// claimNodeID ties the node ID to the peer's key, so another peer can't use
+// it to become the leader. The ID can move to a new key once the peer that
+// had it is down.
+func (p *peerSync) claimNodeID(nodeID, fingerprint string) error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if owner, ok := p.nodeKeys[nodeID]; ok && owner != fingerprint &&
+		time.Since(p.lastSeen[nodeID]) < peerTimeout {
+		return status.Errorf(codes.PermissionDenied,
+			"The -peer_id %v is used by the peer with key fingerprint %v.", nodeID, owner)
+	}
+	p.nodeKeys[nodeID] = fingerprint
+	return nil
+}
+
+type peerToken string
+
+func (token peerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{
+		"authorization": string(token),
+	}, nil
+}
+
+func (token peerToken) RequireTransportSecurity() bool {
+	return true
+}
+
+// dial connects to the peer, checking that its cert has the public key in the
+// -peers entry before anything is sent.
+func (p *peerSync) dial(peer *peerConn) (*grpc.ClientConn, error) {
+	return grpc.NewClient(peer.addr,
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			ServerName: peerServerName,
+			// The peer checks ours against its -peers too
+			Certificates: []tls.Certificate{*p.cert},
+			// The peer certs are self-signed, we check the key fingerprint instead
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				fingerprint, err := certFingerprint(rawCerts)
+				if err != nil {
+					return err
+				}
+				if fingerprint != peer.fingerprint {
+					return fmt.Errorf("The peer's key fingerprint is %v, not the one in -peers.", fingerprint)
+				}
+				return nil
+			},
+		})),
+		grpc.WithPerRPCCredentials(peerToken(p.token)),
+	)
+}
+
+// replicateTo keeps a stream open to the peer to send it our updates,
+// reconnecting when it fails.
+func (p *peerSync) replicateTo(peer *peerConn) {
+	conn, err := p.dial(peer)
+	if err != nil {
+		log.Printf("Failed to set up the connection to peer %v: %v", peer.addr, err)
+		return
+	}
+	defer conn.Close()
+	client := portalpb.NewPortalPeerClient(conn)
+	for {
+		err := p.sendUpdates(client, peer)
+		select {
+		case <-p.quit:
+			return
+		default:
+		}
+		if status.Code(err) == codes.FailedPrecondition {
+			log.Printf("Not replicating to peer %v: %v", peer.addr, err)
+			return
+		}
+		if !peer.failing {
+			log.Printf("Lost the connection to peer %v, retrying: %v", peer.addr, err)
+			peer.failing = true
+		}
+		select {
+		case <-p.quit:
+			return
+		case <-time.After(peerHeartbeat):
+		}
+	}
+}
+
+// sendUpdates sends the whole state to the peer then the updates as they
+// happen, until there's an error.
+func (p *peerSync) sendUpdates(client portalpb.PortalPeerClient, peer *peerConn) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	stream, err := client.Replicate(ctx)
+	if err != nil {
+		return err
+	}
+	peer.resync.Store(false)
+	snapshot := p.state.PeerSnapshot()
+	snapshot.AcmeChallenges = p.challenges.Snapshot()
+	snapshot.NodeId = p.nodeID
+	if err := sendPeerUpdate(stream, snapshot); err != nil {
+		return err
+	}
+	if peer.failing {
+		log.Printf("Reconnected to peer %v", peer.addr)
+		peer.failing = false
+	}
+	ticker := time.NewTicker(peerHeartbeat)
+	defer ticker.Stop()
+	for {
+		var update *portalpb.PeerUpdate
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case update = <-peer.updates:
+		case <-ticker.C:
+			if peer.resync.Load() {
+				return errors.New("Too many updates were queued, sending the whole state again.")
+			}
+			update = &portalpb.PeerUpdate{NodeId: p.nodeID}
+		}
+		if err := sendPeerUpdate(stream, update); err != nil {
+			return err
+		}
+	}
+}
+
+func sendPeerUpdate(stream portalpb.PortalPeer_ReplicateClient, update *portalpb.PeerUpdate) error {
+	err := stream.Send(update)
+	if errors.Is(err, io.EOF) {
+		// The server ended the stream, the error is from CloseAndRecv
+		_, err = stream.CloseAndRecv()
+	}
+	return err
+}
+
+func (p *peerSync) apply(update *portalpb.PeerUpdate) {
+	from := update.NodeId
+	// Everyone uses the ACME account of the lowest ID
+	if len(update.AcmeAccount) > 0 && from < p.nodeID {
+		p.applyACMEAccount(from, update.AcmeAccount)
+	}
+	for _, ca := range update.RootCas {
+		if err := p.state.SaveRootCA(ca); err != nil {
+			log.Printf("Failed to save a root CA from peer %v: %v", from, err)
+		}
+	}
+	// Don't reload the routes file between the isPinned checks and the changes
+	p.rpc.pinnedMut.RLock()
+	for _, r := range update.Registrations {
+		p.applyRegistration(from, r)
+	}
+	for _, lease := range update.Unregistered {
+		if p.rpc.isPinned(lease.Pattern) {
+			continue
+		}
+		leasor := p.rpc.clientLeasor.PortLeasorForClient(lease.Address)
+		// Unregistering removes it from the state with the leasor OnCancel. If
+		// there's an error we already didn't have it.
+		leasor.Unregister(lease)
+	}
+	p.rpc.pinnedMut.RUnlock()
+	for _, c := range update.Certificates {
+		p.applyCertificate(from, c)
+	}
+	for _, m := range update.Maintenance {
+		p.rpc.httpProxy.SetMaintenance(m)
+		p.state.SaveMaintenance(m)
+	}
+	for _, c := range update.AcmeChallenges {
+		if c.Deleted {
+			p.challenges.Delete(c.Path)
+		} else {
+			p.challenges.Write(c.Path, c.Value)
+		}
+	}
+}
+
+// applyRegistration registers a new registration from a peer, or renews ours
+// if the peer's lease has a later timeout.
+func (p *peerSync) applyRegistration(from string, r *portalpb.Registration) {
+	if r.GetLease() == nil || r.GetRequest() == nil || p.rpc.isPinned(r.Lease.Pattern) {
+		return
+	}
+	if isLocalBackend(r) {
+		return // Only the peer can reach it
+	}
+	timeout := r.Lease.Timeout.AsTime()
+	if !time.Now().Before(timeout) {
+		return // The leader will send the unregister
+	}
+	if existing := p.state.LookupRegistration(r.Lease); existing != nil {
+		if existing.Pinned || !timeout.After(existing.Lease.Timeout.AsTime()) {
+			return
+		}
+		leasor := p.rpc.clientLeasor.PortLeasorForClient(r.Lease.Address)
+		newLease, err := leasor.Renew(r.Lease, timeout)
+		if err != nil {
+			log.Printf("Failed to renew lease from peer %v: %v", from, err)
+			return
+		}
+		if err := p.state.RenewRegistration(newLease); err != nil {
+			log.Printf("Error renewing lease state: %v", err)
+		}
+		return
+	}
+	request := proto.Clone(r.Request).(*portalpb.RegisterRequest)
+	if request.FixedPort == 0 {
+		// The backend is listening on the port the peer gave it
+		request.FixedPort = r.Lease.Port
+	}
+	lease, err := p.rpc.internalRegister(r.Lease.Address, request, timeout)
+	if err != nil {
+		log.Printf("Failed to register %v from peer %v: %v", r.Lease.Pattern, from, err)
+		return
+	}
+	if err := p.state.SaveRegistration(&portalpb.Registration{
+		Request: request,
+		Lease:   lease,
+	}); err != nil {
+		log.Printf("Failed to save registration from peer %v: %v", from, err)
+	}
+}
+
+// isLocalBackend returns true if the backend of the registration is only
+// reachable from the machine of the portal it registered with, because it's a
+// unix socket or on a loopback address. The same address on a peer could be
+// anything.
+func isLocalBackend(r *portalpb.Registration) bool {
+	if isDirectResponse(r.Request) {
+		return false
+	}
+	if r.Request.UnixSocket != "" {
+		return true
+	}
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(r.Lease.Address, "["), "]"))
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
+
+func (p *peerSync) applyACMEAccount(from string, accountBytes []byte) {
+	if current := p.state.ACMEAccount(); current != nil {
+		if currentBytes, err := x509.MarshalPKCS8PrivateKey(current); err == nil && bytes.Equal(currentBytes, accountBytes) {
+			return
+		}
+	}
+	accountKeyAny, err := x509.ParsePKCS8PrivateKey(accountBytes)
+	accountKey, ok := accountKeyAny.(crypto.Signer)
+	if err != nil || !ok {
+		log.Printf("Failed to load the acme account key from peer %v: %v", from, err)
+		return
+	}
+	// The running acme client keeps using the old account until portal restarts
+	log.Printf("Switching to the acme account of peer %v", from)
+	p.state.SaveACMEAccount(accountKey)
+}
+
+// applyCertificate saves the acme cert from the peer if it expires later than
+// the one we have.
+func (p *peerSync) applyCertificate(from string, c *portalpb.Certificate) {
+	certKeyAny, err := x509.ParsePKCS8PrivateKey(c.Key)
+	certKey, ok := certKeyAny.(crypto.Signer)
+	if err != nil || !ok {
+		log.Printf("Failed to load the key for domain %v from peer %v: %v", c.Domain, from, err)
+		return
+	}
+	cert, err := tools.TLSCertificateFromBytes(c.Der, certKey)
+	if err != nil {
+		log.Printf("TLS cert for domain %v from peer %v not valid: %v", c.Domain, from, err)
+		return
+	}
+	if old := p.state.TLSCert(c.Domain); old != nil && !certExpiresAfter(cert, old) {
+		return
+	}
+	log.Printf("Saving new TLS cert for %v from peer %v.", c.Domain, from)
+	p.state.SaveTLSCert(c.Domain, cert, c.Directory)
+}
+
+func certExpiresAfter(cert, old *tls.Certificate) bool {
+	oldLeaf := old.Leaf
+	if oldLeaf == nil {
+		var err error
+		if oldLeaf, err = x509.ParseCertificate(old.Certificate[0]); err != nil {
+			return true
+		}
+	}
+	return cert.Leaf.NotAfter.After(oldLeaf.NotAfter)
+}
+
+// loadPeerKey reads the PEM private key in the -peer_key_file, or generates a
+// new one and writes it there if the file doesn't exist.
+func loadPeerKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated a new -peer_key_file: %v", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM data found.")
+	}
+	keyAny, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keyAny.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported key type %T", keyAny)
+	}
+	return key, nil
+}
+
+// peerFingerprint returns the hex sha256 of the DER public key, which is what
+// goes after the # in -peers.
+func peerFingerprint(publicKeyDER []byte) string {
+	hash := sha256.Sum256(publicKeyDER)
+	return hex.EncodeToString(hash[:])
+}
+
+// certFingerprint returns the peerFingerprint of the first cert in the TLS
+// handshake
+func certFingerprint(rawCerts [][]byte) (string, error) {
+	if len(rawCerts) == 0 {
+		return "", errors.New("The peer didn't send a cert.")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return "", err
+	}
+	return peerFingerprint(cert.RawSubjectPublicKeyInfo), nil
+}
+
+// peerCertificate makes a self-signed cert for the -peer_key_file. The peers
+// only check the key so it never needs to be renewed.
+func peerCertificate(key crypto.Signer) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, big.NewInt(0).SetBit(big.NewInt(0), 128, 1))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(100, 0, 0),
+		// Used for both sides of the connections between peers
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:    []string{peerServerName},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return tools.TLSCertificateFromBytes([][]byte{der}, key)
+}
@@ -0,0 +1,180 @@
+package embedportal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"ask.systems/daemon/internal/portalpb"
+	"ask.systems/daemon/tools"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// recordingPeer is a peer RPC server that keeps the updates it receives
+type recordingPeer struct {
+	portalpb.UnimplementedPortalPeerServer
+	updates chan *portalpb.PeerUpdate
+}
+
+func (r *recordingPeer) Replicate(stream portalpb.PortalPeer_ReplicateServer) error {
+	for {
+		update, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		r.updates <- update
+	}
+}
+
+func TestPeerSync_Fingerprint(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	newKey := func() (*ecdsa.PrivateKey, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicKey, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, peerFingerprint(publicKey)
+	}
+	serverKey, serverFingerprint := newKey()
+	clientKey, clientFingerprint := newKey()
+	otherKey, _ := newKey()
+
+	// The server side of a peer that only has the client in -peers
+	rootCert, err := tools.AutorenewSelfSignedCertificate("portal", time.Hour, true, nil, quit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newPeerSync("server", []string{"127.0.0.1:1#" + clientFingerprint},
+		"peer-secret", serverKey, newStateManager("", nil, nil), &acmeChallenges{}, quit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &recordingPeer{updates: make(chan *portalpb.PeerUpdate, 10)}
+	grpcServer := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(server.ServerTLSConfig(rootCert))),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream,
+			info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := server.Authorize(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	portalpb.RegisterPortalPeerServer(grpcServer, recorder)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go grpcServer.Serve(l)
+	defer grpcServer.Stop()
+
+	// Sends the snapshot to the server using the key, pinning the fingerprint
+	send := func(key *ecdsa.PrivateKey, fingerprint string) chan error {
+		t.Helper()
+		p, err := newPeerSync("client", []string{l.Addr().String() + "#" + fingerprint},
+			"peer-secret", key, newStateManager("", nil, nil), &acmeChallenges{}, quit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := p.dial(p.peers[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		result := make(chan error, 1)
+		go func() { result <- p.sendUpdates(portalpb.NewPortalPeerClient(conn), p.peers[0]) }()
+		return result
+	}
+	expectRejected := func(result chan error) {
+		t.Helper()
+		select {
+		case err := <-result:
+			if err == nil {
+				t.Error("Expected an error connecting to the peer")
+			}
+		case update := <-recorder.updates:
+			t.Fatalf("The server got an update from the wrong peer: %v", update)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Connecting with the wrong key didn't fail")
+		}
+		select {
+		case update := <-recorder.updates:
+			t.Fatalf("The server got an update from the wrong peer: %v", update)
+		default:
+		}
+	}
+
+	// A server with a different key never gets the snapshot
+	expectRejected(send(clientKey, clientFingerprint))
+	// The server doesn't accept updates from a key that isn't in its -peers
+	expectRejected(send(otherKey, serverFingerprint))
+
+	// Both keys are in the other's -peers
+	send(clientKey, serverFingerprint)
+	select {
+	case update := <-recorder.updates:
+		if update.NodeId != "client" {
+			t.Errorf("Expected the snapshot from the client, got: %v", update)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The peer with the right key didn't get the snapshot")
+	}
+}
+
+func TestPeerSync_ClaimNodeID(t *testing.T) {
+	p, err := newPeerSync("c", nil, "peer-secret", nil,
+		newStateManager("", nil, nil), &acmeChallenges{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.claimNodeID("a", "key-a"); err != nil {
+		t.Fatal(err)
+	}
+	p.lastSeen["a"] = time.Now()
+	if err := p.claimNodeID("a", "key-b"); err == nil {
+		t.Error("Another key took the node ID while its peer is up")
+	}
+	if err := p.claimNodeID("a", "key-a"); err != nil {
+		t.Errorf("The same key should keep its node ID: %v", err)
+	}
+	// Once the peer is down the ID can move to a new key
+	p.lastSeen["a"] = time.Now().Add(-peerTimeout)
+	if err := p.claimNodeID("a", "key-b"); err != nil {
+		t.Errorf("The node ID should move to the new key when the old one is down: %v", err)
+	}
+}
+
+func TestNewPeerSync_RequiresFingerprint(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{
+		"127.0.0.1:8080",
+		"127.0.0.1:8080#",
+		"127.0.0.1:8080#not-hex",
+		"127.0.0.1:8080#abcd",
+	} {
+		_, err := newPeerSync("a", []string{addr}, "peer-secret", key,
+			newStateManager("", nil, nil), &acmeChallenges{}, nil)
+		if err == nil {
+			t.Errorf("Expected an error for -peers entry %#v", addr)
+		}
+	}
+	if _, err := newPeerSync("a", []string{"127.0.0.1:8080#" + strings.Repeat("0", 64)},
+		"peer-secret", nil, newStateManager("", nil, nil), &acmeChallenges{}, nil); err == nil {
+		t.Error("Expected an error for -peers without a -peer_key_file")
+	}
+}
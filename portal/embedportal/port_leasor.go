@@ -37,9 +37,15 @@ type clientLeasor struct {
 
 	onCancel    []onCancelFunc
 	onCancelMut *sync.Mutex
+
+	// Leases only expire when this returns true, so that only the leader of the
+	// -peers expires them.
+	isLeader func() bool
+	// Leases don't expire while the sockets are handed to a new portal
+	upgrader *upgrader
 }
 
-func makeClientLeasor(startPort, endPort uint16, reservedPorts map[uint16]bool, quit chan struct{}) *clientLeasor {
+func makeClientLeasor(startPort, endPort uint16, reservedPorts map[uint16]bool, isLeader func() bool, upgrader *upgrader, quit chan struct{}) *clientLeasor {
 	if endPort < startPort {
 		startPort, endPort = endPort, startPort
 	}
@@ -50,6 +56,8 @@ func makeClientLeasor(startPort, endPort uint16, reservedPorts map[uint16]bool,
 		startPort:     startPort,
 		endPort:       endPort,
 		reservedPorts: reservedPorts,
+		isLeader:      isLeader,
+		upgrader:      upgrader,
 		quit:          quit,
 	}
 	c.leasorPool = &sync.Pool{
@@ -97,7 +105,7 @@ func (c *clientLeasor) PortLeasorForClient(clientAddr string) *portLeasor {
 		// This same pointer might have been returned from a concurrent call before
 		// we start this goroutine, but this will still only happen once and it's
 		// okay if we start using leasor before this.
-		go leasor.(*portLeasor).monitorTTLs(c.quit)
+		go leasor.(*portLeasor).monitorTTLs(c.isLeader, c.upgrader, c.quit)
 	} else {
 		c.leasorPool.Put(nextLeasor)
 	}
@@ -153,6 +161,12 @@ func (l *portLeasor) OnCancel(cancelFunc func(*portalpb.Lease)) {
 	l.onCancel = append(l.onCancel, cancelFunc)
 }
 
+// usesPort returns false if the registration has no backend port to lease,
+// because portal answers it directly or forwards it to a unix socket.
+func usesPort(request *portalpb.RegisterRequest) bool {
+	return !isDirectResponse(request) && request.GetUnixSocket() == ""
+}
+
 func randomTTL(ttl time.Duration) time.Duration {
 	return time.Duration(float64(ttl) * (1 + rand.Float64()*ttlRandomStagger))
 }
@@ -174,8 +188,11 @@ func (l *portLeasor) Register(request *portalpb.RegisterRequest, fixedTimeout ti
 		Address: l.clientAddr,
 	}
 
-	// Either use the fixed port or select a port automatically
-	if request.FixedPort != 0 {
+	// Either use the fixed port or select a port automatically. Direct responses
+	// and unix socket backends don't use a port at all.
+	if !usesPort(request) {
+		newLease.Port = 0
+	} else if request.FixedPort != 0 {
 		if request.FixedPort >= 1<<16 {
 			return nil, fmt.Errorf(
 				"Error port out of range. Ports only go up to 65535. Requested Port: %v",
@@ -212,7 +229,8 @@ func (l *portLeasor) Register(request *portalpb.RegisterRequest, fixedTimeout ti
 	return proto.Clone(newLease).(*portalpb.Lease), nil
 }
 
-func (l *portLeasor) Renew(lease *portalpb.Lease) (*portalpb.Lease, error) {
+// Renew extends the lease by the TTL, or until the fixedTimeout if it's set.
+func (l *portLeasor) Renew(lease *portalpb.Lease, fixedTimeout time.Time) (*portalpb.Lease, error) {
 	l.mut.Lock()
 	defer l.mut.Unlock()
 
@@ -225,7 +243,11 @@ func (l *portLeasor) Renew(lease *portalpb.Lease) (*portalpb.Lease, error) {
 		if foundLease.Pattern != lease.GetPattern() {
 			continue
 		}
-		foundLease.Timeout = timestamppb.New(time.Now().Add(randomTTL(leaseTTL)))
+		if fixedTimeout.IsZero() {
+			foundLease.Timeout = timestamppb.New(time.Now().Add(randomTTL(leaseTTL)))
+		} else {
+			foundLease.Timeout = timestamppb.New(fixedTimeout)
+		}
 		log.Print("Lease renewed: ", leaseString(foundLease))
 		return proto.Clone(foundLease).(*portalpb.Lease), nil
 	}
@@ -319,12 +341,22 @@ func (l *portLeasor) deleteLeaseUnsafe(lease *portalpb.Lease) {
 // Calls the onTTL functions given in the OnTTL() call for the lease if it
 // expires.
 //
-// Checks the lease once per each ttlCheckFreq duration.
-func (l *portLeasor) monitorTTLs(quit chan struct{}) {
+// Checks the lease once per each ttlCheckFreq duration, when isLeader is true.
+// Waits for the upgrader's handoff so the new portal loads the state after
+// the leases are removed.
+func (l *portLeasor) monitorTTLs(isLeader func() bool, upgrader *upgrader, quit chan struct{}) {
 	ticker := time.NewTicker(ttlCheckFreq)
 	for {
 		select {
 		case <-ticker.C: // on next tick
+			if !isLeader() {
+				// The leader sends us the expired leases
+				continue
+			}
+			done, ok := upgrader.Busy()
+			if !ok {
+				continue // The new portal expires them
+			}
 			l.mut.Lock()
 			now := time.Now()
 			for _, portLeases := range l.leases {
@@ -337,6 +369,7 @@ func (l *portLeasor) monitorTTLs(quit chan struct{}) {
 				}
 			}
 			l.mut.Unlock()
+			done()
 		case <-quit: // on quit
 			ticker.Stop()
 			return
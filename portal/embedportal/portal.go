@@ -6,7 +6,9 @@ package embedportal
 
 import (
 	"context"
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
@@ -30,11 +32,13 @@ var (
 	ttlRandomStagger = 0.05
 )
 
-var kACMEAddress string
-
 // TODO: actually use ctx
 func Run(ctx context.Context, flags *flag.FlagSet, args []string) {
 	leaseTTL = LeaseTTL // TODO
+	if len(args) > 1 && args[1] == "state" {
+		runState(flags, args[1:])
+		return
+	}
 	flags.Usage = func() {
 		fmt.Fprintf(flags.Output(), ""+
 			"Usage: %s [flags]\n"+
@@ -58,14 +62,22 @@ func Run(ctx context.Context, flags *flag.FlagSet, args []string) {
 			"non-portal-client servers in the ports 2050-4096 (by default).\n"+
 			"The other flags only need to be changed in unusual configurations.\n"+
 			"\n"+
+			"To inspect or migrate the -save_file run: %s state\n"+
+			"\n"+
 			"All Flags:\n",
-			flags.Name(), flags.Name())
+			flags.Name(), flags.Name(), flags.Name())
 		flags.PrintDefaults()
 	}
 	rpcPort := flags.Int("rpc_port", 2048, ""+
 		"The port to bind for the portal RPC server that clients use to register\n"+
 		"with. You shouldn't need to change this unless there's a conflict or you\n"+
 		"run multiple instances of portal.")
+	rpcSocket := flags.String("rpc_socket", "", ""+
+		"The path of a unix socket to also serve the RPCs on, for clients on the\n"+
+		"same machine. Clients connect with the address unix:///path/to/socket and\n"+
+		"don't need the API token. Instead only portal's user and group can\n"+
+		"connect (the file mode is 0660), and registrations log the process that\n"+
+		"made them. Set to empty string to turn this off.")
 	portRangeStart := flags.Uint("port_range_start", 2050, ""+
 		"The (inclusive) start of the port range to lease-out to clients when they\n"+
 		"register.")
@@ -92,7 +104,21 @@ func Run(ctx context.Context, flags *flag.FlagSet, args []string) {
 		"certificates. This is uncommon. There are alternate providers, private\n"+
 		"servers, and this is useful for testing. For testing only you can also\n"+
 		"set the ACME_SERVER_CERT env var to a PEM encoded CA cert file for\n"+
-		"connecting to the autocert server over HTTPS.\n")
+		"connecting to the autocert server over HTTPS.\n\n"+
+		"Accepts a comma separated list of directories in order of preference.\n"+
+		"If getting a cert from one fails 3 times in a row, portal uses the next\n"+
+		"one for a day before trying it again.")
+	acmeEmail := flags.String("autocert_email", "", ""+
+		"A comma separated list of contact email addresses for the ACME account,\n"+
+		"which the CA uses to warn you about problems with your certificates.")
+	acmeEABKeyID := flags.String("autocert_eab_kid", "", ""+
+		"The External Account Binding key ID, for CAs that require an existing\n"+
+		"account such as ZeroSSL or a private CA. With multiple -autocert_server\n"+
+		"directories, use a comma separated list with an entry for each server\n"+
+		"and leave the entries empty for servers that don't need it.")
+	acmeEABHMAC := flags.String("autocert_eab_hmac", "", ""+
+		"The base64url encoded External Account Binding HMAC key for the\n"+
+		"-autocert_eab_kid, with the same number of comma separated entries.")
 	tlsCertSpec := flags.String("tls_cert", "", ""+
 		"The filepath to the tls cert file (fullchain.pem).\n"+
 		"Accepts multiple certificates with a comma separated list.\n"+
@@ -105,6 +131,11 @@ func Run(ctx context.Context, flags *flag.FlagSet, args []string) {
 		"Files are automatically re-read when portal receives SIGUSR1\n"+
 		"or 2/3 of the expiration date.\n"+
 		"This is not needed with spawn because it uses the SPAWN_FILES env var.")
+	ocspStapling := flags.Bool("ocsp_stapling", true, ""+
+		"If true, staple OCSP responses from the certificate authority to the TLS\n"+
+		"handshakes, so clients don't need to ask the CA if the certificate was\n"+
+		"revoked. This is required for certificates with the OCSP Must-Staple\n"+
+		"extension. The responses are saved in the -save_file.")
 	certChallengeWebRoot := flags.String("cert_challenge_webroot", "./cert-challenge/", ""+
 		"Set to a local folder path to enable hosting the webroot auto TLS cert\n"+
 		"(ACME) challenge path ("+certChallengePattern+") so you can auto-renew\n"+
@@ -118,29 +149,262 @@ func Run(ctx context.Context, flags *flag.FlagSet, args []string) {
 	httpsPort := flags.Int("https_port", 443, ""+
 		"The port to bind to for https traffic.\n"+
 		"This is overridden if spawn provides ports.")
+	http3Port := flags.Int("http3_port", 0, ""+
+		"The UDP port to bind to for HTTP/3 (QUIC) traffic, usually the same as\n"+
+		"the -https_port. Set to 0 to turn off HTTP/3. When on, HTTPS responses\n"+
+		"include the Alt-Svc header to tell browsers they can use HTTP/3.\n"+
+		"This is overridden if spawn provides a UDP port (udp_ports).")
+	var bindAddresses bindAddrs
+	flags.Var(&bindAddresses, "bind_address", ""+
+		"A comma separated list of the IP addresses (or hostnames) to listen on\n"+
+		"for the HTTP, HTTPS, and HTTP/3 ports and the :tcp and :udp proxy ports,\n"+
+		"such as separate IPv4 and IPv6 addresses. If unset, portal listens on\n"+
+		"all interfaces. This doesn't apply to ports provided by spawn.")
+	var rpcBindAddresses bindAddrs
+	flags.Var(&rpcBindAddresses, "rpc_bind_address", ""+
+		"A comma separated list of the IP addresses (or hostnames) to listen on\n"+
+		"for the -rpc_port, for example to only allow clients from a LAN or VPN\n"+
+		"interface. Defaults to the -bind_address.")
+	udpSessionTimeout := flags.Duration("udp_session_timeout", 2*time.Minute, ""+
+		"How long a client of a :udp registration can be idle before portal closes\n"+
+		"its session and the backend socket for it.")
+	udpMaxSessions := flags.Int("udp_max_sessions", 1024, ""+
+		"The maximum number of clients with an open session for each :udp\n"+
+		"registration. Datagrams from new clients are dropped when it is full.")
+	acceptProxyProtocol := flags.Bool("accept_proxy_protocol", false, ""+
+		"If true, the connections to the HTTP, HTTPS, and :tcp ports must start\n"+
+		"with a HAProxy PROXY protocol header (version 1 or 2) which has the real\n"+
+		"client address. Use this when portal is behind a load balancer that\n"+
+		"sends it. Only use it if clients can't connect to portal directly,\n"+
+		"otherwise they can claim to be any address.")
+	drainTimeout := flags.Duration("drain_timeout", 30*time.Second, ""+
+		"When a registration is replaced or removed, or portal shuts down, portal\n"+
+		"stops sending new requests and connections to the old backend and lets\n"+
+		"the ones in progress finish for up to this long before closing them.\n"+
+		"WebSocket clients are sent a close message. Set to 0 to close them\n"+
+		"right away.")
+	errorPagesDir := flags.String("error_pages", "", ""+
+		"A directory of HTML templates (html/template) to use for the error pages\n"+
+		"portal serves itself. Name the files 404.html, 502.html, 503.html, and\n"+
+		"504.html. Pages in a subdirectory named after a hostname, for example\n"+
+		"example.com/404.html, are only used for that hostname. The templates\n"+
+		"can use {{.StatusCode}}, {{.StatusText}}, {{.Host}}, {{.Path}}, and\n"+
+		"{{.RetryAfter}}. Missing pages use the plain text defaults.")
+	compress := flags.Bool("compress", false, ""+
+		"If true, compress responses with gzip or brotli when the client supports\n"+
+		"it. Responses that are already compressed, or have a content type that is\n"+
+		"already compressed (like images), are sent as-is. Backends can opt-out with\n"+
+		"the no_compression registration option.")
+	compressMinSize := flags.Int("compress_min_size", 1024, ""+
+		"The minimum response size in bytes to compress, when -compress is set.\n"+
+		"Small responses don't get smaller enough to be worth it.")
+	cacheSize := flags.Int64("cache_size", 32<<20, ""+
+		"The number of bytes of HTTP responses to keep in memory in the response\n"+
+		"cache. Only backends that register with the cache option are cached and\n"+
+		"only when their response headers allow it. Set to 0 to turn off caching.")
+	cacheMaxEntrySize := flags.Int64("cache_max_entry_size", 4<<20, ""+
+		"Responses bigger than this number of bytes are never cached.")
+	cacheDir := flags.String("cache_dir", "", ""+
+		"If set, responses that don't fit in the -cache_size memory are moved to\n"+
+		"files in this directory instead of being dropped. The files are kept\n"+
+		"when portal restarts.")
+	cacheDiskSize := flags.Int64("cache_disk_size", 1<<30, ""+
+		"The number of bytes of responses to keep in the -cache_dir.")
+	routesFile := flags.String("routes_file", "", ""+
+		"The path to a textproto file of routes to always serve, for servers that\n"+
+		"don't register themselves, such as legacy servers on other machines.\n"+
+		"The format is: route: { pattern: '/foo/' hostname: 'server' fixed_port: 80 }\n"+
+		"with the same fields as assimilate accepts (RegisterRequest). These routes\n"+
+		"never expire and clients can't replace them. The file is re-read when\n"+
+		"portal receives SIGHUP and removed entries are unregistered.")
+	tlsPolicyFile := flags.String("tls_policy_file", "", ""+
+		"The path to a textproto file of TLS policies per hostname for the HTTPS\n"+
+		"port: the minimum TLS version, cipher suites, ALPN protocols, HSTS\n"+
+		"settings, and whether plain HTTP is allowed. The format is:\n"+
+		"policy: { hostname: 'example.com' min_version: '1.3' hsts_max_age_seconds: 31536000 }\n"+
+		"Use hostname '*.example.com' for subdomains and '' for the default. See\n"+
+		"the TLSPolicy message in storage.proto for all the fields. The file is\n"+
+		"re-read when portal receives SIGHUP.")
+	adminURL := flags.String("admin_url", "", ""+
+		"The pattern to serve the portal admin page on, for example /portal/ or\n"+
+		"admin.example.com/portal/. It shows the registered routes and TCP proxies,\n"+
+		"the serving certificates, and the recent proxy errors, and it can\n"+
+		"unregister leases, toggle maintenance mode, and refresh the certificates.\n"+
+		"Requires -admin_logins. Set to empty string to turn it off.")
+	adminLogins := flags.String("admin_logins", "", ""+
+		"A comma separated list of username:password_hash for the admins that can\n"+
+		"log in to the -admin_url page. Hash passwords with: daemon host -hash_password")
+	alertWebhook := flags.String("alert_webhook", "", ""+
+		"A URL to POST a JSON alert to when a TLS certificate is close to\n"+
+		"expiring or fails to refresh -alert_failures times in a row. This covers\n"+
+		"the -autocert_domains and the -tls_cert files, such as from certbot.\n"+
+		"The alerts are always logged.")
+	alertSMTPServer := flags.String("alert_smtp_server", "", ""+
+		"The host:port of a local SMTP server, such as localhost:25, to email\n"+
+		"the certificate alerts to -alert_email_to with. It must accept mail\n"+
+		"without logging in.")
+	alertEmailTo := flags.String("alert_email_to", "", ""+
+		"A comma separated list of email addresses to send the certificate alerts\n"+
+		"to with the -alert_smtp_server.")
+	alertEmailFrom := flags.String("alert_email_from", "", ""+
+		"The sender address of the alert emails. Defaults to portal@hostname.")
+	alertExpiryDays := flags.Int("alert_expiry_days", 14, ""+
+		"Alert when a TLS certificate expires in less than this many days.")
+	alertFailures := flags.Int("alert_failures", 3, ""+
+		"Alert when refreshing a TLS certificate fails this many times in a row.\n"+
+		"The retries back off from 1 minute up to 1 hour apart.")
+	ddnsProvider := flags.String("ddns_provider", "", ""+
+		"Set to keep the DNS records of the -ddns_domains pointing at portal's\n"+
+		"public IP address, for hosting at home without a static IP. Either\n"+
+		"\"rfc2136\" to send DNS UPDATE messages to the -ddns_server like nsupdate,\n"+
+		"or \"exec\" to run the -ddns_exec command. Unset to turn this off.")
+	var ddnsDomains autocertDomains
+	flags.Var(&ddnsDomains, "ddns_domains", ""+
+		"A comma separated list of the domains to set the A and AAAA records of.\n"+
+		"Defaults to the -autocert_domains.")
+	ddnsIPSource := flags.String("ddns_ip_source", "https://api.ipify.org", ""+
+		"A comma separated list of where to get the public IP address from, the\n"+
+		"first IPv4 and IPv6 address found are used. Either an http(s) URL that\n"+
+		"responds with the client's IP, stun:host:port for a STUN server, or\n"+
+		"interface:name for the public addresses of a local network interface.")
+	ddnsInterval := flags.Duration("ddns_interval", 5*time.Minute, ""+
+		"How often to check if the public IP address changed.")
+	ddnsTTL := flags.Duration("ddns_ttl", 5*time.Minute, ""+
+		"The TTL of the DNS records.")
+	ddnsServer := flags.String("ddns_server", "", ""+
+		"The host:port of the primary DNS server for the -ddns_zone, for the\n"+
+		"rfc2136 -ddns_provider. The port defaults to 53.")
+	ddnsZone := flags.String("ddns_zone", "", ""+
+		"The DNS zone the -ddns_domains are in, for the rfc2136 -ddns_provider.")
+	ddnsTSIGKeyFile := flags.String("ddns_tsig_key_file", "", ""+
+		"The path to the TSIG key to sign the DNS updates with, for the rfc2136\n"+
+		"-ddns_provider. In the nsupdate -y format: [algorithm:]name:secret\n"+
+		"where the secret is base64 and the algorithm defaults to hmac-sha256.")
+	ddnsExec := flags.String("ddns_exec", "", ""+
+		"The command to run to set a DNS record, for the exec -ddns_provider. It\n"+
+		"gets the arguments: domain, record type (A or AAAA), and IP address, and\n"+
+		"the TTL in seconds in the DDNS_TTL env var.")
+	upgradeSocket := flags.String("upgrade_socket", "", ""+
+		"The path of a unix socket used to restart or upgrade portal without\n"+
+		"closing the ports. On SIGUSR2 portal starts a new process from its binary\n"+
+		"which takes over the listening sockets over this socket, and the old\n"+
+		"process drains and exits once the new one has loaded the state. When\n"+
+		"portal runs under spawn, send SIGUSR2 to spawn instead. Off when empty,\n"+
+		"put it somewhere only portal's user can write, e.g. next to -save_file.")
+	peerAddrs := flags.String("peers", "", ""+
+		"A comma separated list of the RPC addresses of other portal instances to\n"+
+		"share the registrations and certs with, so that clients can register with\n"+
+		"any of them and they all serve the same sites. Each entry is\n"+
+		"host:port#fingerprint where the fingerprint is logged by the peer when it\n"+
+		"starts, it's the sha256 of the public key in its -peer_key_file. Each\n"+
+		"instance should list all of the others. Requires -peer_token and\n"+
+		"-peer_key_file.")
+	peerToken := flags.String("peer_token", "", ""+
+		"A secret shared by all of the -peers that they use to authenticate each\n"+
+		"other. Note: each instance has its own API token, clients need the token\n"+
+		"of the one they connect to.")
+	peerKeyFile := flags.String("peer_key_file", "", ""+
+		"The path to the PEM private key this instance uses to prove who it is to\n"+
+		"the -peers. A new key is written there if the file doesn't exist.")
+	peerID := flags.String("peer_id", "", ""+
+		"The unique name of this instance for the -peers. The instance with the\n"+
+		"lowest ID that is up is the leader, which expires leases and renews the\n"+
+		"autocert certificates. Defaults to the hostname and -rpc_port.")
 	saveFilepath := flags.String("save_file", "state.protodata", ""+
 		"The path to the file to store active lease information in so that\n"+
 		"the portal server can safely restart without disrupting proxy service.\n")
+	stateKeyFile := flags.String("state_key_file", "", ""+
+		"The path to a file with a secret (such as a random string or passphrase)\n"+
+		"to encrypt the -save_file with, because it has the private keys for the\n"+
+		"TLS certs. Keep it somewhere other than the -save_file directory so that\n"+
+		"backups of it don't have the key. Set to \"spawn\" to use the last of the\n"+
+		"files passed in by spawn. If unset, the "+stateKeyEnv+" env var is used\n"+
+		"if set. An unencrypted -save_file is encrypted when portal starts.")
+	previousStateKeyFile := flags.String("previous_state_key_file", "", ""+
+		"To change the -state_key_file, set this to the old key file and portal\n"+
+		"re-encrypts the -save_file with the new key when it starts. If there's\n"+
+		"no new key, it's saved unencrypted. If unset, the "+previousStateKeyEnv+"\n"+
+		"env var is used if set.")
 	flags.Parse(args[1:])
-	kACMEAddress = *acmeAddress
+	acmeOpts, err := parseACMEOptions(*acmeAddress, *acmeEmail, *acmeEABKeyID, *acmeEABHMAC)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *adminURL != "" && *adminLogins == "" {
+		log.Fatal("-admin_logins is required to use -admin_url.")
+	}
+	var dns dnsProvider
+	switch *ddnsProvider {
+	case "":
+	case "rfc2136":
+		dns, err = newRFC2136Provider(*ddnsServer, *ddnsZone, *ddnsTSIGKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "exec":
+		if *ddnsExec == "" {
+			log.Fatal("-ddns_exec is required for the exec -ddns_provider.")
+		}
+		dns = execDNSProvider(*ddnsExec)
+	default:
+		log.Fatalf("Unknown -ddns_provider %#v, use rfc2136 or exec.", *ddnsProvider)
+	}
+	if len(ddnsDomains) == 0 {
+		ddnsDomains = domains
+	}
+	if len(rpcBindAddresses) == 0 {
+		rpcBindAddresses = bindAddresses
+	}
 
 	quit := make(chan struct{})
-	tools.CloseOnQuitSignals(quit)
+	reloadRoutes := make(chan struct{}, 1)
+	tools.CloseOnQuitSignalsOrReload(quit, func() {
+		select {
+		case reloadRoutes <- struct{}{}:
+		default:
+		}
+	})
 
 	// TODO: actually use ctx
 	go func() {
 		<-ctx.Done()
-		close(quit)
+		select {
+		case <-quit: // an upgrade already closed it
+		default:
+			close(quit)
+		}
 	}()
 
-	httpListener, httpsListener, err := openWebListeners(*httpPort, *httpsPort)
+	// When upgrading, this gets the listeners from the running portal. It also
+	// makes the running portal stop changing the state before we load it.
+	upgrader, err := newUpgrader(*upgradeSocket, quit)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
 
-	state := newStateManager(*saveFilepath)
+	httpListener, httpsListener, err := openWebListeners(bindAddresses, *httpPort, *httpsPort, upgrader)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *acceptProxyProtocol {
+		httpListener = &tools.ProxyProtocolListener{Listener: httpListener}
+		httpsListener = &tools.ProxyProtocolListener{Listener: httpsListener}
+	}
+
+	stateKey, err := loadStateKey(*stateKeyFile, stateKeyEnv)
+	if err != nil {
+		log.Fatalf("Failed to load the -state_key_file: %v", err)
+	}
+	previousStateKey, err := loadStateKey(*previousStateKeyFile, previousStateKeyEnv)
+	if err != nil {
+		log.Fatalf("Failed to load the -previous_state_key_file: %v", err)
+	}
+	state := newStateManager(*saveFilepath, stateKey, previousStateKey)
 	if err := state.Load(); err != nil {
-		if errors.Is(err, os.ErrNotExist) {
+		if errors.Is(err, stateKeyErr) {
+			// Don't overwrite it, it's probably just the wrong key
+			log.Fatalf("Failed to load state: %v", err)
+		} else if errors.Is(err, os.ErrNotExist) {
 			log.Printf("State file not found. It will be craeted at %v", *saveFilepath)
 		} else {
 			log.Print("Failed to load state:", err)
@@ -150,8 +414,43 @@ func Run(ctx context.Context, flags *flag.FlagSet, args []string) {
 		log.Printf("Successfully loaded state file (%v).", *saveFilepath)
 	}
 
+	// Set up the state replication with the other instances
+	challenges := &acmeChallenges{}
+	if *peerID == "" {
+		hostname, _ := os.Hostname()
+		*peerID = fmt.Sprintf("%v:%v", hostname, *rpcPort)
+	}
+	var peerList []string
+	for _, addr := range strings.Split(*peerAddrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			peerList = append(peerList, addr)
+		}
+	}
+	var peerKey crypto.Signer
+	if *peerKeyFile != "" {
+		peerKey, err = loadPeerKey(*peerKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load the -peer_key_file: %v", err)
+		}
+		publicKey, err := x509.MarshalPKIXPublicKey(peerKey.Public())
+		if err != nil {
+			log.Fatalf("Failed to load the -peer_key_file: %v", err)
+		}
+		log.Printf("The fingerprint for this instance in the -peers of the others is: %v",
+			peerFingerprint(publicKey))
+	}
+	peers, err := newPeerSync(*peerID, peerList, *peerToken, peerKey, state, challenges, quit)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	// Set up the new CA root cert for signing API client TLS certs
 	onCertRenew := func(cert *tls.Certificate) {
+		done, ok := upgrader.Busy()
+		if !ok {
+			return // The new portal has its own
+		}
+		defer done()
 		if err := state.SaveRootCA(cert.Certificate[0]); err != nil {
 			log.Print("Error saving new root CA, new backend connections may not work: ", err)
 		} else {
@@ -164,13 +463,36 @@ func Run(ctx context.Context, flags *flag.FlagSet, args []string) {
 		log.Fatalf("Failed to create a self signed certificate for the RPC server: %v", err)
 	}
 
-	challenges := &acmeChallenges{}
-	leasor := makeClientLeasor(uint16(*portRangeStart), uint16(*portRangeEnd), reservedPorts, quit)
+	errorPages, err := loadErrorPages(*errorPagesDir)
+	if err != nil {
+		log.Fatalf("Failed to load -error_pages: %v", err)
+	}
+
+	var cache *responseCache
+	if *cacheSize > 0 {
+		cache, err = newResponseCache(*cacheSize, *cacheMaxEntrySize, *cacheDir, *cacheDiskSize)
+		if err != nil {
+			log.Fatalf("Failed to start the response cache: %v", err)
+		}
+	}
+
+	leasor := makeClientLeasor(uint16(*portRangeStart), uint16(*portRangeEnd),
+		reservedPorts, peers.IsLeader, upgrader, quit)
+	drainer := &drainer{timeout: *drainTimeout}
+	proxyErrors := &proxyErrors{}
+	tlsPolicies := &tlsPolicies{}
+	if *tlsPolicyFile != "" {
+		if err := tlsPolicies.Load(*tlsPolicyFile); err != nil {
+			log.Fatalf("Error loading -tls_policy_file %v: %v", *tlsPolicyFile, err)
+		}
+		log.Printf("Loaded TLS policy file (%v).", *tlsPolicyFile)
+	}
 
 	httpProxy, err := makeHTTPProxy(leasor, rootCert,
 		httpListener, httpsListener,
 		*defaultHost, challenges, *certChallengeWebRoot,
-		state)
+		errorPages, *compress, *compressMinSize, cache, drainer, proxyErrors,
+		tlsPolicies, state)
 	if err != nil {
 		log.Fatalf("Failed to start HTTP proxy server: %v", err)
 	}
@@ -180,10 +502,18 @@ func Run(ctx context.Context, flags *flag.FlagSet, args []string) {
 
 	// Load the serving TLS certs.
 	// This may cause acme cert challenges over HTTP.
-	serveCert, err := loadTLSConfig(
+	certAlerts := newCertAlerts(*alertWebhook, *alertSMTPServer,
+		*alertEmailFrom, *alertEmailTo,
+		time.Duration(*alertExpiryDays)*24*time.Hour, *alertFailures)
+	var stapler *ocspStapler
+	if *ocspStapling {
+		stapler = newOCSPStapler()
+	}
+	serveCert, certRefresher, err := loadTLSConfig(
 		strings.Split(*tlsCertSpec, ","),
 		strings.Split(*tlsKeySpec, ","),
-		domains, challenges, state, quit)
+		domains, acmeOpts, challenges, state, peers.IsLeader, upgrader,
+		*stateKeyFile == spawnStateKeyFile, certAlerts, stapler, quit)
 	if err != nil {
 		log.Fatalf("Failed to load TLS config: %v", err)
 	} else {
@@ -192,31 +522,114 @@ func Run(ctx context.Context, flags *flag.FlagSet, args []string) {
 
 	// Doesn't actually do anything until there are registrations (there are no
 	// ports to open if clients haven't requested any)
-	tcpProxy := makeTCPProxy(leasor, serveCert, quit)
+	tcpProxy := makeTCPProxy(leasor, serveCert, bindAddresses, *acceptProxyProtocol,
+		drainer, proxyErrors, upgrader, quit)
+	udpProxy := makeUDPProxy(leasor, serveCert, bindAddresses,
+		*udpSessionTimeout, *udpMaxSessions, upgrader, quit)
+	sniProxy := makeSNIProxy(leasor, drainer)
 
 	// Starts serving the rpc server port.
 	// First loads the registrations from the state into the two proxy servers.
-	_, err = startRPCServer(leasor,
-		tcpProxy, httpProxy, *rpcPort,
-		rootCert, state, quit)
+	rpcServ, err := startRPCServer(leasor,
+		tcpProxy, udpProxy, sniProxy, httpProxy, rpcBindAddresses, *rpcPort,
+		rootCert, state, peers, upgrader, quit)
 	if err != nil {
 		log.Fatal("Failed to start RPC server:", err)
 	} else {
 		log.Print("Started rpc server on port ", *rpcPort)
 	}
+	var rpcSocketStopped chan struct{}
+	if *rpcSocket != "" {
+		rpcSocketStopped, err = startRPCSocket(*rpcSocket, rpcServ, upgrader, quit)
+		if err != nil {
+			log.Print("Failed to start the -rpc_socket: ", err)
+		} else {
+			log.Print("Started rpc server on unix socket ", *rpcSocket)
+		}
+	}
+
+	if *routesFile != "" {
+		if err := rpcServ.LoadRoutes(*routesFile); err != nil {
+			log.Printf("Error loading -routes_file %v: %v", *routesFile, err)
+		} else {
+			log.Printf("Loaded routes file (%v).", *routesFile)
+		}
+	}
+	go func() {
+		for {
+			select {
+			case <-quit:
+				return
+			case <-reloadRoutes:
+			}
+			if *tlsPolicyFile != "" {
+				if err := tlsPolicies.Load(*tlsPolicyFile); err != nil {
+					log.Printf("Error reloading -tls_policy_file %v: %v", *tlsPolicyFile, err)
+				} else {
+					log.Printf("Reloaded TLS policy file (%v).", *tlsPolicyFile)
+				}
+			}
+			if *routesFile == "" {
+				continue
+			}
+			if err := rpcServ.LoadRoutes(*routesFile); err != nil {
+				log.Printf("Error reloading -routes_file %v: %v", *routesFile, err)
+			} else {
+				log.Printf("Reloaded routes file (%v).", *routesFile)
+			}
+		}
+	}()
+
+	if *adminURL != "" {
+		err := startAdminPage(*adminURL, *adminLogins, rpcServ, certRefresher, proxyErrors)
+		if err != nil {
+			log.Print("Failed to start the admin page: ", err)
+		} else {
+			log.Print("Serving the admin page on ", *adminURL)
+		}
+	}
 
 	// Wait until after we have loaded the registrations so we don't serve a bunch
 	// of 404s during startup
-	httpProxy.StartHTTPS(serveCert, quit)
+	httpProxy.StartHTTPS(serveCert, sniProxy, quit)
 	log.Print("Started HTTPS proxy server")
 
+	if http3Conns, err := openHTTP3Conns(bindAddresses, *http3Port, upgrader); err != nil {
+		log.Printf("Failed to start HTTP/3: %v", err)
+	} else if http3Conns != nil {
+		httpProxy.StartHTTP3(serveCert, http3Conns, quit)
+		log.Print("Started HTTP/3 proxy server on udp port ",
+			http3Conns[0].LocalAddr().(*net.UDPAddr).Port)
+	}
+
+	if dns != nil {
+		ddns, err := newDDNSUpdater(dns, *ddnsIPSource, ddnsDomains, *ddnsTTL, peers.IsLeader)
+		if err != nil {
+			log.Fatalf("Failed to start dynamic DNS: %v", err)
+		}
+		go ddns.Run(*ddnsInterval, quit)
+		log.Printf("Started dynamic DNS for %v", strings.Join(ddnsDomains, ", "))
+	}
+
 	// Spawn looks for this string to know when portal has started. So we need to
 	// have the API port listening before we print this.
 	//
 	// If this changes you have to update the string in spawn so it can find it
 	log.Printf("**** Portal API token: %v ****", state.Token())
 
+	// If we're upgrading, the old portal drains and exits now
+	upgrader.Ready()
+
 	<-quit // Wait for quit
+
+	// Let the requests and connections in progress finish
+	httpProxy.DrainAll()
+	tcpProxy.DrainAll()
+	sniProxy.DrainAll()
+	drainer.Wait()
+	if rpcSocketStopped != nil {
+		<-rpcSocketStopped // Removes the socket file
+	}
 }
 
 type autocertDomains []string
@@ -281,7 +694,18 @@ func (l portList) Set(in string) error {
 	return nil
 }
 
-func openWebListeners(httpPort, httpsPort int) (httpListener net.Listener, httpsListener net.Listener, err error) {
+func openWebListeners(addrs bindAddrs, httpPort, httpsPort int, upgrader *upgrader) (httpListener net.Listener, httpsListener net.Listener, err error) {
+	// Use the listeners from the old portal if we're upgrading
+	if len(addrs) == 0 {
+		httpListener = upgrader.Listener("http")
+		httpsListener = upgrader.Listener("https")
+		if httpListener != nil && httpsListener != nil {
+			upgrader.Track("http", httpListener)
+			upgrader.Track("https", httpsListener)
+			return httpListener, httpsListener, nil
+		}
+	}
+
 	// Read 2 ports passed in from spawn, in either order
 	spawnPorts, _ := strconv.Atoi(os.Getenv("SPAWN_PORTS"))
 	if spawnPorts > 0 {
@@ -309,27 +733,47 @@ func openWebListeners(httpPort, httpsPort int) (httpListener net.Listener, https
 
 	// If we didn't get passed in ports from spawn try just listening ourselves
 	if httpListener == nil {
-		httpListener, err = listenerFromPortOrFD(httpPort)
+		httpListener, err = listenTCP(upgrader, "http", addrs, httpPort)
 		if err != nil {
 			return nil, nil, fmt.Errorf("Failed to listen on http port (%v): %v", httpPort, err)
 		}
+	} else {
+		upgrader.Track("http", httpListener)
 	}
 	if httpsListener == nil {
-		httpsListener, err = listenerFromPortOrFD(httpsPort)
+		httpsListener, err = listenTCP(upgrader, "https", addrs, httpsPort)
 		if err != nil {
 			return nil, nil, fmt.Errorf("Failed to listen on https port (%v): %v", httpsPort, err)
 		}
+	} else {
+		upgrader.Track("https", httpsListener)
 	}
 	return httpListener, httpsListener, nil
 }
 
-func listenerFromPortOrFD(portOrFD int) (net.Listener, error) {
-	if portOrFD < 0 {
-		fdFile := os.NewFile(uintptr(-portOrFD), "fd")
-		if fdFile == nil {
-			return nil, fmt.Errorf("file descriptor %v is not valid.", -portOrFD)
-		}
-		return net.FileListener(fdFile)
+// openHTTP3Conns returns the UDP sockets from the old portal when upgrading or
+// passed in from spawn if there is one, otherwise it listens on the port at
+// each of the addrs. Returns nil if there's no socket from spawn and the port
+// is 0.
+func openHTTP3Conns(addrs bindAddrs, http3Port int, upgrader *upgrader) ([]net.PacketConn, error) {
+	if conn := upgrader.PacketConn("http3"); conn != nil {
+		upgrader.Track("http3", conn)
+		return []net.PacketConn{conn}, nil
+	}
+	spawnPorts, _ := strconv.Atoi(os.Getenv("SPAWN_PORTS"))
+	spawnFiles, _ := strconv.Atoi(os.Getenv("SPAWN_FILES"))
+	spawnUDPPorts, _ := strconv.Atoi(os.Getenv("SPAWN_UDP_PORTS"))
+	if spawnUDPPorts > 0 {
+		// 3 is stdin, stdout, stderr
+		fd := 3 + spawnPorts + spawnFiles
+		return listenUDP(upgrader, "http3", nil, -fd)
+	}
+	if http3Port == 0 {
+		return nil, nil
+	}
+	conns, err := listenUDP(upgrader, "http3", addrs, http3Port)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on http3 udp port (%v): %v", http3Port, err)
 	}
-	return net.Listen("tcp", fmt.Sprintf(":%v", portOrFD))
+	return conns, nil
 }
@@ -0,0 +1,177 @@
+package embedportal
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"ask.systems/daemon/internal/portalpb"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+// The lease timeout used for pinned routes from the -routes_file so that they
+// never expire
+var pinnedTimeout = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// The address used for pinned routes that don't set a hostname, because
+// there's no RPC client to forward to.
+const pinnedDefaultAddress = "127.0.0.1"
+
+// pinnedRoute is the value type of rpcServ.pinned
+type pinnedRoute struct {
+	Request *portalpb.RegisterRequest
+	Lease   *portalpb.Lease
+}
+
+func readRoutesFile(filename string) (*portalpb.Routes, error) {
+	text, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	routes := &portalpb.Routes{}
+	if err := prototext.Unmarshal(text, routes); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+func pinnedAddress(request *portalpb.RegisterRequest) (string, error) {
+	if request.Hostname == "" {
+		return pinnedDefaultAddress, nil
+	}
+	ipAddrs, err := net.LookupIP(request.Hostname)
+	if err != nil || len(ipAddrs) < 1 {
+		return "", fmt.Errorf("Failed to resolve hostname to an IP: %v", err)
+	}
+	return ipAddrs[0].String(), nil
+}
+
+// LoadRoutes registers the routes in the routes file as pinned registrations
+// and unregisters any pinned registrations no longer in the file.
+//
+// Routes that didn't change are left alone so reloading doesn't interrupt
+// them. If a changed route fails to register the old one is kept.
+func (s *rpcServ) LoadRoutes(filename string) error {
+	routes, err := readRoutesFile(filename)
+	if err != nil {
+		return err
+	}
+	s.pinnedMut.Lock()
+	defer s.pinnedMut.Unlock()
+
+	inFile := make(map[string]bool)
+	errCount := 0
+	for i, request := range routes.Route {
+		if inFile[request.Pattern] {
+			log.Printf("Routes file entry #%v: duplicate pattern %#v, skipping.",
+				i+1, request.Pattern)
+			errCount++
+			continue
+		}
+		inFile[request.Pattern] = true
+		var old *pinnedRoute
+		if val, ok := s.pinned.Load(request.Pattern); ok {
+			old = val.(*pinnedRoute)
+			if proto.Equal(old.Request, request) {
+				continue
+			}
+		}
+		// Check the new entry before taking down the old route for it
+		addr, err := checkPinned(request)
+		if err == nil {
+			if old != nil {
+				s.unregisterPinned(old)
+			}
+			err = s.registerPinned(addr, request)
+		}
+		if err == nil {
+			continue
+		}
+		errCount++
+		if old == nil {
+			log.Printf("Routes file entry #%v (%v) failed: %v", i+1, request.Pattern, err)
+			continue
+		}
+		log.Printf("Routes file entry #%v (%v) failed, keeping the old route: %v", i+1, request.Pattern, err)
+		if _, ok := s.pinned.Load(request.Pattern); !ok {
+			if err := s.registerPinned(old.Lease.Address, old.Request); err != nil {
+				log.Printf("Failed to restore the old route for %v: %v", request.Pattern, err)
+			}
+		}
+	}
+	s.pinned.Range(func(key, value any) bool {
+		if !inFile[key.(string)] {
+			s.unregisterPinned(value.(*pinnedRoute))
+			s.clearMaintenance(key.(string))
+		}
+		return true
+	})
+	if errCount > 0 {
+		return fmt.Errorf("%v of %v routes failed to load", errCount, len(routes.Route))
+	}
+	return nil
+}
+
+// checkPinned returns an error if the route can't be pinned, otherwise the
+// address to register it for.
+func checkPinned(request *portalpb.RegisterRequest) (string, error) {
+	if request.FixedPort == 0 && usesPort(request) {
+		return "", fmt.Errorf("fixed_port or unix_socket is required for pinned routes.")
+	}
+	if len(request.CertificateRequest) != 0 {
+		return "", fmt.Errorf("certificate_request is not supported for pinned routes.")
+	}
+	if isDirectResponse(request) {
+		if _, err := makeDirectResponseHandler(request.Pattern, request); err != nil {
+			return "", err
+		}
+	}
+	return pinnedAddress(request)
+}
+
+// registerPinned registers the route for the address from checkPinned.
+//
+// You must hold pinnedMut
+func (s *rpcServ) registerPinned(addr string, request *portalpb.RegisterRequest) error {
+	lease, err := s.internalRegister(addr, request, pinnedTimeout)
+	if err != nil {
+		return err
+	}
+	if err := s.state.SaveRegistration(&portalpb.Registration{
+		Request: request,
+		Lease:   lease,
+		Pinned:  true,
+	}); err != nil {
+		s.clientLeasor.PortLeasorForClient(addr).Unregister(lease)
+		return err
+	}
+	s.pinned.Store(request.Pattern, &pinnedRoute{
+		Request: request,
+		Lease:   lease,
+	})
+	log.Printf("Pinned route registered: %v", leaseString(lease))
+	return nil
+}
+
+// You must hold pinnedMut
+func (s *rpcServ) unregisterPinned(route *pinnedRoute) {
+	s.pinned.Delete(route.Request.Pattern)
+	leasor := s.clientLeasor.PortLeasorForClient(route.Lease.Address)
+	// This calls the onCancel functions which remove it from the state
+	if err := leasor.Unregister(route.Lease); err != nil {
+		log.Printf("Failed to unregister pinned route %v: %v", route.Request.Pattern, err)
+		return
+	}
+	log.Printf("Pinned route unregistered: %v", leaseString(route.Lease))
+}
+
+// isPinned returns true if the pattern belongs to a route from the routes
+// file, which clients are not allowed to modify. Hold pinnedMut until the
+// lease change is done.
+func (s *rpcServ) isPinned(pattern string) bool {
+	_, ok := s.pinned.Load(pattern)
+	return ok
+}
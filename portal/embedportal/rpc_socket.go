@@ -0,0 +1,183 @@
+package embedportal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"ask.systems/daemon/internal/portalpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// The permissions of the -rpc_socket file. Only portal's user and group can
+// connect.
+const rpcSocketMode = 0660
+
+// unixCreds are the gRPC transport credentials for the -rpc_socket. There is no
+// TLS or API token, the socket file permissions decide who can connect.
+type unixCreds struct{}
+
+// unixAuthInfo identifies the process on the other end of a -rpc_socket
+// connection, if the OS supports it.
+type unixAuthInfo struct {
+	credentials.CommonAuthInfo
+	Known         bool
+	PID, UID, GID int
+}
+
+func (unixAuthInfo) AuthType() string {
+	return "unix"
+}
+
+func (info unixAuthInfo) String() string {
+	if !info.Known {
+		return "an unknown process"
+	}
+	return fmt.Sprintf("pid %v (uid %v, gid %v)", info.PID, info.UID, info.GID)
+}
+
+func (unixCreds) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	info := unixAuthInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{
+			SecurityLevel: credentials.PrivacyAndIntegrity,
+		},
+	}
+	if uc, ok := conn.(*net.UnixConn); ok {
+		info.PID, info.UID, info.GID, info.Known = peerCredentials(uc)
+	}
+	return conn, info, nil
+}
+
+func (unixCreds) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("unixCreds is only for the server")
+}
+
+func (unixCreds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "unix"}
+}
+
+func (c unixCreds) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (unixCreds) OverrideServerName(string) error {
+	return nil
+}
+
+// rpcClientAddress returns the IP address of the RPC client. The clients of
+// the -rpc_socket are on the same machine.
+func rpcClientAddress(p *peer.Peer) (string, error) {
+	if p.Addr.Network() == "unix" {
+		return "127.0.0.1", nil
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	return host, err
+}
+
+// isLocalClient returns true if the RPC client is on the same machine as
+// portal, connected to the -rpc_socket or a loopback address.
+func isLocalClient(p *peer.Peer) bool {
+	if p.Addr.Network() == "unix" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// startRPCSocket serves the Portal RPCs on the unix socket at the path,
+// without the API token. The returned channel is closed after quit once the
+// socket is closed.
+func startRPCSocket(path string, s *rpcServ, upgrader *upgrader, quit chan struct{}) (chan struct{}, error) {
+	l, err := listenRPCSocket(path, upgrader)
+	if err != nil {
+		return nil, err
+	}
+	upgrader.Track("rpc_socket", l)
+	server := grpc.NewServer(
+		grpc.Creds(unixCreds{}),
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{},
+			info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+			// Don't change the state while a new portal is taking over
+			if err := upgrader.Hold(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+	)
+	portalpb.RegisterPortalServer(server, s)
+	go func() {
+		server.Serve(l) // logs any errors itself instead of returning
+		select {
+		case <-quit:
+		default:
+			log.Print("The -rpc_socket server died, clients must use the RPC port.")
+		}
+	}()
+	stopped := make(chan struct{})
+	go func() {
+		<-quit
+		server.GracefulStop()
+		l.Close()
+		// The listener doesn't unlink the file because it was moved there
+		if !upgrader.Upgraded() {
+			os.Remove(path)
+		}
+		close(stopped)
+	}()
+	return stopped, nil
+}
+
+// listenRPCSocket uses the socket from the old portal or listens on the path,
+// replacing the file if no one is listening on it.
+func listenRPCSocket(path string, upgrader *upgrader) (*net.UnixListener, error) {
+	if l := upgrader.Listener("rpc_socket"); l != nil {
+		if ul, ok := l.(*net.UnixListener); ok {
+			// startRPCSocket removes the file
+			ul.SetUnlinkOnClose(false)
+			return ul, nil
+		}
+		l.Close()
+	}
+	addr := &net.UnixAddr{Name: path, Net: "unix"}
+	if _, err := os.Lstat(path); err == nil {
+		if conn, dialErr := net.DialUnix("unix", nil, addr); dialErr == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Another process is listening on the -rpc_socket %v", path)
+		}
+		// Left over from a portal that didn't shut down cleanly
+		os.Remove(path)
+	}
+	// The socket is created with the umask permissions, so create it in a
+	// directory only we can open and move it into place after the chmod.
+	// Otherwise there's a moment where anyone could connect.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".portal")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on the -rpc_socket %v: %w", path, err)
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on the -rpc_socket %v: %w", path, err)
+	}
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmpPath, rpcSocketMode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("Failed to set the -rpc_socket permissions: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("Failed to listen on the -rpc_socket %v: %w", path, err)
+	}
+	return l, nil
+}
@@ -0,0 +1,24 @@
+package embedportal
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredentials returns the process ID, user ID, and group ID of the process
+// that connected to the unix socket.
+func peerCredentials(conn *net.UnixConn) (pid, uid, gid int, ok bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return 0, 0, 0, false
+	}
+	return int(cred.Pid), int(cred.Uid), int(cred.Gid), true
+}
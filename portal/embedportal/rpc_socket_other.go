@@ -0,0 +1,11 @@
+//go:build !linux
+
+package embedportal
+
+import "net"
+
+// peerCredentials isn't supported on this OS, so the -rpc_socket clients are
+// logged as unknown.
+func peerCredentials(conn *net.UnixConn) (pid, uid, gid int, ok bool) {
+	return 0, 0, 0, false
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"ask.systems/daemon/internal/portalpb"
@@ -30,16 +31,30 @@ type rpcServ struct {
 
 	clientLeasor *clientLeasor
 	tcpProxy     *tcpProxy
+	udpProxy     *udpProxy
+	sniProxy     *sniProxy
 	httpProxy    *httpProxy
 	rootCert     *tls.Config
 	state        *stateManager
 	quit         chan struct{}
+
+	// Map from pattern to *pinnedRoute for the routes from the routes file
+	pinned sync.Map
+	// Written while loading the routes file. Read while clients change leases,
+	// so a reload can't happen between the isPinned check and the change.
+	pinnedMut sync.RWMutex
 }
 
 func (s *rpcServ) loadRegistrations() {
 	attempted := 0
 	loaded := 0
+	var pinned []*portalpb.Lease
 	s.state.ForEachRegistration(func(registration *portalpb.Registration) {
+		if registration.Pinned {
+			// These are re-registered from the routes file, if they're still there
+			pinned = append(pinned, registration.Lease)
+			return
+		}
 		attempted += 1
 		if registration.Request.FixedPort == 0 {
 			// Request a new lease for the port we had before if the original request
@@ -66,32 +81,60 @@ func (s *rpcServ) loadRegistrations() {
 	if attempted > 0 {
 		log.Printf("Successfully loaded %v/%v saved registrations", loaded, attempted)
 	}
+	for _, lease := range pinned {
+		s.state.Unregister(lease)
+	}
 }
 
 func (s *rpcServ) MyHostname(ctx context.Context, empty *emptypb.Empty) (*portalpb.Hostname, error) {
 	p, _ := peer.FromContext(ctx)
-	clientAddr, _, err := net.SplitHostPort(p.Addr.String())
+	clientAddr, err := rpcClientAddress(p)
 	if err != nil {
 		return nil, err
 	}
+	// Bracket IPv6 addresses so clients can add a port
+	if strings.Contains(clientAddr, ":") {
+		clientAddr = "[" + clientAddr + "]"
+	}
 	return &portalpb.Hostname{Hostname: clientAddr}, nil
 }
 
 // Register registers a new forwarding rule to the rpc client's ip address.
 // Randomly assigns port for the client to listen on
 func (s *rpcServ) Register(ctx context.Context, request *portalpb.RegisterRequest) (*portalpb.Lease, error) {
+	s.pinnedMut.RLock()
+	defer s.pinnedMut.RUnlock()
+	if s.isPinned(request.Pattern) {
+		return nil, status.Errorf(codes.PermissionDenied,
+			"Pattern %#v is pinned by the portal routes file.", request.Pattern)
+	}
 	// Get the RPC client's address (without the port) from gRPC
 	p, _ := peer.FromContext(ctx)
+	if info, ok := p.AuthInfo.(unixAuthInfo); ok {
+		log.Printf("Registration for %#v from the -rpc_socket by %v", request.Pattern, info)
+	}
+
+	if isDirectResponse(request) {
+		if _, err := makeDirectResponseHandler(request.Pattern, request); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if request.UnixSocket != "" && !isLocalClient(p) {
+		return nil, status.Error(codes.PermissionDenied,
+			"unix_socket backends can only be registered from the portal machine.")
+	}
 
 	var clientAddr string
 	if request.Hostname == "" {
 		var err error
-		clientAddr, _, err = net.SplitHostPort(p.Addr.String())
+		clientAddr, err = rpcClientAddress(p)
 		if err != nil {
 			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
 	} else {
-		ipAddrs, err := net.LookupIP(request.Hostname)
+		// Accept bracketed IPv6 addresses, like from MyHostname
+		hostname := strings.TrimSuffix(strings.TrimPrefix(request.Hostname, "["), "]")
+		ipAddrs, err := net.LookupIP(hostname)
 		if err != nil || len(ipAddrs) < 1 {
 			return nil, status.Errorf(codes.InvalidArgument,
 				"Failed to resolve request.Hostname to an IP: %v", err)
@@ -134,8 +177,18 @@ func (s *rpcServ) Register(ctx context.Context, request *portalpb.RegisterReques
 }
 
 func (s *rpcServ) internalRegister(clientAddr string, request *portalpb.RegisterRequest, fixedTimeout time.Time) (lease *portalpb.Lease, err error) {
+	if request.ProxyProtocol > 2 {
+		return nil, fmt.Errorf("Unsupported PROXY protocol version: %v", request.ProxyProtocol)
+	}
+	if err := checkUnixSocket(request); err != nil {
+		return nil, err
+	}
 	if strings.HasPrefix(request.Pattern, tcpProxyPrefix) {
 		lease, err = s.tcpProxy.Register(clientAddr, request, fixedTimeout)
+	} else if strings.HasPrefix(request.Pattern, udpProxyPrefix) {
+		lease, err = s.udpProxy.Register(clientAddr, request, fixedTimeout)
+	} else if strings.HasPrefix(request.Pattern, sniProxyPrefix) {
+		lease, err = s.sniProxy.Register(clientAddr, request, fixedTimeout)
 	} else {
 		lease, err = s.httpProxy.Register(clientAddr, request, fixedTimeout)
 	}
@@ -161,8 +214,73 @@ func (s *rpcServ) signCert(request *portalpb.RegisterRequest, lease *portalpb.Le
 	return nil
 }
 
+// leaseCanceled removes the registration from the state when its lease is
+// unregistered, replaced, or expires. Expired leases also turn off maintenance
+// mode for the pattern.
+func (s *rpcServ) leaseCanceled(lease *portalpb.Lease) {
+	s.state.Unregister(lease)
+	if time.Now().After(lease.Timeout.AsTime()) {
+		s.clearMaintenance(lease.Pattern)
+	}
+}
+
+// clearMaintenance turns off maintenance mode for a pattern that is no longer
+// registered, so it doesn't stay in the state forever. Replacing a lease
+// doesn't call this, so backends can re-register while in maintenance.
+func (s *rpcServ) clearMaintenance(pattern string) {
+	off := &portalpb.MaintenanceRequest{Pattern: pattern}
+	s.httpProxy.SetMaintenance(off)
+	s.state.SaveMaintenance(off)
+}
+
+// SetMaintenance turns maintenance mode on or off for an HTTP pattern
+func (s *rpcServ) SetMaintenance(ctx context.Context, request *portalpb.MaintenanceRequest) (*portalpb.MaintenanceRequest, error) {
+	if strings.HasPrefix(request.Pattern, tcpProxyPrefix) ||
+		strings.HasPrefix(request.Pattern, udpProxyPrefix) ||
+		strings.HasPrefix(request.Pattern, sniProxyPrefix) {
+		return nil, status.Error(codes.InvalidArgument,
+			"Maintenance mode is only supported for HTTP patterns.")
+	}
+	// Only check for enabling so that you can always turn it off, even if the
+	// lease has expired in the meantime.
+	if request.Enabled && !s.httpProxy.IsRegistered(request.Pattern) {
+		return nil, status.Errorf(codes.NotFound,
+			"No registration found for pattern %#v", request.Pattern)
+	}
+	s.httpProxy.SetMaintenance(request)
+	s.state.SaveMaintenance(request)
+	if request.Enabled {
+		log.Printf("Maintenance mode on for pattern: %v", request.Pattern)
+	} else {
+		log.Printf("Maintenance mode off for pattern: %v", request.Pattern)
+	}
+	return request, nil
+}
+
+// Purge removes responses from the HTTP response cache
+func (s *rpcServ) Purge(ctx context.Context, request *portalpb.PurgeRequest) (*portalpb.PurgeResponse, error) {
+	if request.Pattern == "" && request.UrlPrefix == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"One of pattern or url_prefix is required.")
+	}
+	if s.httpProxy.cache == nil {
+		return nil, status.Error(codes.FailedPrecondition,
+			"The response cache is turned off with -cache_size=0.")
+	}
+	count := s.httpProxy.cache.Purge(request.Pattern, request.UrlPrefix)
+	log.Printf("Purged %v cached responses (pattern: %#v, url_prefix: %#v)",
+		count, request.Pattern, request.UrlPrefix)
+	return &portalpb.PurgeResponse{Purged: uint32(count)}, nil
+}
+
 // Unregister unregisters the forwarding rule with the given pattern
 func (s *rpcServ) Unregister(ctx context.Context, lease *portalpb.Lease) (*portalpb.Lease, error) {
+	s.pinnedMut.RLock()
+	defer s.pinnedMut.RUnlock()
+	if s.isPinned(lease.Pattern) {
+		return nil, status.Errorf(codes.PermissionDenied,
+			"Pattern %#v is pinned by the portal routes file.", lease.Pattern)
+	}
 	leasor := s.clientLeasor.PortLeasorForClient(lease.Address)
 	err := leasor.Unregister(lease)
 	if err != nil {
@@ -176,14 +294,21 @@ func (s *rpcServ) Unregister(ctx context.Context, lease *portalpb.Lease) (*porta
 	}
 	log.Printf("Unregistered rule with pattern: %v", lease.Pattern)
 	s.state.Unregister(lease)
+	s.clearMaintenance(lease.Pattern)
 	lease.Timeout = timestamppb.Now()
 	return lease, nil
 }
 
 // Renew renews the lease on a currently registered pattern
 func (s *rpcServ) Renew(ctx context.Context, lease *portalpb.Lease) (*portalpb.Lease, error) {
+	s.pinnedMut.RLock()
+	defer s.pinnedMut.RUnlock()
+	if s.isPinned(lease.Pattern) {
+		return nil, status.Errorf(codes.PermissionDenied,
+			"Pattern %#v is pinned by the portal routes file.", lease.Pattern)
+	}
 	leasor := s.clientLeasor.PortLeasorForClient(lease.Address)
-	newLease, err := leasor.Renew(lease)
+	newLease, err := leasor.Renew(lease, time.Time{})
 	if err != nil {
 		log.Print(err)
 		if errors.Is(err, UnregisteredErr) {
@@ -218,20 +343,27 @@ func (s *rpcServ) Renew(ctx context.Context, lease *portalpb.Lease) (*portalpb.L
 
 // StartNew creates a new RPCServ and starts it
 func startRPCServer(clientLeasor *clientLeasor,
-	tcpProxy *tcpProxy, httpProxy *httpProxy,
-	port int, rootCert *tls.Config,
-	state *stateManager, quit chan struct{}) (*rpcServ, error) {
+	tcpProxy *tcpProxy, udpProxy *udpProxy, sniProxy *sniProxy,
+	httpProxy *httpProxy,
+	addrs bindAddrs, port int, rootCert *tls.Config,
+	state *stateManager, peers *peerSync, upgrader *upgrader,
+	quit chan struct{}) (*rpcServ, error) {
 
 	s := &rpcServ{
 		clientLeasor: clientLeasor,
 		state:        state,
 		tcpProxy:     tcpProxy,
+		udpProxy:     udpProxy,
+		sniProxy:     sniProxy,
 		httpProxy:    httpProxy,
 		quit:         quit,
 		rootCert:     rootCert,
 	}
-	clientLeasor.OnCancel(s.state.Unregister)
+	clientLeasor.OnCancel(s.leaseCanceled)
 	s.loadRegistrations()
+	s.state.ForEachMaintenance(s.httpProxy.SetMaintenance)
+	// After loading so the peers get all of our state
+	peers.Start(s)
 	server := grpc.NewServer(
 		// TODO: Have a flag like -internet_accessable_rpc which makes the RPC
 		// server use the web server cert, and make the portal client library verify
@@ -239,9 +371,13 @@ func startRPCServer(clientLeasor *clientLeasor,
 		// for sure talking to your portal server when it's not just on a local
 		// network, in which case authenticating the server is good so that we don't
 		// send our auth token to a MITM attacker.
-		grpc.Creds(credentials.NewTLS(rootCert)),
+		grpc.Creds(credentials.NewTLS(peers.ServerTLSConfig(rootCert))),
 		grpc.UnaryInterceptor(func(ctx context.Context, req interface{},
 			info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+			// Don't change the state while a new portal is taking over
+			if err := upgrader.Hold(ctx); err != nil {
+				return nil, err
+			}
 			md, ok := metadata.FromIncomingContext(ctx)
 			noTokenErr := grpc.Errorf(codes.Unauthenticated, "A metadata authorization token must be presented")
 			if !ok {
@@ -256,9 +392,19 @@ func startRPCServer(clientLeasor *clientLeasor,
 			}
 			return handler(ctx, req)
 		}),
+		// The only streaming RPC is PortalPeer.Replicate, which uses the
+		// -peer_token instead of the API token
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream,
+			info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := peers.Authorize(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
 	)
 	portalpb.RegisterPortalServer(server, s)
-	l, err := listenerFromPortOrFD(port)
+	portalpb.RegisterPortalPeerServer(server, peers)
+	l, err := listenTCP(upgrader, "rpc", addrs, port)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to start listener: %v", err)
 	}
@@ -0,0 +1,283 @@
+package embedportal
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"ask.systems/daemon/internal/portalpb"
+)
+
+// The RegisterRequest.Pattern prefix for TLS passthrough on the HTTPS port
+const sniProxyPrefix = ":sni:"
+
+// How long clients have to send the TLS ClientHello before we close the
+// connection
+const clientHelloTimeout = 10 * time.Second
+
+// sniProxy forwards the raw TLS connections on the HTTPS port to the backends
+// for ":sni:hostname" patterns without decrypting them, based on the server
+// name in the ClientHello. The backend terminates TLS itself. Connections for
+// all other hostnames are served by the httpProxy.
+type sniProxy struct {
+	clientLeasor *clientLeasor
+	// Lets connections finish when leases are unregistered
+	drainer *drainer
+	// Map from lowercase hostname to *sniLease
+	leases sync.Map
+}
+
+type sniLease struct {
+	Lease         *portalpb.Lease
+	ServerAddress string
+	// The PROXY protocol version to send to the backend, or 0 for none
+	ProxyProtocol int
+	Drain         *drainGroup
+}
+
+func makeSNIProxy(l *clientLeasor, drainer *drainer) *sniProxy {
+	p := &sniProxy{
+		clientLeasor: l,
+		drainer:      drainer,
+	}
+	l.OnCancel(p.Unregister)
+	return p
+}
+
+func sniHostname(pattern string) string {
+	return strings.ToLower(strings.TrimPrefix(pattern, sniProxyPrefix))
+}
+
+func (p *sniProxy) Unregister(lease *portalpb.Lease) {
+	if !strings.HasPrefix(lease.GetPattern(), sniProxyPrefix) {
+		return
+	}
+	val, _ := p.leases.LoadAndDelete(sniHostname(lease.Pattern))
+	if l, ok := val.(*sniLease); ok {
+		p.drainer.Drain(l.Drain, lease.Pattern)
+	}
+}
+
+// DrainAll lets the open connections for all the leases finish, up to the
+// drain timeout, then closes them. Used when portal shuts down.
+func (p *sniProxy) DrainAll() {
+	p.leases.Range(func(key, value any) bool {
+		l := value.(*sniLease)
+		p.drainer.Drain(l.Drain, l.Lease.Pattern)
+		return true
+	})
+}
+
+func (p *sniProxy) Register(clientAddr string, request *portalpb.RegisterRequest, fixedTimeout time.Time) (*portalpb.Lease, error) {
+	if isDirectResponse(request) {
+		return nil, fmt.Errorf("Redirects and static responses are only supported for HTTP patterns.")
+	}
+	host := sniHostname(request.Pattern)
+	if host == "" || strings.ContainsAny(host, "/:") {
+		return nil, fmt.Errorf("Invalid TLS passthrough pattern %#v, it must be %vhostname", request.Pattern, sniProxyPrefix)
+	}
+	leasor := p.clientLeasor.PortLeasorForClient(clientAddr)
+
+	val, _ := p.leases.Load(host)
+	if l, ok := val.(*sniLease); ok && l != nil {
+		log.Printf("Replacing existing lease with the same pattern: %#v", request.Pattern)
+		leasor.Unregister(l.Lease) // calls sniProxy.Unregister
+	}
+
+	lease, err := leasor.Register(request, fixedTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var backend string
+	if request.Hostname != "" {
+		backend = request.Hostname
+	} else {
+		backend = clientAddr
+	}
+	serverAddress := backendAddress(backend, lease.Port)
+	p.leases.Store(host, &sniLease{
+		Lease:         lease,
+		ServerAddress: serverAddress,
+		ProxyProtocol: int(request.ProxyProtocol),
+		Drain:         newDrainGroup(),
+	})
+	log.Printf("Registered TLS passthrough forwarding %v to %v.", host, serverAddress)
+	return lease, nil
+}
+
+// Listener returns a listener for the HTTPS server that accepts the
+// connections from the httpsList that are not for a TLS passthrough hostname.
+// The passthrough connections are forwarded to their backend.
+func (p *sniProxy) Listener(httpsList net.Listener) net.Listener {
+	l := &sniListener{
+		Listener: httpsList,
+		proxy:    p,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// sniListener is the net.Listener for the httpProxy HTTPS server returned by
+// [sniProxy.Listener]
+type sniListener struct {
+	net.Listener
+	proxy *sniProxy
+	conns chan net.Conn
+
+	done      chan struct{}
+	err       error // set before done is closed
+	closeOnce sync.Once
+}
+
+func (l *sniListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			l.closeOnce.Do(func() {
+				l.err = err
+				close(l.done)
+			})
+			return
+		}
+		go l.route(conn)
+	}
+}
+
+// route reads the ClientHello and either forwards the connection to a
+// passthrough backend or hands it to the HTTPS server.
+func (l *sniListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, peeked, err := peekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	replay := &peekedConn{Conn: conn, peeked: peeked}
+	if err == nil && serverName != "" {
+		val, _ := l.proxy.leases.Load(strings.ToLower(serverName))
+		if lease, ok := val.(*sniLease); ok {
+			lease.Drain.Add()
+			spliceTLSPassthrough(replay, lease.ServerAddress, lease.ProxyProtocol,
+				lease.Drain.Context().Done())
+			lease.Drain.Done()
+			return
+		}
+	}
+	// Let the HTTPS server report any handshake errors
+	select {
+	case l.conns <- replay:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sniListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// peekServerName reads the TLS ClientHello from the conn and returns the
+// server name (SNI) it requested along with all the bytes that were read, so
+// they can be replayed to the real TLS server.
+func peekServerName(conn net.Conn) (serverName string, peeked []byte, err error) {
+	var buf bytes.Buffer
+	errDone := errors.New("done reading ClientHello")
+	// Use crypto/tls to parse the ClientHello then abort the handshake
+	hs := tls.Server(readOnlyConn{io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errDone
+		},
+	})
+	err = hs.Handshake()
+	if errors.Is(err, errDone) {
+		err = nil
+	}
+	return serverName, buf.Bytes(), err
+}
+
+// readOnlyConn is a net.Conn that reads from the reader and drops writes.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekedConn replays the peeked bytes before reading more from the Conn
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(p, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// spliceTLSPassthrough copies the raw bytes between the public conn and the
+// backend in both directions until either side closes or quit is closed.
+func spliceTLSPassthrough(publicConn net.Conn, serverAddress string,
+	proxyVersion int, quit <-chan struct{}) {
+
+	privateConn, err := dialBackend(publicConn, serverAddress, proxyVersion, nil)
+	if err != nil {
+		log.Printf("Failed to connect to TLS passthrough backend (for client %v): %v",
+			publicConn.RemoteAddr(), err)
+		publicConn.Close()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-quit: // close when the drain times out
+		case <-done:
+		}
+		publicConn.Close()
+		privateConn.Close()
+	}()
+	log.Printf("TLS passthrough Established; user: %v -> backend: %v. Appears to backend as %v ",
+		publicConn.RemoteAddr(), serverAddress, privateConn.LocalAddr())
+	var closeOnce sync.Once
+	closeAll := func() { closeOnce.Do(func() { close(done) }) }
+	go func() {
+		io.Copy(publicConn, privateConn)
+		closeAll()
+	}()
+	io.Copy(privateConn, publicConn)
+	closeAll()
+	log.Printf("TLS passthrough Closed; user: %v -> backend: %v. Appears to backend as %v ",
+		publicConn.RemoteAddr(), serverAddress, privateConn.LocalAddr())
+}
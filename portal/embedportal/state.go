@@ -1,9 +1,12 @@
 package embedportal
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -15,15 +18,21 @@ import (
 	"ask.systems/daemon/internal/portalpb"
 	"ask.systems/daemon/tools"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+var errAlreadySaved = errors.New("already saved")
+
 func leaseKey(lease *portalpb.Lease) string {
-	return fmt.Sprintf("%s:%d:%s", lease.Address, lease.Port, lease.Pattern)
+	return backendAddress(lease.Address, lease.Port) + ":" + lease.Pattern
 }
 
 type stateManager struct {
 	mut          *sync.Mutex
 	saveFilepath string
+	// Encrypts the save file if not nil. The file can also be decrypted with the
+	// previousKey, then it is saved with the key (or not encrypted if nil).
+	key, previousKey *stateKey
 
 	registrations map[string]*portalpb.Registration // leaseKey(lease) for the key
 
@@ -40,12 +49,25 @@ type stateManager struct {
 
 	acmeAccount  crypto.Signer
 	certificates map[string]*tls.Certificate // domain name key
+	// The -autocert_server directory that issued each of the certificates
+	certDirectories map[string]string // domain name key
+
+	maintenance map[string]*portalpb.MaintenanceRequest // pattern key
+
+	// Not sent to the -peers, each instance fetches its own
+	ocspStaples map[[sha256.Size]byte]*portalpb.OCSPStaple // cert_hash key
+
+	// Called with the changes to send to the -peers. Only called when something
+	// actually changed so that updates from the peers aren't sent back forever.
+	onChange func(*portalpb.PeerUpdate)
 }
 
-func newStateManager(saveFilepath string) *stateManager {
+func newStateManager(saveFilepath string, key, previousKey *stateKey) *stateManager {
 	s := &stateManager{
 		mut:          &sync.Mutex{},
 		saveFilepath: saveFilepath,
+		key:          key,
+		previousKey:  previousKey,
 
 		registrations: make(map[string]*portalpb.Registration),
 
@@ -53,8 +75,11 @@ func newStateManager(saveFilepath string) *stateManager {
 		mutCertPool:  x509.NewCertPool(),
 		readCertPool: &atomic.Value{},
 
-		token:        &atomic.Value{},
-		certificates: make(map[string]*tls.Certificate),
+		token:           &atomic.Value{},
+		certificates:    make(map[string]*tls.Certificate),
+		certDirectories: make(map[string]string),
+		maintenance:     make(map[string]*portalpb.MaintenanceRequest),
+		ocspStaples:     make(map[[sha256.Size]byte]*portalpb.OCSPStaple),
 	}
 	// Always generate a random token so that the token is never nil
 	// Load() might overwrite this with the value in the file.
@@ -70,13 +95,9 @@ func (s *stateManager) Load() error {
 	if s.saveFilepath == "" {
 		return nil
 	}
-	saveData, err := os.ReadFile(s.saveFilepath)
+	state, resave, err := readStateFile(s.saveFilepath, s.key, s.previousKey)
 	if err != nil {
-		return fmt.Errorf("No save data: %w", err)
-	}
-	state := &portalpb.State{}
-	if err := proto.Unmarshal(saveData, state); err != nil {
-		return fmt.Errorf("Failed to unmarshal save state file: %w", err)
+		return err
 	}
 	s.mut.Lock()
 	defer s.mut.Unlock()
@@ -92,7 +113,9 @@ func (s *stateManager) Load() error {
 	// Load the root CA certs
 	loaded := 0
 	for i, ca := range state.RootCAs {
-		if err := s.unsafeSaveRootCA(ca); err != nil {
+		if err := s.unsafeSaveRootCA(ca); errors.Is(err, errAlreadySaved) {
+			continue
+		} else if err != nil {
 			return fmt.Errorf("Failed to save root CA #%v: %w", i, err)
 		}
 		loaded += 1
@@ -125,11 +148,139 @@ func (s *stateManager) Load() error {
 			return fmt.Errorf("TLS cert for domain %v not valid: %w", cert.Domain, err)
 		}
 		s.certificates[cert.Domain] = tlsCert
+		s.certDirectories[cert.Domain] = cert.Directory
+	}
+
+	// Load the patterns in maintenance mode
+	for _, m := range state.Maintenance {
+		s.maintenance[m.Pattern] = m
+	}
+
+	// Load the OCSP responses
+	for _, staple := range state.OcspStaples {
+		if len(staple.CertHash) != sha256.Size {
+			continue
+		}
+		s.ocspStaples[[sha256.Size]byte(staple.CertHash)] = staple
 	}
 
+	if resave {
+		// Save again right away so the old key can be deleted
+		s.saveUnsafe()
+	}
 	return nil
 }
 
+// readStateFile reads the -save_file, decrypting it with the key or the
+// previousKey if it is encrypted. Returns true if it needs to be saved again to
+// encrypt it with the key.
+func readStateFile(path string, key, previousKey *stateKey) (state *portalpb.State, resave bool, err error) {
+	saveData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, fmt.Errorf("No save data: %w", err)
+	}
+	if isEncryptedState(saveData) {
+		saveData, resave, err = decryptState(saveData, key, previousKey)
+		if err != nil {
+			return nil, false, err
+		}
+	} else if key != nil {
+		log.Print("The state file is not encrypted, encrypting it with the state key.")
+		resave = true
+	}
+	state = &portalpb.State{}
+	if err := proto.Unmarshal(saveData, state); err != nil {
+		return nil, false, fmt.Errorf("Failed to unmarshal save state file: %w", err)
+	}
+	return state, resave, nil
+}
+
+// writeStateFile atomically replaces the -save_file with the state, encrypted
+// with the key if it's not nil.
+func writeStateFile(path string, state *portalpb.State, key *stateKey) error {
+	saveData, err := proto.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal save state: %w", err)
+	}
+	if key != nil {
+		saveData, err = key.Encrypt(saveData)
+		if err != nil {
+			return fmt.Errorf("Failed to encrypt save state: %w", err)
+		}
+	}
+	tmpFilepath := path + ".tmp"
+	// Only the owner can read it because it has private keys in it
+	if err := writeFileSync(tmpFilepath, saveData, 0600); err != nil {
+		return fmt.Errorf("Failed to write temp save state file: %w", err)
+	}
+	if err := atomicReplaceFile(tmpFilepath, path); err != nil {
+		return fmt.Errorf("Failed to overwrite save state file: %w", err)
+	}
+	return nil
+}
+
+// decryptState opens the state file with the key or the previousKey. Returns
+// true if it needs to be saved with the current key.
+func decryptState(data []byte, key, previousKey *stateKey) (plaintext []byte, resave bool, err error) {
+	if key == nil && previousKey == nil {
+		return nil, false, fmt.Errorf("%w It is encrypted and there is no key set.", stateKeyErr)
+	}
+	if key != nil {
+		plaintext, err := key.Decrypt(data)
+		if err == nil {
+			return plaintext, false, nil
+		} else if !errors.Is(err, stateKeyErr) || previousKey == nil {
+			return nil, false, err
+		}
+	}
+	plaintext, err = previousKey.Decrypt(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if key == nil {
+		log.Print("Decrypted the state file with the previous key, it will be saved unencrypted.")
+	} else {
+		log.Print("Decrypted the state file with the previous key, encrypting it with the new key.")
+	}
+	return plaintext, true, nil
+}
+
+// OnChange sets the function called (with the lock held) for each change to
+// the state. It must be set before the state is used.
+func (s *stateManager) OnChange(onChange func(*portalpb.PeerUpdate)) {
+	s.onChange = onChange
+}
+
+func (s *stateManager) changedUnsafe(update *portalpb.PeerUpdate) {
+	if s.onChange != nil {
+		s.onChange(update)
+	}
+}
+
+// PeerSnapshot returns the whole state to send to a peer when connecting.
+// Pinned registrations are left out because each instance has its own
+// -routes_file.
+func (s *stateManager) PeerSnapshot() *portalpb.PeerUpdate {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	state := s.stateProtoUnsafe()
+	update := &portalpb.PeerUpdate{
+		RootCas:      state.RootCAs,
+		Certificates: state.Certificates,
+		Maintenance:  state.Maintenance,
+		AcmeAccount:  state.AcmeAccount,
+	}
+	for _, r := range state.Registrations {
+		if !r.Pinned {
+			update.Registrations = append(update.Registrations, proto.Clone(r).(*portalpb.Registration))
+		}
+	}
+	for i, m := range update.Maintenance {
+		update.Maintenance[i] = proto.Clone(m).(*portalpb.MaintenanceRequest)
+	}
+	return update
+}
+
 func writeFileSync(name string, data []byte, perm os.FileMode) error {
 	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
@@ -149,7 +300,15 @@ func (s *stateManager) saveUnsafe() {
 	if s.saveFilepath == "" {
 		return
 	}
-	// Build the save state proto from the current in memory state
+	if err := writeStateFile(s.saveFilepath, s.stateProtoUnsafe(), s.key); err != nil {
+		log.Print(err)
+		return
+	}
+	log.Print("Saved state file")
+}
+
+// Build the save state proto from the current in memory state
+func (s *stateManager) stateProtoUnsafe() *portalpb.State {
 	state := &portalpb.State{}
 
 	for _, r := range s.registrations {
@@ -187,29 +346,34 @@ func (s *stateManager) saveUnsafe() {
 		}
 		state.Certificates = append(state.Certificates,
 			&portalpb.Certificate{
-				Domain: domain,
-				Der:    cert.Certificate,
-				Key:    keyBytes,
+				Domain:    domain,
+				Der:       cert.Certificate,
+				Key:       keyBytes,
+				Directory: s.certDirectories[domain],
 			})
 	}
 	sort.Slice(state.Certificates, func(i, j int) bool {
 		return state.Certificates[i].Domain < state.Certificates[j].Domain
 	})
 
-	saveData, err := proto.Marshal(state)
-	if err != nil {
-		log.Print("Failed to marshal save state: ", err)
-		return
-	}
-	tmpFilepath := s.saveFilepath + ".tmp"
-	if err := writeFileSync(tmpFilepath, saveData, 0660); err != nil {
-		log.Print("Failed to write temp save state file: ", err)
-		return
+	for _, m := range s.maintenance {
+		state.Maintenance = append(state.Maintenance, m)
 	}
-	if err := atomicReplaceFile(tmpFilepath, s.saveFilepath); err != nil {
-		log.Print("Failed to overwrite save state file: ", err)
+	sort.Slice(state.Maintenance, func(i, j int) bool {
+		return state.Maintenance[i].Pattern < state.Maintenance[j].Pattern
+	})
+
+	for hash, staple := range s.ocspStaples {
+		if time.Now().After(staple.NextUpdate.AsTime()) {
+			delete(s.ocspStaples, hash)
+			continue // Don't save expired responses
+		}
+		state.OcspStaples = append(state.OcspStaples, staple)
 	}
-	log.Print("Saved state file")
+	sort.Slice(state.OcspStaples, func(i, j int) bool {
+		return bytes.Compare(state.OcspStaples[i].CertHash, state.OcspStaples[j].CertHash) < 0
+	})
+	return state
 }
 
 func (s *stateManager) Token() string {
@@ -221,6 +385,11 @@ func (s *stateManager) unsafeSaveRootCA(rawCert []byte) error {
 	if err != nil {
 		return err
 	}
+	for ca := range s.rootCAs {
+		if bytes.Equal(ca.Raw, rawCert) {
+			return errAlreadySaved
+		}
+	}
 
 	s.rootCAs[newRoot] = struct{}{}
 	s.mutCertPool.AddCert(newRoot)
@@ -233,10 +402,14 @@ func (s *stateManager) SaveRootCA(rawCert []byte) error {
 	defer s.mut.Unlock()
 
 	if err := s.unsafeSaveRootCA(rawCert); err != nil {
+		if errors.Is(err, errAlreadySaved) {
+			return nil
+		}
 		return err
 	}
 
 	s.saveUnsafe()
+	s.changedUnsafe(&portalpb.PeerUpdate{RootCas: [][]byte{rawCert}})
 	return nil
 }
 
@@ -252,11 +425,17 @@ func (s *stateManager) ForEachRegistration(body func(*portalpb.Registration)) {
 	}
 }
 
+// LookupRegistration returns a copy of the registration for the lease, or nil.
+// It's a copy because RenewRegistration changes the lease.
 func (s *stateManager) LookupRegistration(lease *portalpb.Lease) *portalpb.Registration {
 	s.mut.Lock()
 	defer s.mut.Unlock()
 
-	return s.registrations[leaseKey(lease)]
+	r, ok := s.registrations[leaseKey(lease)]
+	if !ok {
+		return nil
+	}
+	return proto.Clone(r).(*portalpb.Registration)
 }
 
 func (s *stateManager) unsafeSaveRegistration(r *portalpb.Registration) error {
@@ -277,6 +456,11 @@ func (s *stateManager) SaveRegistration(r *portalpb.Registration) error {
 		return err
 	}
 	s.saveUnsafe()
+	if !r.Pinned {
+		s.changedUnsafe(&portalpb.PeerUpdate{
+			Registrations: []*portalpb.Registration{proto.Clone(r).(*portalpb.Registration)},
+		})
+	}
 	return nil
 }
 
@@ -292,6 +476,11 @@ func (s *stateManager) RenewRegistration(lease *portalpb.Lease) error {
 
 	r.Lease = lease
 	s.saveUnsafe()
+	if !r.Pinned {
+		s.changedUnsafe(&portalpb.PeerUpdate{
+			Registrations: []*portalpb.Registration{proto.Clone(r).(*portalpb.Registration)},
+		})
+	}
 	return nil
 }
 
@@ -299,9 +488,19 @@ func (s *stateManager) Unregister(oldLease *portalpb.Lease) {
 	s.mut.Lock()
 	defer s.mut.Unlock()
 
-	delete(s.registrations, leaseKey(oldLease))
+	key := leaseKey(oldLease)
+	r, ok := s.registrations[key]
+	if !ok {
+		return
+	}
+	delete(s.registrations, key)
 
 	s.saveUnsafe()
+	if !r.Pinned {
+		s.changedUnsafe(&portalpb.PeerUpdate{
+			Unregistered: []*portalpb.Lease{proto.Clone(r.Lease).(*portalpb.Lease)},
+		})
+	}
 }
 
 func (s *stateManager) TLSCert(domain string) *tls.Certificate {
@@ -315,13 +514,38 @@ func (s *stateManager) TLSCert(domain string) *tls.Certificate {
 	return cert
 }
 
-func (s *stateManager) SaveTLSCert(domain string, cert *tls.Certificate) error {
+// TLSCertDirectory returns the -autocert_server directory URL that issued the
+// cert for the domain, or empty if it isn't known.
+func (s *stateManager) TLSCertDirectory(domain string) string {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.certDirectories[domain]
+}
+
+// SaveTLSCert saves the acme cert for the domain, and the directory URL of the
+// CA that issued it.
+func (s *stateManager) SaveTLSCert(domain string, cert *tls.Certificate, directory string) error {
 	s.mut.Lock()
 	defer s.mut.Unlock()
 
 	s.certificates[domain] = cert
+	s.certDirectories[domain] = directory
 
 	s.saveUnsafe()
+	if s.onChange != nil {
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("Failed to marshal the cert key for %v: %w", domain, err)
+		}
+		s.changedUnsafe(&portalpb.PeerUpdate{
+			Certificates: []*portalpb.Certificate{{
+				Domain:    domain,
+				Der:       cert.Certificate,
+				Key:       keyBytes,
+				Directory: directory,
+			}},
+		})
+	}
 	return nil
 }
 
@@ -340,3 +564,64 @@ func (s *stateManager) SaveACMEAccount(accountKey crypto.Signer) error {
 	s.saveUnsafe()
 	return nil
 }
+
+func (s *stateManager) ForEachMaintenance(body func(*portalpb.MaintenanceRequest)) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for _, m := range s.maintenance {
+		body(m)
+	}
+}
+
+// Saves the maintenance mode setting for a pattern, or removes it if the
+// request is not enabled.
+func (s *stateManager) SaveMaintenance(m *portalpb.MaintenanceRequest) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	old, ok := s.maintenance[m.Pattern]
+	if m.Enabled {
+		if ok && proto.Equal(old, m) {
+			return
+		}
+		s.maintenance[m.Pattern] = m
+	} else {
+		if !ok {
+			return
+		}
+		delete(s.maintenance, m.Pattern)
+	}
+
+	s.saveUnsafe()
+	s.changedUnsafe(&portalpb.PeerUpdate{
+		Maintenance: []*portalpb.MaintenanceRequest{proto.Clone(m).(*portalpb.MaintenanceRequest)},
+	})
+}
+
+// OCSPStaple returns the saved OCSP response for the leaf cert DER or nil
+func (s *stateManager) OCSPStaple(leaf []byte) []byte {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	staple, ok := s.ocspStaples[sha256.Sum256(leaf)]
+	if !ok || time.Now().After(staple.NextUpdate.AsTime()) {
+		return nil
+	}
+	return staple.Response
+}
+
+func (s *stateManager) SaveOCSPStaple(leaf, response []byte, nextUpdate time.Time) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	hash := sha256.Sum256(leaf)
+	if old, ok := s.ocspStaples[hash]; ok && bytes.Equal(old.Response, response) {
+		return
+	}
+	s.ocspStaples[hash] = &portalpb.OCSPStaple{
+		CertHash:   hash[:],
+		Response:   response,
+		NextUpdate: timestamppb.New(nextUpdate),
+	}
+	s.saveUnsafe()
+}
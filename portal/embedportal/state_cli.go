@@ -0,0 +1,358 @@
+package embedportal
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"ask.systems/daemon/internal/portalpb"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+)
+
+// What the secrets are replaced with by state dump
+const redactedSecret = "REDACTED"
+
+type stateCommand struct {
+	name        string
+	run         func(*flag.FlagSet, []string)
+	description string
+}
+
+var stateCommands = []stateCommand{
+	{"dump", runStateDump, "" +
+		"Print the state as textproto or JSON. The secrets are redacted unless\n" +
+		"-show_secrets is set."},
+	{"import", runStateImport, "" +
+		"Replace the state with a textproto or JSON file, in the format of dump."},
+	{"prune", runStatePrune, "" +
+		"Remove the expired registrations."},
+	{"export-certs", runStateExportCerts, "" +
+		"Write the autocert certificates and keys to PEM files."},
+	{"import-cert", runStateImportCert, "" +
+		"Add a PEM certificate and key to the autocert certificates, such as\n" +
+		"ones from certbot."},
+}
+
+// runState is the "portal state" subcommand, for debugging and migrating the
+// -save_file. args[0] is "state".
+func runState(flags *flag.FlagSet, args []string) {
+	usage := func() {
+		fmt.Fprintf(flags.Output(), ""+
+			"Usage: %s state <command> [flags]\n"+
+			"Reads and edits the portal -save_file, for debugging and moving portal\n"+
+			"to a new machine. Stop portal before changing the file because portal\n"+
+			"overwrites it whenever it saves. Run a command with -help for its flags.\n"+
+			"\n"+
+			"Commands:\n",
+			flags.Name())
+		for _, cmd := range stateCommands {
+			fmt.Fprintf(flags.Output(), "  %-12s  %s\n", cmd.name,
+				bytes.ReplaceAll([]byte(cmd.description), []byte("\n"), []byte("\n                ")))
+		}
+	}
+	if len(args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, cmd := range stateCommands {
+		if args[1] != cmd.name {
+			continue
+		}
+		description := cmd.description
+		flags.Usage = func() {
+			fmt.Fprintf(flags.Output(), "Usage: %s state %s [flags]\n%s\n\nFlags:\n",
+				flags.Name(), cmd.name, description)
+			flags.PrintDefaults()
+		}
+		cmd.run(flags, args[2:])
+		return
+	}
+	fmt.Fprintf(flags.Output(), "Invalid state command %#v\n\n", args[1])
+	usage()
+	os.Exit(2)
+}
+
+type stateFileFlags struct {
+	saveFilepath         *string
+	stateKeyFile         *string
+	previousStateKeyFile *string
+}
+
+// The same flags portal uses for the state file
+func addStateFileFlags(flags *flag.FlagSet) *stateFileFlags {
+	return &stateFileFlags{
+		saveFilepath: flags.String("save_file", "state.protodata", ""+
+			"The path to the portal state file."),
+		stateKeyFile: flags.String("state_key_file", "", ""+
+			"The file with the secret the -save_file is encrypted with, if it is.\n"+
+			"Changes are saved with this key. If unset, the "+stateKeyEnv+"\n"+
+			"env var is used if set."),
+		previousStateKeyFile: flags.String("previous_state_key_file", "", ""+
+			"Another key to try to decrypt the -save_file with. If unset, the\n"+
+			previousStateKeyEnv+" env var is used if set."),
+	}
+}
+
+// read loads the state and the key to save it with
+func (f *stateFileFlags) read() (*portalpb.State, *stateKey, error) {
+	key, err := loadStateKey(*f.stateKeyFile, stateKeyEnv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to load the -state_key_file: %w", err)
+	}
+	previousKey, err := loadStateKey(*f.previousStateKeyFile, previousStateKeyEnv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to load the -previous_state_key_file: %w", err)
+	}
+	state, _, err := readStateFile(*f.saveFilepath, key, previousKey)
+	return state, key, err
+}
+
+func (f *stateFileFlags) write(state *portalpb.State, key *stateKey) error {
+	return writeStateFile(*f.saveFilepath, state, key)
+}
+
+func addFormatFlag(flags *flag.FlagSet) *string {
+	return flags.String("format", "textproto", ""+
+		"The format of the state, either textproto or json.")
+}
+
+func runStateDump(flags *flag.FlagSet, args []string) {
+	file := addStateFileFlags(flags)
+	format := addFormatFlag(flags)
+	showSecrets := flags.Bool("show_secrets", false, ""+
+		"If true, print the API token and the private keys instead of "+redactedSecret+".")
+	flags.Parse(args)
+
+	state, _, err := file.read()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !*showSecrets {
+		state.ApiToken = redactedSecret
+		if len(state.AcmeAccount) > 0 {
+			state.AcmeAccount = []byte(redactedSecret)
+		}
+		for _, cert := range state.Certificates {
+			cert.Key = []byte(redactedSecret)
+		}
+	}
+	var out []byte
+	switch *format {
+	case "textproto":
+		out, err = prototext.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(state)
+	case "json":
+		out, err = protojson.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(state)
+	default:
+		log.Fatalf("Unknown -format %#v", *format)
+	}
+	if err != nil {
+		log.Fatal("Failed to format the state: ", err)
+	}
+	os.Stdout.Write(out)
+	fmt.Println()
+}
+
+func runStateImport(flags *flag.FlagSet, args []string) {
+	file := addStateFileFlags(flags)
+	format := addFormatFlag(flags)
+	input := flags.String("input", "-", ""+
+		"The file to import, - is stdin.")
+	force := flags.Bool("force", false, ""+
+		"If true, overwrite the -save_file if it exists.")
+	flags.Parse(args)
+
+	var data []byte
+	var err error
+	if *input == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*input)
+	}
+	if err != nil {
+		log.Fatal("Failed to read the -input: ", err)
+	}
+	state := &portalpb.State{}
+	switch *format {
+	case "textproto":
+		err = prototext.Unmarshal(data, state)
+	case "json":
+		err = protojson.Unmarshal(data, state)
+	default:
+		log.Fatalf("Unknown -format %#v", *format)
+	}
+	if err != nil {
+		log.Fatal("Failed to parse the -input: ", err)
+	}
+	if isRedacted(state) {
+		log.Fatal("The -input has redacted secrets. Dump it with -show_secrets to import it.")
+	}
+	if _, err := os.Stat(*file.saveFilepath); err == nil && !*force {
+		log.Fatalf("The -save_file %v already exists, set -force to replace it.", *file.saveFilepath)
+	}
+	key, err := loadStateKey(*file.stateKeyFile, stateKeyEnv)
+	if err != nil {
+		log.Fatal("Failed to load the -state_key_file: ", err)
+	}
+	if err := file.write(state, key); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Imported %v registrations and %v certificates to %v\n",
+		len(state.Registrations), len(state.Certificates), *file.saveFilepath)
+}
+
+func isRedacted(state *portalpb.State) bool {
+	if state.ApiToken == redactedSecret || string(state.AcmeAccount) == redactedSecret {
+		return true
+	}
+	for _, cert := range state.Certificates {
+		if string(cert.Key) == redactedSecret {
+			return true
+		}
+	}
+	return false
+}
+
+func runStatePrune(flags *flag.FlagSet, args []string) {
+	file := addStateFileFlags(flags)
+	flags.Parse(args)
+
+	state, key, err := file.read()
+	if err != nil {
+		log.Fatal(err)
+	}
+	now := time.Now()
+	var kept []*portalpb.Registration
+	for _, r := range state.Registrations {
+		if r.Pinned || r.GetLease().GetTimeout().AsTime().After(now) {
+			kept = append(kept, r)
+			continue
+		}
+		fmt.Printf("Removing expired registration: %v\n", leaseString(r.Lease))
+	}
+	removed := len(state.Registrations) - len(kept)
+	if removed == 0 {
+		fmt.Println("There are no expired registrations.")
+		return
+	}
+	state.Registrations = kept
+	if err := file.write(state, key); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Removed %v expired registrations.\n", removed)
+}
+
+func runStateExportCerts(flags *flag.FlagSet, args []string) {
+	file := addStateFileFlags(flags)
+	outDir := flags.String("out", "certs", ""+
+		"The directory to write the certs to. Each domain gets a directory with\n"+
+		"fullchain.pem and privkey.pem in it, like certbot.")
+	flags.Parse(args)
+
+	state, _, err := file.read()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(state.Certificates) == 0 {
+		fmt.Println("There are no autocert certificates in the state.")
+		return
+	}
+	for _, cert := range state.Certificates {
+		dir := filepath.Join(*outDir, cert.Domain)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.Fatal(err)
+		}
+		var chain bytes.Buffer
+		for _, der := range cert.Der {
+			pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+		}
+		if err := os.WriteFile(filepath.Join(dir, "fullchain.pem"), chain.Bytes(), 0644); err != nil {
+			log.Fatal(err)
+		}
+		// The key is saved in PKCS #8 already
+		key := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: cert.Key})
+		if err := os.WriteFile(filepath.Join(dir, "privkey.pem"), key, 0600); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Exported the certificate for %v to %v\n", cert.Domain, dir)
+	}
+}
+
+func runStateImportCert(flags *flag.FlagSet, args []string) {
+	file := addStateFileFlags(flags)
+	certFile := flags.String("cert", "", ""+
+		"The PEM certificate file with the full chain (fullchain.pem).")
+	keyFile := flags.String("key", "", ""+
+		"The PEM private key file (privkey.pem).")
+	domain := flags.String("domain", "", ""+
+		"The domain to use the cert for. Portal uses it if the domain is in\n"+
+		"-autocert_domains, and renews it automatically. Defaults to the first\n"+
+		"domain name in the cert.")
+	flags.Parse(args)
+
+	if *certFile == "" || *keyFile == "" {
+		log.Fatal("-cert and -key are required.")
+	}
+	certBytes, err := os.ReadFile(*certFile)
+	if err != nil {
+		log.Fatal("Failed to read the -cert: ", err)
+	}
+	keyBytes, err := os.ReadFile(*keyFile)
+	if err != nil {
+		log.Fatal("Failed to read the -key: ", err)
+	}
+	cert, err := certFromBytes(certBytes, keyBytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *domain == "" {
+		if len(cert.Leaf.DNSNames) > 0 {
+			*domain = cert.Leaf.DNSNames[0]
+		} else {
+			*domain = cert.Leaf.Subject.CommonName
+		}
+		if *domain == "" {
+			log.Fatal("The cert has no domain names, set -domain.")
+		}
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		log.Fatal("Failed to marshal the -key: ", err)
+	}
+
+	state, stateKey, err := file.read()
+	if errors.Is(err, os.ErrNotExist) {
+		state = &portalpb.State{}
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	newCert := &portalpb.Certificate{
+		Domain: *domain,
+		Der:    cert.Certificate,
+		Key:    key,
+	}
+	replaced := false
+	for i, c := range state.Certificates {
+		if c.Domain == *domain {
+			state.Certificates[i] = newCert
+			replaced = true
+		}
+	}
+	if !replaced {
+		state.Certificates = append(state.Certificates, newCert)
+	}
+	if err := file.write(state, stateKey); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Imported the certificate for %v (expires %v)\n",
+		*domain, cert.Leaf.NotAfter.Format(time.DateOnly))
+}
@@ -0,0 +1,167 @@
+package embedportal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// The start of an encrypted -save_file, followed by the salt, the nonce, and
+// the AES-GCM sealed State proto.
+const encryptedStateMagic = "portal encrypted state v1\n"
+
+const stateSaltSize = 16
+
+// The env vars for the keys when the flags are not set
+const (
+	stateKeyEnv         = "PORTAL_STATE_KEY"
+	previousStateKeyEnv = "PORTAL_PREVIOUS_STATE_KEY"
+)
+
+var stateKeyErr = errors.New("The state file could not be decrypted with the state key.")
+
+// stateKey encrypts the state file with AES-256-GCM using a key derived from
+// the secret with scrypt, so the secret can be a passphrase or random bytes.
+type stateKey struct {
+	secret []byte
+
+	mut  sync.Mutex
+	salt []byte // the salt for aead, nil until it's used
+	aead cipher.AEAD
+}
+
+// The -state_key_file value for using the last file passed in by spawn
+const spawnStateKeyFile = "spawn"
+
+// loadStateKey reads the key from the file path, file descriptor number, or
+// the last spawn file, or the env var if the path is empty. Returns nil if
+// neither is set.
+func loadStateKey(pathOrFD, envVar string) (*stateKey, error) {
+	var secret []byte
+	if pathOrFD == spawnStateKeyFile {
+		spawnPorts, _ := strconv.Atoi(os.Getenv("SPAWN_PORTS"))
+		spawnFiles, _ := strconv.Atoi(os.Getenv("SPAWN_FILES"))
+		if spawnFiles == 0 {
+			return nil, errors.New("Spawn didn't pass in any files for the state key.")
+		}
+		// 3 is stdin, stdout, stderr
+		pathOrFD = strconv.Itoa(3 + spawnPorts + spawnFiles - 1)
+	}
+	if pathOrFD != "" {
+		f, err := openFilePathOrFD(pathOrFD)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if isPipeFile(f) {
+			// Spawn sends the file contents followed by an EOT over a pipe
+			scanner := bufio.NewScanner(f)
+			scanner.Split(scanEOT)
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("Failed to read the key from spawn: %v", scanner.Err())
+			}
+			secret = scanner.Bytes()
+		} else {
+			secret, err = io.ReadAll(f)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if env := os.Getenv(envVar); env != "" {
+		secret = []byte(env)
+	} else {
+		return nil, nil
+	}
+	// Allow a trailing newline in the file
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, errors.New("The state key is empty.")
+	}
+	return &stateKey{secret: secret}, nil
+}
+
+func isEncryptedState(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedStateMagic))
+}
+
+// cipherForSalt returns the AEAD for the salt, deriving it only when the salt
+// changes because scrypt is slow on purpose.
+func (k *stateKey) cipherForSalt(salt []byte) (cipher.AEAD, error) {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	if k.aead != nil && bytes.Equal(k.salt, salt) {
+		return k.aead, nil
+	}
+	key, err := scrypt.Key(k.secret, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k.salt, k.aead = salt, aead
+	return aead, nil
+}
+
+// Encrypt seals the state with the salt from the last Decrypt, or a new random
+// salt if there wasn't one.
+func (k *stateKey) Encrypt(plaintext []byte) ([]byte, error) {
+	k.mut.Lock()
+	salt := k.salt
+	k.mut.Unlock()
+	if salt == nil {
+		salt = make([]byte, stateSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := k.cipherForSalt(salt)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(encryptedStateMagic), salt...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(header, nonce...)
+	// The header is authenticated too
+	return aead.Seal(out, nonce, plaintext, header), nil
+}
+
+// Decrypt opens a state file written by Encrypt.
+func (k *stateKey) Decrypt(data []byte) ([]byte, error) {
+	headerSize := len(encryptedStateMagic) + stateSaltSize
+	if !isEncryptedState(data) || len(data) < headerSize {
+		return nil, errors.New("The state file is not encrypted.")
+	}
+	header := data[:headerSize]
+	aead, err := k.cipherForSalt(bytes.Clone(header[len(encryptedStateMagic):]))
+	if err != nil {
+		return nil, err
+	}
+	rest := data[headerSize:]
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("The state file is truncated: %w", stateKeyErr)
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, stateKeyErr
+	}
+	return plaintext, nil
+}
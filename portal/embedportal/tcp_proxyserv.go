@@ -2,8 +2,8 @@ package embedportal
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"strings"
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"ask.systems/daemon/internal/portalpb"
+	"ask.systems/daemon/tools"
 )
 
 // The RegisterRequest.Pattern prefix for tcp proxies
@@ -22,18 +23,36 @@ type tcpProxy struct {
 	tlsConfig    *tls.Config
 	quit         chan struct{}
 	leases       sync.Map // map from pattern to *tcpLease
+	// The -bind_address list to listen on
+	bindAddrs bindAddrs
+	// If true, the public connections start with a PROXY protocol header
+	acceptProxyProtocol bool
+	// Lets connections finish when leases are unregistered
+	drainer *drainer
+	// The recent backend errors, for the admin page
+	proxyErrors *proxyErrors
+	// Hands the listeners to a new portal when upgrading
+	upgrader *upgrader
 }
 
 type tcpLease struct {
-	Cancel chan struct{}
-	Lease  *portalpb.Lease
+	Cancel    chan struct{}
+	Lease     *portalpb.Lease
+	Forwarder *tcpForwarder
 }
 
-func makeTCPProxy(l *clientLeasor, tlsConfig *tls.Config, quit chan struct{}) *tcpProxy {
+func makeTCPProxy(l *clientLeasor, tlsConfig *tls.Config, bindAddrs bindAddrs,
+	acceptProxyProtocol bool, drainer *drainer, proxyErrors *proxyErrors,
+	upgrader *upgrader, quit chan struct{}) *tcpProxy {
 	p := &tcpProxy{
-		clientLeasor: l,
-		tlsConfig:    tlsConfig,
-		quit:         quit,
+		clientLeasor:        l,
+		tlsConfig:           tlsConfig,
+		quit:                quit,
+		bindAddrs:           bindAddrs,
+		acceptProxyProtocol: acceptProxyProtocol,
+		drainer:             drainer,
+		proxyErrors:         proxyErrors,
+		upgrader:            upgrader,
 	}
 	l.OnCancel(p.Unregister)
 	return p
@@ -44,10 +63,17 @@ func (p *tcpProxy) Unregister(lease *portalpb.Lease) {
 	if l, ok := val.(*tcpLease); ok && l != nil {
 		close(l.Cancel)
 		p.leases.Delete(lease.Pattern)
+		p.upgrader.Untrack(lease.Pattern)
 	}
 }
 
 func (p *tcpProxy) Register(clientAddr string, request *portalpb.RegisterRequest, fixedTimeout time.Time) (*portalpb.Lease, error) {
+	if isDirectResponse(request) {
+		return nil, fmt.Errorf("Redirects and static responses are only supported for HTTP patterns.")
+	}
+	if _, ok := portalpb.TCPMode_name[int32(request.TcpMode)]; !ok {
+		return nil, fmt.Errorf("Unknown TCP mode: %v", request.TcpMode)
+	}
 	cancelLease := make(chan struct{})
 	go func() {
 		select {
@@ -70,60 +96,179 @@ func (p *tcpProxy) Register(clientAddr string, request *portalpb.RegisterRequest
 		return nil, err
 	}
 	port := strings.TrimPrefix(request.Pattern, tcpProxyPrefix)
-	listener, err := tls.Listen("tcp", port, p.tlsConfig) // hopefully the old listener has closed by now
+	publicPort, err := parsePatternPort(port)
+	if err != nil {
+		leasor.Unregister(lease)
+		return nil, fmt.Errorf("Invalid TCP pattern %#v: %v", request.Pattern, err)
+	}
+	// hopefully the old listener has closed by now
+	listener, err := listenTCP(p.upgrader, request.Pattern, p.bindAddrs, publicPort)
 	if err != nil {
 		leasor.Unregister(lease)
 		return nil, fmt.Errorf("Failed to listen on the requested port for TCP Proxy (%v): %v", lease.Port, err)
 	}
+	if p.acceptProxyProtocol {
+		listener = &tools.ProxyProtocolListener{Listener: listener}
+	}
+	if request.TcpMode == portalpb.TCPMode_TCP_MODE_TLS {
+		listener = tls.NewListener(listener, p.tlsConfig)
+	}
 	var host string
 	if request.Hostname != "" {
 		host = request.Hostname
 	} else {
 		host = clientAddr
 	}
-	hostPort := fmt.Sprintf("%v:%v", host, lease.Port)
-	startTCPForward(listener, hostPort, cancelLease)
-	log.Printf("Registered a TCP proxy forwarding %v to %v.", port, hostPort)
+	hostPort := backendAddress(host, lease.Port)
+	if request.UnixSocket != "" {
+		hostPort = unixBackend(request.UnixSocket)
+	}
+	f := &tcpForwarder{
+		Pattern:        request.Pattern,
+		ServerAddress:  hostPort,
+		ProxyVersion:   int(request.ProxyProtocol),
+		Mode:           request.TcpMode,
+		IdleTimeout:    time.Duration(request.TcpIdleTimeoutSeconds) * time.Second,
+		MaxConnections: int(request.TcpMaxConnections),
+		quit:           cancelLease,
+		drainer:        p.drainer,
+		drain:          newDrainGroup(),
+		proxyErrors:    p.proxyErrors,
+	}
+	f.start(listener)
+	log.Printf("Registered a TCP proxy (%v) forwarding %v to %v.", request.TcpMode, port, hostPort)
 	p.leases.Store(request.Pattern, &tcpLease{
-		Lease:  lease,
-		Cancel: cancelLease,
+		Lease:     lease,
+		Cancel:    cancelLease,
+		Forwarder: f,
 	})
 	return lease, nil
 }
 
-func handleConnection(publicConn net.Conn, serverAddress string, tlsCheck *tlsChecker, quit chan struct{}) {
-	var privateConn net.Conn
-	var err error
-	switch tlsCheck.State() {
+// DrainAll lets the open connections for all the leases finish, up to the
+// drain timeout, then closes them. Used when portal shuts down.
+func (p *tcpProxy) DrainAll() {
+	p.leases.Range(func(key, value any) bool {
+		f := value.(*tcpLease).Forwarder
+		p.drainer.Drain(f.drain, f.ServerAddress)
+		return true
+	})
+}
+
+// dialBackend connects to the backend, first sending the PROXY protocol header
+// for the publicConn if proxyVersion is not 0, then starting TLS if tlsConf is
+// not nil. The serverAddress is host:port or a unixBackend.
+func dialBackend(publicConn net.Conn, serverAddress string,
+	proxyVersion int, tlsConf *tls.Config) (net.Conn, error) {
+
+	network, address := backendNetwork(serverAddress)
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if proxyVersion != 0 {
+		err := tools.WriteProxyHeader(conn, proxyVersion,
+			publicConn.RemoteAddr(), publicConn.LocalAddr())
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if tlsConf == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, tlsConf)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// tcpForwarder forwards the connections for one ":tcp" registration
+type tcpForwarder struct {
+	Pattern string
+	// host:port or a unixBackend
+	ServerAddress string
+	// The PROXY protocol version to send to the backend, or 0 for none
+	ProxyVersion int
+	Mode         portalpb.TCPMode
+	// If non-zero, close connections with no data for this long
+	IdleTimeout time.Duration
+	// If non-zero, the maximum number of open connections
+	MaxConnections int
+
+	tlsCheck *tlsChecker
+	// When closed, stop accepting connections and start draining
+	quit        chan struct{}
+	drainer     *drainer
+	drain       *drainGroup
+	proxyErrors *proxyErrors
+
+	conns atomic.Int32
+	// Totals for all the connections, for the logs
+	totalConns atomic.Uint64
+	bytesIn    atomic.Uint64 // from users to the backend
+	bytesOut   atomic.Uint64 // from the backend to users
+}
+
+func (f *tcpForwarder) dial(publicConn net.Conn) (net.Conn, error) {
+	switch f.Mode {
+	case portalpb.TCPMode_TCP_MODE_PLAIN:
+		return dialBackend(publicConn, f.ServerAddress, f.ProxyVersion, nil)
+	case portalpb.TCPMode_TCP_MODE_BACKEND_TLS:
+		return dialBackend(publicConn, f.ServerAddress, f.ProxyVersion, f.tlsCheck.Conf)
+	}
+	switch f.tlsCheck.State() {
 	case tlsState_UNKNOWN:
-		privateConn, err = tls.Dial("tcp", serverAddress, tlsCheck.Conf)
+		privateConn, err := dialBackend(publicConn, f.ServerAddress, f.ProxyVersion, f.tlsCheck.Conf)
 		if err != nil {
 			tlsErr := err
-			privateConn, err = net.Dial("tcp", serverAddress)
+			privateConn, err = dialBackend(publicConn, f.ServerAddress, f.ProxyVersion, nil)
 			if err == nil {
-				tlsCheck.TCPOnly()
+				f.tlsCheck.TCPOnly()
 				log.Printf("Warning: TLS is not supported for the %v TCP backend. This internal traffic will not be encrypted. Message: %v",
-					serverAddress, tlsErr)
+					f.ServerAddress, tlsErr)
 			}
 		} else {
-			tlsCheck.TLSOnly()
+			f.tlsCheck.TLSOnly()
 		}
+		return privateConn, err
 	case tlsState_TLS_ONLY:
-		privateConn, err = tls.Dial("tcp", serverAddress, tlsCheck.Conf)
-	case tlsState_TCP_ONLY:
-		privateConn, err = net.Dial("tcp", serverAddress)
+		return dialBackend(publicConn, f.ServerAddress, f.ProxyVersion, f.tlsCheck.Conf)
+	default:
+		return dialBackend(publicConn, f.ServerAddress, f.ProxyVersion, nil)
 	}
+}
 
+func (f *tcpForwarder) handleConnection(publicConn net.Conn) {
+	if n := f.conns.Add(1); f.MaxConnections != 0 && int(n) > f.MaxConnections {
+		f.conns.Add(-1)
+		log.Printf("TCP Proxy for backend %v has the max %v connections, rejected user %v",
+			f.ServerAddress, f.MaxConnections, publicConn.RemoteAddr())
+		publicConn.Close()
+		return
+	}
+	f.drain.Add()
+	privateConn, err := f.dial(publicConn)
 	if err != nil {
+		f.conns.Add(-1)
+		f.drain.Done()
 		log.Printf("Failed to connect to TCP Proxy backend (for client %v): %v",
 			publicConn.RemoteAddr(), err)
+		f.proxyErrors.Add(f.Pattern, fmt.Sprintf("Failed to connect to %v (for client %v): %v",
+			f.ServerAddress, publicConn.RemoteAddr(), err))
 		publicConn.Close()
 		return
 	}
+	f.totalConns.Add(1)
 
+	done := make(chan struct{})
 	go func() {
-		<-quit // when we quit, close all the connections
-		// TODO: do we want to have a timeout for graceful stopping?
+		select {
+		case <-f.drain.Context().Done(): // close when the drain times out
+		case <-done:
+		}
 		publicConn.Close()
 		privateConn.Close()
 	}()
@@ -131,24 +276,60 @@ func handleConnection(publicConn net.Conn, serverAddress string, tlsCheck *tlsCh
 	//
 	// If either copy direction has an error or closes, we need to make sure
 	// both connections are closed (and we only want to log once)
-	var closedLog sync.Once
-	closedMsg := fmt.Sprintf(
-		"TCP Proxy Closed; user: %v -> backend: %v. Appears to backend as %v ",
-		publicConn.RemoteAddr(), serverAddress, privateConn.LocalAddr())
+	var closeOnce sync.Once
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+	var in, out atomic.Uint64
+	closeAll := func() {
+		closeOnce.Do(func() {
+			close(done)
+			f.conns.Add(-1)
+			f.drain.Done()
+			log.Printf("TCP Proxy Closed; user: %v -> backend: %v. Appears to backend as %v. Sent %v bytes, received %v bytes.",
+				publicConn.RemoteAddr(), f.ServerAddress, privateConn.LocalAddr(),
+				in.Load(), out.Load())
+		})
+	}
 	go func() {
-		io.Copy(publicConn, privateConn)
-		publicConn.Close()
-		privateConn.Close()
-		closedLog.Do(func() { log.Printf(closedMsg) })
+		f.copy(publicConn, privateConn, &lastActive, &out, &f.bytesOut)
+		closeAll()
 	}()
 	go func() {
-		io.Copy(privateConn, publicConn)
-		publicConn.Close()
-		privateConn.Close()
-		closedLog.Do(func() { log.Printf(closedMsg) })
+		f.copy(privateConn, publicConn, &lastActive, &in, &f.bytesIn)
+		closeAll()
 	}()
 	log.Printf("TCP Proxy Established; user: %v -> backend: %v. Appears to backend as %v ",
-		publicConn.RemoteAddr(), serverAddress, privateConn.LocalAddr())
+		publicConn.RemoteAddr(), f.ServerAddress, privateConn.LocalAddr())
+}
+
+// copy copies from src to dst until there's an error or, if IdleTimeout is
+// set, neither direction had data for the IdleTimeout. Adds the bytes copied
+// to the counters.
+func (f *tcpForwarder) copy(dst, src net.Conn, lastActive *atomic.Int64, counters ...*atomic.Uint64) {
+	buf := make([]byte, 32*1024)
+	for {
+		if f.IdleTimeout != 0 {
+			src.SetReadDeadline(time.Now().Add(f.IdleTimeout))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			lastActive.Store(time.Now().UnixNano())
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+			for _, c := range counters {
+				c.Add(uint64(n))
+			}
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() &&
+				time.Since(time.Unix(0, lastActive.Load())) < f.IdleTimeout {
+				continue // The other direction is still active
+			}
+			return
+		}
+	}
 }
 
 // Conf is read only once set. Tracks a simple state machine atomically.
@@ -184,16 +365,17 @@ func (c *tlsChecker) TLSOnly() {
 	c.state.CompareAndSwap(int32(tlsState_UNKNOWN), int32(tlsState_TLS_ONLY))
 }
 
-func startTCPForward(tlsListener net.Listener, serverAddress string, quit chan struct{}) {
+func (f *tcpForwarder) start(listener net.Listener) {
 	go func() {
-		<-quit // stop listening when we quit
-		tlsListener.Close()
+		<-f.quit // stop listening when we quit
+		listener.Close()
+		f.drainer.Drain(f.drain, f.ServerAddress)
 	}()
 
 	// TODO: when assimilate supports certificate requests, make it so we
 	// verify using the portal root CA (and maybe system CAs) when the cert
 	// request was used.
-	tlsCheck := &tlsChecker{
+	f.tlsCheck = &tlsChecker{
 		Conf: &tls.Config{
 			InsecureSkipVerify: true,
 		},
@@ -201,17 +383,19 @@ func startTCPForward(tlsListener net.Listener, serverAddress string, quit chan s
 
 	go func() {
 		for {
-			publicConn, err := tlsListener.Accept()
+			publicConn, err := listener.Accept()
 			if err != nil {
 				log.Printf("Failed to accept user connection on TCP Proxy (backend: %v): %v",
-					serverAddress, err)
+					f.ServerAddress, err)
 				break
 			}
 
 			// Use a goroutine just to not wait until the Dial is done before we
 			// can accept connections again
-			go handleConnection(publicConn, serverAddress, tlsCheck, quit)
+			go f.handleConnection(publicConn)
 		}
-		tlsListener.Close()
+		listener.Close()
+		log.Printf("TCP Proxy for backend %v stopped listening after %v connections. Users sent %v bytes, received %v bytes.",
+			f.ServerAddress, f.totalConns.Load(), f.bytesIn.Load(), f.bytesOut.Load())
 	}()
 }
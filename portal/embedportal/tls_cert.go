@@ -20,19 +20,72 @@ import (
 	"time"
 
 	"ask.systems/daemon/tools"
-	"golang.org/x/crypto/acme"
 )
 
 type tlsRefresher struct {
-	cache     []*atomic.Value
+	cache []*atomic.Value
+	// The status of each cert in the cache, for the admin page
+	status    []*certStatus
 	quit      chan struct{}
 	generator *acmeCertGenerator // nil if there were no acme certs to register
+	// Only the leader of the -peers renews the acme certs, the others use the
+	// copies it sends.
+	isLeader func() bool
+	// The acme certs aren't renewed while the sockets are handed to a new
+	// portal, because it saves them in the state
+	upgrader *upgrader
+	alerts   *certAlerts
+	// Staples OCSP responses to the certs, nil if -ocsp_stapling is off
+	stapler *ocspStapler
+	state   *stateManager
 }
 
+// certStatus tracks the refreshes of one of the serving certs
+type certStatus struct {
+	// The -tls_cert file, or the domain for -autocert_domains
+	Source string
+	ACME   bool
+	// Refreshes the cert right away when sent to, nil for spawn's pipes
+	force chan struct{}
+	// Sent to after the cert is refreshed, to staple a new OCSP response
+	newCert chan struct{}
+
+	mut         sync.Mutex
+	nextRefresh time.Time
+	lastError   string
+	// The number of failed refreshes in a row
+	failures int
+	// When the stapled OCSP response expires, zero if there isn't one
+	stapleExpires time.Time
+}
+
+// certInfo is a snapshot of a serving cert and its certStatus
+type certInfo struct {
+	Source string
+	ACME   bool
+	// The -autocert_server that issued an ACME cert, if known
+	Directory   string
+	Names       []string
+	NotAfter    time.Time
+	NextRefresh time.Time
+	LastError   string
+	Failures    int
+	// From certAlerts.Health
+	Health        string
+	StapleExpires time.Time
+	MustStaple    bool
+}
+
+// When a follower's copy of an acme cert has less than this left before its
+// refresh time, it renews the cert itself because the leader hasn't.
+const followerRenewGrace = 24 * time.Hour
+
 type acmeCertGenerator struct {
 	AccountKey crypto.Signer
-	Client     *acme.Client
-	Account    *acme.Account
+	Contacts   []string
+	// In order of preference, portal falls back to the next one when the
+	// previous one fails too many times in a row.
+	CAs        []*acmeCA
 	Challenges *acmeChallenges
 	acmeMut    sync.Mutex
 	state      *stateManager
@@ -45,22 +98,72 @@ func (c *acmeCertGenerator) Certificate(domain string) (*tls.Certificate, error)
 	c.acmeMut.Lock()
 	defer c.acmeMut.Unlock()
 
-	newCert, err := obtainACMECert(domain, c.Client, c.Account, c.Challenges)
-	if err != nil {
-		log.Printf("Error getting TLS cert for %v: %v", domain, err)
-		return nil, err
+	var err error
+	for i, ca := range c.CAs {
+		last := i == len(c.CAs)-1
+		if !last && ca.failures >= acmeFallbackFailures &&
+			time.Since(ca.lastFailure) < acmeFallbackTimeout {
+			continue // Using the fallback until the timeout
+		}
+		var newCert *tls.Certificate
+		newCert, err = c.obtain(ca, domain)
+		if err == nil {
+			ca.failures = 0
+			log.Printf("Saving new TLS cert for %v from %v.", domain, ca.Directory)
+			c.state.SaveTLSCert(domain, newCert, ca.Directory)
+			return newCert, nil
+		}
+		ca.failures++
+		ca.lastFailure = time.Now()
+		log.Printf("Error getting TLS cert for %v from %v: %v", domain, ca.Directory, err)
+		if last || ca.failures < acmeFallbackFailures {
+			break
+		}
+		log.Printf("Getting certs from %v failed %v times in a row, falling back to %v for %v.",
+			ca.Directory, ca.failures, c.CAs[i+1].Directory, acmeFallbackTimeout)
 	}
-	log.Printf("Saving new TLS cert for %v.", domain)
-	c.state.SaveTLSCert(domain, newCert)
-	return newCert, nil
+	return nil, err
+}
+
+// obtain registers the account with the CA if needed and gets a cert from it
+func (c *acmeCertGenerator) obtain(ca *acmeCA, domain string) (*tls.Certificate, error) {
+	if ca.account == nil {
+		account, err := fetchACMEAccount(ca.client, c.Contacts, ca.EAB)
+		if err != nil {
+			return nil, err
+		}
+		ca.account = account
+	}
+	return obtainACMECert(domain, ca.client, ca.account, c.Challenges)
 }
 
+// LogCAARecord logs the CAA record to use for the domain with the CA that
+// issued its cert, or the first -autocert_server.
 func (c *acmeCertGenerator) LogCAARecord(domain string) error {
-	_, err := logCAARecord(domain, c.Client, c.Account)
+	c.acmeMut.Lock()
+	defer c.acmeMut.Unlock()
+
+	ca := c.CAs[0]
+	directory := c.state.TLSCertDirectory(domain)
+	for _, other := range c.CAs {
+		if other.Directory == directory {
+			ca = other
+		}
+	}
+	if ca.account == nil {
+		account, err := fetchACMEAccount(ca.client, c.Contacts, ca.EAB)
+		if err != nil {
+			return err
+		}
+		ca.account = account
+	}
+	_, err := logCAARecord(domain, ca.client, ca.account)
 	return err
 }
 
-func makeCertGenerator(state *stateManager, challenges *acmeChallenges) (*acmeCertGenerator, error) {
+// The accounts are registered with the CAs when they're first used
+func makeCertGenerator(state *stateManager, challenges *acmeChallenges,
+	opts *acmeOptions) (*acmeCertGenerator, error) {
 	accountKey := state.ACMEAccount()
 	if accountKey == nil {
 		var err error
@@ -72,16 +175,14 @@ func makeCertGenerator(state *stateManager, challenges *acmeChallenges) (*acmeCe
 			return nil, err
 		}
 	}
-	client := acmeClient(accountKey)
-	account, err := fetchACMEAccount(client)
-	if err != nil {
-		return nil, err
+	for _, ca := range opts.CAs {
+		ca.client = acmeClient(accountKey, ca.Directory)
 	}
 	return &acmeCertGenerator{
 		Challenges: challenges,
 		AccountKey: accountKey,
-		Client:     client,
-		Account:    account,
+		Contacts:   opts.Contacts,
+		CAs:        opts.CAs,
 		state:      state,
 	}, nil
 }
@@ -99,12 +200,19 @@ func isPipeFile(files ...*os.File) bool {
 // into the cert cache.
 func startTLSRefresher(
 	tlsCert, tlsKey []*os.File,
-	domains []string, challenges *acmeChallenges,
-	state *stateManager, quit chan struct{}) *tlsRefresher {
+	domains []string, acmeOpts *acmeOptions, challenges *acmeChallenges,
+	state *stateManager, isLeader func() bool, upgrader *upgrader,
+	alerts *certAlerts, stapler *ocspStapler, quit chan struct{}) *tlsRefresher {
 
 	t := &tlsRefresher{
-		quit:  quit,
-		cache: make([]*atomic.Value, len(tlsCert)+len(domains)),
+		quit:     quit,
+		cache:    make([]*atomic.Value, len(tlsCert)+len(domains)),
+		status:   make([]*certStatus, len(tlsCert)+len(domains)),
+		isLeader: isLeader,
+		upgrader: upgrader,
+		alerts:   alerts,
+		stapler:  stapler,
+		state:    state,
 	}
 
 	// Handle the direct cert files / pipes from spawn
@@ -115,6 +223,17 @@ func startTLSRefresher(
 		t.cache[i] = &atomic.Value{}
 		cert := tlsCert[i]
 		key := tlsKey[i]
+		t.status[i] = &certStatus{
+			Source:  cert.Name(),
+			newCert: make(chan struct{}, 1),
+		}
+		if isPipeFile(cert) {
+			// Spawn sends the new cert and then SIGUSR1, so there's nothing to read
+			// until then. The force chan is left nil.
+			t.status[i].Source = fmt.Sprintf("spawn file #%v", i+1)
+		} else {
+			t.status[i].force = make(chan struct{}, 1)
+		}
 		if cert.Name() != key.Name() && (isPipeFile(cert) || isPipeFile(key)) {
 			log.Fatalf("Entry #%v: -tls_cert and -tls_key must being either both paths or both OS pipes for -auto_tls_certs.", i)
 		}
@@ -139,7 +258,7 @@ func startTLSRefresher(
 		idx := i // go loop variables are reused
 		t.cache[idx].Store(startCert)
 		go t.keepCertRefreshed(
-			startCert,
+			idx, startCert,
 			func() (*tls.Certificate, error) {
 				return t.refreshCertFile(idx, cert, key)
 			})
@@ -148,8 +267,7 @@ func startTLSRefresher(
 	// Handle the auto acme certs
 	if len(domains) > 0 {
 		var err error
-		// Note: This registers an acme account with the provider
-		t.generator, err = makeCertGenerator(state, challenges)
+		t.generator, err = makeCertGenerator(state, challenges, acmeOpts)
 		if err != nil {
 			log.Fatalf("Failed to start acme cert generator: %v", err)
 		}
@@ -158,6 +276,12 @@ func startTLSRefresher(
 		idx := i + len(tlsCert)
 		d := domain // go loop variables are reused
 		t.cache[idx] = &atomic.Value{}
+		t.status[idx] = &certStatus{
+			Source:  d,
+			ACME:    true,
+			force:   make(chan struct{}, 1),
+			newCert: make(chan struct{}, 1),
+		}
 		startCert := state.TLSCert(d)
 		if startCert == nil {
 			var err error
@@ -173,8 +297,20 @@ func startTLSRefresher(
 		}
 		t.cache[idx].Store(startCert)
 		go t.keepCertRefreshed(
-			startCert,
+			idx, startCert,
 			func() (*tls.Certificate, error) {
+				done, ok := t.upgrader.Busy()
+				if !ok {
+					// Quitting, the new portal renews it
+					return t.cache[idx].Load().(*tls.Certificate), nil
+				}
+				defer done()
+				if !t.isLeader() {
+					if cert := state.TLSCert(d); cert != nil && refreshTime(cert) > followerRenewGrace {
+						t.cache[idx].Store(cert)
+						return cert, nil
+					}
+				}
 				newCert, err := t.generator.Certificate(d)
 				if err != nil {
 					return nil, err
@@ -183,9 +319,32 @@ func startTLSRefresher(
 				return newCert, nil
 			})
 	}
+	go t.monitorExpiry()
+	if t.stapler != nil {
+		for i := range t.cache {
+			go t.keepStapleRefreshed(i)
+		}
+	}
 	return t
 }
 
+// monitorExpiry checks for certs close to expiring, which happens when the
+// refreshes fail or certbot doesn't renew a -tls_cert file.
+func (t *tlsRefresher) monitorExpiry() {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		for i := range t.cache {
+			t.alerts.Check(t.certInfo(i))
+		}
+		select {
+		case <-t.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func (t *tlsRefresher) refreshCertFile(idx int, cert, key *os.File) (*tls.Certificate, error) {
 	log.Printf("Starting TLS certificate refresh #%v...", idx+1)
 	var newCert *tls.Certificate
@@ -221,9 +380,11 @@ func refreshTime(c *tls.Certificate) time.Duration {
 }
 
 // Assumes startCert is not nil and startCert.Leaf is not nil
-func (t *tlsRefresher) keepCertRefreshed(startCert *tls.Certificate, refresh func() (*tls.Certificate, error)) {
+func (t *tlsRefresher) keepCertRefreshed(idx int, startCert *tls.Certificate, refresh func() (*tls.Certificate, error)) {
+	status := t.status[idx]
 	refreshIn := refreshTime(startCert)
 	log.Print("Running cert refresh in ", refreshIn)
+	status.update(refreshIn, nil, false)
 	timer := time.NewTimer(refreshIn)
 	defer timer.Stop()
 	sig := t.refreshSignal()
@@ -234,31 +395,110 @@ func (t *tlsRefresher) keepCertRefreshed(startCert *tls.Certificate, refresh fun
 			log.Print("Qutting cert refresh")
 			return
 		case <-sig:
-			// Stop and drain the timer channel for pre-go 1.23 compatibility.
-			// This is to fix channel misfires due to old data in the buffer.
-			// It is needed any time you call reset and we always do here.
-			if !timer.Stop() {
-				select {
-				case <-timer.C:
-				default:
-				}
-			}
+			stopTimer(timer)
+		case <-status.force:
+			stopTimer(timer)
 		case <-timer.C:
 		}
 		log.Print("Attempting cert refresh")
 		cert, err := refresh()
 		if err != nil {
-			log.Print("Error from cert refresh: ", err)
-			// TODO: exponential backoff or something?
-			timer.Reset(time.Minute)
+			status.mut.Lock()
+			retryIn := refreshBackoff(status.failures + 1)
+			status.mut.Unlock()
+			log.Printf("Error from cert refresh, retrying in %v: %v", retryIn, err)
+			timer.Reset(retryIn)
+			status.update(retryIn, err, true)
 		} else {
 			refreshIn := refreshTime(cert)
 			log.Print("Success! Running next cert refresh in ", refreshIn)
 			timer.Reset(refreshIn)
+			status.update(refreshIn, nil, true)
+			select {
+			case status.newCert <- struct{}{}:
+			default: // Already going to staple
+			}
+		}
+		t.alerts.Check(t.certInfo(idx))
+	}
+}
+
+// Stop and drain the timer channel for pre-go 1.23 compatibility.
+// This is to fix channel misfires due to old data in the buffer.
+// It is needed any time you call reset.
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+// update records the result of a refresh, or just the next refresh time if
+// refreshed is false
+func (s *certStatus) update(refreshIn time.Duration, err error, refreshed bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.nextRefresh = time.Now().Add(refreshIn)
+	if !refreshed {
+		return
+	}
+	if err != nil {
+		s.lastError = err.Error()
+		s.failures++
+	} else {
+		s.lastError = ""
+		s.failures = 0
+	}
+}
+
+// Refresh makes the certs refresh right away, except the ones spawn sends.
+func (t *tlsRefresher) Refresh() {
+	for _, status := range t.status {
+		select {
+		case status.force <- struct{}{}:
+		default: // Already going to refresh
 		}
 	}
 }
 
+// Certs returns the current serving certs and their refresh status.
+func (t *tlsRefresher) Certs() []certInfo {
+	var ret []certInfo
+	for i := range t.cache {
+		ret = append(ret, t.certInfo(i))
+	}
+	return ret
+}
+
+func (t *tlsRefresher) certInfo(idx int) certInfo {
+	status := t.status[idx]
+	info := certInfo{
+		Source: status.Source,
+		ACME:   status.ACME,
+	}
+	if info.ACME {
+		info.Directory = t.state.TLSCertDirectory(info.Source)
+	}
+	if cert, ok := t.cache[idx].Load().(*tls.Certificate); ok && cert != nil && cert.Leaf != nil {
+		info.Names = cert.Leaf.DNSNames
+		if len(info.Names) == 0 {
+			info.Names = []string{cert.Leaf.Subject.CommonName}
+		}
+		info.NotAfter = cert.Leaf.NotAfter
+		info.MustStaple = isMustStaple(cert.Leaf)
+	}
+	status.mut.Lock()
+	info.NextRefresh = status.nextRefresh
+	info.LastError = status.lastError
+	info.Failures = status.failures
+	info.StapleExpires = status.stapleExpires
+	status.mut.Unlock()
+	info.Health = t.alerts.Health(info)
+	return info
+}
+
 func (t *tlsRefresher) GetCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	for _, c := range t.cache {
 		cert, ok := c.Load().(*tls.Certificate)
@@ -340,10 +580,12 @@ func loadTLSCertFiles(tlsCert, tlsKey *os.File) (*tls.Certificate, error) {
 
 func loadTLSConfig(
 	tlsCertSpec, tlsKeySpec []string,
-	domains []string, challenges *acmeChallenges,
-	state *stateManager, quit chan struct{}) (*tls.Config, error) {
+	domains []string, acmeOpts *acmeOptions, challenges *acmeChallenges,
+	state *stateManager, isLeader func() bool, upgrader *upgrader, spawnStateKey bool,
+	alerts *certAlerts, stapler *ocspStapler,
+	quit chan struct{}) (*tls.Config, *tlsRefresher, error) {
 	if len(tlsCertSpec) != len(tlsKeySpec) {
-		return nil, fmt.Errorf("-tls_cert and -tls_key must have the same number of entries.")
+		return nil, nil, fmt.Errorf("-tls_cert and -tls_key must have the same number of entries.")
 	}
 
 	// Open the files from the flags
@@ -353,13 +595,13 @@ func loadTLSConfig(
 			continue // strings.Split returns this unfortunately
 		}
 		if cert, err := openFilePathOrFD(tlsCertSpec[i]); err != nil {
-			return nil, fmt.Errorf("Failed to load TLS cert file (%v): %w",
+			return nil, nil, fmt.Errorf("Failed to load TLS cert file (%v): %w",
 				tlsCertSpec[i], err)
 		} else {
 			tlsCert = append(tlsCert, cert)
 		}
 		if key, err := openFilePathOrFD(tlsKeySpec[i]); err != nil {
-			return nil, fmt.Errorf("Failed to load TLS key file (%v): %w",
+			return nil, nil, fmt.Errorf("Failed to load TLS key file (%v): %w",
 				tlsKeySpec[i], err)
 		} else {
 			tlsKey = append(tlsKey, key)
@@ -371,6 +613,9 @@ func loadTLSConfig(
 	spawnFiles, _ := strconv.Atoi(os.Getenv("SPAWN_FILES"))
 	startFD := 3 + spawnPorts // 3 is stdin, stdout, stderr
 	numFD := 3 + spawnPorts + spawnFiles
+	if spawnStateKey {
+		numFD -= 1 // The last file is the -state_key_file
+	}
 	if (numFD-startFD)%2 == 0 { // must have pairs of files for cert and key
 		for fd := startFD; fd < numFD; fd += 2 {
 			cert, err := openFilePathOrFD(strconv.Itoa(fd))
@@ -401,14 +646,16 @@ func loadTLSConfig(
 	if len(tlsCert) == 0 && len(domains) == 0 {
 		log.Printf("Warning: no TLS certificate loaded. Using a self-signed certificate.")
 		log.Printf("If you set -autocert_domains=example.com you will get a https://letsencrypt.org certificate automatically.")
-		return tools.AutorenewSelfSignedCertificate( /*hostname*/ "*",
+		conf, err := tools.AutorenewSelfSignedCertificate( /*hostname*/ "*",
 			3*24*time.Hour, false /*isCA*/, nil /*onRenew*/, quit)
+		return conf, nil, err
 	}
 
-	refresher := startTLSRefresher(tlsCert, tlsKey, domains, challenges, state, quit)
+	refresher := startTLSRefresher(tlsCert, tlsKey, domains, acmeOpts, challenges,
+		state, isLeader, upgrader, alerts, stapler, quit)
 	return &tls.Config{
 		GetCertificate: refresher.GetCertificate,
-	}, nil
+	}, refresher, nil
 }
 
 func openFilePathOrFD(pathOrFD string) (*os.File, error) {
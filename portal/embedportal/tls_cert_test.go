@@ -0,0 +1,66 @@
+package embedportal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestACMECertGenerator_Fallback(t *testing.T) {
+	// CAs that are always down, counting the requests so we know which was used
+	var requests [2]atomic.Int32
+	var directories []string
+	for i := range requests {
+		count := &requests[i]
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			count.Add(1)
+			http.NotFound(w, req)
+		}))
+		defer srv.Close()
+		directories = append(directories, srv.URL)
+	}
+	opts := &acmeOptions{}
+	for _, directory := range directories {
+		opts.CAs = append(opts.CAs, &acmeCA{Directory: directory})
+	}
+	c, err := makeCertGenerator(newStateManager("", nil, nil), &acmeChallenges{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Returns which CAs got requests for one Certificate call
+	certificate := func() [2]bool {
+		t.Helper()
+		var before [2]int32
+		for i := range requests {
+			before[i] = requests[i].Load()
+		}
+		if _, err := c.Certificate("example.com"); err == nil {
+			t.Fatal("Expected an error from CAs that are down")
+		}
+		var used [2]bool
+		for i := range requests {
+			used[i] = requests[i].Load() > before[i]
+		}
+		return used
+	}
+
+	for i := 1; i < acmeFallbackFailures; i++ {
+		if used := certificate(); used != [2]bool{true, false} {
+			t.Fatalf("Failure %v should only use the first CA, used: %v", i, used)
+		}
+	}
+	if used := certificate(); used != [2]bool{true, true} {
+		t.Fatalf("The last failure should fall back to the second CA, used: %v", used)
+	}
+	if used := certificate(); used != [2]bool{false, true} {
+		t.Fatalf("Should use the fallback until the timeout, used: %v", used)
+	}
+
+	// After the timeout the first CA gets another chance
+	c.CAs[0].lastFailure = time.Now().Add(-acmeFallbackTimeout)
+	if used := certificate(); used != [2]bool{true, true} {
+		t.Fatalf("Should try the first CA again after the timeout, used: %v", used)
+	}
+}
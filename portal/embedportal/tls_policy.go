@@ -0,0 +1,199 @@
+package embedportal
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"ask.systems/daemon/internal/portalpb"
+	"google.golang.org/protobuf/encoding/prototext"
+)
+
+// The Strict-Transport-Security max-age used for hostnames without one in
+// their policy
+const defaultHSTSMaxAge = 300
+
+// tlsPolicy is a parsed portalpb.TLSPolicy
+type tlsPolicy struct {
+	// Zero for the defaults
+	MinVersion uint16
+	// nil for the defaults
+	CipherSuites []uint16
+	NextProtos   []string
+
+	HSTSMaxAge            int64 // 0 for the default, -1 for off
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+	HTTPSOnly             bool
+}
+
+// Used for the hostnames without a policy
+var noTLSPolicy = &tlsPolicy{}
+
+type tlsPolicySet struct {
+	exact map[string]*tlsPolicy
+	// Keyed by the parent domain, example.com for *.example.com
+	wildcard map[string]*tlsPolicy
+	fallback *tlsPolicy
+}
+
+// tlsPolicies has the -tls_policy_file policies. The zero value has no
+// policies.
+type tlsPolicies struct {
+	set atomic.Pointer[tlsPolicySet]
+}
+
+// Load replaces the policies with the ones in the file. The old policies are
+// kept if there's an error.
+func (p *tlsPolicies) Load(filename string) error {
+	text, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	config := &portalpb.TLSPolicies{}
+	if err := prototext.Unmarshal(text, config); err != nil {
+		return err
+	}
+	set := &tlsPolicySet{
+		exact:    make(map[string]*tlsPolicy),
+		wildcard: make(map[string]*tlsPolicy),
+	}
+	for i, pb := range config.Policy {
+		policy, err := parseTLSPolicy(pb)
+		if err != nil {
+			return fmt.Errorf("Invalid policy #%v (%#v): %w", i+1, pb.Hostname, err)
+		}
+		hostname := strings.ToLower(pb.Hostname)
+		var duplicate bool
+		switch {
+		case hostname == "" || hostname == "*":
+			duplicate = set.fallback != nil
+			set.fallback = policy
+		case strings.HasPrefix(hostname, "*."):
+			_, duplicate = set.wildcard[hostname[2:]]
+			set.wildcard[hostname[2:]] = policy
+		default:
+			_, duplicate = set.exact[hostname]
+			set.exact[hostname] = policy
+		}
+		if duplicate {
+			return fmt.Errorf("There is more than one policy for %#v", pb.Hostname)
+		}
+	}
+	p.set.Store(set)
+	return nil
+}
+
+func parseTLSPolicy(pb *portalpb.TLSPolicy) (*tlsPolicy, error) {
+	policy := &tlsPolicy{
+		HSTSMaxAge:            pb.HstsMaxAgeSeconds,
+		HSTSIncludeSubdomains: pb.HstsIncludeSubdomains,
+		HSTSPreload:           pb.HstsPreload,
+		HTTPSOnly:             pb.HttpsOnly,
+		NextProtos:            pb.Alpn,
+	}
+	switch pb.MinVersion {
+	case "":
+	case "1.0":
+		policy.MinVersion = tls.VersionTLS10
+	case "1.1":
+		policy.MinVersion = tls.VersionTLS11
+	case "1.2":
+		policy.MinVersion = tls.VersionTLS12
+	case "1.3":
+		policy.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("Unknown min_version %#v, use 1.0, 1.1, 1.2, or 1.3", pb.MinVersion)
+	}
+	if len(pb.CipherSuites) > 0 {
+		ids := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			ids[suite.Name] = suite.ID
+		}
+		for _, name := range pb.CipherSuites {
+			id, ok := ids[name]
+			if !ok {
+				return nil, fmt.Errorf("Unknown or insecure cipher suite %#v", name)
+			}
+			policy.CipherSuites = append(policy.CipherSuites, id)
+		}
+	}
+	if policy.HSTSMaxAge < -1 {
+		return nil, fmt.Errorf("hsts_max_age_seconds must be -1 or more, got %v", policy.HSTSMaxAge)
+	}
+	return policy, nil
+}
+
+// Lookup returns the most specific policy for the hostname, which may have a
+// port. Returns noTLSPolicy if no policy matches.
+func (p *tlsPolicies) Lookup(hostname string) *tlsPolicy {
+	set := p.set.Load()
+	if set == nil {
+		return noTLSPolicy
+	}
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if policy, ok := set.exact[hostname]; ok {
+		return policy
+	}
+	if _, parent, ok := strings.Cut(hostname, "."); ok {
+		if policy, ok := set.wildcard[parent]; ok {
+			return policy
+		}
+	}
+	if set.fallback != nil {
+		return set.fallback
+	}
+	return noTLSPolicy
+}
+
+// ConfigForClient returns a tls.Config.GetConfigForClient function that
+// applies the policy for the SNI hostname to a copy of the base config.
+func (p *tlsPolicies) ConfigForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		policy := p.Lookup(hello.ServerName)
+		if policy == noTLSPolicy {
+			return nil, nil // Use the base config
+		}
+		conf := base.Clone()
+		if policy.MinVersion != 0 {
+			conf.MinVersion = policy.MinVersion
+		}
+		if policy.CipherSuites != nil {
+			conf.CipherSuites = policy.CipherSuites
+		}
+		if policy.NextProtos != nil {
+			conf.NextProtos = policy.NextProtos
+		}
+		return conf, nil
+	}
+}
+
+// HSTSHeader returns the Strict-Transport-Security header value for the
+// policy, or empty if it shouldn't be sent. allowsHTTP is true if a
+// registration for the hostname sets allow_http.
+func (policy *tlsPolicy) HSTSHeader(allowsHTTP bool) string {
+	maxAge := policy.HSTSMaxAge
+	switch {
+	case maxAge < 0:
+		return ""
+	case maxAge == 0:
+		if allowsHTTP && !policy.HTTPSOnly {
+			return ""
+		}
+		maxAge = defaultHSTSMaxAge
+	}
+	header := fmt.Sprintf("max-age=%v", maxAge)
+	if policy.HSTSIncludeSubdomains {
+		header += "; includeSubDomains"
+	}
+	if policy.HSTSPreload {
+		header += "; preload"
+	}
+	return header
+}
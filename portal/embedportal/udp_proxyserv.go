@@ -0,0 +1,506 @@
+package embedportal
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"ask.systems/daemon/internal/portalpb"
+	"github.com/pion/dtls/v3"
+)
+
+// The RegisterRequest.Pattern prefix for udp proxies
+const udpProxyPrefix = ":udp"
+
+// The largest UDP datagram
+const maxDatagramSize = 65535
+
+// udpProxy relays datagrams between public clients and the backends for
+// ":udp:port" patterns.
+//
+// UDP has no connections so portal tracks a session for each client address
+// with its own socket to the backend, so the backend can tell the clients
+// apart and portal knows where to send the replies. Sessions are closed after
+// they are idle for the idleTimeout and there can be at most maxSessions per
+// registration.
+type udpProxy struct {
+	clientLeasor *clientLeasor
+	tlsConfig    *tls.Config
+	quit         chan struct{}
+	idleTimeout  time.Duration
+	maxSessions  int
+	leases       sync.Map // map from pattern to *udpLease
+	// The -bind_address list to listen on
+	bindAddrs bindAddrs
+	// Hands the sockets to a new portal when upgrading
+	upgrader *upgrader
+}
+
+type udpLease struct {
+	// Stops the forwarder, safe to call more than once
+	Cancel func()
+	Lease  *portalpb.Lease
+}
+
+func makeUDPProxy(l *clientLeasor, tlsConfig *tls.Config, bindAddrs bindAddrs,
+	idleTimeout time.Duration, maxSessions int, upgrader *upgrader,
+	quit chan struct{}) *udpProxy {
+
+	p := &udpProxy{
+		clientLeasor: l,
+		tlsConfig:    tlsConfig,
+		quit:         quit,
+		idleTimeout:  idleTimeout,
+		maxSessions:  maxSessions,
+		bindAddrs:    bindAddrs,
+		upgrader:     upgrader,
+	}
+	l.OnCancel(p.Unregister)
+	return p
+}
+
+func (p *udpProxy) Unregister(lease *portalpb.Lease) {
+	val, _ := p.leases.Load(lease.GetPattern())
+	if l, ok := val.(*udpLease); ok && l != nil {
+		l.Cancel()
+		p.leases.Delete(lease.Pattern)
+		p.upgrader.Untrack(lease.Pattern)
+	}
+}
+
+func (p *udpProxy) Register(clientAddr string, request *portalpb.RegisterRequest, fixedTimeout time.Time) (*portalpb.Lease, error) {
+	if isDirectResponse(request) {
+		return nil, fmt.Errorf("Redirects and static responses are only supported for HTTP patterns.")
+	}
+	port := strings.TrimPrefix(request.Pattern, udpProxyPrefix)
+	publicPort, err := parsePatternPort(port)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid UDP pattern %#v: %v", request.Pattern, err)
+	}
+	// The addresses to listen on for DTLS, all interfaces by default
+	laddrs := []*net.UDPAddr{{Port: publicPort}}
+	if len(p.bindAddrs) > 0 {
+		laddrs = nil
+		for _, addr := range p.bindAddrs {
+			laddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(addr, strconv.Itoa(publicPort)))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid -bind_address %v: %v", addr, err)
+			}
+			laddrs = append(laddrs, laddr)
+		}
+	}
+	// Closed to stop the forwarder. Every error return below must cancel, the
+	// lease isn't in p.leases yet so Unregister doesn't.
+	cancelLease := make(chan struct{})
+	cancel := sync.OnceFunc(func() { close(cancelLease) })
+	go func() {
+		select {
+		case <-p.quit:
+			cancel()
+		case <-cancelLease:
+			return
+		}
+	}()
+	leasor := p.clientLeasor.PortLeasorForClient(clientAddr)
+
+	val, _ := p.leases.Load(request.Pattern)
+	if l, ok := val.(*udpLease); ok && l != nil {
+		log.Printf("Replacing existing lease with the same pattern: %#v", request.Pattern)
+		leasor.Unregister(l.Lease) // calls udpProxy.Unregister
+	}
+
+	lease, err := leasor.Register(request, fixedTimeout)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	var host string
+	if request.Hostname != "" {
+		host = request.Hostname
+	} else {
+		host = clientAddr
+	}
+	hostPort := backendAddress(host, lease.Port)
+	backend, err := net.ResolveUDPAddr("udp", hostPort)
+	if err != nil {
+		cancel()
+		leasor.Unregister(lease)
+		return nil, fmt.Errorf("Failed to resolve the UDP backend address (%v): %v", hostPort, err)
+	}
+	f := &udpForwarder{
+		backend:     backend,
+		idleTimeout: p.idleTimeout,
+		maxSessions: p.maxSessions,
+		quit:        cancelLease,
+	}
+	// hopefully the old listener has closed by now
+	if request.Dtls {
+		for _, laddr := range laddrs {
+			err = f.startDTLS(laddr, p.tlsConfig)
+			if errors.Is(err, syscall.EADDRINUSE) && p.upgrader.Inheriting() {
+				// DTLS sockets can't be handed over, the old portal closes it when it
+				// exits after the upgrade.
+				go f.retryDTLS(laddr, p.tlsConfig)
+				err = nil
+			}
+			if err != nil {
+				break
+			}
+		}
+	} else {
+		var publicConns []*net.UDPConn
+		publicConns, err = p.listen(request.Pattern, publicPort)
+		if err == nil {
+			f.start(publicConns)
+		}
+	}
+	if err != nil {
+		// Closes the DTLS listeners that started and stops retryDTLS
+		cancel()
+		leasor.Unregister(lease)
+		return nil, fmt.Errorf("Failed to listen on the requested port for UDP Proxy (%v): %v", lease.Port, err)
+	}
+	if request.Dtls {
+		log.Printf("Registered a UDP proxy forwarding %v (DTLS) to %v.", port, hostPort)
+	} else {
+		log.Printf("Registered a UDP proxy forwarding %v to %v.", port, hostPort)
+	}
+	p.leases.Store(request.Pattern, &udpLease{
+		Lease:  lease,
+		Cancel: cancel,
+	})
+	return lease, nil
+}
+
+// udpForwarder relays the datagrams for one registration
+type udpForwarder struct {
+	backend     *net.UDPAddr
+	idleTimeout time.Duration
+	maxSessions int
+	quit        chan struct{}
+
+	mut      sync.Mutex
+	sessions map[string]*udpSession // by client address
+	// True if we already logged that the table is full since the last cleanup
+	loggedFull bool
+}
+
+// udpSession is one client's socket to the backend
+type udpSession struct {
+	ClientAddr  net.Addr
+	BackendConn *net.UDPConn
+	// Unix nano time of the last datagram in either direction
+	LastActive atomic.Int64
+}
+
+func (s *udpSession) touch() {
+	s.LastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idleSince(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, s.LastActive.Load()))
+}
+
+// listen returns the sockets from the old portal when upgrading, otherwise it
+// listens on the port at each of the -bind_address addresses.
+func (p *udpProxy) listen(pattern string, port int) ([]*net.UDPConn, error) {
+	conns, err := listenUDP(p.upgrader, pattern, p.bindAddrs, port)
+	if err != nil {
+		return nil, err
+	}
+	var publicConns []*net.UDPConn
+	for _, conn := range conns {
+		publicConn, ok := conn.(*net.UDPConn)
+		if !ok {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, fmt.Errorf("The socket for %v is a %T, not UDP", pattern, conn)
+		}
+		publicConns = append(publicConns, publicConn)
+	}
+	return publicConns, nil
+}
+
+// start relays the plain UDP datagrams from the publicConns
+func (f *udpForwarder) start(publicConns []*net.UDPConn) {
+	f.sessions = make(map[string]*udpSession)
+	go func() {
+		<-f.quit // stop listening when we quit
+		for _, publicConn := range publicConns {
+			publicConn.Close()
+		}
+		f.mut.Lock()
+		for key, s := range f.sessions {
+			s.BackendConn.Close()
+			delete(f.sessions, key)
+		}
+		f.mut.Unlock()
+	}()
+	go f.closeIdleSessions()
+	for _, publicConn := range publicConns {
+		go f.relay(publicConn)
+	}
+}
+
+// relay sends the datagrams from the publicConn to the backend, in the
+// session for each client
+func (f *udpForwarder) relay(publicConn *net.UDPConn) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, clientAddr, err := publicConn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Failed to read from UDP Proxy client (backend: %v): %v", f.backend, err)
+			continue
+		}
+		s := f.session(publicConn, clientAddr)
+		if s == nil {
+			continue // dropped
+		}
+		s.touch()
+		if _, err := s.BackendConn.Write(buf[:n]); err != nil {
+			log.Printf("Failed to write to UDP Proxy backend %v: %v", f.backend, err)
+		}
+	}
+}
+
+// session returns the session for the client, creating it if needed. Returns
+// nil if the datagram should be dropped.
+func (f *udpForwarder) session(publicConn *net.UDPConn, clientAddr *net.UDPAddr) *udpSession {
+	key := clientAddr.String()
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if s, ok := f.sessions[key]; ok {
+		return s
+	}
+	if len(f.sessions) >= f.maxSessions {
+		if !f.loggedFull {
+			log.Printf("UDP Proxy for backend %v has the max %v sessions, dropping datagrams from new clients.",
+				f.backend, f.maxSessions)
+			f.loggedFull = true
+		}
+		return nil
+	}
+	backendConn, err := net.DialUDP("udp", nil, f.backend)
+	if err != nil {
+		log.Printf("Failed to connect to UDP Proxy backend (for client %v): %v", clientAddr, err)
+		return nil
+	}
+	s := &udpSession{
+		ClientAddr:  clientAddr,
+		BackendConn: backendConn,
+	}
+	s.touch()
+	f.sessions[key] = s
+	log.Printf("UDP Proxy session started; user: %v -> backend: %v. Appears to backend as %v",
+		clientAddr, f.backend, backendConn.LocalAddr())
+	// Relay the replies
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := backendConn.Read(buf)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("Failed to read from UDP Proxy backend %v: %v", f.backend, err)
+				}
+				break
+			}
+			s.touch()
+			publicConn.WriteToUDP(buf[:n], clientAddr)
+		}
+		f.mut.Lock()
+		if f.sessions[key] == s {
+			delete(f.sessions, key)
+		}
+		f.mut.Unlock()
+		backendConn.Close()
+	}()
+	return s
+}
+
+// closeIdleSessions periodically closes the sessions that have been idle for
+// the idleTimeout, until quit.
+func (f *udpForwarder) closeIdleSessions() {
+	ticker := time.NewTicker(max(f.idleTimeout/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.quit:
+			return
+		case now := <-ticker.C:
+			f.mut.Lock()
+			for key, s := range f.sessions {
+				if s.idleSince(now) > f.idleTimeout {
+					delete(f.sessions, key)
+					s.BackendConn.Close()
+					log.Printf("UDP Proxy session closed after being idle; user: %v -> backend: %v",
+						s.ClientAddr, f.backend)
+				}
+			}
+			f.loggedFull = false
+			f.mut.Unlock()
+		}
+	}
+}
+
+// startDTLS listens for DTLS connections using the portal serving
+// certificate and relays the decrypted datagrams to the backend.
+func (f *udpForwarder) startDTLS(laddr *net.UDPAddr, tlsConfig *tls.Config) error {
+	listener, err := dtls.Listen("udp", laddr, &dtls.Config{
+		GetCertificate: func(hello *dtls.ClientHelloInfo) (*tls.Certificate, error) {
+			return tlsConfig.GetCertificate(dtlsHelloToTLS(hello))
+		},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-f.quit // stop listening when we quit
+		listener.Close()
+	}()
+	var sessions atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-f.quit: // the listener was closed
+				default:
+					log.Printf("Failed to accept user connection on UDP Proxy (backend: %v): %v",
+						f.backend, err)
+				}
+				return
+			}
+			if int(sessions.Add(1)) > f.maxSessions {
+				sessions.Add(-1)
+				log.Printf("UDP Proxy for backend %v has the max %v sessions, rejected DTLS client %v",
+					f.backend, f.maxSessions, conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+			go func() {
+				f.relayDTLS(conn)
+				sessions.Add(-1)
+			}()
+		}
+	}()
+	return nil
+}
+
+// retryDTLS calls startDTLS until the port is free or quit
+func (f *udpForwarder) retryDTLS(laddr *net.UDPAddr, tlsConfig *tls.Config) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.quit:
+			return
+		case <-ticker.C:
+		}
+		err := f.startDTLS(laddr, tlsConfig)
+		if err == nil {
+			log.Printf("Started the DTLS UDP proxy on %v for backend %v", laddr, f.backend)
+			return
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			log.Printf("Failed to listen for the DTLS UDP proxy (backend: %v): %v", f.backend, err)
+			return
+		}
+	}
+}
+
+// relayDTLS relays datagrams between the DTLS client conn and the backend
+// until either side closes, the session is idle for idleTimeout, or quit.
+func (f *udpForwarder) relayDTLS(publicConn net.Conn) {
+	defer publicConn.Close()
+	backendConn, err := net.DialUDP("udp", nil, f.backend)
+	if err != nil {
+		log.Printf("Failed to connect to UDP Proxy backend (for client %v): %v",
+			publicConn.RemoteAddr(), err)
+		return
+	}
+	defer backendConn.Close()
+	s := &udpSession{
+		ClientAddr:  publicConn.RemoteAddr(),
+		BackendConn: backendConn,
+	}
+	s.touch()
+	log.Printf("UDP Proxy session started; user: %v (DTLS) -> backend: %v. Appears to backend as %v",
+		publicConn.RemoteAddr(), f.backend, backendConn.LocalAddr())
+
+	done := make(chan struct{})
+	var closeOnce sync.Once
+	closeAll := func() {
+		closeOnce.Do(func() {
+			close(done)
+			publicConn.Close()
+			backendConn.Close()
+		})
+	}
+	go func() {
+		select {
+		case <-f.quit:
+		case <-done:
+		}
+		closeAll()
+	}()
+	go func() {
+		f.copyDatagrams(backendConn, publicConn, s)
+		closeAll()
+	}()
+	f.copyDatagrams(publicConn, backendConn, s)
+	closeAll()
+	log.Printf("UDP Proxy session closed; user: %v (DTLS) -> backend: %v",
+		publicConn.RemoteAddr(), f.backend)
+}
+
+// copyDatagrams reads datagrams from src and writes them to dst until there's
+// an error or the session has been idle for the idleTimeout.
+func (f *udpForwarder) copyDatagrams(dst, src net.Conn, s *udpSession) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		src.SetReadDeadline(time.Now().Add(f.idleTimeout))
+		n, err := src.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() &&
+				s.idleSince(time.Now()) < f.idleTimeout {
+				continue // The other direction is still active
+			}
+			return
+		}
+		s.touch()
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// dtlsHelloToTLS converts the DTLS client hello to the crypto/tls type so we
+// can use the same GetCertificate function as for TLS. DTLS 1.2 is equivalent
+// to TLS 1.2.
+func dtlsHelloToTLS(hello *dtls.ClientHelloInfo) *tls.ClientHelloInfo {
+	cipherSuites := make([]uint16, len(hello.CipherSuites))
+	for i, id := range hello.CipherSuites {
+		cipherSuites[i] = uint16(id)
+	}
+	return &tls.ClientHelloInfo{
+		ServerName:        hello.ServerName,
+		CipherSuites:      cipherSuites,
+		SupportedVersions: []uint16{tls.VersionTLS12},
+		SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+		SupportedPoints:   []uint8{0}, // uncompressed
+	}
+}
@@ -0,0 +1,64 @@
+package embedportal
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"ask.systems/daemon/internal/portalpb"
+)
+
+// Test that when DTLS fails to start on one of the -bind_address addresses
+// the listeners that already started are closed.
+func TestUDPProxy_DTLSBindFailure(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	// Find a port that's free on both addresses and hold it on the second one
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+	blocker, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.2:%v", port))
+	if err != nil {
+		t.Skipf("Needs to listen on 127.0.0.2: %v", err)
+	}
+	defer blocker.Close()
+
+	upgrader, err := newUpgrader("", quit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leasor := makeClientLeasor(9000, 9999, nil, func() bool { return true }, upgrader, quit)
+	p := makeUDPProxy(leasor, &tls.Config{}, bindAddrs{"127.0.0.1", "127.0.0.2"},
+		time.Minute, 10, upgrader, quit)
+	pattern := fmt.Sprintf("%v:%v", udpProxyPrefix, port)
+	_, err = p.Register("127.0.0.1", &portalpb.RegisterRequest{
+		Pattern: pattern,
+		Dtls:    true,
+	}, time.Time{})
+	if err == nil || !strings.Contains(err.Error(), "Failed to listen") {
+		t.Fatalf("Expected a listen error when the port is in use on the second address, got: %v", err)
+	}
+	if _, ok := p.leases.Load(pattern); ok {
+		t.Error("The failed registration is in the leases")
+	}
+
+	// The listener on the first address closes in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%v", port))
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The DTLS listener on the first address is still open: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,261 @@
+package embedportal
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// When this env var is set portal gets its listening sockets from the portal
+// that is already running, over the -upgrade_socket, instead of listening.
+// Spawn sets it when it restarts portal.
+const upgradeEnv = "PORTAL_UPGRADE"
+
+// How long the old portal waits for the new one to load the state and start
+const upgradeReadyTimeout = 2 * time.Minute
+
+// upgrader hands the listening sockets to a new portal process so portal can
+// restart or be upgraded without closing the ports. The old process keeps
+// serving until the new one is ready, then it drains and exits.
+//
+// The RPC calls that arrive at the old process during the handoff wait until
+// it is done. If the new process took over they fail with Unavailable so the
+// clients retry on the new process, which has the same registrations because
+// it loaded the state after the old process stopped changing it. The
+// background work that changes the state, like expiring leases and renewing
+// certs, is paused with Busy.
+type upgrader struct {
+	socketPath string
+	quit       chan struct{}
+
+	mut sync.Mutex
+	// The sockets to hand to the next process by name
+	sockets map[string]socketFile
+	// Closed when the handoff in progress is done. Nil if there isn't one.
+	handoff  chan struct{}
+	upgraded bool
+	// The Busy calls that haven't called done. Only added to when there's no
+	// handoff.
+	busy sync.WaitGroup
+
+	// The sockets from the old process, when we were started for an upgrade.
+	// They are removed when used.
+	inherited map[string]*os.File
+	// Used to tell the old process we're ready, nil after we have
+	oldConn *net.UnixConn
+}
+
+// socketFile is implemented by *net.TCPListener, *net.UDPConn, and
+// *net.UnixListener
+type socketFile interface {
+	File() (*os.File, error)
+}
+
+// Listener returns the inherited listener with the name or nil if there isn't
+// one.
+func (u *upgrader) Listener(name string) net.Listener {
+	f := u.takeInherited(name)
+	if f == nil {
+		return nil
+	}
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		log.Printf("Failed to use the %v listener from the old portal: %v", name, err)
+		return nil
+	}
+	return l
+}
+
+// PacketConn returns the inherited UDP socket with the name or nil if there
+// isn't one.
+func (u *upgrader) PacketConn(name string) net.PacketConn {
+	f := u.takeInherited(name)
+	if f == nil {
+		return nil
+	}
+	defer f.Close()
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		log.Printf("Failed to use the %v socket from the old portal: %v", name, err)
+		return nil
+	}
+	return conn
+}
+
+func (u *upgrader) takeInherited(name string) *os.File {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	f := u.inherited[name]
+	delete(u.inherited, name)
+	return f
+}
+
+// Inheriting is true when we were started for an upgrade and the old process
+// hasn't been told we're ready yet, so it still has its sockets open.
+func (u *upgrader) Inheriting() bool {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	return u.oldConn != nil
+}
+
+// Upgraded returns true if a new process took over the sockets
+func (u *upgrader) Upgraded() bool {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	return u.upgraded
+}
+
+// Track adds a socket to hand to the next process. The socket must be the raw
+// socket (without TLS or PROXY protocol wrappers) or it is ignored.
+func (u *upgrader) Track(name string, socket any) {
+	s, ok := socket.(socketFile)
+	if !ok {
+		log.Printf("Can't hand %v to a new portal when upgrading, it is a %T", name, socket)
+		return
+	}
+	u.mut.Lock()
+	u.sockets[name] = s
+	u.mut.Unlock()
+}
+
+// Untrack removes the sockets with the name, for all of the bind addresses
+func (u *upgrader) Untrack(name string) {
+	u.mut.Lock()
+	for key := range u.sockets {
+		if key == name || strings.HasPrefix(key, name+"@") {
+			delete(u.sockets, key)
+		}
+	}
+	u.mut.Unlock()
+}
+
+// Hold waits while there is a handoff in progress. Returns an Unavailable
+// error if the new process took over, so the RPC isn't handled here.
+func (u *upgrader) Hold(ctx context.Context) error {
+	u.mut.Lock()
+	handoff := u.handoff
+	u.mut.Unlock()
+	if handoff != nil {
+		select {
+		case <-handoff:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	if u.upgraded {
+		return status.Error(codes.Unavailable, "Portal restarted for an upgrade, try again.")
+	}
+	return nil
+}
+
+// Busy waits while there is a handoff in progress, then keeps a new one from
+// starting until done is called. Used for the background work that changes
+// the state. Returns false if the new process took over, then the work should
+// be skipped.
+func (u *upgrader) Busy() (done func(), ok bool) {
+	u.mut.Lock()
+	for u.handoff != nil {
+		handoff := u.handoff
+		u.mut.Unlock()
+		<-handoff
+		u.mut.Lock()
+	}
+	defer u.mut.Unlock()
+	if u.upgraded {
+		return nil, false
+	}
+	u.busy.Add(1)
+	return sync.OnceFunc(u.busy.Done), true
+}
+
+// Ready tells the old process that we have loaded the state and are serving,
+// so it can drain and exit. Closes the inherited sockets that weren't used.
+func (u *upgrader) Ready() {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	for name, f := range u.inherited {
+		log.Printf("Closing the %v socket from the old portal, it wasn't used", name)
+		f.Close()
+	}
+	u.inherited = nil
+	if u.oldConn == nil {
+		return
+	}
+	if _, err := u.oldConn.Write([]byte("ready\n")); err != nil {
+		log.Print("Failed to tell the old portal we're ready: ", err)
+	} else {
+		log.Print("Took over from the old portal.")
+	}
+	u.oldConn.Close()
+	u.oldConn = nil
+}
+
+// beginHandoff returns the sockets to send to the new process, sorted by
+// name, after the Busy work is done. Returns false if there's already a
+// handoff or one finished.
+func (u *upgrader) beginHandoff() (names []string, files []*os.File, ok bool) {
+	u.mut.Lock()
+	if u.handoff != nil || u.upgraded {
+		u.mut.Unlock()
+		return nil, nil, false
+	}
+	u.handoff = make(chan struct{})
+	u.mut.Unlock()
+	// So the new process loads the state after the changes
+	u.busy.Wait()
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	for name := range u.sockets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sent []string
+	for _, name := range names {
+		// Note: File returns a dup of the socket, closing it doesn't close ours
+		f, err := u.sockets[name].File()
+		if err != nil {
+			log.Printf("Failed to get the %v socket for the new portal: %v", name, err)
+			continue
+		}
+		sent = append(sent, name)
+		files = append(files, f)
+	}
+	return sent, files, true
+}
+
+// finishHandoff lets the held RPCs continue and quits if the new process took
+// over.
+func (u *upgrader) finishHandoff(upgraded bool) {
+	u.mut.Lock()
+	u.upgraded = upgraded
+	close(u.handoff)
+	u.handoff = nil
+	if upgraded {
+		// The new process is listening on the same paths now
+		for _, s := range u.sockets {
+			if l, ok := s.(*net.UnixListener); ok {
+				l.SetUnlinkOnClose(false)
+			}
+		}
+	}
+	u.mut.Unlock()
+	if !upgraded {
+		return
+	}
+	select {
+	case <-u.quit:
+	default:
+		close(u.quit)
+	}
+}
@@ -0,0 +1,56 @@
+package embedportal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpgrader_Busy(t *testing.T) {
+	u := &upgrader{
+		quit:    make(chan struct{}),
+		sockets: make(map[string]socketFile),
+	}
+	done, ok := u.Busy()
+	if !ok {
+		t.Fatal("Busy should work before an upgrade")
+	}
+
+	// The handoff waits for the work that started before it
+	handoffStarted := make(chan struct{})
+	go func() {
+		u.beginHandoff()
+		close(handoffStarted)
+	}()
+	select {
+	case <-handoffStarted:
+		t.Fatal("The handoff started while the state was changing")
+	case <-time.After(50 * time.Millisecond):
+	}
+	done()
+	select {
+	case <-handoffStarted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The handoff didn't start after the work was done")
+	}
+
+	// New work waits for the handoff and is skipped if the new process took over
+	result := make(chan bool)
+	go func() {
+		_, ok := u.Busy()
+		result <- ok
+	}()
+	select {
+	case <-result:
+		t.Fatal("Busy returned during the handoff")
+	case <-time.After(50 * time.Millisecond):
+	}
+	u.finishHandoff(true)
+	select {
+	case ok := <-result:
+		if ok {
+			t.Error("Busy should return false after the new process took over")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Busy didn't return after the handoff")
+	}
+}
@@ -0,0 +1,281 @@
+//go:build !windows
+
+package embedportal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The most sockets to send in one message, the kernel limit is 253
+const maxSocketsPerMessage = 200
+
+// newUpgrader receives the sockets from the running portal if portal was
+// started for an upgrade, then listens on the socketPath for the next one. It
+// also starts a new portal process when we get SIGUSR2.
+func newUpgrader(socketPath string, quit chan struct{}) (*upgrader, error) {
+	u := &upgrader{
+		socketPath: socketPath,
+		quit:       quit,
+		sockets:    make(map[string]socketFile),
+	}
+	if os.Getenv(upgradeEnv) != "" {
+		if socketPath == "" {
+			return nil, fmt.Errorf("%v is set but -upgrade_socket is empty.", upgradeEnv)
+		}
+		if err := u.receive(); err != nil {
+			return nil, fmt.Errorf("Failed to get the sockets from the running portal: %w", err)
+		}
+	}
+	if socketPath == "" {
+		return u, nil
+	}
+	l, err := u.listen()
+	if err != nil {
+		return nil, err
+	}
+	u.Track("upgrade", l)
+	go u.serve(l)
+	go u.startOnSignal()
+	return u, nil
+}
+
+// listen uses the socket from the old portal or listens on the socketPath,
+// replacing the file if no one is listening on it.
+func (u *upgrader) listen() (*net.UnixListener, error) {
+	if l := u.Listener("upgrade"); l != nil {
+		if ul, ok := l.(*net.UnixListener); ok {
+			return ul, nil
+		}
+		l.Close()
+	}
+	addr := &net.UnixAddr{Name: u.socketPath, Net: "unix"}
+	l, err := net.ListenUnix("unix", addr)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		if conn, dialErr := net.DialUnix("unix", nil, addr); dialErr == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Another portal is listening on the -upgrade_socket %v", u.socketPath)
+		}
+		// Left over from a portal that didn't shut down cleanly
+		os.Remove(u.socketPath)
+		l, err = net.ListenUnix("unix", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on the -upgrade_socket %v: %w", u.socketPath, err)
+	}
+	if err := os.Chmod(u.socketPath, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("Failed to set the -upgrade_socket permissions: %w", err)
+	}
+	return l, nil
+}
+
+func (u *upgrader) serve(l *net.UnixListener) {
+	go func() {
+		<-u.quit
+		l.Close()
+	}()
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			select {
+			case <-u.quit: // the listener was closed
+			default:
+				log.Print("Failed to accept on the -upgrade_socket, upgrades are off: ", err)
+			}
+			return
+		}
+		go u.handoffTo(conn)
+	}
+}
+
+// handoffTo sends our sockets to the new process on the conn and quits when it
+// says it is ready.
+func (u *upgrader) handoffTo(conn *net.UnixConn) {
+	defer conn.Close()
+	names, files, ok := u.beginHandoff()
+	if !ok {
+		log.Print("Rejected an upgrade request, there is already an upgrade in progress.")
+		return
+	}
+	upgraded := false
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+		u.finishHandoff(upgraded)
+	}()
+	log.Printf("Handing %v sockets to the new portal for an upgrade...", len(files))
+	if err := writeSockets(conn, names, files); err != nil {
+		log.Print("Failed to send the sockets to the new portal: ", err)
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(upgradeReadyTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ready\n" {
+		log.Printf("The new portal didn't start (%v), continuing to serve.", err)
+		return
+	}
+	log.Print("The new portal is ready. Draining and exiting.")
+	upgraded = true
+}
+
+// receive connects to the running portal and gets its sockets
+func (u *upgrader) receive() error {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: u.socketPath, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	// The old process sends them after its cert renewals and expiring leases
+	// are done
+	conn.SetReadDeadline(time.Now().Add(upgradeReadyTimeout))
+	sockets, err := readSockets(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	u.inherited = sockets
+	u.oldConn = conn
+	log.Printf("Received %v sockets from the running portal.", len(sockets))
+	return nil
+}
+
+// startOnSignal starts a new portal process from our binary when we get
+// SIGUSR2. It takes over the sockets using the -upgrade_socket.
+func (u *upgrader) startOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-u.quit:
+			return
+		case <-sigs:
+		}
+		if err := u.startNewPortal(); err != nil {
+			log.Print("Failed to start the new portal for the upgrade: ", err)
+		}
+	}
+}
+
+func (u *upgrader) startNewPortal() error {
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(binary, os.Args[1:]...)
+	// The spawn files and ports are not passed on, when running with spawn send
+	// SIGUSR2 to spawn instead.
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, "SPAWN_") || strings.HasPrefix(env, upgradeEnv+"=") {
+			continue
+		}
+		cmd.Env = append(cmd.Env, env)
+	}
+	cmd.Env = append(cmd.Env, upgradeEnv+"=1")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("Started the new portal for the upgrade (pid: %v)", cmd.Process.Pid)
+	go func() {
+		err := cmd.Wait()
+		log.Printf("The new portal (pid: %v) exited: %v", cmd.Process.Pid, err)
+	}()
+	return nil
+}
+
+// writeSockets sends the files in messages with a line of the space separated
+// names followed by an empty line at the end.
+func writeSockets(conn *net.UnixConn, names []string, files []*os.File) error {
+	for start := 0; start < len(files); start += maxSocketsPerMessage {
+		end := min(start+maxSocketsPerMessage, len(files))
+		var fds []int
+		for _, f := range files[start:end] {
+			fds = append(fds, int(f.Fd()))
+		}
+		line := strings.Join(names[start:end], " ") + "\n"
+		if _, _, err := conn.WriteMsgUnix([]byte(line), syscall.UnixRights(fds...), nil); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write([]byte("\n"))
+	return err
+}
+
+// readSockets reads the files sent by writeSockets.
+//
+// It reads one byte at a time because the files are attached to the first
+// byte of each line, that way they always line up with the names.
+func readSockets(conn *net.UnixConn) (map[string]*os.File, error) {
+	sockets := make(map[string]*os.File)
+	var line []byte
+	var fds []int
+	fail := func(err error) (map[string]*os.File, error) {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		for _, f := range sockets {
+			f.Close()
+		}
+		return nil, err
+	}
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(maxSocketsPerMessage*4))
+	for {
+		n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if oobn > 0 {
+			msgs, parseErr := syscall.ParseSocketControlMessage(oob[:oobn])
+			if parseErr != nil {
+				return fail(parseErr)
+			}
+			for i := range msgs {
+				rights, parseErr := syscall.ParseUnixRights(&msgs[i])
+				if parseErr != nil {
+					return fail(parseErr)
+				}
+				for _, fd := range rights {
+					syscall.CloseOnExec(fd)
+				}
+				fds = append(fds, rights...)
+			}
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if n == 0 {
+			return fail(io.ErrUnexpectedEOF)
+		}
+		if buf[0] != '\n' {
+			line = append(line, buf[0])
+			continue
+		}
+		if len(line) == 0 { // the end
+			if len(fds) != 0 {
+				return fail(errors.New("got sockets without names"))
+			}
+			return sockets, nil
+		}
+		names := strings.Split(string(line), " ")
+		if len(names) != len(fds) {
+			return fail(fmt.Errorf("got %v sockets for %v names", len(fds), len(names)))
+		}
+		for i, name := range names {
+			sockets[name] = os.NewFile(uintptr(fds[i]), name)
+		}
+		line, fds = nil, nil
+	}
+}
@@ -0,0 +1,19 @@
+package embedportal
+
+import (
+	"fmt"
+	"os"
+)
+
+// Handing the sockets to a new process isn't supported on windows, so this
+// only returns an upgrader to track them.
+func newUpgrader(socketPath string, quit chan struct{}) (*upgrader, error) {
+	if os.Getenv(upgradeEnv) != "" {
+		return nil, fmt.Errorf("Upgrading portal without downtime is not supported on windows.")
+	}
+	return &upgrader{
+		socketPath: socketPath,
+		quit:       quit,
+		sockets:    make(map[string]socketFile),
+	}, nil
+}
@@ -17,8 +17,9 @@ import (
 
 func init() {
 	gate.Address = flag.String("portal_addr", "127.0.0.1:2048",
-		"Address and port for the portal server")
+		"Address and port for the portal server, or unix:///path/to/socket for\n"+
+			"the portal -rpc_socket.")
 	gate.Token = flag.String("portal_token", "", ""+
 		"API Token for authorization with the portal server.\n"+
-		"Printed in the portal logs on startup.")
+		"Printed in the portal logs on startup. Not needed for -rpc_socket.")
 }
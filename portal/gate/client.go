@@ -56,6 +56,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
@@ -69,12 +70,17 @@ import (
 // you can set the values here, or use the PORTAL_ADDR and PORTAL_TOKEN env vars
 // read by [ResolveFlags].
 var (
-	// The hostname (or IP) and port of the portal server to connect to.
+	// The hostname (or IP) and port of the portal server to connect to, or
+	// unix:///path/to/socket for the portal -rpc_socket.
 	Address *string
 	// The API authentication token for portal RPCs. Portal logs this on startup.
+	// Not needed for the -rpc_socket.
 	Token *string
 )
 
+// The [Address] prefix for connecting to the portal -rpc_socket
+const unixAddrPrefix = "unix://"
+
 var ServiceProto = portalpb.ServiceProto
 
 // The options proto when making a requests to portal to register for a reverse proxy
@@ -87,8 +93,11 @@ var ServiceProto = portalpb.ServiceProto
 // doing custom cert management.
 type RegisterRequest struct {
 	// For HTTP: A url pattern that works with http.DefaultServMux. Ex: /images/
-	// For TCP: ":tcp:port" for the port number portal should listen on. Only tcp
-	// is accepted for now.
+	// For TCP: ":tcp:port" for the port number portal should listen on.
+	// For UDP: ":udp:port" for the port number portal should listen on.
+	// For TLS passthrough: ":sni:hostname" to forward the TLS connections for
+	// the hostname on portal's HTTPS port to your server without decrypting
+	// them. Your server terminates TLS with its own certificate.
 	//
 	// HTTP patterns optionally accept a hostname (URL) constraint prefix. Or if
 	// portal is configured to use the default hostname for no hostname patterns,
@@ -128,6 +137,19 @@ type RegisterRequest struct {
 	// sure you only use this with a trusted local network.
 	Hostname string
 
+	// Optional: If set, portal forwards to the unix socket at this absolute
+	// path instead of a port, so your server doesn't need one of the ports in
+	// portal's range. No port is leased so FixedPort is ignored and
+	// [Lease.Port] is 0. Serve on the socket with
+	// [tools.HTTPServerOptions.Listener].
+	//
+	// Portal opens the path itself, so your server must be on the same machine
+	// as portal and register from a loopback address or the portal -rpc_socket.
+	// Hostname must not be set.
+	//
+	// Ignored for UDP proxies.
+	UnixSocket string
+
 	// If true, remove the pattern in the URL of HTTP requests we forward to the
 	// backend to hide that it is behind a reverse proxy.
 	//
@@ -146,6 +168,65 @@ type RegisterRequest struct {
 	// Ignored for TCP proxies.
 	AllowHttp bool
 
+	// If true, portal will not compress responses from this server even if
+	// portal has compression turned on. Use this if your server handles
+	// compression itself or streams data where latency matters.
+	//
+	// Ignored for TCP proxies.
+	NoCompression bool
+
+	// If true, portal keeps responses from this server in its HTTP cache when
+	// the response headers allow caching (Cache-Control, Expires, ETag, etc.).
+	// Use [Client.Purge] to remove them early.
+	//
+	// Ignored for TCP proxies.
+	Cache bool
+	// If non-zero, cached responses are fresh for this long instead of the time
+	// given by the response headers. Responses that forbid caching are still not
+	// cached.
+	CacheTTL time.Duration
+
+	// If true, portal connects to your server with HTTP/2. This is required
+	// for gRPC servers, which then can be served on the same port as other web
+	// servers behind portal. Portal also translates gRPC-web requests for these
+	// servers so browsers can call them.
+	//
+	// With a CertificateRequest (the default for AutoRegister) the connection
+	// uses TLS, otherwise it is HTTP/2 without TLS (h2c) unless the FixedPort
+	// server supports TLS.
+	//
+	// Ignored for TCP proxies.
+	HTTP2 bool
+
+	// If true, portal terminates DTLS from clients of a ":udp" pattern using
+	// its serving certificate and forwards the plain datagrams to your server.
+	//
+	// Only used for UDP proxies.
+	DTLS bool
+
+	// If 1 or 2, portal sends a PROXY protocol header of that version at the
+	// start of each connection to your server with the real client address.
+	// Use [tools.ProxyProtocolListener] or [tools.HTTPServerOptions] to read it.
+	//
+	// For HTTP servers portal makes a new connection for every request, and it
+	// is not supported with HTTP2. Ignored for UDP proxies.
+	ProxyProtocol int
+
+	// How portal handles TLS for TCP proxies. The default is TCPModeTLS.
+	//
+	// Only used for TCP proxies.
+	TCPMode TCPMode
+	// If non-zero, portal closes TCP proxy connections when no data is sent in
+	// either direction for this long.
+	//
+	// Only used for TCP proxies.
+	TCPIdleTimeout time.Duration
+	// If non-zero, the maximum number of open connections for a TCP proxy.
+	// Portal closes new connections right away when there are this many.
+	//
+	// Only used for TCP proxies.
+	TCPMaxConnections int
+
 	// If set, the server will sign the certificate request with portal's
 	// certificate as the root and accept connections to the signed cert. This way
 	// network traffic behind the reverse proxy can be encrypted.
@@ -160,6 +241,64 @@ type RegisterRequest struct {
 	// not actually sent over the network, it is used by the client to cleate the
 	// [*tls.Certificate] in the [Lease].
 	PrivateKey crypto.PrivateKey
+
+	// Optional: If set, portal responds to requests for the pattern with this
+	// redirect itself instead of forwarding them to a server. No port is leased
+	// so FixedPort is ignored and [Lease.Port] is 0.
+	//
+	// Ignored for TCP proxies.
+	Redirect *Redirect
+
+	// Optional: If set, portal responds to requests for the pattern with this
+	// fixed response itself instead of forwarding them to a server. No port is
+	// leased so FixedPort is ignored and [Lease.Port] is 0.
+	//
+	// Ignored for TCP proxies.
+	StaticResponse *StaticResponse
+}
+
+// How portal handles TLS for TCP proxies. See [RegisterRequest.TCPMode].
+type TCPMode int
+
+const (
+	// Clients connect with TLS using the portal certificate and portal connects
+	// to your server with TLS if it supports it, otherwise with plain TCP.
+	TCPModeTLS TCPMode = iota
+	// Portal forwards the bytes unchanged with no TLS on either side. Use this
+	// for protocols that don't use TLS or start it themselves, like SSH or
+	// STARTTLS.
+	TCPModePlain
+	// Clients connect with plain TCP and portal always connects to your server
+	// with TLS, so only the traffic behind portal is encrypted.
+	TCPModeBackendTLS
+)
+
+// A redirect served directly by portal. See [RegisterRequest.Redirect].
+type Redirect struct {
+	// The absolute or relative URL to redirect to.
+	URL string
+	// One of 301, 302, 307, or 308. If unset 302 (Found) is used.
+	StatusCode int
+	// If true, the part of the request path after the pattern is appended to
+	// the URL path. For example with the pattern /old/ and URL /new/ a request
+	// for /old/page.html redirects to /new/page.html
+	PreservePath bool
+	// If true, the request query string is added to the URL query.
+	PreserveQuery bool
+}
+
+// A fixed response served directly by portal. See
+// [RegisterRequest.StaticResponse].
+type StaticResponse struct {
+	Body []byte
+	// If unset, the type is detected with [net/http.DetectContentType]
+	ContentType string
+	// If unset 200 (OK) is used.
+	StatusCode int
+}
+
+func (req *RegisterRequest) isDirectResponse() bool {
+	return req.Redirect != nil || req.StaticResponse != nil
 }
 
 type Lease struct {
@@ -227,14 +366,40 @@ type Client struct {
 }
 
 func (c *Client) Register(ctx context.Context, req *RegisterRequest) (*Lease, error) {
-	lease, err := c.rpc.Register(ctx, &portalpb.RegisterRequest{
-		Pattern:            req.Pattern,
-		FixedPort:          uint32(req.FixedPort),
-		Hostname:           req.Hostname,
-		StripPattern:       req.StripPattern,
-		AllowHttp:          req.AllowHttp,
-		CertificateRequest: req.CertificateRequest,
-	})
+	request := &portalpb.RegisterRequest{
+		Pattern:               req.Pattern,
+		FixedPort:             uint32(req.FixedPort),
+		Hostname:              req.Hostname,
+		UnixSocket:            req.UnixSocket,
+		StripPattern:          req.StripPattern,
+		AllowHttp:             req.AllowHttp,
+		NoCompression:         req.NoCompression,
+		Cache:                 req.Cache,
+		CacheTtlSeconds:       uint32(req.CacheTTL / time.Second),
+		Http2:                 req.HTTP2,
+		Dtls:                  req.DTLS,
+		ProxyProtocol:         uint32(req.ProxyProtocol),
+		TcpMode:               portalpb.TCPMode(req.TCPMode),
+		TcpIdleTimeoutSeconds: uint32(req.TCPIdleTimeout / time.Second),
+		TcpMaxConnections:     uint32(req.TCPMaxConnections),
+		CertificateRequest:    req.CertificateRequest,
+	}
+	if r := req.Redirect; r != nil {
+		request.Redirect = &portalpb.Redirect{
+			Url:           r.URL,
+			Status:        uint32(r.StatusCode),
+			PreservePath:  r.PreservePath,
+			PreserveQuery: r.PreserveQuery,
+		}
+	}
+	if r := req.StaticResponse; r != nil {
+		request.StaticResponse = &portalpb.StaticResponse{
+			Body:        r.Body,
+			ContentType: r.ContentType,
+			Status:      uint32(r.StatusCode),
+		}
+	}
+	lease, err := c.rpc.Register(ctx, request)
 	if err != nil {
 		return nil, err
 	}
@@ -254,9 +419,47 @@ func (c *Client) Unregister(ctx context.Context, lease *Lease) error {
 	return err
 }
 
+// Turns maintenance mode on or off for a registered HTTP pattern.
+//
+// While on, portal responds to requests for the pattern with a 503 page
+// instead of forwarding them to the backend, so the backend can be taken down
+// for an upgrade. If retryAfter is non-zero it is sent in the Retry-After
+// header. The lease must still be renewed as usual while in maintenance.
+//
+// Maintenance mode stays on if you register the pattern again while the lease
+// is valid, but it is turned off when the pattern is unregistered or the lease
+// expires.
+func (c *Client) SetMaintenance(ctx context.Context, pattern string, enabled bool, retryAfter time.Duration) error {
+	_, err := c.rpc.SetMaintenance(ctx, &portalpb.MaintenanceRequest{
+		Pattern:           pattern,
+		Enabled:           enabled,
+		RetryAfterSeconds: uint32(retryAfter / time.Second),
+	})
+	return err
+}
+
+// Removes responses from the portal HTTP response cache.
+//
+// If pattern is set, only responses for that exact registered pattern are
+// removed. If urlPrefix is set, only responses with a URL starting with the
+// prefix are removed. The prefix is either a host and path, like
+// "example.com/blog/", or only a path, like "/blog/", which matches any host.
+// Returns the number of responses removed.
+func (c *Client) Purge(ctx context.Context, pattern, urlPrefix string) (int, error) {
+	resp, err := c.rpc.Purge(ctx, &portalpb.PurgeRequest{
+		Pattern:   pattern,
+		UrlPrefix: urlPrefix,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(resp.Purged), nil
+}
+
 // Returns the address that will be used to connect to your server if
 // registered. It is necessary to register the correct hostname in the TLS
-// certificate signed by portal.
+// certificate signed by portal. IPv6 addresses are returned in brackets, like
+// [2001:db8::1].
 func (c *Client) MyHostname(ctx context.Context) (string, error) {
 	resp, err := c.rpc.MyHostname(ctx, &emptypb.Empty{})
 	if err != nil {
@@ -306,7 +509,7 @@ func ResolveFlags() error {
 		envToken := os.Getenv("PORTAL_TOKEN")
 		Token = &envToken
 	}
-	if *Token == "" {
+	if *Token == "" && !(Address != nil && strings.HasPrefix(*Address, unixAddrPrefix)) {
 		if noSetup {
 			return errors.New("" +
 				"You need to set the portal address and token (printed on portal startup)\n" +
@@ -408,11 +611,24 @@ func DefaultClient() (*Client, error) {
 //
 // For most use cases [DefaultClient] is what you want.
 //
+// The portalAddr can be unix:///path/to/socket to connect to the portal
+// -rpc_socket, which doesn't need the token.
+//
 // Note: this function doesn't actually perform I/O anymore. Originally it used
 // [grpc.Dial] but now it uses [grpc.NewClient]. See: [grpc antipatterns]
 //
 // [grpc antipatterns]: https://github.com/grpc/grpc-go/blob/master/Documentation/anti-patterns.md
 func Connect(portalAddr, token string) (*Client, error) {
+	if path, ok := strings.CutPrefix(portalAddr, unixAddrPrefix); ok {
+		// The socket file permissions are the authorization
+		conn, err := grpc.NewClient("unix:"+path,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to connect to portal RPC socket: %w", err)
+		}
+		return &Client{portalpb.NewPortalClient(conn), conn}, nil
+	}
 	conn, err := grpc.NewClient(portalAddr,
 		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
 			InsecureSkipVerify: true,
@@ -536,7 +752,7 @@ func autoTLSConfig() (conf *tls.Config, setCert func(*tls.Certificate)) {
 func (c *Client) AutoRegister(ctx context.Context, request *RegisterRequest, newLease func(*Lease)) error {
 	// Add a certificate request if one isn't already set
 	var privateKey crypto.PrivateKey
-	if request.CertificateRequest == nil {
+	if request.CertificateRequest == nil && !request.isDirectResponse() {
 		// Setup the request for a new certificate
 		hostname, err := c.MyHostname(ctx)
 		if err != nil {
@@ -4,25 +4,51 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"ask.systems/daemon/portal/embedportal"
 	"ask.systems/daemon/portal/gate"
 	"ask.systems/daemon/tools"
+
+	"github.com/pion/dtls/v3"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/dns/dnsmessage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
 // TODO: another top level Test function that checks if restarting portal
@@ -113,34 +139,63 @@ func FreePort(t *testing.T) (uint16, net.Listener, *os.File) {
 	return uint16(l.Addr().(*net.TCPAddr).Port), l, f
 }
 
+// Same as FreePort but for UDP
+func FreeUDPPort(t *testing.T) (uint16, net.PacketConn, *os.File) {
+	t.Helper()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Failed to listen on a free udp port:", err)
+	}
+	var f *os.File
+	if runtime.GOOS != "windows" {
+		f, err = c.File()
+		if err != nil {
+			t.Fatal("Failed to get file for a free udp port:", err)
+		}
+	}
+	t.Cleanup(func() {
+		c.Close()
+		if f != nil {
+			f.Close()
+		}
+	})
+	return uint16(c.LocalAddr().(*net.UDPAddr).Port), c, f
+}
+
 func PortalPorts(t *testing.T) (*PortalTest, []string) {
 	httpPort, hl, httpFD := FreePort(t)
 	httpsPort, sl, httpsFD := FreePort(t)
 	rpcPort, rl, rpcFD := FreePort(t)
+	http3Port, h3c, http3FD := FreeUDPPort(t)
 
 	if runtime.GOOS == "windows" {
 		hl.Close()
 		sl.Close()
 		rl.Close()
+		h3c.Close()
 
 		return &PortalTest{
 				HTTPPort:  httpPort,
 				HTTPSPort: httpsPort,
 				RPCPort:   rpcPort,
+				HTTP3Port: http3Port,
 			}, []string{
 				fmt.Sprintf("-http_port=%v", httpPort),
 				fmt.Sprintf("-https_port=%v", httpsPort),
 				fmt.Sprintf("-rpc_port=%v", rpcPort),
+				fmt.Sprintf("-http3_port=%v", http3Port),
 			}
 	} else {
 		return &PortalTest{
 				HTTPPort:  httpPort,
 				HTTPSPort: httpsPort,
 				RPCPort:   rpcPort,
+				HTTP3Port: http3Port,
 			}, []string{
 				fmt.Sprintf("-http_port=-%v", httpFD.Fd()),
 				fmt.Sprintf("-https_port=-%v", httpsFD.Fd()),
 				fmt.Sprintf("-rpc_port=-%v", rpcFD.Fd()),
+				fmt.Sprintf("-http3_port=-%v", http3FD.Fd()),
 			}
 	}
 }
@@ -205,10 +260,17 @@ func CaptureTokenFromLogs(t *testing.T) <-chan string {
 	return ret
 }
 
+// The -admin_url page of the TestPortal portal and its admin password
+const (
+	adminURL      = "/portal-admin/"
+	adminPassword = "correct horse battery staple"
+)
+
 type PortalTest struct {
 	RPCPort   uint16
 	HTTPPort  uint16
 	HTTPSPort uint16
+	HTTP3Port uint16
 }
 
 func TestPortal(t *testing.T) {
@@ -218,6 +280,10 @@ func TestPortal(t *testing.T) {
 
 	fs := flag.NewFlagSet(t.Name(), flag.PanicOnError)
 	embedportal.LeaseTTL = 2 * time.Second
+	adminHash, err := bcrypt.GenerateFromPassword([]byte(adminPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 	t.Cleanup(wg.Wait) // Needs to be after PortalToken(t)
@@ -230,6 +296,9 @@ func TestPortal(t *testing.T) {
 				"-port_range_start=9000",
 				"-port_range_end=9999",
 				"-save_file=",
+				"-compress",
+				"-admin_url=" + adminURL,
+				"-admin_logins=admin:" + string(adminHash),
 			}, portArgs...))
 		wg.Done()
 	}()
@@ -528,3 +597,2411 @@ func (*PortalTest) AutoRegister_Wait(t *testing.T) {
 		t.Error("wait exited earlier than it should.")
 	}
 }
+
+// Check that [gate.Client.SetMaintenance] switches a pattern to the 503 page
+// and back without losing the registration.
+func (p *PortalTest) SetMaintenance(t *testing.T) {
+	t.Parallel()
+
+	pattern := fmt.Sprintf("/%v/", t.Name())
+	port, listener, _ := FreePort(t)
+
+	regctx, killAutoRegister := context.WithCancel(t.Context())
+	port, tlsconf, waitAutoRegister, err := gate.AutoRegister(regctx, &gate.RegisterRequest{
+		Pattern:   pattern,
+		FixedPort: port,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})}
+	httpctx, killHTTP := context.WithCancel(t.Context())
+	waitHTTP := make(chan struct{})
+	go func() {
+		err := tools.HTTPServer(httpctx, port, tlsconf, &tools.HTTPServerOptions{
+			Server:          srv,
+			ShutdownTimeout: time.Second,
+			Listener:        listener,
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		close(waitHTTP)
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	url := fmt.Sprintf("https://127.0.0.1:%v%v", p.HTTPSPort, pattern)
+	portal, err := gate.DefaultClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer portal.Close()
+
+	if err := portal.SetMaintenance(t.Context(), pattern, true, time.Minute); err != nil {
+		t.Error(err)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Error("Wanted 503 in maintenance mode, got:", resp.Status)
+		}
+		if got := resp.Header.Get("Retry-After"); got != "60" {
+			t.Errorf("Wanted Retry-After: 60, got: %q", got)
+		}
+	}
+
+	if err := portal.SetMaintenance(t.Context(), pattern, false, 0); err != nil {
+		t.Error(err)
+	}
+	resp, err = client.Get(url)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Error("Wanted 200 after maintenance mode, got:", resp.Status)
+		}
+	}
+
+	if err := portal.SetMaintenance(t.Context(), "/not-registered/", true, 0); status.Code(err) != codes.NotFound {
+		t.Error("Wanted NotFound for an unregistered pattern, got:", err)
+	}
+
+	// Unregistering the pattern turns maintenance mode off
+	if err := portal.SetMaintenance(t.Context(), pattern, true, 0); err != nil {
+		t.Error(err)
+	}
+	killAutoRegister()
+	<-waitAutoRegister
+	lease, err := portal.Register(t.Context(), &gate.RegisterRequest{
+		Pattern:   pattern,
+		FixedPort: port,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Get(url)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Error("Wanted maintenance mode off after unregistering, got:", resp.Status)
+		}
+	}
+	if err := portal.Unregister(t.Context(), lease); err != nil {
+		t.Error(err)
+	}
+
+	killHTTP()
+	<-waitHTTP
+}
+
+// Check that redirect and static response registrations are answered by
+// portal without a backend server.
+func (p *PortalTest) DirectResponses(t *testing.T) {
+	t.Parallel()
+
+	redirectPattern := fmt.Sprintf("/%v/old/", t.Name())
+	staticPattern := fmt.Sprintf("/%v/robots.txt", t.Name())
+	ctx, cancel := context.WithCancel(t.Context())
+	_, _, waitRedirect, err := gate.AutoRegister(ctx, &gate.RegisterRequest{
+		Pattern: redirectPattern,
+		Redirect: &gate.Redirect{
+			URL:           "https://example.com/new/",
+			StatusCode:    http.StatusPermanentRedirect,
+			PreservePath:  true,
+			PreserveQuery: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, waitStatic, err := gate.AutoRegister(ctx, &gate.RegisterRequest{
+		Pattern: staticPattern,
+		StaticResponse: &gate.StaticResponse{
+			Body: []byte("User-agent: *\nDisallow: /\n"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	base := fmt.Sprintf("https://127.0.0.1:%v", p.HTTPSPort)
+
+	resp, err := client.Get(base + redirectPattern + "page.html?a=b")
+	if err != nil {
+		t.Error(err)
+	} else {
+		if resp.StatusCode != http.StatusPermanentRedirect {
+			t.Error("Wanted 308 redirect, got:", resp.Status)
+		}
+		want := "https://example.com/new/page.html?a=b"
+		if got := resp.Header.Get("Location"); got != want {
+			t.Errorf("Wrong redirect location. Got %q, wanted %q", got, want)
+		}
+	}
+
+	resp, err = client.Get(base + staticPattern)
+	if err != nil {
+		t.Error(err)
+	} else {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Error("Wanted 200 for the static response, got:", resp.Status)
+		}
+		if string(body) != "User-agent: *\nDisallow: /\n" {
+			t.Errorf("Wrong static response body: %q", body)
+		}
+	}
+
+	// Only final response codes are allowed
+	portal, err := gate.DefaultClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer portal.Close()
+	for _, code := range []int{101, 199, 600} {
+		_, err := portal.Register(t.Context(), &gate.RegisterRequest{
+			Pattern:        fmt.Sprintf("/%v/status/", t.Name()),
+			StaticResponse: &gate.StaticResponse{StatusCode: code},
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Wanted InvalidArgument for static response status %v, got: %v", code, err)
+		}
+	}
+
+	cancel()
+	<-waitRedirect
+	<-waitStatic
+}
+
+// Test the -routes_file pinned routes, reloading them with SIGHUP, and that
+// clients can't change them.
+func (*PortalTest) RoutesFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows can't send SIGHUP to reload the routes")
+	}
+	backendPort, backendListener, _ := FreePort(t)
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "backend")
+	})}
+	go backend.Serve(backendListener)
+	defer backend.Close()
+
+	routesFile := filepath.Join(t.TempDir(), "routes.textproto")
+	writeRoutes := func(routes string) {
+		if err := os.WriteFile(routesFile, []byte(routes), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRoutes(fmt.Sprintf(`
+route: { pattern: "/static/" allow_http: true static_response: { body: "one" } }
+route: { pattern: "/proxied/" allow_http: true fixed_port: %v }
+`, backendPort))
+
+	var ports []int
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+	}
+	token := CaptureTokenFromLogs(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		embedportal.Run(ctx, flag.NewFlagSet(t.Name(), flag.PanicOnError), []string{
+			"portal",
+			fmt.Sprintf("-http_port=%v", ports[0]),
+			fmt.Sprintf("-https_port=%v", ports[1]),
+			fmt.Sprintf("-rpc_port=%v", ports[2]),
+			"-http3_port=0",
+			"-save_file=",
+			"-routes_file=" + routesFile,
+		})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	var tok string
+	select {
+	case tok = <-token:
+	case <-done:
+		t.Fatal("Portal exited before starting")
+	case <-time.After(10 * time.Second):
+		t.Fatal("Portal didn't start")
+	}
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v%v", ports[0], path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	// Sends SIGHUP and waits until the path responds with the body
+	reloadUntil := func(path string, wantCode int, wantBody string) {
+		self, err := os.FindProcess(os.Getpid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := self.Signal(syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			code, body := get(path)
+			if code == wantCode && (wantBody == "" || body == wantBody) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("After reloading, wanted %v %q for %v, got %v %q",
+					wantCode, wantBody, path, code, body)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if code, body := get("/static/"); code != http.StatusOK || body != "one" {
+		t.Errorf("Wanted the static route, got %v %q", code, body)
+	}
+	if code, body := get("/proxied/"); code != http.StatusOK || body != "backend" {
+		t.Errorf("Wanted the proxied route, got %v %q", code, body)
+	}
+
+	// Changes that fail to register keep the old route
+	writeRoutes(fmt.Sprintf(`
+route: { pattern: "/static/" allow_http: true redirect: { status: 200 url: "/elsewhere/" } }
+route: { pattern: "/proxied/" allow_http: true hostname: "nonexistent.invalid" fixed_port: %v }
+route: { pattern: "/marker/" allow_http: true static_response: { body: "reloaded" } }
+`, backendPort))
+	reloadUntil("/marker/", http.StatusOK, "reloaded")
+	if code, body := get("/static/"); code != http.StatusOK || body != "one" {
+		t.Errorf("Wanted the old static route after an invalid change, got %v %q", code, body)
+	}
+	if code, body := get("/proxied/"); code != http.StatusOK || body != "backend" {
+		t.Errorf("Wanted the old proxied route after an unresolvable change, got %v %q", code, body)
+	}
+
+	client, err := gate.Connect(fmt.Sprintf("127.0.0.1:%v", ports[2]), tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_, err = client.Register(t.Context(), &gate.RegisterRequest{
+		Pattern:   "/static/",
+		FixedPort: backendPort,
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Error("Wanted PermissionDenied registering a pinned pattern, got:", err)
+	}
+
+	// A client lease that a new route in the file takes over
+	lease, err := client.Register(t.Context(), &gate.RegisterRequest{
+		Pattern:   "/added/",
+		FixedPort: backendPort,
+		AllowHttp: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRoutes(fmt.Sprintf(`
+route: { pattern: "/static/" allow_http: true static_response: { body: "two" } }
+route: { pattern: "/proxied/" allow_http: true fixed_port: %v }
+route: { pattern: "/added/" allow_http: true static_response: { body: "added" } }
+`, backendPort))
+	reloadUntil("/added/", http.StatusOK, "added")
+	if code, body := get("/static/"); code != http.StatusOK || body != "two" {
+		t.Errorf("Wanted the changed static route, got %v %q", code, body)
+	}
+	if _, err := client.Renew(t.Context(), lease); status.Code(err) != codes.PermissionDenied {
+		t.Error("Wanted PermissionDenied renewing a pinned pattern, got:", err)
+	}
+	if err := client.Unregister(t.Context(), lease); status.Code(err) != codes.PermissionDenied {
+		t.Error("Wanted PermissionDenied unregistering a pinned pattern, got:", err)
+	}
+
+	// Removed routes are unregistered and clients can use the pattern again
+	writeRoutes(`
+route: { pattern: "/static/" allow_http: true static_response: { body: "two" } }
+`)
+	reloadUntil("/proxied/", http.StatusNotFound, "")
+	if code, _ := get("/added/"); code != http.StatusNotFound {
+		t.Errorf("Wanted the removed route to be unregistered, got %v", code)
+	}
+	if _, err := client.Register(t.Context(), &gate.RegisterRequest{
+		Pattern:   "/proxied/",
+		FixedPort: backendPort,
+	}); err != nil {
+		t.Error("Failed to register a pattern removed from the routes file:", err)
+	}
+}
+
+// Check that responses are compressed unless the registration opts out
+func (p *PortalTest) Compression(t *testing.T) {
+	t.Parallel()
+
+	body := []byte("<html><body>" + strings.Repeat("hello compression ", 200) + "</body></html>")
+	compressedPattern := fmt.Sprintf("/%v/compressed", t.Name())
+	uncompressedPattern := fmt.Sprintf("/%v/uncompressed", t.Name())
+	ctx, cancel := context.WithCancel(t.Context())
+	_, _, waitCompressed, err := gate.AutoRegister(ctx, &gate.RegisterRequest{
+		Pattern: compressedPattern,
+		StaticResponse: &gate.StaticResponse{
+			Body:        body,
+			ContentType: "text/html; charset=utf-8",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, waitUncompressed, err := gate.AutoRegister(ctx, &gate.RegisterRequest{
+		Pattern:       uncompressedPattern,
+		NoCompression: true,
+		StaticResponse: &gate.StaticResponse{
+			Body:        body,
+			ContentType: "text/html; charset=utf-8",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	base := fmt.Sprintf("https://127.0.0.1:%v", p.HTTPSPort)
+
+	// The go client asks for gzip and decompresses it transparently
+	resp, err := client.Get(base + compressedPattern)
+	if err != nil {
+		t.Error(err)
+	} else {
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !resp.Uncompressed {
+			t.Error("Wanted a compressed response")
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("Wrong body after decompression: %q", got)
+		}
+	}
+
+	resp, err = client.Get(base + uncompressedPattern)
+	if err != nil {
+		t.Error(err)
+	} else {
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Uncompressed {
+			t.Error("Wanted an uncompressed response with NoCompression set")
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("Wrong body: %q", got)
+		}
+	}
+
+	cancel()
+	<-waitCompressed
+	<-waitUncompressed
+}
+
+// Check that cacheable responses are served from the cache, revalidated with
+// ETags, and removed by Purge
+func (p *PortalTest) Cache(t *testing.T) {
+	t.Parallel()
+
+	pattern := fmt.Sprintf("/%v/", t.Name())
+	port, listener, _ := FreePort(t)
+
+	regctx, killAutoRegister := context.WithCancel(t.Context())
+	port, tlsconf, waitAutoRegister, err := gate.AutoRegister(regctx, &gate.RegisterRequest{
+		Pattern:   pattern,
+		FixedPort: port,
+		Cache:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var backendRequests, notModified atomic.Int32
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		backendRequests.Add(1)
+		if strings.HasSuffix(req.URL.Path, "/etag") {
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				notModified.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte("cached body"))
+	})}
+	httpctx, killHTTP := context.WithCancel(t.Context())
+	waitHTTP := make(chan struct{})
+	go func() {
+		err := tools.HTTPServer(httpctx, port, tlsconf, &tools.HTTPServerOptions{
+			Server:          srv,
+			ShutdownTimeout: time.Second,
+			Listener:        listener,
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		close(waitHTTP)
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	base := fmt.Sprintf("https://127.0.0.1:%v%v", p.HTTPSPort, pattern)
+	get := func(path string) string {
+		resp, err := client.Get(base + path)
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "cached body" {
+			t.Errorf("Wrong body for %v: %q", path, body)
+		}
+		return resp.Header.Get("Cache-Status")
+	}
+
+	if got := get("fresh"); got != "portal; fwd=miss" {
+		t.Errorf("Wanted a cache miss the first time, got Cache-Status: %q", got)
+	}
+	if got := get("fresh"); got != "portal; hit" {
+		t.Errorf("Wanted a cache hit the second time, got Cache-Status: %q", got)
+	}
+	if got := backendRequests.Load(); got != 1 {
+		t.Errorf("Wanted 1 backend request, got %v", got)
+	}
+
+	get("etag")
+	if got := get("etag"); !strings.Contains(got, "fwd-status=304") {
+		t.Errorf("Wanted a revalidated response, got Cache-Status: %q", got)
+	}
+	if got := notModified.Load(); got != 1 {
+		t.Errorf("Wanted 1 revalidation request, got %v", got)
+	}
+
+	portal, err := gate.DefaultClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer portal.Close()
+	purged, err := portal.Purge(t.Context(), "", pattern+"fresh")
+	if err != nil {
+		t.Error(err)
+	} else if purged != 1 {
+		t.Errorf("Wanted 1 purged response, got %v", purged)
+	}
+	if got := get("fresh"); got != "portal; fwd=miss" {
+		t.Errorf("Wanted a cache miss after purging, got Cache-Status: %q", got)
+	}
+
+	killAutoRegister()
+	<-waitAutoRegister
+	killHTTP()
+	<-waitHTTP
+}
+
+// Check that gRPC and gRPC-web requests are forwarded to an HTTP/2 backend
+func (p *PortalTest) GRPC(t *testing.T) {
+	t.Parallel()
+
+	pattern := "/grpc.health.v1.Health/"
+	port, listener, _ := FreePort(t)
+
+	regctx, killAutoRegister := context.WithCancel(t.Context())
+	_, tlsconf, waitAutoRegister, err := gate.AutoRegister(regctx, &gate.RegisterRequest{
+		Pattern:   pattern,
+		FixedPort: port,
+		HTTP2:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsconf)))
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	waitGRPC := make(chan struct{})
+	go func() {
+		srv.Serve(listener)
+		close(waitGRPC)
+	}()
+
+	addr := fmt.Sprintf("127.0.0.1:%v", p.HTTPSPort)
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(
+		credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	resp, err := healthpb.NewHealthClient(conn).Check(t.Context(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Error(err)
+	} else if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Error("Wanted SERVING from the health check, got:", resp.Status)
+	}
+
+	// An empty HealthCheckRequest message frame
+	req, err := http.NewRequest(http.MethodPost, "https://"+addr+pattern+"Check",
+		bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc-web+proto")
+	req.Header.Set("X-Grpc-Web", "1")
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	webResp, err := client.Do(req)
+	if err != nil {
+		t.Error(err)
+	} else {
+		body, _ := io.ReadAll(webResp.Body)
+		webResp.Body.Close()
+		if got := webResp.Header.Get("Content-Type"); got != "application/grpc-web+proto" {
+			t.Errorf("Wrong gRPC-web content type: %q", got)
+		}
+		// The SERVING response message followed by the trailers frame
+		if !bytes.HasPrefix(body, []byte{0, 0, 0, 0, 2, 0x08, 0x01, 0x80}) {
+			t.Errorf("Wrong gRPC-web response body: %q", body)
+		}
+		if !bytes.Contains(body, []byte("grpc-status: 0\r\n")) {
+			t.Errorf("Missing grpc-status trailer in gRPC-web response: %q", body)
+		}
+	}
+
+	killAutoRegister()
+	<-waitAutoRegister
+	srv.Stop()
+	<-waitGRPC
+}
+
+// Check that HTTPS responses advertise HTTP/3 and that it serves requests
+func (p *PortalTest) HTTP3(t *testing.T) {
+	t.Parallel()
+
+	pattern := fmt.Sprintf("/%v/", t.Name())
+	ctx, cancel := context.WithCancel(t.Context())
+	_, _, waitRegister, err := gate.AutoRegister(ctx, &gate.RegisterRequest{
+		Pattern: pattern,
+		StaticResponse: &gate.StaticResponse{
+			Body: []byte("hello quic"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%v%v", p.HTTPSPort, pattern))
+	if err != nil {
+		t.Error(err)
+	} else {
+		resp.Body.Close()
+		want := fmt.Sprintf(`h3=":%v"`, p.HTTP3Port)
+		if got := resp.Header.Get("Alt-Svc"); !strings.Contains(got, want) {
+			t.Errorf("Wanted Alt-Svc to contain %v, got: %q", want, got)
+		}
+	}
+
+	h3Transport := &http3.RoundTripper{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+	defer h3Transport.Close()
+	h3Client := &http.Client{Transport: h3Transport}
+	resp, err = h3Client.Get(fmt.Sprintf("https://127.0.0.1:%v%v", p.HTTP3Port, pattern))
+	if err != nil {
+		t.Error(err)
+	} else {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 3 {
+			t.Error("Wanted an HTTP/3 response, got:", resp.Proto)
+		}
+		if string(body) != "hello quic" {
+			t.Errorf("Wrong body over HTTP/3: %q", body)
+		}
+	}
+
+	cancel()
+	<-waitRegister
+}
+
+func (p *PortalTest) UDPProxy(t *testing.T) {
+	t.Parallel()
+
+	// Echo server backend
+	backendPort, backend, _ := FreeUDPPort(t)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(append([]byte("echo: "), buf[:n]...), addr)
+		}
+	}()
+
+	for _, useDTLS := range []bool{false, true} {
+		public, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicPort := public.LocalAddr().(*net.UDPAddr).Port
+		public.Close() // portal will listen on it
+
+		ctx, cancel := context.WithCancel(t.Context())
+		_, _, waitRegister, err := gate.AutoRegister(ctx, &gate.RegisterRequest{
+			Pattern:   fmt.Sprintf(":udp:%v", publicPort),
+			FixedPort: backendPort,
+			DTLS:      useDTLS,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: publicPort}
+		var conn net.Conn
+		if useDTLS {
+			conn, err = dtls.Dial("udp", addr, &dtls.Config{
+				InsecureSkipVerify: true,
+			})
+		} else {
+			conn, err = net.DialUDP("udp", nil, addr)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			msg := fmt.Sprintf("hello %v", i)
+			if _, err := conn.Write([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 1500)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("Failed to read reply (dtls: %v): %v", useDTLS, err)
+			}
+			if got, want := string(buf[:n]), "echo: "+msg; got != want {
+				t.Errorf("Wrong reply (dtls: %v), got: %q want: %q", useDTLS, got, want)
+			}
+		}
+		conn.Close()
+
+		cancel()
+		<-waitRegister
+	}
+}
+
+func (p *PortalTest) TLSPassthrough(t *testing.T) {
+	t.Parallel()
+
+	// The backend serves its own certificate, portal must not decrypt
+	hostname := "passthrough.test"
+	cert, err := tools.GenerateSelfSignedCertificate(hostname,
+		time.Now().Add(time.Hour), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, listener, _ := FreePort(t)
+	httpctx, cancelHTTP := context.WithCancel(t.Context())
+	defer cancelHTTP()
+	go tools.HTTPServer(httpctx, port, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+	}, &tools.HTTPServerOptions{
+		Server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				io.WriteString(w, "hello from the backend")
+			}),
+		},
+		Listener: listener,
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	_, _, waitRegister, err := gate.AutoRegister(ctx, &gate.RegisterRequest{
+		Pattern:   ":sni:" + hostname,
+		FixedPort: port,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, fmt.Sprintf("127.0.0.1:%v", p.HTTPSPort))
+			},
+		},
+	}
+	resp, err := client.Get(fmt.Sprintf("https://%v/", hostname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello from the backend" {
+		t.Errorf("Wrong body from the passthrough backend: %q", body)
+	}
+	if got := resp.TLS.PeerCertificates[0].Raw; !bytes.Equal(got, cert.Certificate[0]) {
+		t.Error("The connection was not terminated by the backend certificate")
+	}
+
+	// Other hostnames still go to the HTTP proxy
+	resp, err = client.Get("https://other.test/not-registered/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Wanted 404 from portal for other hostnames, got: %v", resp.Status)
+	}
+	if got := resp.TLS.PeerCertificates[0].Raw; bytes.Equal(got, cert.Certificate[0]) {
+		t.Error("Other hostnames got the passthrough backend certificate")
+	}
+
+	cancel()
+	<-waitRegister
+}
+
+func (p *PortalTest) ProxyProtocol(t *testing.T) {
+	t.Parallel()
+
+	pattern := fmt.Sprintf("/%v/", t.Name())
+	port, listener, _ := FreePort(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	_, tlsconf, waitRegister, err := gate.AutoRegister(ctx, &gate.RegisterRequest{
+		Pattern:       pattern,
+		FixedPort:     port,
+		ProxyProtocol: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpctx, cancelHTTP := context.WithCancel(t.Context())
+	defer cancelHTTP()
+	go tools.HTTPServer(httpctx, port, tlsconf, &tools.HTTPServerOptions{
+		Server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				io.WriteString(w, req.RemoteAddr)
+			}),
+		},
+		Listener:      listener,
+		ProxyProtocol: true,
+	})
+
+	for i := 0; i < 2; i++ {
+		// Each request is from a different client port
+		var clientAddr net.Addr
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var d net.Dialer
+					conn, err := d.DialContext(ctx, network, addr)
+					if err == nil {
+						clientAddr = conn.LocalAddr()
+					}
+					return conn, err
+				},
+			},
+		}
+		resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%v%v", p.HTTPSPort, pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != clientAddr.String() {
+			t.Errorf("The backend saw the wrong client address, got: %q want: %q",
+				body, clientAddr)
+		}
+	}
+
+	cancel()
+	<-waitRegister
+}
+
+func (p *PortalTest) TCPPlainMode(t *testing.T) {
+	t.Parallel()
+
+	// Echo server backend
+	backendPort, backend, _ := FreePort(t)
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPort := public.Addr().(*net.TCPAddr).Port
+	public.Close() // portal will listen on it
+
+	ctx, cancel := context.WithCancel(t.Context())
+	_, _, waitRegister, err := gate.AutoRegister(ctx, &gate.RegisterRequest{
+		Pattern:           fmt.Sprintf(":tcp:%v", publicPort),
+		FixedPort:         backendPort,
+		TCPMode:           gate.TCPModePlain,
+		TCPIdleTimeout:    time.Second,
+		TCPMaxConnections: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%v", publicPort)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "hello" {
+		t.Errorf("Wrong echo over plain TCP: %q", buf)
+	}
+
+	// Over the max connections
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(buf); err != io.EOF {
+		t.Error("Wanted the second connection to be closed, got:", err)
+	}
+
+	// The first connection is closed after the idle timeout
+	start := time.Now()
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Error("Wanted the idle connection to be closed, got:", err)
+	} else if time.Since(start) > 3*time.Second {
+		t.Error("The idle connection took too long to close:", time.Since(start))
+	}
+
+	cancel()
+	<-waitRegister
+}
+
+func (p *PortalTest) DrainOnUnregister(t *testing.T) {
+	t.Parallel()
+
+	// Echo server backend
+	backendPort, backend, _ := FreePort(t)
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPort := public.Addr().(*net.TCPAddr).Port
+	public.Close() // portal will listen on it
+
+	ctx, cancel := context.WithCancel(t.Context())
+	_, _, waitRegister, err := gate.AutoRegister(ctx, &gate.RegisterRequest{
+		Pattern:   fmt.Sprintf(":tcp:%v", publicPort),
+		FixedPort: backendPort,
+		TCPMode:   gate.TCPModePlain,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%v", publicPort)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	echo := func(msg string) {
+		t.Helper()
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != msg {
+			t.Errorf("Wrong echo: %q", buf)
+		}
+	}
+	echo("before")
+
+	cancel()
+	<-waitRegister
+
+	// The open connection keeps working but new ones are refused
+	echo("after")
+	if newConn, err := net.Dial("tcp", addr); err == nil {
+		newConn.Close()
+		t.Error("Wanted new connections to be refused after unregistering")
+	}
+}
+
+// Test that a new portal can take over the listeners from a running portal
+// over the -upgrade_socket, and that the old one exits when it's ready. The
+// new portal is just another Run call in this process.
+func (*PortalTest) Upgrade(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Upgrades are not supported on windows")
+	}
+	var ports []int
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+	}
+	dir := t.TempDir()
+	args := []string{
+		"portal",
+		fmt.Sprintf("-http_port=%v", ports[0]),
+		fmt.Sprintf("-https_port=%v", ports[1]),
+		fmt.Sprintf("-rpc_port=%v", ports[2]),
+		"-http3_port=0",
+		"-port_range_start=9000",
+		"-port_range_end=9999",
+		"-drain_timeout=1s",
+		"-save_file=" + filepath.Join(dir, "state.protodata"),
+		"-upgrade_socket=" + filepath.Join(dir, "upgrade.sock"),
+	}
+	run := func(name string, token <-chan string) (string, <-chan struct{}) {
+		done := make(chan struct{})
+		go func() {
+			embedportal.Run(t.Context(), flag.NewFlagSet(name, flag.PanicOnError), args)
+			close(done)
+		}()
+		t.Cleanup(func() { <-done })
+		select {
+		case tok := <-token:
+			return tok, done
+		case <-done:
+			t.Fatalf("The %v portal exited before starting", name)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("The %v portal didn't start", name)
+		}
+		return "", nil
+	}
+	get := func() {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/upgrade/", ports[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Wanted 404 for an unregistered path, got: %v", resp.Status)
+		}
+	}
+
+	oldToken, oldDone := run("old", CaptureTokenFromLogs(t))
+	get()
+
+	t.Setenv("PORTAL_UPGRADE", "1")
+	newToken, _ := run("new", CaptureTokenFromLogs(t))
+	if newToken != oldToken {
+		t.Errorf("Wanted the new portal to load the state with the same token")
+	}
+	select {
+	case <-oldDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The old portal didn't exit after the new one was ready")
+	}
+	// The new portal is serving on the same port
+	get()
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", ports[2])); err != nil {
+		t.Error("Wanted the new portal to serve the RPC port: ", err)
+	} else {
+		conn.Close()
+	}
+}
+
+// Test that two portals with each other in -peers share the registrations,
+// so a client can register with either one and both serve it. Each keeps its
+// own API token.
+func (*PortalTest) Peers(t *testing.T) {
+	// The backend that's shared needs an address the other portal can reach
+	var hostIP net.IP
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && !ipNet.IP.IsLoopback() {
+				hostIP = ipNet.IP
+				break
+			}
+		}
+	}
+	if hostIP == nil {
+		t.Skip("Needs a non-loopback IPv4 address for the backend")
+	}
+	var ports [2][3]int
+	for i := range ports {
+		for j := range ports[i] {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ports[i][j] = l.Addr().(*net.TCPAddr).Port
+			l.Close()
+		}
+	}
+	// Write the -peer_key_file for each so we know the fingerprints up front
+	var keyFiles, fingerprints [2]string
+	for i := range keyFiles {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyFiles[i] = filepath.Join(t.TempDir(), "peer.key")
+		if err := os.WriteFile(keyFiles[i], pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		publicKey, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := sha256.Sum256(publicKey)
+		fingerprints[i] = hex.EncodeToString(hash[:])
+	}
+	run := func(i int, id string) string {
+		token := CaptureTokenFromLogs(t)
+		done := make(chan struct{})
+		go func() {
+			embedportal.Run(t.Context(), flag.NewFlagSet(id, flag.PanicOnError), []string{
+				"portal",
+				fmt.Sprintf("-http_port=%v", ports[i][0]),
+				fmt.Sprintf("-https_port=%v", ports[i][1]),
+				fmt.Sprintf("-rpc_port=%v", ports[i][2]),
+				fmt.Sprintf("-peers=127.0.0.1:%v#%v", ports[1-i][2], fingerprints[1-i]),
+				"-peer_token=peer-secret",
+				"-peer_key_file=" + keyFiles[i],
+				"-peer_id=" + id,
+				"-http3_port=0",
+				"-port_range_start=9000",
+				"-port_range_end=9999",
+				"-save_file=",
+			})
+			close(done)
+		}()
+		t.Cleanup(func() { <-done })
+		select {
+		case tok := <-token:
+			return tok
+		case <-done:
+			t.Fatalf("Portal %v exited before starting", id)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Portal %v didn't start", id)
+		}
+		return ""
+	}
+	tokenA := run(0, "a")
+	tokenB := run(1, "b")
+	if tokenA == tokenB {
+		t.Fatal("The peers should each have their own API token")
+	}
+
+	// Registers a backend on the listener with b, connecting to b's RPC port on
+	// the listener's IP so that's the backend address portal uses
+	register := func(l net.Listener, pattern string) (unregister func()) {
+		t.Helper()
+		ip := l.Addr().(*net.TCPAddr).IP
+		b, err := gate.Connect(net.JoinHostPort(ip.String(), fmt.Sprint(ports[1][2])), tokenB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The backend uses the cert signed by b, so a needs the root CA of b
+		var cert atomic.Pointer[tls.Certificate]
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			io.WriteString(w, "peers")
+		})}
+		go srv.Serve(tls.NewListener(l, &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return cert.Load(), nil
+			},
+		}))
+		ctx, cancel := context.WithCancel(t.Context())
+		registered := make(chan struct{})
+		waitRegister := make(chan struct{})
+		go func() {
+			b.AutoRegister(ctx, &gate.RegisterRequest{
+				Pattern:   pattern,
+				FixedPort: uint16(l.Addr().(*net.TCPAddr).Port),
+			}, func(lease *gate.Lease) {
+				cert.Store(lease.Certificate)
+				select {
+				case <-registered:
+				default:
+					close(registered)
+				}
+			})
+			close(waitRegister)
+		}()
+		select {
+		case <-registered:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Failed to register %v with portal b", pattern)
+		}
+		unregister = func() {
+			cancel()
+			<-waitRegister
+			srv.Close()
+			b.Close()
+		}
+		t.Cleanup(unregister)
+		return unregister
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	waitForStatus := func(portal int, path string, want int) {
+		t.Helper()
+		url := fmt.Sprintf("https://127.0.0.1:%v%v", ports[portal][1], path)
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			var last string
+			resp, err := client.Get(url)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode == want {
+					return
+				}
+				last = resp.Status
+			} else {
+				last = err.Error()
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Portal %v never served %v for %v (last: %v)",
+					portal, want, path, last)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	// A backend on b's loopback address is only served by b, on a the same
+	// address would be some other server
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	register(local, "/local/")
+	waitForStatus(1, "/local/", http.StatusOK)
+
+	// Register with b on the network address and check that a serves it
+	remote, err := net.Listen("tcp", net.JoinHostPort(hostIP.String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unregister := register(remote, "/peers/")
+	waitForStatus(0, "/peers/", http.StatusOK)
+	// The updates are in order so a has seen the local one by now
+	waitForStatus(0, "/local/", http.StatusNotFound)
+	// Outlive the 2 second leases so the renewals have to be replicated
+	time.Sleep(3 * time.Second)
+	waitForStatus(0, "/peers/", http.StatusOK)
+	waitForStatus(0, "/local/", http.StatusNotFound)
+
+	// Unregistering with b removes it from a
+	unregister()
+	waitForStatus(0, "/peers/", http.StatusNotFound)
+}
+
+// Test that the -save_file is encrypted with the -state_key_file, including
+// encrypting an existing unencrypted file and changing the key.
+func (*PortalTest) StateEncryption(t *testing.T) {
+	dir := t.TempDir()
+	saveFile := filepath.Join(dir, "state.protodata")
+	writeKey := func(name, key string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	oldKey := writeKey("old.key", "correct horse battery staple")
+	newKey := writeKey("new.key", "a different secret")
+	run := func(keyArgs ...string) string {
+		t.Helper()
+		// New ports each time because the old listeners might not be closed yet
+		var ports []int
+		for i := 0; i < 3; i++ {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+			l.Close()
+		}
+		token := CaptureTokenFromLogs(t)
+		ctx, cancel := context.WithCancel(t.Context())
+		done := make(chan struct{})
+		go func() {
+			embedportal.Run(ctx, flag.NewFlagSet(t.Name(), flag.PanicOnError), append([]string{
+				"portal",
+				fmt.Sprintf("-http_port=%v", ports[0]),
+				fmt.Sprintf("-https_port=%v", ports[1]),
+				fmt.Sprintf("-rpc_port=%v", ports[2]),
+				"-http3_port=0",
+				"-save_file=" + saveFile,
+			}, keyArgs...))
+			close(done)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+		select {
+		case tok := <-token:
+			return tok
+		case <-done:
+			t.Fatal("Portal exited before starting")
+		case <-time.After(10 * time.Second):
+			t.Fatal("Portal didn't start")
+		}
+		return ""
+	}
+	contains := func(token string) bool {
+		t.Helper()
+		data, err := os.ReadFile(saveFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Contains(data, []byte(token))
+	}
+
+	token := run()
+	if !contains(token) {
+		t.Fatal("Wanted the token in the unencrypted state file")
+	}
+	if got := run("-state_key_file=" + oldKey); got != token {
+		t.Error("Wanted the unencrypted state to be loaded with the key set")
+	}
+	if contains(token) {
+		t.Error("Wanted the state file to be encrypted")
+	}
+	if got := run("-state_key_file=" + newKey, "-previous_state_key_file=" + oldKey); got != token {
+		t.Error("Wanted the state to be loaded with the previous key")
+	}
+	t.Setenv("PORTAL_STATE_KEY", "a different secret")
+	if got := run(); got != token {
+		t.Error("Wanted the state to be re-encrypted with the new key")
+	}
+	// Turn encryption off
+	t.Setenv("PORTAL_STATE_KEY", "")
+	if got := run("-previous_state_key_file=" + newKey); got != token {
+		t.Error("Wanted the state to be decrypted with the previous key")
+	}
+	if !contains(token) {
+		t.Error("Wanted the state file to be unencrypted without a key")
+	}
+}
+
+// Test the portal state subcommands that read and edit the -save_file offline.
+func (*PortalTest) StateSubcommands(t *testing.T) {
+	dir := t.TempDir()
+	saveFile := filepath.Join(dir, "state.protodata")
+	state := func(args ...string) string {
+		t.Helper()
+		// Capture stdout, which is why this test isn't parallel
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout := os.Stdout
+		os.Stdout = w
+		out := make(chan []byte)
+		go func() {
+			data, _ := io.ReadAll(r)
+			out <- data
+		}()
+		embedportal.Run(t.Context(), flag.NewFlagSet(t.Name(), flag.PanicOnError),
+			append([]string{"portal", "state", args[0], "-save_file=" + saveFile}, args[1:]...))
+		os.Stdout = stdout
+		w.Close()
+		return string(<-out)
+	}
+
+	input := filepath.Join(dir, "state.textproto")
+	expired := time.Now().Add(-time.Hour).Unix()
+	current := time.Now().Add(time.Hour).Unix()
+	err := os.WriteFile(input, []byte(fmt.Sprintf(`
+		api_token: "the secret token"
+		registrations { lease { pattern: "/expired/" port: 2050 timeout { seconds: %v } } }
+		registrations { lease { pattern: "/current/" port: 2051 timeout { seconds: %v } } }
+		registrations { lease { pattern: "/pinned/" port: 2052 } pinned: true }
+	`, expired, current)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state("import", "-input="+input)
+	if out := state("dump"); strings.Contains(out, "the secret token") || !strings.Contains(out, "/expired/") {
+		t.Errorf("Wanted the token redacted and the registrations in the dump, got:\n%v", out)
+	}
+	if out := state("dump", "-format=json", "-show_secrets"); !strings.Contains(out, "the secret token") {
+		t.Errorf("Wanted the token in the JSON dump with -show_secrets, got:\n%v", out)
+	}
+
+	state("prune")
+	out := state("dump")
+	if strings.Contains(out, "/expired/") || !strings.Contains(out, "/current/") || !strings.Contains(out, "/pinned/") {
+		t.Errorf("Wanted only the expired registration pruned, got:\n%v", out)
+	}
+
+	cert, err := tools.GenerateSelfSignedCertificate("example.com", time.Now().Add(time.Hour), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+	state("import-cert", "-cert="+certFile, "-key="+keyFile)
+
+	certsDir := filepath.Join(dir, "certs")
+	state("export-certs", "-out="+certsDir)
+	exported, err := tls.LoadX509KeyPair(
+		filepath.Join(certsDir, "example.com", "fullchain.pem"),
+		filepath.Join(certsDir, "example.com", "privkey.pem"))
+	if err != nil {
+		t.Fatal("Failed to load the exported cert:", err)
+	}
+	if !equalCerts(exported.Certificate, cert.Certificate) {
+		t.Error("Wanted the exported cert to match the imported one")
+	}
+}
+
+// Test the -admin_url page shows the routes and that its buttons work.
+func (p *PortalTest) Admin(t *testing.T) {
+	t.Parallel()
+
+	pattern := fmt.Sprintf("/%v/", t.Name())
+	portal, err := gate.DefaultClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer portal.Close()
+	// Not AutoRegister because it would register again after the admin
+	// unregisters it
+	_, err = portal.Register(t.Context(), &gate.RegisterRequest{
+		Pattern: pattern,
+		StaticResponse: &gate.StaticResponse{
+			Body: []byte("Hello"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	base := fmt.Sprintf("https://127.0.0.1:%v", p.HTTPSPort)
+	admin := func(method, password string, form url.Values, header ...string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, base+adminURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("admin", password)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	getStatus := func() int {
+		t.Helper()
+		resp, err := client.Get(base + pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code, _ := admin("GET", "wrong password", nil); code != http.StatusUnauthorized {
+		t.Error("Wanted 401 with the wrong password, got:", code)
+	}
+	if code, body := admin("GET", adminPassword, nil); code != http.StatusOK || !strings.Contains(body, pattern) {
+		t.Errorf("Wanted the admin page to list %v, got %v:\n%v", pattern, code, body)
+	}
+
+	maintenance := url.Values{"submit": {"maintenance"}, "pattern": {pattern}}
+	for _, header := range [][]string{
+		{"Sec-Fetch-Site", "cross-site"},
+		{"Origin", "https://evil.example.com"},
+		{"Sec-Fetch-Site", "same-origin", "Origin", "https://evil.example.com"},
+		nil, // Without the fetch metadata we can't tell where it came from
+	} {
+		if code, _ := admin("POST", adminPassword, maintenance, header...); code != http.StatusForbidden {
+			t.Errorf("Wanted 403 for a cross site post with headers %v, got: %v", header, code)
+		}
+	}
+	if got := getStatus(); got != http.StatusOK {
+		t.Error("Wanted 200 before maintenance mode, got:", got)
+	}
+	if code, _ := admin("POST", adminPassword, maintenance, "Origin", base); code != http.StatusSeeOther {
+		t.Error("Wanted a redirect after toggling maintenance mode, got:", code)
+	}
+	if got := getStatus(); got != http.StatusServiceUnavailable {
+		t.Error("Wanted 503 in maintenance mode, got:", got)
+	}
+	admin("POST", adminPassword, maintenance, "Sec-Fetch-Site", "same-origin")
+
+	unregister := url.Values{"submit": {"unregister"}, "pattern": {pattern}}
+	if code, _ := admin("POST", adminPassword, unregister, "Origin", base); code != http.StatusSeeOther {
+		t.Error("Wanted a redirect after unregistering, got:", code)
+	}
+	if got := getStatus(); got != http.StatusNotFound {
+		t.Error("Wanted 404 after unregistering, got:", got)
+	}
+}
+
+// Test that a -tls_cert file close to expiring sends an alert to the
+// -alert_webhook.
+func (*PortalTest) CertExpiryAlert(t *testing.T) {
+	dir := t.TempDir()
+	cert, err := tools.GenerateSelfSignedCertificate("expiring.example.com",
+		time.Now().Add(48*time.Hour), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+
+	alerts := make(chan map[string]any, 1)
+	webhook := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var alert map[string]any
+		if err := json.NewDecoder(req.Body).Decode(&alert); err != nil {
+			t.Error("Failed to decode the alert:", err)
+		}
+		select {
+		case alerts <- alert:
+		default:
+		}
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go webhook.Serve(l)
+	defer webhook.Close()
+
+	var ports []int
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		embedportal.Run(ctx, flag.NewFlagSet(t.Name(), flag.PanicOnError), []string{
+			"portal",
+			fmt.Sprintf("-http_port=%v", ports[0]),
+			fmt.Sprintf("-https_port=%v", ports[1]),
+			fmt.Sprintf("-rpc_port=%v", ports[2]),
+			"-http3_port=0",
+			"-save_file=",
+			"-tls_cert=" + certFile,
+			"-tls_key=" + keyFile,
+			"-alert_expiry_days=7",
+			fmt.Sprintf("-alert_webhook=http://%v/", l.Addr()),
+		})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case alert := <-alerts:
+		if alert["type"] != "cert_expiring" {
+			t.Errorf("Wanted a cert_expiring alert, got: %v", alert)
+		}
+		if names, _ := alert["names"].([]any); len(names) != 1 || names[0] != "expiring.example.com" {
+			t.Errorf("Wanted the alert for expiring.example.com, got: %v", alert)
+		}
+	case <-done:
+		t.Fatal("Portal exited before sending the alert")
+	case <-time.After(10 * time.Second):
+		t.Fatal("Didn't get the alert")
+	}
+}
+
+// Test that portal staples the OCSP response for a -tls_cert file, and staples
+// the saved response after a restart without asking the responder again.
+func (*PortalTest) OCSPStapling(t *testing.T) {
+	dir := t.TempDir()
+	saveFile := filepath.Join(dir, "state.protodata")
+	ca, err := tools.GenerateSelfSignedCertificate("Test OCSP CA",
+		time.Now().Add(24*time.Hour), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey := ca.PrivateKey.(crypto.Signer)
+
+	var requests atomic.Int32
+	responder := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			t.Error("Failed to parse the OCSP request:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(ca.Leaf, ca.Leaf, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Hour),
+			NextUpdate:   time.Now().Add(7 * 24 * time.Hour),
+		}, caKey)
+		if err != nil {
+			t.Error("Failed to create the OCSP response:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go responder.Serve(l)
+	defer responder.Close()
+
+	// Sign a cert for the server with the responder in it
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1234),
+		DNSNames:     []string{"ocsp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   []string{fmt.Sprintf("http://%v/", l.Addr())},
+	}, ca.Leaf, leafKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "fullchain.pem")
+	keyFile := filepath.Join(dir, "privkey.pem")
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})...)
+	os.WriteFile(certFile, chain, 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	// Runs portal and returns the OCSP response it staples
+	run := func() []byte {
+		t.Helper()
+		// New ports each time because the old listeners might not be closed yet
+		var ports []int
+		for i := 0; i < 3; i++ {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+			l.Close()
+		}
+		ctx, cancel := context.WithCancel(t.Context())
+		done := make(chan struct{})
+		go func() {
+			embedportal.Run(ctx, flag.NewFlagSet(t.Name(), flag.PanicOnError), []string{
+				"portal",
+				fmt.Sprintf("-http_port=%v", ports[0]),
+				fmt.Sprintf("-https_port=%v", ports[1]),
+				fmt.Sprintf("-rpc_port=%v", ports[2]),
+				"-http3_port=0",
+				"-save_file=" + saveFile,
+				"-tls_cert=" + certFile,
+				"-tls_key=" + keyFile,
+			})
+			close(done)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", ports[1]), &tls.Config{
+				ServerName:         "ocsp.example.com",
+				InsecureSkipVerify: true,
+			})
+			if err == nil {
+				staple := conn.ConnectionState().OCSPResponse
+				conn.Close()
+				if staple != nil {
+					return staple
+				}
+			}
+			select {
+			case <-done:
+				t.Fatal("Portal exited before stapling the OCSP response")
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		t.Fatal("Portal didn't staple the OCSP response")
+		return nil
+	}
+
+	staple := run()
+	resp, err := ocsp.ParseResponseForCert(staple, leaf, ca.Leaf)
+	if err != nil {
+		t.Fatal("Invalid stapled OCSP response:", err)
+	}
+	if resp.Status != ocsp.Good {
+		t.Errorf("Wanted a good OCSP response, got status %v", resp.Status)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("Wanted 1 request to the OCSP responder, got %v", got)
+	}
+
+	// After restarting the saved response is used
+	responder.Close()
+	if restarted := run(); !bytes.Equal(restarted, staple) {
+		t.Error("Wanted the saved OCSP response to be stapled after restarting")
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("Wanted no more requests to the OCSP responder, got %v", got)
+	}
+}
+
+// Test the -tls_policy_file settings for the TLS handshake, HSTS, and plain
+// HTTP per hostname.
+func (*PortalTest) TLSPolicy(t *testing.T) {
+	dir := t.TempDir()
+	routesFile := filepath.Join(dir, "routes.textproto")
+	os.WriteFile(routesFile, []byte(`
+route: { pattern: "secure.example.com/" static_response: { body: "secure" } }
+route: { pattern: "default.example.com/" static_response: { body: "default" } }
+route: { pattern: "open.example.com/" allow_http: true static_response: { body: "open" } }
+route: { pattern: "strict.example.com/" allow_http: true static_response: { body: "strict" } }
+`), 0600)
+	policyFile := filepath.Join(dir, "policy.textproto")
+	os.WriteFile(policyFile, []byte(`
+policy: {
+	hostname: "secure.example.com"
+	min_version: "1.3"
+	alpn: "http/1.1"
+	hsts_max_age_seconds: 31536000
+	hsts_include_subdomains: true
+	hsts_preload: true
+}
+policy: { hostname: "*.example.com" min_version: "1.2" }
+policy: { hostname: "strict.example.com" https_only: true }
+`), 0600)
+
+	var ports []int
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		embedportal.Run(ctx, flag.NewFlagSet(t.Name(), flag.PanicOnError), []string{
+			"portal",
+			fmt.Sprintf("-http_port=%v", ports[0]),
+			fmt.Sprintf("-https_port=%v", ports[1]),
+			fmt.Sprintf("-rpc_port=%v", ports[2]),
+			"-http3_port=0",
+			"-save_file=",
+			"-routes_file=" + routesFile,
+			"-tls_policy_file=" + policyFile,
+		})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	httpsAddr := fmt.Sprintf("127.0.0.1:%v", ports[1])
+	dial := func(conf *tls.Config) (*tls.Conn, error) {
+		conf.InsecureSkipVerify = true
+		return tls.Dial("tcp", httpsAddr, conf)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := dial(&tls.Config{ServerName: "default.example.com"})
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Portal didn't start:", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if conn, err := dial(&tls.Config{
+		ServerName: "secure.example.com",
+		MaxVersion: tls.VersionTLS12,
+	}); err == nil {
+		conn.Close()
+		t.Error("Wanted TLS 1.2 to be refused for secure.example.com")
+	}
+	conn, err := dial(&tls.Config{
+		ServerName: "secure.example.com",
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := conn.ConnectionState(); state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("Wanted http/1.1 for secure.example.com, got %#v", state.NegotiatedProtocol)
+	}
+	conn.Close()
+	conn, err = dial(&tls.Config{
+		ServerName: "default.example.com",
+		MaxVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatal("Wanted TLS 1.2 to work for default.example.com:", err)
+	}
+	if state := conn.ConnectionState(); state.NegotiatedProtocol != "h2" {
+		t.Errorf("Wanted h2 for default.example.com, got %#v", state.NegotiatedProtocol)
+	}
+	conn.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(scheme, host string) *http.Response {
+		t.Helper()
+		addr := fmt.Sprintf("127.0.0.1:%v", ports[0])
+		if scheme == "https" {
+			addr = httpsAddr
+		}
+		req, err := http.NewRequest("GET", scheme+"://"+addr+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		client.Transport.(*http.Transport).TLSClientConfig.ServerName = host
+		client.Transport.(*http.Transport).CloseIdleConnections()
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	for _, tc := range []struct {
+		host string
+		hsts string
+	}{
+		{"secure.example.com", "max-age=31536000; includeSubDomains; preload"},
+		{"default.example.com", "max-age=300"},
+		// The other registration allowing HTTP doesn't turn it off here
+		{"open.example.com", ""},
+		{"strict.example.com", "max-age=300"},
+	} {
+		if got := get("https", tc.host).Header.Get("Strict-Transport-Security"); got != tc.hsts {
+			t.Errorf("Wanted HSTS %#v for %v, got %#v", tc.hsts, tc.host, got)
+		}
+	}
+	if resp := get("http", "open.example.com"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Wanted plain HTTP to work for open.example.com, got %v", resp.Status)
+	}
+	if resp := get("http", "strict.example.com"); resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		t.Errorf("Wanted a redirect to HTTPS for strict.example.com, got %v", resp.Status)
+	}
+}
+
+// Test that portal sends a signed DNS UPDATE with its public IP from an HTTP
+// echo server for the -ddns_domains.
+func (*PortalTest) DynamicDNS(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "tsig.key")
+	secret := base64.StdEncoding.EncodeToString([]byte("not very secret"))
+	os.WriteFile(keyFile, []byte("hmac-sha256:portal-key:"+secret+"\n"), 0600)
+
+	echo := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "203.0.113.7\n")
+	})}
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go echo.Serve(echoListener)
+	defer echo.Close()
+
+	type update struct {
+		header      dnsmessage.Header
+		zone        dnsmessage.Question
+		records     []dnsmessage.Resource
+		additionals []dnsmessage.Resource
+	}
+	updates := make(chan update, 1)
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dns.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := dns.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var parser dnsmessage.Parser
+			var u update
+			u.header, err = parser.Start(buf[:n])
+			if err != nil {
+				t.Error("Invalid DNS message:", err)
+				continue
+			}
+			questions, err := parser.AllQuestions()
+			if err != nil || len(questions) != 1 {
+				t.Errorf("Wanted one zone in the update, got %v: %v", questions, err)
+				continue
+			}
+			u.zone = questions[0]
+			parser.SkipAllAnswers()
+			if u.records, err = parser.AllAuthorities(); err != nil {
+				t.Error("Invalid update section:", err)
+				continue
+			}
+			if u.additionals, err = parser.AllAdditionals(); err != nil {
+				t.Error("Invalid additional section:", err)
+				continue
+			}
+			select {
+			case updates <- u:
+			default:
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+				ID: u.header.ID, Response: true, OpCode: u.header.OpCode,
+			})
+			resp, _ := b.Finish()
+			dns.WriteTo(resp, addr)
+		}
+	}()
+
+	var ports []int
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		embedportal.Run(ctx, flag.NewFlagSet(t.Name(), flag.PanicOnError), []string{
+			"portal",
+			fmt.Sprintf("-http_port=%v", ports[0]),
+			fmt.Sprintf("-https_port=%v", ports[1]),
+			fmt.Sprintf("-rpc_port=%v", ports[2]),
+			"-http3_port=0",
+			"-save_file=",
+			"-ddns_provider=rfc2136",
+			"-ddns_domains=home.example.com",
+			fmt.Sprintf("-ddns_ip_source=http://%v/", echoListener.Addr()),
+			fmt.Sprintf("-ddns_server=%v", dns.LocalAddr()),
+			"-ddns_zone=example.com",
+			"-ddns_tsig_key_file=" + keyFile,
+			"-ddns_ttl=60s",
+		})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var u update
+	select {
+	case u = <-updates:
+	case <-done:
+		t.Fatal("Portal exited before sending the DNS update")
+	case <-time.After(10 * time.Second):
+		t.Fatal("Didn't get the DNS update")
+	}
+	if u.header.OpCode != 5 {
+		t.Errorf("Wanted an UPDATE (opcode 5), got opcode %v", u.header.OpCode)
+	}
+	if u.zone.Name.String() != "example.com." || u.zone.Type != dnsmessage.TypeSOA {
+		t.Errorf("Wanted the example.com. zone, got: %v", u.zone)
+	}
+	if len(u.records) != 2 {
+		t.Fatalf("Wanted a delete and an add record, got: %v", u.records)
+	}
+	del, add := u.records[0].Header, u.records[1]
+	if del.Name.String() != "home.example.com." || del.Type != dnsmessage.TypeA ||
+		del.Class != dnsmessage.ClassANY {
+		t.Errorf("Wanted to delete the home.example.com. A records, got: %v", del)
+	}
+	a, ok := add.Body.(*dnsmessage.AResource)
+	if !ok || add.Header.Name.String() != "home.example.com." ||
+		add.Header.TTL != 60 || a.A != [4]byte{203, 0, 113, 7} {
+		t.Errorf("Wanted to add home.example.com. A 203.0.113.7 TTL 60, got: %v", add)
+	}
+	if len(u.additionals) != 1 || u.additionals[0].Header.Type != 250 ||
+		u.additionals[0].Header.Name.String() != "portal-key." {
+		t.Errorf("Wanted the update signed with a TSIG record, got: %v", u.additionals)
+	}
+}
+
+// Test that portal listens on each -bind_address, only serves RPCs on the
+// -rpc_bind_address, and proxies to IPv6 backends.
+func (*PortalTest) BindAddress(t *testing.T) {
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("IPv6 is not available: ", err)
+	} else {
+		l.Close()
+	}
+	var ports []int
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+	}
+	token := CaptureTokenFromLogs(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		embedportal.Run(ctx, flag.NewFlagSet(t.Name(), flag.PanicOnError), []string{
+			"portal",
+			fmt.Sprintf("-http_port=%v", ports[0]),
+			fmt.Sprintf("-https_port=%v", ports[1]),
+			fmt.Sprintf("-rpc_port=%v", ports[2]),
+			"-bind_address=127.0.0.1,[::1]",
+			"-rpc_bind_address=127.0.0.1",
+			"-http3_port=0",
+			"-save_file=",
+		})
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	var tok string
+	select {
+	case tok = <-token:
+	case <-done:
+		t.Fatal("Portal exited before starting")
+	case <-time.After(10 * time.Second):
+		t.Fatal("Portal didn't start")
+	}
+
+	if conn, err := net.Dial("tcp", fmt.Sprintf("[::1]:%v", ports[2])); err == nil {
+		conn.Close()
+		t.Error("The RPC port is open on ::1, which isn't in -rpc_bind_address")
+	}
+	client, err := gate.Connect(fmt.Sprintf("127.0.0.1:%v", ports[2]), tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	backend, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ipv6 backend")
+	})}
+	go srv.Serve(backend)
+	defer srv.Close()
+	_, err = client.Register(t.Context(), &gate.RegisterRequest{
+		Pattern:   "/ipv6/",
+		FixedPort: uint16(backend.Addr().(*net.TCPAddr).Port),
+		Hostname:  "[::1]",
+		AllowHttp: true,
+	})
+	if err != nil {
+		t.Fatal("Failed to register the IPv6 backend: ", err)
+	}
+
+	for _, host := range []string{"127.0.0.1", "[::1]"} {
+		resp, err := http.Get(fmt.Sprintf("http://%v:%v/ipv6/", host, ports[0]))
+		if err != nil {
+			t.Errorf("Failed to connect to portal on %v: %v", host, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "ipv6 backend" {
+			t.Errorf("Wanted the IPv6 backend response on %v, got %v: %q", host, resp.Status, body)
+		}
+	}
+}
+
+// Test that clients can register over the -rpc_socket without the API token
+func (*PortalTest) RPCSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The file permissions don't apply to unix sockets on windows")
+	}
+	socket := filepath.Join(t.TempDir(), "portal.sock")
+	var ports []int
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+	}
+	token := CaptureTokenFromLogs(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		embedportal.Run(ctx, flag.NewFlagSet(t.Name(), flag.PanicOnError), []string{
+			"portal",
+			fmt.Sprintf("-http_port=%v", ports[0]),
+			fmt.Sprintf("-https_port=%v", ports[1]),
+			fmt.Sprintf("-rpc_port=%v", ports[2]),
+			"-rpc_socket=" + socket,
+			"-http3_port=0",
+			"-save_file=",
+		})
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		if _, err := os.Stat(socket); !os.IsNotExist(err) {
+			t.Errorf("Portal didn't remove the -rpc_socket file on exit: %v", err)
+		}
+	})
+	select {
+	case <-token:
+	case <-done:
+		t.Fatal("Portal exited before starting")
+	case <-time.After(10 * time.Second):
+		t.Fatal("Portal didn't start")
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("Wanted the -rpc_socket to have mode 0660, got %v", info.Mode().Perm())
+	}
+
+	client, err := gate.Connect("unix://"+socket, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	hostname, err := client.MyHostname(t.Context())
+	if err != nil {
+		t.Fatal("MyHostname over the -rpc_socket failed: ", err)
+	}
+	if hostname != "127.0.0.1" {
+		t.Errorf("Wanted the hostname 127.0.0.1 for a -rpc_socket client, got %v", hostname)
+	}
+
+	port, listener, _ := FreePort(t)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "from the socket")
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+	_, err = client.Register(t.Context(), &gate.RegisterRequest{
+		Pattern:   "/socket/",
+		FixedPort: port,
+		AllowHttp: true,
+	})
+	if err != nil {
+		t.Fatal("Failed to register over the -rpc_socket: ", err)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%v/socket/", ports[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "from the socket" {
+		t.Errorf("Wanted the backend response, got %v: %q", resp.Status, body)
+	}
+}
+
+// Test HTTP and TCP backends that listen on unix sockets instead of ports
+func (p *PortalTest) UnixSocketBackends(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The test uses unix socket paths")
+	}
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	// HTTP with the certificate from AutoRegister
+	httpSocket := filepath.Join(dir, "http.sock")
+	httpListener, err := net.Listen("unix", httpSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pattern := fmt.Sprintf("/%v/", t.Name())
+	port, tlsconf, waitHTTPRegister, err := gate.AutoRegister(ctx, &gate.RegisterRequest{
+		Pattern:    pattern,
+		UnixSocket: httpSocket,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 0 {
+		t.Errorf("Wanted no port leased for the unix socket, got %v", port)
+	}
+	waitHTTP := make(chan struct{})
+	go func() {
+		tools.HTTPServer(ctx, 0, tlsconf, &tools.HTTPServerOptions{
+			Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				io.WriteString(w, "unix socket backend")
+			})},
+			ShutdownTimeout: time.Second,
+			Listener:        httpListener,
+			Quiet:           true,
+		})
+		close(waitHTTP)
+	}()
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%v%v", p.HTTPSPort, pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "unix socket backend" {
+		t.Errorf("Wanted the response from the unix socket, got %v: %q", resp.Status, body)
+	}
+
+	// TCP echo server
+	tcpSocket := filepath.Join(dir, "tcp.sock")
+	backend, err := net.Listen("unix", tcpSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPort := public.Addr().(*net.TCPAddr).Port
+	public.Close() // portal will listen on it
+	_, _, waitTCPRegister, err := gate.AutoRegister(ctx, &gate.RegisterRequest{
+		Pattern:    fmt.Sprintf(":tcp:%v", publicPort),
+		UnixSocket: tcpSocket,
+		TCPMode:    gate.TCPModePlain,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", publicPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Error(err)
+	} else if string(buf) != "hello" {
+		t.Errorf("Wrong echo from the unix socket: %q", buf)
+	}
+	conn.Close()
+
+	// Invalid registrations
+	rpc, err := gate.Connect(*gate.Address, *gate.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Close()
+	for _, req := range []*gate.RegisterRequest{
+		{Pattern: ":udp:5353", UnixSocket: tcpSocket},
+		{Pattern: "/relative/", UnixSocket: "relative.sock"},
+		{Pattern: "/both/", UnixSocket: tcpSocket, Hostname: "127.0.0.1"},
+	} {
+		if _, err := rpc.Register(t.Context(), req); err == nil {
+			t.Errorf("Wanted an error registering %v with unix_socket %#v",
+				req.Pattern, req.UnixSocket)
+		}
+	}
+
+	cancel()
+	<-waitHTTPRegister
+	<-waitTCPRegister
+	<-waitHTTP
+}
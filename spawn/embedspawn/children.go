@@ -91,9 +91,10 @@ func (c *children) StartPrograms(programs []*spawnpb.Command) (errCnt int) {
 	return errCnt
 }
 
-func (c *children) waitForPortalToken() (string, error) {
-	logs, cancel := c.StreamLogs(true /*includeHistory*/)
-	defer cancel()
+// waitForPortalToken reads the portal token from the logs, which should be
+// subscribed to before portal starts. Returns an error if died is closed
+// first.
+func (c *children) waitForPortalToken(logs <-chan logMessage, died <-chan struct{}) (string, error) {
 	// TODO: A smarter way to wait would be nice. Portal loads all of the saved
 	// registrations and that can take longer if there's a lot of them, that's
 	// why this deadline is so long. Maybe we could do like 1 second per
@@ -105,6 +106,8 @@ func (c *children) waitForPortalToken() (string, error) {
 		select {
 		case <-ttl:
 			return "", errors.New("Deadline exceeded")
+		case <-died:
+			return "", errors.New("Portal exited")
 		case line := <-logs:
 			if line.Tag != "portal" {
 				continue
@@ -126,6 +129,10 @@ func (c *children) waitForPortalToken() (string, error) {
 	}
 }
 
+func isPortalCommand(cmd *spawnpb.Command) bool {
+	return filepath.Base(cmd.Binary) == "portal"
+}
+
 func commandName(cmd *spawnpb.Command) string {
 	name := filepath.Base(cmd.Binary)
 	if cmd.Name != "" {
@@ -143,6 +150,16 @@ func (c *children) RestartChild(name string) {
 		c.Unlock()
 		return
 	}
+	if child.Up && isPortalCommand(child.Cmd) {
+		c.Unlock()
+		err := c.UpgradePortal(name)
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to restart %v without downtime, stopping it first instead: %v", name, err)
+		c.Lock()
+		child = c.ByName[name]
+	}
 	proc := child.Proc
 	if proc != nil {
 		log.Print("Killing ", name)
@@ -209,6 +226,16 @@ func (c *children) ReportDown(pid int, message error) {
 	// Don't accumulate old Child structs in the ByPID map forever, we will still
 	// have it in the ByName map until it gets reloaded then the GC will delete it
 	delete(c.ByPID, pid)
+
+	// The old process after an upgrade, or a new one that failed to take over,
+	// so the child that is running is still up.
+	if c.ByName[child.Name] != child {
+		if child.quitChild != nil {
+			close(child.quitChild)
+		}
+		log.Printf("%v (pid: %v) exited after being replaced: %v", child.Cmd.Binary, pid, message)
+		return
+	}
 	child.Up = false
 	child.Message = message
 	if child.quitChild != nil {
@@ -253,6 +280,25 @@ func listenPortsTCP(ports []uint32) ([]*os.File, error) {
 	return ret, nil
 }
 
+func listenPortsUDP(ports []uint32) ([]*os.File, error) {
+	var ret []*os.File
+	for _, port := range ports {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+		if err != nil {
+			return nil, fmt.Errorf("error listening on udp port (%v): %v",
+				port, err)
+		}
+		defer c.Close()
+		f, err := c.File()
+		if err != nil {
+			return nil, fmt.Errorf("error getting FD for udp port (%v): %v",
+				port, err)
+		}
+		ret = append(ret, f)
+	}
+	return ret, nil
+}
+
 func openFiles(files []string) ([]*os.File, error) {
 	var ret []*os.File
 	for _, fileName := range files {
@@ -421,6 +467,14 @@ func (children *children) setupChildFiles(cmd *spawnpb.Command, quit chan struct
 	if err != nil {
 		return files, err
 	}
+
+	if len(cmd.UdpPorts) != 0 {
+		socketFiles, err := listenPortsUDP(cmd.UdpPorts)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, socketFiles...)
+	}
 	go children.HandleLogs(r, commandName(cmd))
 	return files, nil
 }
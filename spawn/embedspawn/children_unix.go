@@ -16,11 +16,14 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"ask.systems/daemon/internal/spawnpb"
 	"ask.systems/daemon/portal/gate"
+
+	"google.golang.org/protobuf/proto"
 )
 
 // Wrap os.StartProcess for linux only to make child killing work right
@@ -65,17 +68,100 @@ type platformSpecificChildrenInfo struct{}
 func (p *platformSpecificChildrenInfo) Init(c *children) {}
 
 func (children *children) StartProgram(cmd *spawnpb.Command) error {
+	return children.startProgram(cmd, false /*upgrade*/)
+}
+
+// UpgradePortal restarts the portal child without closing its ports. It
+// starts a new portal process (from the binary in the config, so it may be a
+// new version) which takes over the listening sockets from the running one.
+// The old process drains and exits by itself once the new one is ready.
+//
+// If the new process doesn't start, the old one keeps running.
+func (children *children) UpgradePortal(name string) error {
+	children.Lock()
+	old, ok := children.ByName[name]
+	children.Unlock()
+	if !ok || !old.Up || old.Proc == nil {
+		return fmt.Errorf("%v is not running", name)
+	}
+	if !isPortalCommand(old.Cmd) {
+		return fmt.Errorf("%v is not portal", name)
+	}
+	if !hasUpgradeSocket(old.Cmd) {
+		return fmt.Errorf("%v doesn't set -upgrade_socket", name)
+	}
+	return children.startProgram(old.Cmd, true /*upgrade*/)
+}
+
+// hasUpgradeSocket reports if the portal command sets a non-empty
+// -upgrade_socket, which the new process needs to take over the sockets.
+func hasUpgradeSocket(cmd *spawnpb.Command) bool {
+	for i, arg := range cmd.Args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name != "upgrade_socket" || !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if !hasValue && i+1 < len(cmd.Args) {
+			value = cmd.Args[i+1]
+		}
+		return value != ""
+	}
+	return false
+}
+
+// UpgradeOnSignal calls UpgradePortal for the running portal children when
+// spawn gets SIGUSR2.
+func (children *children) UpgradeOnSignal(quit chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-quit:
+			return
+		case <-sigs:
+		}
+		var names []string
+		children.Lock()
+		for name, child := range children.ByName {
+			if child.Up && isPortalCommand(child.Cmd) {
+				names = append(names, name)
+			}
+		}
+		children.Unlock()
+		for _, name := range names {
+			log.Print("Upgrading ", name)
+			if err := children.UpgradePortal(name); err != nil {
+				log.Printf("Failed to upgrade %v: %v", name, err)
+			}
+		}
+	}
+}
+
+func (children *children) startProgram(cmd *spawnpb.Command, upgrade bool) error {
 	if len(cmd.Binary) == 0 {
 		return fmt.Errorf("Binary is required")
 	}
-	isPortal := filepath.Base(cmd.Binary) == "portal"
+	isPortal := isPortalCommand(cmd)
 	name := commandName(cmd)
+	configCmd := cmd
+	if upgrade {
+		// The new portal gets the sockets from the old one, we can't listen on
+		// the ports while it still is.
+		cmd = proto.Clone(cmd).(*spawnpb.Command)
+		cmd.Ports = nil
+		cmd.UdpPorts = nil
+	}
 	attr := &os.ProcAttr{
 		Env: []string{
 			fmt.Sprintf("SPAWN_FILES=%v", len(cmd.Files)),
 			fmt.Sprintf("SPAWN_PORTS=%v", len(cmd.Ports)),
+			fmt.Sprintf("SPAWN_UDP_PORTS=%v", len(cmd.UdpPorts)),
 		},
 	}
+	if upgrade {
+		attr.Env = append(attr.Env, "PORTAL_UPGRADE=1")
+	}
 	err := gate.ResolveFlags()
 	if err == nil {
 		attr.Env = append(attr.Env, fmt.Sprintf("PORTAL_ADDR=%v", *gate.Address))
@@ -200,10 +286,19 @@ func (children *children) StartProgram(cmd *spawnpb.Command) error {
 		}
 	}
 
+	// Subscribe before starting so we don't miss the token. When upgrading
+	// the old portal's token is in the history.
+	var portalLogs <-chan logMessage
+	if isPortal {
+		var cancel func()
+		portalLogs, cancel = children.StreamLogs(!upgrade /*includeHistory*/)
+		defer cancel()
+	}
+
 	// Start the process
 	proc, err := startProcess(binpath, argv, attr)
 	c := &child{
-		Cmd:         cmd,
+		Cmd:         configCmd,
 		Proc:        proc,
 		Name:        name,
 		ChrootFiles: chrootedFiles,
@@ -216,25 +311,53 @@ func (children *children) StartProgram(cmd *spawnpb.Command) error {
 			c.Up = false
 			c.Message = msg
 			close(quitChild)
-			children.Store(c)
+			if !upgrade {
+				children.Store(c)
+			}
 		}
 		return msg
 	}
 	c.Up = true
-	children.Store(c)
+	if upgrade {
+		// Replaces the old child in ByName when the new one is ready
+		children.Lock()
+		children.ByPID[proc.Pid] = c
+		children.Unlock()
+	} else {
+		children.Store(c)
+	}
 	log.Printf("Started process: %v; pid: %v", name, proc.Pid)
 	log.Printf("Args: %v", argv)
 
 	if isPortal {
 		log.Print("Waiting for portal API token...")
-		token, err := children.waitForPortalToken()
+		token, err := children.waitForPortalToken(portalLogs, quitChild)
 		if err != nil {
 			log.Printf("Did not receive portal token: %v", err)
+			if upgrade {
+				// The old portal is still using the same chroot files
+				children.Lock()
+				c.ChrootFiles = nil
+				children.Unlock()
+				proc.Signal(syscall.SIGTERM)
+				return fmt.Errorf("The new portal didn't start: %w", err)
+			}
 		} else {
 			gate.Token = &token
 			log.Print("Token received.")
 		}
 	}
+	if upgrade {
+		children.Lock()
+		// The new process uses the same chroot files, the old one shouldn't delete
+		// them when it exits.
+		if old, ok := children.ByName[name]; ok {
+			old.ChrootFiles = nil
+		}
+		children.ByName[name] = c
+		children.Unlock()
+		log.Printf("Upgraded %v, the old process exits when it's done draining.", name)
+	}
 	log.Printf("Waiting %v...", *spawningDelay)
 	time.Sleep(*spawningDelay)
 	return nil
@@ -98,6 +98,7 @@ func (children *children) StartProgram(cmd *spawnpb.Command) error {
 		Env: append(os.Environ(), []string{
 			fmt.Sprintf("SPAWN_FILES=%v", len(cmd.Files)),
 			fmt.Sprintf("SPAWN_PORTS=%v", len(cmd.Ports)),
+			fmt.Sprintf("SPAWN_UDP_PORTS=%v", len(cmd.UdpPorts)),
 		}...),
 	}
 	err = gate.ResolveFlags()
@@ -151,6 +152,14 @@ func (children *children) StartProgram(cmd *spawnpb.Command) error {
 	}
 	argv := append([]string{binary}, cmd.Args...)
 
+	// Subscribe before starting so we don't miss the token
+	var portalLogs <-chan logMessage
+	if isPortalCommand(cmd) {
+		var cancel func()
+		portalLogs, cancel = children.StreamLogs(true /*includeHistory*/)
+		defer cancel()
+	}
+
 	// Start the process
 	proc, err := os.StartProcess(binary, argv, attr)
 	c := &child{
@@ -186,9 +195,9 @@ func (children *children) StartProgram(cmd *spawnpb.Command) error {
 		}
 	}
 
-	if filepath.Base(cmd.Binary) == "portal" {
+	if isPortalCommand(cmd) {
 		log.Print("Waiting for portal API token...")
-		token, err := children.waitForPortalToken()
+		token, err := children.waitForPortalToken(portalLogs, quitChild)
 		if err != nil {
 			log.Printf("Did not receive portal token: %v", err)
 		} else {
@@ -283,3 +292,12 @@ func openOrRefreshFiles(cmd *spawnpb.Command, quitFileRefresh <-chan struct{}) (
 	}
 	return openFiles(cmd.Files)
 }
+
+// UpgradePortal is not supported on windows because portal can't hand over
+// its sockets
+func (children *children) UpgradePortal(name string) error {
+	return fmt.Errorf("Upgrading portal without downtime is not supported on windows.")
+}
+
+// UpgradeOnSignal does nothing on windows, there is no SIGUSR2
+func (children *children) UpgradeOnSignal(quit chan struct{}) {}
@@ -182,6 +182,7 @@ func Run(ctx context.Context, flagset *flag.FlagSet, args []string) {
 
 	children := newChildren(quit)
 	go children.MonitorDeaths(quit)
+	go children.UpgradeOnSignal(quit)
 	if errcnt := children.StartPrograms(commands); errcnt != 0 {
 		log.Printf("%v errors occurred in spawning", errcnt)
 	}
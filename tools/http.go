@@ -27,6 +27,9 @@ Less common features:
     this for all client connections, and will only connect to your backend via
     HTTPS. So you don't really need to use this unless you're accepting
     connections from clients other than portal.
+  - See the real client address when your server is behind portal or a load
+    balancer that sends the PROXY protocol header with
+    [ProxyProtocolListener] or [HTTPServerOptions.ProxyProtocol].
   - Create a flag that parses with no value and runs a callback when it is
     parsed with [BoolFuncFlag]. This is how -version and -syslog from
     [ask.systems/daemon/tools/flags] works.
@@ -82,8 +85,16 @@ type HTTPServerOptions struct {
 	// internally. This bypasses the port argument to [HTTPServer] and the
 	// AddrHost field.
 	//
-	// Use this if you want a pipe or an FD for the server socket.
+	// Use this if you want a pipe, an FD, or a unix socket for the server socket.
+	// Portal can forward to a unix socket, see
+	// [ask.systems/daemon/portal/gate.RegisterRequest.UnixSocket].
 	Listener net.Listener
+
+	// If true, the connections must start with a PROXY protocol header, which
+	// portal sends when registered with ProxyProtocol set. Then the
+	// [http.Request.RemoteAddr] is the real client address. See
+	// [ProxyProtocolListener].
+	ProxyProtocol bool
 }
 
 // Start an HTTPS (or HTTP) server on the specified port, shutdown when quit is
@@ -126,17 +137,29 @@ func HTTPServer(ctx context.Context, port uint16, conf *tls.Config, opt *HTTPSer
 		proto = "HTTP"
 	}
 
+	listener := opt.Listener
+	if opt.ProxyProtocol {
+		if listener == nil {
+			l, err := net.Listen("tcp", opt.Server.Addr)
+			if err != nil {
+				return err
+			}
+			listener = l
+		}
+		listener = &ProxyProtocolListener{Listener: listener}
+	}
+
 	exitChan := make(chan error, 1)
 	go func() {
 		if !opt.Quiet {
 			log.Printf("Starting %v server on port %d...", proto, port)
 		}
 		var err error
-		if opt.Listener != nil {
+		if listener != nil {
 			if opt.Server.TLSConfig != nil {
-				err = opt.Server.ServeTLS(opt.Listener, "", "")
+				err = opt.Server.ServeTLS(listener, "", "")
 			} else {
-				err = opt.Server.Serve(opt.Listener)
+				err = opt.Server.Serve(listener)
 			}
 		} else {
 			if opt.Server.TLSConfig != nil {
@@ -0,0 +1,302 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The first 12 bytes of a PROXY protocol version 2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The longest PROXY protocol version 1 header, including the CRLF
+const proxyProtocolV1MaxLength = 107
+
+// WriteProxyHeader writes a HAProxy PROXY protocol header for a connection
+// from the client address src to the server address dst. The version must be
+// 1 (text) or 2 (binary).
+//
+// Send this before any other data on the connection to the backend so the
+// backend can see the real client address when it is behind a proxy. If the
+// addresses are not TCP or UDP addresses, the header says the addresses are
+// unknown.
+//
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+func WriteProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	srcIP, srcPort, srcUDP := splitProxyAddr(src)
+	dstIP, dstPort, _ := splitProxyAddr(dst)
+	known := srcIP != nil && dstIP != nil &&
+		(srcIP.To4() == nil) == (dstIP.To4() == nil)
+
+	switch version {
+	case 1:
+		if !known || srcUDP {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		family := "TCP6"
+		if srcIP.To4() != nil {
+			family = "TCP4"
+			srcIP, dstIP = srcIP.To4(), dstIP.To4()
+		}
+		_, err := fmt.Fprintf(w, "PROXY %v %v %v %v %v\r\n",
+			family, srcIP, dstIP, srcPort, dstPort)
+		return err
+	case 2:
+		header := bytes.NewBuffer(append([]byte{}, proxyProtocolV2Signature...))
+		if !known {
+			// LOCAL command with no addresses
+			header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			_, err := w.Write(header.Bytes())
+			return err
+		}
+		header.WriteByte(0x21) // Version 2, PROXY command
+		var family byte = 0x20 // IPv6
+		addrs := make([]byte, 0, 36)
+		if srcIP.To4() != nil {
+			family = 0x10 // IPv4
+			addrs = append(addrs, srcIP.To4()...)
+			addrs = append(addrs, dstIP.To4()...)
+		} else {
+			addrs = append(addrs, srcIP.To16()...)
+			addrs = append(addrs, dstIP.To16()...)
+		}
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcPort))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstPort))
+		if srcUDP {
+			header.WriteByte(family | 0x02) // DGRAM
+		} else {
+			header.WriteByte(family | 0x01) // STREAM
+		}
+		binary.Write(header, binary.BigEndian, uint16(len(addrs)))
+		header.Write(addrs)
+		_, err := w.Write(header.Bytes())
+		return err
+	default:
+		return fmt.Errorf("Unsupported PROXY protocol version: %v", version)
+	}
+}
+
+func splitProxyAddr(addr net.Addr) (ip net.IP, port int, udp bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, false
+	case *net.UDPAddr:
+		return a.IP, a.Port, true
+	}
+	return nil, 0, false
+}
+
+// ProxyProtocolListener accepts connections that start with a HAProxy PROXY
+// protocol header (version 1 or 2), which is sent by load balancers and by
+// [ask.systems/daemon/portal] when configured to. The header is removed from
+// the connection data and RemoteAddr and LocalAddr of the accepted
+// connections return the addresses from the header, so servers see the real
+// client address instead of the proxy's address.
+//
+// The header is read on the first call to Read, RemoteAddr, or LocalAddr so
+// Accept doesn't block on slow clients. If a connection doesn't have a valid
+// header, Read returns an error.
+//
+// Only use this when all the connections come from a trusted proxy, anyone
+// who can connect directly can claim to be any address.
+type ProxyProtocolListener struct {
+	net.Listener
+	// How long to wait for the header. If zero, 10 seconds is used.
+	HeaderTimeout time.Duration
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	timeout := l.HeaderTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &proxyProtocolConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: timeout,
+	}, nil
+}
+
+// proxyProtocolConn is the connection returned by
+// [ProxyProtocolListener.Accept]
+type proxyProtocolConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+
+	// The read deadline set by the caller, restored after the header is read.
+	// The header deadline is only set while reading the header.
+	deadlineMut    sync.Mutex
+	readDeadline   time.Time
+	headerDeadline time.Time
+}
+
+func (c *proxyProtocolConn) readHeaderOnce() error {
+	c.once.Do(func() {
+		c.deadlineMut.Lock()
+		c.headerDeadline = time.Now().Add(c.timeout)
+		c.Conn.SetReadDeadline(earliest(c.readDeadline, c.headerDeadline))
+		c.deadlineMut.Unlock()
+
+		c.remoteAddr, c.localAddr, c.err = readProxyHeader(c.reader)
+
+		c.deadlineMut.Lock()
+		c.headerDeadline = time.Time{}
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.deadlineMut.Unlock()
+		if c.err != nil {
+			c.err = fmt.Errorf("Invalid PROXY protocol header from %v: %w",
+				c.Conn.RemoteAddr(), c.err)
+		}
+	})
+	return c.err
+}
+
+// earliest returns the earlier of two deadlines where zero means no deadline
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.SetReadDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMut.Lock()
+	defer c.deadlineMut.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(earliest(t, c.headerDeadline))
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	if err := c.readHeaderOnce(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.readHeaderOnce() != nil || c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if c.readHeaderOnce() != nil || c.localAddr == nil {
+		return c.Conn.LocalAddr()
+	}
+	return c.localAddr
+}
+
+// readProxyHeader parses a version 1 or 2 header. The addresses are nil if the
+// header doesn't have them (UNKNOWN or LOCAL).
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	start, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(start, proxyProtocolV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, nil, errors.New("missing header")
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, errors.New("version 1 header is too long")
+	}
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid version 1 header %q", text)
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return nil, nil, fmt.Errorf("invalid version 1 header %q", text)
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)},
+		&net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("invalid version 2 header version: %v", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	if header[12]&0x0F == 0x00 { // LOCAL command, for health checks
+		return nil, nil, nil
+	}
+	var ipLen int
+	switch header[13] >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil // UNSPEC or unix sockets, keep the real addresses
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errors.New("version 2 header is too short for the addresses")
+	}
+	srcIP := net.IP(payload[:ipLen])
+	dstIP := net.IP(payload[ipLen : 2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(payload[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))
+	if header[13]&0x0F == 0x2 { // DGRAM
+		return &net.UDPAddr{IP: srcIP, Port: srcPort},
+			&net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort},
+		&net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
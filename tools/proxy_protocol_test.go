@@ -0,0 +1,170 @@
+package tools
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProxyProtocolListener(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  int
+		src, dst net.Addr
+		// nil if the listener should report the real connection addresses
+		wantSrc net.Addr
+	}{
+		{
+			name:    "v1 TCP4",
+			version: 1,
+			src:     &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51234},
+			dst:     &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+			wantSrc: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51234},
+		},
+		{
+			name:    "v1 TCP6",
+			version: 1,
+			src:     &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234},
+			dst:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			wantSrc: &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234},
+		},
+		{
+			name:    "v1 unknown",
+			version: 1,
+		},
+		{
+			name:    "v2 TCP4",
+			version: 2,
+			src:     &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51234},
+			dst:     &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+			wantSrc: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7).To4(), Port: 51234},
+		},
+		{
+			name:    "v2 UDP6",
+			version: 2,
+			src:     &net.UDPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234},
+			dst:     &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			wantSrc: &net.UDPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234},
+		},
+		{
+			name:    "v2 local",
+			version: 2,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go func() {
+				conn, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				var buf bytes.Buffer
+				if err := WriteProxyHeader(&buf, tc.version, tc.src, tc.dst); err != nil {
+					t.Error(err)
+				}
+				buf.WriteString("hello")
+				conn.Write(buf.Bytes())
+			}()
+
+			conn, err := (&ProxyProtocolListener{Listener: l}).Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			data, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "hello" {
+				t.Errorf("Wrong data after the header: %q", data)
+			}
+			wantSrc := tc.wantSrc
+			if wantSrc == nil {
+				wantSrc = conn.(*proxyProtocolConn).Conn.RemoteAddr()
+			}
+			if got := conn.RemoteAddr(); got.String() != wantSrc.String() ||
+				got.Network() != wantSrc.Network() {
+				t.Errorf("Wrong RemoteAddr, got: %v want: %v", got, wantSrc)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolListener_MissingHeader(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	}()
+
+	conn, err := (&ProxyProtocolListener{Listener: l}).Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 10)); err == nil {
+		t.Error("Expected an error reading a connection without the header")
+	}
+}
+
+func TestProxyProtocolListener_KeepsReadDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	clientDone := make(chan struct{})
+	defer close(clientDone)
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		src := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51234}
+		dst := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+		WriteProxyHeader(conn, 1, src, dst)
+		// Send nothing after the header so only the deadline ends the read
+		<-clientDone
+	}()
+
+	conn, err := (&ProxyProtocolListener{Listener: l}).Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 10))
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Expected the read deadline to be exceeded, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reading the header cleared the caller's read deadline")
+	}
+}
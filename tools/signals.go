@@ -48,6 +48,40 @@ func CloseOnQuitSignals(quit chan struct{}) {
 	})
 }
 
+// Like [CloseOnQuitSignals] but SIGHUP calls reload instead of closing the
+// channel, as long as the parent process that started this one is still
+// running. This is the usual convention for reloading daemon config files.
+//
+// Spawn sends SIGHUP to its children when it dies, so in that case SIGHUP is
+// still treated as a quit signal.
+//
+// Catches: SIGINT, SIGKILL, SIGTERM, SIGHUP
+func CloseOnQuitSignalsOrReload(quit chan struct{}, reload func()) {
+	ppid := os.Getppid()
+	// Notify before returning so signals sent right after are caught
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case sig := <-sigs:
+				// When the parent dies we get reparented before the signal is sent
+				if sig == syscall.SIGHUP && os.Getppid() == ppid {
+					log.Print("Received hang up signal, reloading")
+					reload()
+					continue
+				}
+				log.Print(signalMessage(sig))
+				close(quit)
+				return
+			case <-quit:
+				return
+			}
+		}
+	}()
+}
+
 // Returns a new context that will be cancelled with a cause when the OS sends
 // a signal to stop.
 //
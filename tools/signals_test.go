@@ -0,0 +1,49 @@
+package tools
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCloseOnQuitSignalsOrReload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows can't send signals to a process")
+	}
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	quit := make(chan struct{})
+	reloaded := make(chan struct{}, 1)
+	CloseOnQuitSignalsOrReload(quit, func() {
+		reloaded <- struct{}{}
+	})
+
+	// SIGHUP reloads since the parent process is still running
+	for i := 0; i < 2; i++ {
+		if err := self.Signal(syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-reloaded:
+		case <-quit:
+			t.Fatal("SIGHUP closed the quit channel instead of reloading")
+		case <-time.After(5 * time.Second):
+			t.Fatal("SIGHUP didn't call reload")
+		}
+	}
+
+	if err := self.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-quit:
+	case <-reloaded:
+		t.Fatal("SIGTERM called reload instead of closing the quit channel")
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGTERM didn't close the quit channel")
+	}
+}
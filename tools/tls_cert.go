@@ -12,6 +12,7 @@ import (
 	"log"
 	"math/big"
 	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -97,7 +98,8 @@ func GenerateCertificateRequest(hostname string) ([]byte, crypto.PrivateKey, err
 	template := &x509.CertificateRequest{
 		SignatureAlgorithm: x509.ECDSAWithSHA256,
 	}
-	if ip := net.ParseIP(hostname); ip != nil {
+	// MyHostname brackets IPv6 addresses
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(hostname, "["), "]")); ip != nil {
 		template.IPAddresses = []net.IP{ip}
 	} else {
 		template.DNSNames = []string{hostname}